@@ -2,10 +2,12 @@ package application
 
 import (
 	"log"
+	"sync"
 	"time"
 
 	d "github.com/imyousuf/lan-messenger/application/domains"
 	"github.com/imyousuf/lan-messenger/network"
+	"github.com/imyousuf/lan-messenger/packet"
 )
 
 // EventListener encapsulates the two network interfaces into one as the application listens to both
@@ -14,21 +16,156 @@ type EventListener interface {
 	network.MessageListener
 }
 
+// pendingFileOffers are the files offered by peers, keyed by transfer ID, that are yet to be
+// accepted or rejected
+var pendingFileOffers sync.Map
+
 type _EventListener struct {
 	completeNotificationChannel chan int
+	messenger                   Messenger
 }
 
 func (el _EventListener) HandleMessageReceived(event network.MessageEvent) {
-	log.Println("MESSAGE: ", event.GetMessage())
+	msgPacket := event.GetMessagePacket()
+	var sender *d.User
+	if roomID := msgPacket.GetRoomID(); roomID != "" {
+		room, roomSender, found := getRoomAndSender(roomID, msgPacket.GetSessionID())
+		if !found || room.GetMembership(roomSender) != d.Joined {
+			log.Println("Ignoring post to room by non-member", roomID, msgPacket.GetSessionID())
+			return
+		}
+		sender = roomSender
+		log.Println("ROOM MESSAGE: ", room.GetName(), sender.GetUserProfile().GetUsername(),
+			msgPacket.GetContentType(), msgPacket.GetBody())
+	} else if session, found := d.GetSessionBySessionID(msgPacket.GetSessionID()); found {
+		sender = session.GetSessionOwner()
+		log.Println("MESSAGE: ", msgPacket.GetSessionID(), msgPacket.GetContentType(), msgPacket.GetBody())
+	} else {
+		log.Println("Ignoring message from unknown session", msgPacket.GetSessionID())
+		return
+	}
+	var err error
+	if sender.GetUserProfile().GetUsername() == el.messenger.GetSelfProfile().GetUsername() {
+		// Sent from another device of this user, so keep the conversation in sync
+		_, err = d.SaveOutgoingMessage(sender, msgPacket)
+	} else {
+		_, err = d.SaveIncomingMessage(sender, msgPacket)
+	}
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func getRoomAndSender(roomID string, sessionID string) (*d.Room, *d.User, bool) {
+	room, roomFound := d.GetRoomByRoomID(roomID)
+	session, sessionFound := d.GetSessionBySessionID(sessionID)
+	if !sessionFound {
+		return room, nil, false
+	}
+	return room, session.GetSessionOwner(), roomFound
+}
+
+// applyMemberships marks the known users among the usernames to be in the membership
+func applyMemberships(usernames []string, applyMembership func(user *d.User) bool) {
+	for _, username := range usernames {
+		if user, found := d.GetUserByUsername(username); found {
+			applyMembership(user)
+		}
+	}
+}
+
+func (el _EventListener) HandleRoomEvent(event network.RoomEvent) {
+	roomPacket := event.GetRoomPacket()
+	log.Println("Handled ROOM Message: ", roomPacket.ToJSON())
+	room, sender, roomFound := getRoomAndSender(roomPacket.GetRoomID(), roomPacket.GetSessionID())
+	if sender == nil {
+		log.Println("Ignoring room update from unknown session", roomPacket.GetSessionID())
+		return
+	}
+	switch roomPacket.GetAction() {
+	case packet.RoomCreateAction:
+		if roomFound {
+			log.Println("Ignoring creation of existing room", roomPacket.GetRoomID())
+			return
+		}
+		room = d.NewRoom(roomPacket.GetRoomID(), roomPacket.GetRoomName())
+		room.Join(sender)
+		applyMemberships(roomPacket.GetInviteeUsernames(), room.Invite)
+	case packet.RoomInviteAction:
+		if !roomFound {
+			// Invited to a room not known yet. Only the inviter is taken to be a member, the other
+			// members claimed by the invitation being invited till their own join is received.
+			room = d.NewRoom(roomPacket.GetRoomID(), roomPacket.GetRoomName())
+			room.Join(sender)
+			applyMemberships(roomPacket.GetMemberUsernames(), room.Invite)
+		}
+		if room.GetMembership(sender) != d.Joined {
+			log.Println("Ignoring invitation to room by non-member", roomPacket.GetRoomID())
+			return
+		}
+		applyMemberships(roomPacket.GetInviteeUsernames(), room.Invite)
+	case packet.RoomJoinAction:
+		if membership := room.GetMembership(sender); !roomFound ||
+			(membership != d.Invited && membership != d.Joined) {
+			log.Println("Ignoring joining room without invitation", roomPacket.GetRoomID())
+			return
+		}
+		room.Join(sender)
+	case packet.RoomLeaveAction:
+		if roomFound {
+			room.Leave(sender)
+		}
+	}
+}
+
+func (el _EventListener) HandleFileEvent(event network.FileEvent) {
+	filePacket := event.GetFilePacket()
+	log.Println("Handled FILE Message: ", filePacket.ToJSON())
+	session, found := d.GetSessionBySessionID(filePacket.GetSessionID())
+	if !found {
+		log.Println("Ignoring file transfer from unknown session", filePacket.GetSessionID())
+		return
+	}
+	switch filePacket.GetAction() {
+	case packet.FileOfferAction:
+		log.Println("FILE OFFER: ", session.GetSessionOwner().GetUserProfile().GetUsername(),
+			filePacket.GetTransferID(), filePacket.GetFileName(), filePacket.GetFileSize())
+		pendingFileOffers.Store(filePacket.GetTransferID(), filePacket)
+	case packet.FileRejectAction:
+		log.Println("FILE REJECTED: ", filePacket.GetTransferID())
+	}
 }
 
 func (el _EventListener) HandleRegisterEvent(event network.RegisterEvent) {
 	regPacket := event.GetRegisterPacket()
 	log.Println("Handled RE Broadcast: ", regPacket.ToJSON())
 	user := d.NewUser(regPacket.GetUserProfile())
-	session := d.NewSession(regPacket.GetSessionID(), regPacket.GetDevicePreferenceIndex(),
-		regPacket.GetExpiryTime(), regPacket.GetReplyTo())
-	user.AddSession(session)
+	if !user.TrustPublicKey(regPacket.GetPublicKey()) {
+		log.Println("Ignoring registration with untrusted identity key for", user.GetUserProfile().GetUsername())
+		return
+	}
+	if session, found := d.GetSessionBySessionID(regPacket.GetSessionID()); found {
+		// Registering again, e.g. from a new address
+		if session.GetSessionOwner().GetUserProfile().GetUsername() != user.GetUserProfile().GetUsername() {
+			log.Println("Ignoring registration of a session of another user", regPacket.GetSessionID())
+			return
+		}
+		if err := session.UpdateReplyTo(regPacket.GetReplyTo()); err != nil {
+			log.Println(err)
+		}
+		if err := session.Renew(regPacket.GetExpiryTime()); err != nil {
+			log.Println(err)
+		}
+		if err := session.UpdatePresence(regPacket.GetPresence()); err != nil {
+			log.Println(err)
+		}
+	} else {
+		session := d.NewSession(regPacket.GetSessionID(), regPacket.GetDevicePreferenceIndex(),
+			regPacket.GetExpiryTime(), regPacket.GetReplyTo())
+		session.UpdatePresence(regPacket.GetPresence())
+		user.AddSession(session)
+	}
+	el.messenger.FlushOutboxAsync(user.GetUserProfile().GetUsername())
 }
 
 func (el _EventListener) HandlePingEvent(event network.PingEvent) {
@@ -39,6 +176,9 @@ func (el _EventListener) HandlePingEvent(event network.PingEvent) {
 		if err := session.Renew(pingPacket.GetExpiryTime()); err != nil {
 			log.Println(err)
 		}
+		if err := session.UpdatePresence(pingPacket.GetPresence()); err != nil {
+			log.Println(err)
+		}
 	}
 }
 
@@ -58,7 +198,9 @@ func (el _EventListener) HandleEndOfBroadcasts() {
 	el.completeNotificationChannel <- 2
 }
 
-// NewEventListener creates a new instance of EventListener
-func NewEventListener(completeNotificationChannel chan int) EventListener {
-	return &_EventListener{completeNotificationChannel: completeNotificationChannel}
+// NewEventListener creates a new instance of EventListener, which flushes the outbox of users using
+// the messenger as they register
+func NewEventListener(completeNotificationChannel chan int, messenger Messenger) EventListener {
+	return &_EventListener{completeNotificationChannel: completeNotificationChannel,
+		messenger: messenger}
 }
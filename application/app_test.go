@@ -18,7 +18,7 @@ import (
 
 func TestHandleEndOfMessages(t *testing.T) {
 	endOfMsgChan := make(chan int)
-	eventListener := NewEventListener(endOfMsgChan)
+	eventListener := newTestEventListener(endOfMsgChan)
 	counter := 0
 	go func() {
 		<-endOfMsgChan
@@ -33,7 +33,7 @@ func TestHandleEndOfMessages(t *testing.T) {
 
 func TestHandleEndOfBroadcasts(t *testing.T) {
 	endOfBroadcastChan := make(chan int)
-	eventListener := NewEventListener(endOfBroadcastChan)
+	eventListener := newTestEventListener(endOfBroadcastChan)
 	counter := 0
 	go func() {
 		<-endOfBroadcastChan
@@ -46,21 +46,32 @@ func TestHandleEndOfBroadcasts(t *testing.T) {
 	}
 }
 
-var globalDbSetupForAppTests = sync.Once{}
+var globalConfSetupForAppTests = sync.Once{}
 
 func setupCleanTestTablesForHandlerTests() {
-	globalDbSetupForAppTests.Do(func() {
+	globalConfSetupForAppTests.Do(func() {
 		conf.SetupNewConfiguration(testutils.MockLoadFunc)
-		s.ReInitDBConnection()
 	})
-	s.GetDB().Exec(testutils.DeleteSessionModelsSQL)
-	s.GetDB().Exec(testutils.DeleteUserModelsSQL)
-
+	domains.SetRepository(s.NewMemoryRepository())
 }
 
 type _MockRegisterEvent struct {
 	regPacket         packet.RegisterPacket
 	packetInitializer sync.Once
+	publicKey         []byte
+	replyTo           string
+	sessionID         string
+	deviceIndex       uint8
+}
+
+// _SessionRegisterPacket is a register packet of another session than the current one
+type _SessionRegisterPacket struct {
+	packet.RegisterPacket
+	sessionID string
+}
+
+func (regPacket _SessionRegisterPacket) GetSessionID() string {
+	return regPacket.sessionID
 }
 
 func (mockEvent *_MockRegisterEvent) GetName() string {
@@ -77,15 +88,41 @@ func (mockEvent *_MockRegisterEvent) GetRegisterPacket() packet.RegisterPacket {
 		mockEvent.regPacket = packet.NewBuilderFactory().
 			CreateNewSession().CreateSession(5*time.Minute).
 			CreateUserProfile(profile.NewUserProfile(conf.GetUserProfile())).
-			RegisterDevice("127.0.0.1:30000", 1).BuildRegisterPacket()
+			RegisterDevice(mockEvent.getReplyTo(), mockEvent.getDeviceIndex()).
+			PublishIdentityKey(mockEvent.getPublicKey()).BuildRegisterPacket()
+		if mockEvent.sessionID != "" {
+			mockEvent.regPacket = _SessionRegisterPacket{RegisterPacket: mockEvent.regPacket,
+				sessionID: mockEvent.sessionID}
+		}
 	})
 	return mockEvent.regPacket
 }
 
+func (mockEvent *_MockRegisterEvent) getReplyTo() string {
+	if mockEvent.replyTo == "" {
+		return "127.0.0.1:30000"
+	}
+	return mockEvent.replyTo
+}
+
+func (mockEvent *_MockRegisterEvent) getDeviceIndex() uint8 {
+	if mockEvent.deviceIndex == 0 {
+		return 1
+	}
+	return mockEvent.deviceIndex
+}
+
+func (mockEvent *_MockRegisterEvent) getPublicKey() []byte {
+	if mockEvent.publicKey == nil {
+		return []byte("mock-public-key")
+	}
+	return mockEvent.publicKey
+}
+
 func TestHandleRegisterEvent(t *testing.T) {
 	setupCleanTestTablesForHandlerTests()
 	endOfBroadcastChan := make(chan int)
-	eventListener := NewEventListener(endOfBroadcastChan)
+	eventListener := newTestEventListener(endOfBroadcastChan)
 	regEvent := &_MockRegisterEvent{}
 	eventListener.HandleRegisterEvent(regEvent)
 	loadedSession, found := domains.GetSessionBySessionID(regEvent.GetRegisterPacket().GetSessionID())
@@ -97,6 +134,47 @@ func TestHandleRegisterEvent(t *testing.T) {
 	}
 }
 
+func TestHandleRegisterEventAgain(t *testing.T) {
+	setupCleanTestTablesForHandlerTests()
+	eventListener := newTestEventListener(make(chan int))
+	eventListener.HandleRegisterEvent(&_MockRegisterEvent{})
+	eventListener.HandleRegisterEvent(&_MockRegisterEvent{replyTo: "[fd00::2]:30000"})
+	loadedSession, found := domains.GetSessionBySessionID(packet.GetCurrentSessionID())
+	if !found || loadedSession.GetReplyToConnectionString() != "[fd00::2]:30000" {
+		t.Error("Session registered again should have been updated with the new reply-to")
+	}
+}
+
+func TestHandleRegisterEventRoutedInDeviceIndexOrder(t *testing.T) {
+	setupCleanTestTablesForHandlerTests()
+	eventListener := newTestEventListener(make(chan int))
+	eventListener.HandleRegisterEvent(&_MockRegisterEvent{sessionID: "S3", deviceIndex: 3,
+		replyTo: "127.0.0.3:30000"})
+	eventListener.HandleRegisterEvent(&_MockRegisterEvent{sessionID: "S2", deviceIndex: 2,
+		replyTo: "127.0.0.2:30000"})
+	user, _ := domains.GetUserByUsername(profile.NewUserProfile(conf.GetUserProfile()).GetUsername())
+	route := domains.RouteDelivery(user, domains.MainThenFallback)
+	if len(route.Sessions) != 2 || route.Sessions[0].GetSessionID() != "S2" ||
+		route.Sessions[1].GetSessionID() != "S3" {
+		t.Error("Sessions should have been routed to in the order of their device index", route.Sessions)
+	}
+	if route = domains.RouteDelivery(user, domains.MainSessionOnly); len(route.Sessions) != 1 ||
+		route.Sessions[0].GetSessionID() != "S2" {
+		t.Error("Session with the lowest device index should have been the main session", route.Sessions)
+	}
+}
+
+func TestHandleRegisterEventWithUntrustedKey(t *testing.T) {
+	setupCleanTestTablesForHandlerTests()
+	domains.NewUser(profile.NewUserProfile(conf.GetUserProfile())).TrustPublicKey([]byte("trusted-public-key"))
+	eventListener := newTestEventListener(make(chan int))
+	impostorEvent := &_MockRegisterEvent{}
+	eventListener.HandleRegisterEvent(impostorEvent)
+	if _, found := domains.GetSessionBySessionID(impostorEvent.GetRegisterPacket().GetSessionID()); found {
+		t.Error("Session of user with a different identity key should not have been registered")
+	}
+}
+
 type _MockPingEvent struct {
 	pingPacket        packet.PingPacket
 	packetInitializer sync.Once
@@ -112,13 +190,14 @@ func (mockEvent *_MockPingEvent) GetEventIdentifier() (string, uint64) {
 	return "SessionID", 10001
 }
 func (mockEvent *_MockPingEvent) GetPingPacket() packet.PingPacket {
-	return packet.NewBuilderFactory().Ping().RenewSession(15 * time.Minute).BuildPingPacket()
+	return packet.NewBuilderFactory().Ping().RenewSession(15 * time.Minute).
+		UpdatePresence(profile.NewPresence(profile.Away, "Lunch")).BuildPingPacket()
 }
 
 func TestHandlePingEvent(t *testing.T) {
 	setupCleanTestTablesForHandlerTests()
 	endOfBroadcastChan := make(chan int)
-	eventListener := NewEventListener(endOfBroadcastChan)
+	eventListener := newTestEventListener(endOfBroadcastChan)
 	regEvent := &_MockRegisterEvent{}
 	eventListener.HandleRegisterEvent(regEvent)
 	pingEvent := &_MockPingEvent{}
@@ -131,6 +210,10 @@ func TestHandlePingEvent(t *testing.T) {
 	if !loadedSession.GetExpiryTime().Truncate(time.Second).Equal(newExpiryTime) {
 		t.Error("Expiry time not updated", loadedSession.GetExpiryTime(), newExpiryTime)
 	}
+	if loadedSession.GetPresence().GetState() != profile.Away ||
+		loadedSession.GetPresence().GetStatusMessage() != "Lunch" {
+		t.Error("Presence not updated")
+	}
 }
 
 type _MockSignOffEvent struct {
@@ -152,7 +235,7 @@ func (mockEvent _MockSignOffEvent) GetSignOffPacket() packet.SignOffPacket {
 func TestHandleSignOffEvent(t *testing.T) {
 	setupCleanTestTablesForHandlerTests()
 	endOfBroadcastChan := make(chan int)
-	eventListener := NewEventListener(endOfBroadcastChan)
+	eventListener := newTestEventListener(endOfBroadcastChan)
 	regEvent := &_MockRegisterEvent{}
 	eventListener.HandleRegisterEvent(regEvent)
 	signOffEvent := _MockSignOffEvent{}
@@ -165,3 +248,145 @@ func TestHandleSignOffEvent(t *testing.T) {
 		t.Error("Sign off did not expire session")
 	}
 }
+
+type _MockRoomEvent struct {
+	roomPacket packet.RoomPacket
+}
+
+func (mockEvent _MockRoomEvent) GetName() string {
+	return network.RoomEventName
+}
+func (mockEvent _MockRoomEvent) GetEventData() []byte {
+	return []byte{}
+}
+func (mockEvent _MockRoomEvent) GetEventIdentifier() (string, uint64) {
+	return mockEvent.roomPacket.GetSessionID(), mockEvent.roomPacket.GetPacketID()
+}
+func (mockEvent _MockRoomEvent) GetRoomPacket() packet.RoomPacket {
+	return mockEvent.roomPacket
+}
+
+type _MockMessageEvent struct {
+	messagePacket packet.MessagePacket
+}
+
+func (mockEvent _MockMessageEvent) GetName() string {
+	return network.MessageEventName
+}
+func (mockEvent _MockMessageEvent) GetEventData() []byte {
+	return []byte{}
+}
+func (mockEvent _MockMessageEvent) GetEventIdentifier() (string, uint64) {
+	return mockEvent.messagePacket.GetSessionID(), mockEvent.messagePacket.GetPacketID()
+}
+func (mockEvent _MockMessageEvent) GetMessagePacket() packet.MessagePacket {
+	return mockEvent.messagePacket
+}
+
+func TestHandleMessageReceived(t *testing.T) {
+	setupCleanTestTablesForHandlerTests()
+	eventListener := newTestEventListener(make(chan int))
+	selfUsername := profile.NewUserProfile(conf.GetUserProfile()).GetUsername()
+	message := packet.NewBuilderFactory().Message().To(selfUsername).
+		WithBody(packet.TextContentType, "Hi").BuildMessagePacket()
+	eventListener.HandleMessageReceived(_MockMessageEvent{message})
+	if domains.CountMessages(domains.MessageCriteria{}) != 0 {
+		t.Error("Message from unknown session should not have been saved")
+	}
+	// Message packets built in tests are of the current session, so make it a session of the sender
+	sender := domains.NewUser(profile.NewUserProfile("b", "b", "b@b.co"))
+	sender.AddSession(domains.NewSession(packet.GetCurrentSessionID(), 1, time.Now().Add(time.Minute),
+		"127.0.0.1:30000"))
+	eventListener.HandleMessageReceived(_MockMessageEvent{message})
+	eventListener.HandleMessageReceived(_MockMessageEvent{message})
+	messages := domains.GetDirectConversation(sender).GetMessages(domains.Page{})
+	if len(messages) != 1 || messages[0].GetBody() != "Hi" || messages[0].IsOutgoing() {
+		t.Error("Message should have been saved once in the conversation with the sender")
+	}
+	domains.NewRoom("R1", "Team")
+	eventListener.HandleMessageReceived(_MockMessageEvent{packet.NewBuilderFactory().Message().
+		To(selfUsername).InRoom("R1").WithBody(packet.TextContentType, "Hi").BuildMessagePacket()})
+	if domains.CountMessages(domains.MessageCriteria{}) != 1 {
+		t.Error("Post by non-member should not have been saved")
+	}
+}
+
+func TestHandleMessageReceivedFromSelf(t *testing.T) {
+	setupCleanTestTablesForHandlerTests()
+	eventListener := newTestEventListener(make(chan int))
+	// Message packets built in tests are of the current session, so make it a session of this user
+	self := domains.NewUser(profile.NewUserProfile(conf.GetUserProfile()))
+	self.AddSession(domains.NewSession(packet.GetCurrentSessionID(), 1, time.Now().Add(time.Minute),
+		"127.0.0.1:30000"))
+	recipient := domains.NewUser(profile.NewUserProfile("b", "b", "b@b.co"))
+	eventListener.HandleMessageReceived(_MockMessageEvent{packet.NewBuilderFactory().Message().To("b").
+		WithBody(packet.TextContentType, "Hi").BuildMessagePacket()})
+	messages := domains.GetDirectConversation(recipient).GetMessages(domains.Page{})
+	if len(messages) != 1 || !messages[0].IsOutgoing() {
+		t.Error("Message sent from another device should have been saved as outgoing")
+	}
+}
+
+type _MockFileEvent struct {
+	filePacket packet.FilePacket
+}
+
+func (mockEvent _MockFileEvent) GetName() string {
+	return network.FileEventName
+}
+func (mockEvent _MockFileEvent) GetEventData() []byte {
+	return []byte{}
+}
+func (mockEvent _MockFileEvent) GetEventIdentifier() (string, uint64) {
+	return mockEvent.filePacket.GetSessionID(), mockEvent.filePacket.GetPacketID()
+}
+func (mockEvent _MockFileEvent) GetFilePacket() packet.FilePacket {
+	return mockEvent.filePacket
+}
+
+func TestHandleRoomEvent(t *testing.T) {
+	setupCleanTestTablesForHandlerTests()
+	eventListener := newTestEventListener(make(chan int))
+	self := domains.NewUser(profile.NewUserProfile(conf.GetUserProfile()))
+	// Room packets built in tests are of the current session, so make it a session of the sender
+	sender := domains.NewUser(profile.NewUserProfile("b", "b", "b@b.co"))
+	sender.AddSession(domains.NewSession(packet.GetCurrentSessionID(), 1, time.Now().Add(time.Minute),
+		"127.0.0.1:30000"))
+	selfUsername := self.GetUserProfile().GetUsername()
+	eventListener.HandleRoomEvent(_MockRoomEvent{packet.NewBuilderFactory().Room("R1", "Team").
+		WithMembers("b").Create(selfUsername).BuildRoomPacket()})
+	room, found := domains.GetRoomByRoomID("R1")
+	if !found || room.GetMembership(sender) != domains.Joined || room.GetMembership(self) != domains.Invited {
+		t.Fatal("Room should have been created with the sender joined and invitee invited")
+	}
+	eventListener.HandleRoomEvent(_MockRoomEvent{packet.NewBuilderFactory().Room("R1", "Team").
+		WithMembers("b").Leave().BuildRoomPacket()})
+	if room.GetMembership(sender) != domains.Left {
+		t.Error("Sender should have left the room")
+	}
+	eventListener.HandleRoomEvent(_MockRoomEvent{packet.NewBuilderFactory().Room("R1", "Team").
+		WithMembers("b").Join().BuildRoomPacket()})
+	if room.GetMembership(sender) != domains.Left {
+		t.Error("Sender should not have joined the room without being invited")
+	}
+	eventListener.HandleRoomEvent(_MockRoomEvent{packet.NewBuilderFactory().Room("R1", "Team").
+		WithMembers("b").Invite(selfUsername).BuildRoomPacket()})
+	if room.GetMembership(self) != domains.Invited {
+		t.Error("Invitation by non-member should have been ignored")
+	}
+	eventListener.HandleRoomEvent(_MockRoomEvent{packet.NewBuilderFactory().Room("R2", "Other").
+		WithMembers("b").Invite(selfUsername).BuildRoomPacket()})
+	otherRoom, found := domains.GetRoomByRoomID("R2")
+	if !found || otherRoom.GetMembership(sender) != domains.Joined ||
+		otherRoom.GetMembership(self) != domains.Invited {
+		t.Error("Room should have been learnt of from the invitation")
+	}
+	member := domains.NewUser(profile.NewUserProfile("c", "c", "c@c.co"))
+	eventListener.HandleRoomEvent(_MockRoomEvent{packet.NewBuilderFactory().Room("R3", "Third").
+		WithMembers("b", "c").Invite(selfUsername).BuildRoomPacket()})
+	thirdRoom, found := domains.GetRoomByRoomID("R3")
+	if !found || thirdRoom.GetMembership(sender) != domains.Joined ||
+		thirdRoom.GetMembership(member) != domains.Invited {
+		t.Error("Members claimed by the inviter should only have been invited till they join")
+	}
+}
@@ -0,0 +1,194 @@
+// Package backup archives the local store, i.e. the DB, the identity keys and the configuration, to
+// move it to another machine or to recover it
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/imyousuf/lan-messenger/application/conf"
+	"github.com/imyousuf/lan-messenger/application/storage"
+	"github.com/imyousuf/lan-messenger/identity"
+	"github.com/imyousuf/lan-messenger/utils"
+)
+
+const (
+	dbEntryName       = "lamess.db"
+	identityEntryName = identity.KeyFileName
+	configEntryName   = conf.ConfigurationFileName
+	// InvalidArchiveErrorMsg is the error returned when restoring an archive not created by Backup
+	InvalidArchiveErrorMsg = "not a valid lamess backup archive"
+)
+
+// addFile adds the file to the archive under the entry name
+func addFile(archive *tar.Writer, filePath string, entryName string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	header := &tar.Header{Name: entryName, Mode: 0600, Size: fileInfo.Size(), ModTime: fileInfo.ModTime(),
+		Typeflag: tar.TypeReg}
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(archive, file)
+	return err
+}
+
+func writeArchive(archivePath string, entries map[string]string) error {
+	archiveFile, err := os.OpenFile(archivePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer archiveFile.Close()
+	compressor := gzip.NewWriter(archiveFile)
+	archive := tar.NewWriter(compressor)
+	for _, entryName := range []string{dbEntryName, identityEntryName, configEntryName} {
+		if filePath, found := entries[entryName]; found {
+			if err := addFile(archive, filePath, entryName); err != nil {
+				return err
+			}
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	if err := compressor.Close(); err != nil {
+		return err
+	}
+	return archiveFile.Sync()
+}
+
+// Backup writes a gzipped tar archive of the online backup of the DB, the identity keys and the
+// configuration file. The key file of an encrypted DB is not archived, as it is meant to be kept
+// apart from the DB; it is to be moved to the other machine separately.
+func Backup(archivePath string) error {
+	directory, err := ioutil.TempDir("", "lamess-backup")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(directory)
+	entries := map[string]string{dbEntryName: filepath.Join(directory, dbEntryName)}
+	if err := storage.BackupDB(entries[dbEntryName]); err != nil {
+		return err
+	}
+	if keyFilePath := filepath.Join(conf.GetStorageLocation(), identityEntryName); isFile(keyFilePath) {
+		entries[identityEntryName] = keyFilePath
+	}
+	if isFile(conf.ConfigurationFileName) {
+		entries[configEntryName] = conf.ConfigurationFileName
+	}
+	partialPath := archivePath + ".part"
+	if err := writeArchive(partialPath, entries); err != nil {
+		os.Remove(partialPath)
+		return err
+	}
+	return os.Rename(partialPath, archivePath)
+}
+
+func isFile(filePath string) bool {
+	fileInfo, err := os.Stat(filePath)
+	return err == nil && fileInfo.Mode().IsRegular()
+}
+
+// extractArchive extracts the entries of the archive to the directory, refusing any entry but the
+// ones Backup writes
+func extractArchive(archivePath string, directory string) error {
+	archiveFile, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer archiveFile.Close()
+	decompressor, err := gzip.NewReader(archiveFile)
+	if err != nil {
+		return errors.New(InvalidArchiveErrorMsg)
+	}
+	archive := tar.NewReader(decompressor)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.New(InvalidArchiveErrorMsg)
+		}
+		if header.Typeflag != tar.TypeReg || (header.Name != dbEntryName && header.Name != identityEntryName &&
+			header.Name != configEntryName) {
+			return errors.New(InvalidArchiveErrorMsg)
+		}
+		file, err := os.OpenFile(filepath.Join(directory, header.Name), os.O_CREATE|os.O_WRONLY|os.O_TRUNC,
+			0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(file, archive)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Restore replaces the local store with the one archived by Backup. The archive is validated before
+// anything is replaced: the DB has to be intact and of a schema version this application can
+// migrate, and the identity keys have to be loadable. The configuration archived is only restored
+// if there is no configuration file yet, in which case the storage location it configures is the
+// one restored to.
+func Restore(archivePath string) error {
+	directory, err := ioutil.TempDir("", "lamess-restore")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(directory)
+	if err := extractArchive(archivePath, directory); err != nil {
+		return err
+	}
+	dbPath := filepath.Join(directory, dbEntryName)
+	if !isFile(dbPath) {
+		return errors.New(InvalidArchiveErrorMsg)
+	}
+	version, err := storage.ValidateDBFile(dbPath)
+	if err != nil {
+		return err
+	}
+	keyFilePath := filepath.Join(directory, identityEntryName)
+	if isFile(keyFilePath) {
+		// Encrypted identity keys can only be checked to be well formed, as the secret they are
+		// encrypted with is not archived
+		if _, err := identity.LoadOrCreateIdentity(directory, nil); err != nil &&
+			err.Error() != identity.WrappedKeyFileErrorMsg {
+			return err
+		}
+	}
+	if configPath := filepath.Join(directory, configEntryName); isFile(configPath) {
+		if isFile(conf.ConfigurationFileName) {
+			log.Println("Keeping the existing", conf.ConfigurationFileName, "instead of the one archived")
+		} else if err := utils.ReplaceFile(configPath, conf.ConfigurationFileName, 0600); err != nil {
+			return err
+		}
+	}
+	if err := storage.RestoreDB(dbPath); err != nil {
+		return err
+	}
+	if isFile(keyFilePath) {
+		restoredKeyFilePath := filepath.Join(conf.GetStorageLocation(), identityEntryName)
+		if err := utils.ReplaceFile(keyFilePath, restoredKeyFilePath, 0600); err != nil {
+			return err
+		}
+	}
+	log.Println("Restored DB of schema version", version, "to", conf.GetStorageLocation())
+	return nil
+}
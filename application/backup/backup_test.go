@@ -0,0 +1,123 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-ini/ini"
+	"github.com/imyousuf/lan-messenger/application/conf"
+	"github.com/imyousuf/lan-messenger/application/storage"
+	"github.com/imyousuf/lan-messenger/application/testutils"
+	"github.com/imyousuf/lan-messenger/identity"
+)
+
+// setupTestStore points the storage location to a new temporary directory and changes the working
+// directory to another, returning the function restoring both
+func setupTestStore(t *testing.T) (string, func()) {
+	location, err := ioutil.TempDir("", "lamess-backup-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	workingDirectory, _ := ioutil.TempDir("", "lamess-backup-cwd")
+	previousWorkingDirectory, _ := os.Getwd()
+	os.Chdir(workingDirectory)
+	conf.SetupNewConfiguration(func() (*ini.File, error) {
+		return ini.InsensitiveLoad([]byte(fmt.Sprintf("[storage]\nlocation=%s\n", location)))
+	})
+	storage.ReInitDBConnection()
+	return location, func() {
+		os.Chdir(previousWorkingDirectory)
+		os.RemoveAll(workingDirectory)
+		os.RemoveAll(location)
+		conf.SetupNewConfiguration(testutils.MockLoadFunc)
+		storage.ReInitDBConnection()
+	}
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	location, cleanup := setupTestStore(t)
+	defer cleanup()
+	if _, err := identity.LoadOrCreateIdentity(location, nil); err != nil {
+		t.Fatal(err)
+	}
+	keyFileContent, _ := ioutil.ReadFile(filepath.Join(location, identity.KeyFileName))
+	ioutil.WriteFile(conf.ConfigurationFileName, []byte("[profile]\nusername=a\n"), 0600)
+	repo := storage.NewGormRepository()
+	repo.CreateUser(&storage.UserModel{Username: "a", Email: "a@email.co"})
+	archivePath := filepath.Join(location, "backup.tar.gz")
+	if err := Backup(archivePath); err != nil {
+		t.Fatal("Local store should have been archived", err)
+	}
+	if _, err := os.Stat(archivePath + ".part"); !os.IsNotExist(err) {
+		t.Error("Partial archive should not have been left behind")
+	}
+	repo.CreateUser(&storage.UserModel{Username: "b", Email: "b@email.co"})
+	ioutil.WriteFile(filepath.Join(location, identity.KeyFileName), []byte("garbage"), 0600)
+	os.Remove(conf.ConfigurationFileName)
+	if err := Restore(archivePath); err != nil {
+		t.Fatal("Local store should have been restored", err)
+	}
+	if _, found := repo.FindUserByUsername("a"); !found {
+		t.Error("User archived should have been restored")
+	}
+	if _, found := repo.FindUserByUsername("b"); found {
+		t.Error("User created after the backup should not have been restored")
+	}
+	if content, _ := ioutil.ReadFile(filepath.Join(location, identity.KeyFileName)); !bytes.Equal(content,
+		keyFileContent) {
+		t.Error("Identity keys should have been restored")
+	}
+	if content, _ := ioutil.ReadFile(conf.ConfigurationFileName); string(content) != "[profile]\nusername=a\n" {
+		t.Error("Configuration should have been restored", string(content))
+	}
+}
+
+func TestRestoreInvalidArchive(t *testing.T) {
+	location, cleanup := setupTestStore(t)
+	defer cleanup()
+	archivePath := filepath.Join(location, "invalid.tar.gz")
+	archiveContent := &bytes.Buffer{}
+	compressor := gzip.NewWriter(archiveContent)
+	archive := tar.NewWriter(compressor)
+	archive.WriteHeader(&tar.Header{Name: "../escape", Mode: 0600, Size: 1, Typeflag: tar.TypeReg})
+	archive.Write([]byte("x"))
+	archive.Close()
+	compressor.Close()
+	ioutil.WriteFile(archivePath, archiveContent.Bytes(), 0600)
+	if err := Restore(archivePath); err == nil || err.Error() != InvalidArchiveErrorMsg {
+		t.Error("Archive with an unknown entry should not have been restored", err)
+	}
+	ioutil.WriteFile(archivePath, []byte("not an archive"), 0600)
+	if err := Restore(archivePath); err == nil || err.Error() != InvalidArchiveErrorMsg {
+		t.Error("File not an archive should not have been restored", err)
+	}
+	if _, err := os.Stat(filepath.Join(location, "../escape")); !os.IsNotExist(err) {
+		t.Error("Unknown entry should not have been extracted")
+	}
+}
+
+func TestRestoreNewerSchemaVersion(t *testing.T) {
+	location, cleanup := setupTestStore(t)
+	defer cleanup()
+	storage.GetDB().Exec("INSERT INTO schema_version (version, description) VALUES (?, 'from the future')",
+		storage.GetLatestSchemaVersion()+1)
+	archivePath := filepath.Join(location, "newer.tar.gz")
+	if err := Backup(archivePath); err != nil {
+		t.Fatal(err)
+	}
+	storage.ReInitDBConnection()
+	os.Remove(storage.GetDBPath())
+	if err := Restore(archivePath); err == nil || err.Error() != fmt.Sprintf(storage.SchemaTooNewErrorFmt,
+		storage.GetLatestSchemaVersion()+1, storage.GetLatestSchemaVersion()) {
+		t.Error("DB of a newer schema version should not have been restored", err)
+	}
+	if _, err := os.Stat(storage.GetDBPath()); !os.IsNotExist(err) {
+		t.Error("DB should not have been replaced")
+	}
+}
@@ -4,14 +4,18 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 
 	"github.com/go-ini/ini"
 	"github.com/imyousuf/lan-messenger/utils"
 )
 
+// ConfigurationFileName is the name of the configuration file in the working directory
+const ConfigurationFileName = "lamess.cfg"
+
 var loadConfiguration = func() (*ini.File, error) {
-	return ini.InsensitiveLoad("lamess.cfg")
+	return ini.InsensitiveLoad(ConfigurationFileName)
 }
 
 func getSection(sectionName string, loadFunc func() (*ini.File, error)) *ini.Section {
@@ -34,10 +38,12 @@ func getOptionalSection(sectionName string, loadFunc func() (*ini.File, error))
 	return section
 }
 
-// GetNetworkConfig returns the port to listen to and the interface to listen to. Though we take a
+// GetNetworkConfig returns the port to listen to and the interfaces to listen to. Though we take a
 // single port in, the configuration represents a sequential 3 port config - listening for incoming
 // msg, listen for broadcasting message and listening for transmitted message response respectively.
-func GetNetworkConfig() (int, string) {
+// The interfaces are configured as a comma separated list of names, which may be wildcards such as
+// `en*`.
+func GetNetworkConfig() (int, []string) {
 	section := getSection("network", loadConfiguration)
 	sPort, pErr := section.GetKey("port")
 	port := 0
@@ -47,15 +53,69 @@ func GetNetworkConfig() (int, string) {
 	if port <= 0 {
 		port = 30000
 	}
-	sInterfaceName, iErr := section.GetKey("interface")
-	interfaceName := ""
+	sInterfaceNames, iErr := section.GetKey("interface")
+	var interfaceNames []string
 	if iErr == nil {
-		interfaceName = sInterfaceName.String()
+		for _, interfaceName := range sInterfaceNames.Strings(",") {
+			if len(interfaceName) > 0 {
+				interfaceNames = append(interfaceNames, interfaceName)
+			}
+		}
+	}
+	if len(interfaceNames) <= 0 {
+		interfaceNames = []string{"wlan0"}
+	}
+	return port, interfaceNames
+}
+
+// GetMulticastConfig returns the IPv4 and the IPv6 multicast group peers are discovered through,
+// the TTL of multicasts and whether multicasts are looped back to this host. Blank groups and zero
+// TTL stand for the defaults of the network layer; multicasts are looped back unless disabled, so
+// that instances on the same host discover each other.
+func GetMulticastConfig() (string, string, int, bool) {
+	section := getSection("network", loadConfiguration)
+	var ipv4Group, ipv6Group string
+	ttl, loopback := 0, true
+	if sGroup, err := section.GetKey("multicastgroup"); err == nil {
+		ipv4Group = sGroup.String()
+	}
+	if sGroup, err := section.GetKey("multicastgroup6"); err == nil {
+		ipv6Group = sGroup.String()
 	}
-	if len(interfaceName) <= 0 {
-		interfaceName = "wlan0"
+	if sTTL, err := section.GetKey("multicastttl"); err == nil {
+		ttl, _ = sTTL.Int()
 	}
-	return port, interfaceName
+	if sLoopback, err := section.GetKey("multicastloopback"); err == nil {
+		if value, bErr := sLoopback.Bool(); bErr == nil {
+			loopback = value
+		}
+	}
+	return ipv4Group, ipv6Group, ttl, loopback
+}
+
+// GetDiscoveryMode returns how peers are discovered, i.e. "multicast", "broadcast" or "auto", which
+// is the default and falls back from multicast to broadcast when no peer is found
+func GetDiscoveryMode() string {
+	section := getSection("network", loadConfiguration)
+	mode := ""
+	if sMode, err := section.GetKey("discovery"); err == nil {
+		mode = strings.ToLower(strings.TrimSpace(sMode.String()))
+	}
+	if len(mode) <= 0 {
+		mode = "auto"
+	}
+	return mode
+}
+
+// IsMDNSEnabled returns whether peers are also discovered through mDNS, which is the default
+func IsMDNSEnabled() bool {
+	section := getSection("network", loadConfiguration)
+	if sEnabled, err := section.GetKey("mdns"); err == nil {
+		if value, bErr := sEnabled.Bool(); bErr == nil {
+			return value
+		}
+	}
+	return true
 }
 
 // GetDeviceConfig returns the index of important for the current device for the specified user
@@ -129,6 +189,36 @@ func GetStorageLocation() string {
 	return storageLocation
 }
 
+// GetStorageEncryptionConfig returns the passphrase and the path of the key file the key encrypting
+// sensitive data in storage is derived from; both are blank when storage is not encrypted
+func GetStorageEncryptionConfig() (string, string) {
+	section := getOptionalSection("storage", loadConfiguration)
+	var passphrase, keyFile string
+	if section != nil {
+		if sPassphrase, err := section.GetKey("passphrase"); err == nil {
+			passphrase = sPassphrase.String()
+		}
+		if sKeyFile, err := section.GetKey("keyfile"); err == nil {
+			keyFile = sKeyFile.String()
+		}
+	}
+	return passphrase, keyFile
+}
+
+// IsBlindSearchEnabled returns whether messages of encrypted storage are searched through a blind
+// index, which is the default; without it search is not available while storage is encrypted
+func IsBlindSearchEnabled() bool {
+	section := getOptionalSection("storage", loadConfiguration)
+	if section != nil {
+		if sEnabled, err := section.GetKey("blindsearch"); err == nil {
+			if value, bErr := sEnabled.Bool(); bErr == nil {
+				return value
+			}
+		}
+	}
+	return true
+}
+
 // SetupNewConfiguration allows the application to load configuration in an alternate way
 func SetupNewConfiguration(newLoadFunc func() (*ini.File, error)) {
 	loadConfiguration = newLoadFunc
@@ -62,9 +62,17 @@ func TestGetDeviceConfig(t *testing.T) {
 
 func TestGetNetworkConfig(t *testing.T) {
 	loadConfiguration = mockLoadFunc
-	if cPort, cIface := GetNetworkConfig(); cPort != port || cIface != iface {
+	if cPort, cIfaces := GetNetworkConfig(); cPort != port || len(cIfaces) != 1 || cIfaces[0] != iface {
 		t.Error("Network config not returned correctly!")
 	}
+	loadConfiguration = func() (*ini.File, error) {
+		return ini.InsensitiveLoad([]byte(`
+		[network]
+		interface=eth0, en* ,`))
+	}
+	if _, cIfaces := GetNetworkConfig(); len(cIfaces) != 2 || cIfaces[0] != "eth0" || cIfaces[1] != "en*" {
+		t.Error("Interface list not returned correctly!", cIfaces)
+	}
 }
 
 func TestGetUserProfile(t *testing.T) {
@@ -124,12 +132,62 @@ func TestDefaultNetworkConfig(t *testing.T) {
 		[network]
 		deviceindex1=0`))
 	}
-	port, interfaceName := GetNetworkConfig()
-	if port != 30000 && interfaceName != "wlan0" {
+	port, interfaceNames := GetNetworkConfig()
+	if port != 30000 || len(interfaceNames) != 1 || interfaceNames[0] != "wlan0" {
 		t.Error("Default values for network config does not match")
 	}
 }
 
+func TestGetMulticastConfig(t *testing.T) {
+	loadConfiguration = mockLoadFunc
+	if ipv4Group, ipv6Group, ttl, loopback := GetMulticastConfig(); ipv4Group != "" || ipv6Group != "" ||
+		ttl != 0 || !loopback {
+		t.Error("Default values for multicast config does not match")
+	}
+	loadConfiguration = func() (*ini.File, error) {
+		return ini.InsensitiveLoad([]byte(`
+		[network]
+		multicastgroup=239.1.2.3
+		multicastgroup6=ff02::1234
+		multicastttl=4
+		multicastloopback=false`))
+	}
+	if ipv4Group, ipv6Group, ttl, loopback := GetMulticastConfig(); ipv4Group != "239.1.2.3" ||
+		ipv6Group != "ff02::1234" || ttl != 4 || loopback {
+		t.Error("Multicast config not returned correctly!", ipv4Group, ipv6Group, ttl, loopback)
+	}
+}
+
+func TestGetDiscoveryMode(t *testing.T) {
+	loadConfiguration = mockLoadFunc
+	if mode := GetDiscoveryMode(); mode != "auto" {
+		t.Error("Default discovery mode does not match", mode)
+	}
+	loadConfiguration = func() (*ini.File, error) {
+		return ini.InsensitiveLoad([]byte(`
+		[network]
+		discovery=Broadcast`))
+	}
+	if mode := GetDiscoveryMode(); mode != "broadcast" {
+		t.Error("Discovery mode not returned correctly!", mode)
+	}
+}
+
+func TestIsMDNSEnabled(t *testing.T) {
+	loadConfiguration = mockLoadFunc
+	if !IsMDNSEnabled() {
+		t.Error("mDNS should have been enabled by default")
+	}
+	loadConfiguration = func() (*ini.File, error) {
+		return ini.InsensitiveLoad([]byte(`
+		[network]
+		mdns=false`))
+	}
+	if IsMDNSEnabled() {
+		t.Error("mDNS should have been disabled")
+	}
+}
+
 func TestMissingUserProfileConfig(t *testing.T) {
 	loadConfigurations := []func() (*ini.File, error){func() (*ini.File, error) {
 		return ini.InsensitiveLoad([]byte(`
@@ -162,6 +220,38 @@ func TestMissingUserProfileConfig(t *testing.T) {
 	}
 }
 
+func TestGetStorageEncryptionConfig(t *testing.T) {
+	SetupNewConfiguration(GetTestConfiguration())
+	if passphrase, keyFile := GetStorageEncryptionConfig(); passphrase != "" || keyFile != "" {
+		t.Error("Storage should not have been encrypted by default")
+	}
+	SetupNewConfiguration(func() (*ini.File, error) {
+		return ini.InsensitiveLoad([]byte(`
+		[storage]
+		passphrase=secret words
+		keyfile=/etc/lamess.key`))
+	})
+	if passphrase, keyFile := GetStorageEncryptionConfig(); passphrase != "secret words" ||
+		keyFile != "/etc/lamess.key" {
+		t.Error("Storage encryption config not returned correctly!", passphrase, keyFile)
+	}
+}
+
+func TestIsBlindSearchEnabled(t *testing.T) {
+	SetupNewConfiguration(GetTestConfiguration())
+	if !IsBlindSearchEnabled() {
+		t.Error("Blind search should have been enabled by default")
+	}
+	SetupNewConfiguration(func() (*ini.File, error) {
+		return ini.InsensitiveLoad([]byte(`
+		[storage]
+		blindsearch=false`))
+	})
+	if IsBlindSearchEnabled() {
+		t.Error("Blind search should have been disabled")
+	}
+}
+
 func TestPanicableGetStorageLocation(t *testing.T) {
 	SetupNewConfiguration(func() (*ini.File, error) {
 		return ini.InsensitiveLoad([]byte(`
@@ -1,7 +1,9 @@
 package domains
 
 import (
+	"bytes"
 	"errors"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -26,8 +28,42 @@ const (
 	InvalidRenewTimeErrorMsg = "renew time can not be from past"
 	// RenewFailureMsg should returned whenever the update to DB fails.
 	RenewFailureMsg = "renew session failed"
+	// PresenceUpdateFailureMsg should be returned whenever the update of presence to DB fails.
+	PresenceUpdateFailureMsg = "update presence failed"
+	// ReplyToUpdateFailureMsg should be returned whenever the update of reply-to to DB fails.
+	ReplyToUpdateFailureMsg = "update reply-to failed"
+	// InvalidExpiryTimeErrorMsg should be returned when queuing a message expiring in the past
+	InvalidExpiryTimeErrorMsg = "expiry time can not be from past"
+	// MessageQueueFailureMsg should be returned whenever queuing a message to DB fails
+	MessageQueueFailureMsg = "queue message failed"
 )
 
+// ******************** Repository ********************
+
+var (
+	repository      s.Repository
+	repositoryMutex sync.Mutex
+)
+
+// SetRepository sets the storage the domains are persisted to and loaded from, e.g. an in-memory
+// repository for tests. It is expected to be set before any domain is loaded, as the domains
+// loaded from a repository are not carried over to another.
+func SetRepository(repo s.Repository) {
+	repositoryMutex.Lock()
+	defer repositoryMutex.Unlock()
+	repository = repo
+}
+
+// getRepository returns the repository set, defaulting to the SQLite DB of the application
+func getRepository() s.Repository {
+	repositoryMutex.Lock()
+	defer repositoryMutex.Unlock()
+	if repository == nil {
+		repository = s.NewGormRepository()
+	}
+	return repository
+}
+
 // ******************** User ********************
 
 var userMutex sync.Mutex
@@ -48,7 +84,7 @@ func (user *User) persistOrLoad() {
 		} else {
 			userModel.Username, userModel.DisplayName, userModel.Email = user.userProfile.GetUsername(),
 				user.userProfile.GetDisplayName(), user.userProfile.GetEmail()
-			s.GetDB().Create(userModel)
+			getRepository().CreateUser(userModel)
 			user.userModel = userModel
 		}
 	}
@@ -59,9 +95,33 @@ func (user User) GetUserProfile() profile.UserProfile {
 	return user.userProfile
 }
 
+// GetPublicKey returns the identity key trusted for the user, which is empty till a key is trusted
+func (user User) GetPublicKey() []byte {
+	return user.userModel.PublicKey
+}
+
+// TrustPublicKey binds the identity key to the user if the user does not have one yet, which is
+// trust on first use. It returns false if the user is already bound to a different key, which
+// means someone else is claiming to be the user, or if the key could not be stored.
+func (user *User) TrustPublicKey(publicKey []byte) bool {
+	if len(publicKey) == 0 || !user.IsPersisted() {
+		return false
+	}
+	userMutex.Lock()
+	defer userMutex.Unlock()
+	if len(user.userModel.PublicKey) > 0 {
+		return bytes.Equal(user.userModel.PublicKey, publicKey)
+	}
+	if getRepository().UpdateUserPublicKey(user.userModel, publicKey) != nil {
+		return false
+	}
+	user.userModel.PublicKey = publicKey
+	return true
+}
+
 // IsPersisted returns whether the instance represents a persisted model
 func (user User) IsPersisted() bool {
-	return !s.GetDB().NewRecord(user.userModel)
+	return user.userModel != nil && user.userModel.ID != 0
 }
 
 // AddSession adds a session to the user. One can only add a non-persisted session to a persisted
@@ -105,6 +165,16 @@ func (user *User) GetActiveSessions() []*Session {
 	return activeSessions
 }
 
+// GetPresence returns the presence of the user as announced by its main session. It returns false
+// if the user does not have any active session, i.e. the user is offline.
+func (user User) GetPresence() (profile.Presence, bool) {
+	mainSession, found := user.GetMainSession()
+	if !found {
+		return nil, false
+	}
+	return mainSession.GetPresence(), true
+}
+
 // GetMainSession gets the session with lowest device preference index for the given user
 func (user User) GetMainSession() (*Session, bool) {
 	sessions := user.GetActiveSessions()
@@ -121,9 +191,7 @@ func (user User) GetMainSession() (*Session, bool) {
 }
 
 func getUserModelByUsername(username string) (*s.UserModel, bool) {
-	userModel := &s.UserModel{}
-	newDB := s.GetDB().Where("username = ?", username).First(userModel)
-	return userModel, !newDB.RecordNotFound()
+	return getRepository().FindUserByUsername(username)
 }
 
 // NewUser returns a new instance of the User
@@ -159,11 +227,17 @@ type Session struct {
 	devicePreferenceIndex   uint8
 	expiryTime              time.Time
 	replyToConnectionString string
+	presence                profile.Presence
 }
 
 // IsPersisted returns whether the instance represents a persisted model
 func (session Session) IsPersisted() bool {
-	return !s.GetDB().NewRecord(session.sessionModel)
+	return session.sessionModel != nil && session.sessionModel.ID != 0
+}
+
+// GetSessionID returns the ID of the session, which messages to the session are encrypted for
+func (session Session) GetSessionID() string {
+	return session.sessionID
 }
 
 // GetSessionOwner returns the User who owns this session instance
@@ -186,6 +260,37 @@ func (session Session) GetReplyToConnectionString() string {
 	return session.replyToConnectionString
 }
 
+// GetPresence returns the latest presence announced by the session
+func (session Session) GetPresence() profile.Presence {
+	return session.presence
+}
+
+// UpdatePresence changes the presence of the session, persisting it if the session is persisted
+func (session *Session) UpdatePresence(presence profile.Presence) error {
+	if session.IsPersisted() {
+		rowsAffected := getRepository().UpdateSessionPresence(session.sessionModel,
+			string(presence.GetState()), presence.GetStatusMessage())
+		if rowsAffected != 1 {
+			return errors.New(PresenceUpdateFailureMsg)
+		}
+	}
+	session.presence = presence
+	return nil
+}
+
+// UpdateReplyTo changes the connection string to send messages to the session to, e.g. when the
+// session registers again from a new address, persisting it if the session is persisted
+func (session *Session) UpdateReplyTo(replyTo string) error {
+	if session.IsPersisted() {
+		rowsAffected := getRepository().UpdateSessionReplyTo(session.sessionModel, replyTo)
+		if rowsAffected != 1 {
+			return errors.New(ReplyToUpdateFailureMsg)
+		}
+	}
+	session.replyToConnectionString = replyTo
+	return nil
+}
+
 // IsSelf retrieves whether the current session is of this app itself.
 func (session Session) IsSelf() bool {
 	return packet.GetCurrentSessionID() == session.sessionID
@@ -195,8 +300,7 @@ func (session *Session) updateExpiryTime(newExpiryTime time.Time) error {
 	if !session.IsPersisted() {
 		return errors.New(RenewFailureMsg)
 	}
-	rowsAffected := s.GetDB().Model(session.sessionModel).
-		Updates(s.SessionModel{ExpiryTime: newExpiryTime}).RowsAffected
+	rowsAffected := getRepository().UpdateSessionExpiryTime(session.sessionModel, newExpiryTime)
 	if rowsAffected < 1 {
 		return errors.New(RenewFailureMsg)
 	}
@@ -228,12 +332,13 @@ func (session *Session) persistSession(user *User) {
 	sessionModel.ExpiryTime = session.expiryTime
 	sessionModel.SessionID = session.sessionID
 	sessionModel.ReplyToConnectionString = session.replyToConnectionString
-	saveResultDB := s.GetDB().Save(sessionModel)
-	if saveResultDB.Error != nil {
-		if strings.Contains(saveResultDB.Error.Error(), "UNIQUE constraint failed") {
-			panic(SaveOperationFailedError(saveResultDB.Error.Error()))
+	sessionModel.PresenceState = string(session.presence.GetState())
+	sessionModel.StatusMessage = session.presence.GetStatusMessage()
+	if err := getRepository().SaveSession(sessionModel); err != nil {
+		if _, duplicate := err.(s.DuplicateError); duplicate {
+			panic(SaveOperationFailedError(err.Error()))
 		} else {
-			panic(saveResultDB.Error)
+			panic(err)
 		}
 	}
 	session.user = user
@@ -242,24 +347,32 @@ func (session *Session) persistSession(user *User) {
 func getSessionFromModel(sessionModel *s.SessionModel) *Session {
 	session := &Session{sessionID: sessionModel.SessionID, sessionModel: sessionModel,
 		devicePreferenceIndex: sessionModel.DevicePreferenceIndex, expiryTime: sessionModel.ExpiryTime,
-		replyToConnectionString: sessionModel.ReplyToConnectionString}
+		replyToConnectionString: sessionModel.ReplyToConnectionString,
+		presence:                getPresenceFromModel(sessionModel)}
 	return session
 }
 
+// getPresenceFromModel loads the presence of the session, which is available for sessions stored
+// before presence was introduced
+func getPresenceFromModel(sessionModel *s.SessionModel) profile.Presence {
+	state := profile.PresenceState(sessionModel.PresenceState)
+	if !profile.IsValidPresenceState(state) {
+		return profile.NewPresence(profile.Available, "")
+	}
+	return profile.NewPresence(state, sessionModel.StatusMessage)
+}
+
 func loadUserFromSession(session *Session) {
-	sessionModel := session.sessionModel
-	s.GetDB().Model(sessionModel).Related(&sessionModel.UserModel)
 	user := &User{}
-	populateUserFromModel(user, &sessionModel.UserModel)
+	populateUserFromModel(user, &session.sessionModel.UserModel)
 	session.user = user
 }
 
 func getSessionsForUser(user *User) []*Session {
-	sessionModels := []s.SessionModel{}
-	s.GetDB().Find(&sessionModels, s.SessionModel{UserModelID: user.userModel.ID})
+	sessionModels := getRepository().FindSessionsByUser(user.userModel.ID)
 	sessions := make([]*Session, len(sessionModels), len(sessionModels))
 	for index, sessionModel := range sessionModels {
-		sessions[index] = getSessionFromModel(&sessionModel)
+		sessions[index] = getSessionFromModel(sessionModel)
 		sessions[index].user = user
 	}
 	return sessions
@@ -267,21 +380,679 @@ func getSessionsForUser(user *User) []*Session {
 
 // GetSessionBySessionID loads from DB with the matching session id
 func GetSessionBySessionID(sessionID string) (*Session, bool) {
-	sessionModel := &s.SessionModel{}
-	s.GetDB().Where(s.SessionModel{SessionID: sessionID}).First(sessionModel)
+	sessionModel, found := getRepository().FindSessionBySessionID(sessionID)
 	session := getSessionFromModel(sessionModel)
-	found := false
-	if session.IsPersisted() {
+	if found {
 		loadUserFromSession(session)
-		found = true
 	}
 	return session, found
 }
 
-// NewSession creates a non-persisted new Session to be added to a user
+// NewSession creates a non-persisted new Session to be added to a user; the session is Available
+// till its presence is updated
 func NewSession(sessionID string, devicePreferenceIndex uint8, expiryTime time.Time,
 	replyTo string) *Session {
 	session := &Session{sessionID: sessionID, devicePreferenceIndex: devicePreferenceIndex,
-		expiryTime: expiryTime, replyToConnectionString: replyTo, sessionModel: &s.SessionModel{}}
+		expiryTime: expiryTime, replyToConnectionString: replyTo, sessionModel: &s.SessionModel{},
+		presence: profile.NewPresence(profile.Available, "")}
 	return session
 }
+
+// ******************** Room ********************
+
+// Membership represents the state of a User in a Room
+type Membership uint8
+
+const (
+	// NotAMember signifies that the user has never been invited to the room
+	NotAMember Membership = iota
+	// Invited signifies that the user has been invited to but has not joined the room yet
+	Invited
+	// Joined signifies that the user is a member of the room and receives posts to it
+	Joined
+	// Left signifies that the user has left the room
+	Left
+)
+
+var roomMutex sync.Mutex
+
+// Room represents a chat room whose posts are sent to every active session of its members
+type Room struct {
+	roomModel *s.RoomModel
+}
+
+// GetRoomID returns the ID of the room which is unique across peers
+func (room Room) GetRoomID() string {
+	return room.roomModel.RoomID
+}
+
+// GetName returns the name of the room
+func (room Room) GetName() string {
+	return room.roomModel.Name
+}
+
+// IsPersisted returns whether the instance represents a persisted model
+func (room Room) IsPersisted() bool {
+	return room.roomModel != nil && room.roomModel.ID != 0
+}
+
+func (room Room) getMemberModel(user *User) (*s.RoomMemberModel, bool) {
+	return getRepository().FindRoomMember(room.roomModel.ID, user.userModel.ID)
+}
+
+// GetMembership returns the state of the user in this room
+func (room Room) GetMembership(user *User) Membership {
+	if !room.IsPersisted() || !user.IsPersisted() {
+		return NotAMember
+	}
+	memberModel, found := room.getMemberModel(user)
+	if !found {
+		return NotAMember
+	}
+	return Membership(memberModel.Membership)
+}
+
+// setMembership changes the state of the user in this room; a persisted user is expected to be
+// passed in as it would panic with InvalidStateError otherwise.
+func (room *Room) setMembership(user *User, membership Membership) bool {
+	if !room.IsPersisted() || !user.IsPersisted() {
+		panic(InvalidStateError("Membership being changed before room or user being persisted"))
+	}
+	roomMutex.Lock()
+	defer roomMutex.Unlock()
+	memberModel, found := room.getMemberModel(user)
+	if found && Membership(memberModel.Membership) == membership {
+		return false
+	}
+	memberModel.RoomModelID, memberModel.UserModelID = room.roomModel.ID, user.userModel.ID
+	memberModel.Membership = uint8(membership)
+	return getRepository().SaveRoomMember(memberModel) == nil
+}
+
+// Invite invites the user to the room. It returns false if the user is already a member or if
+// unexpected error occurs.
+func (room *Room) Invite(user *User) bool {
+	if room.GetMembership(user) == Joined {
+		return false
+	}
+	return room.setMembership(user, Invited)
+}
+
+// Join makes the user a member of the room. It is up to the caller to decide whether the user
+// should have been invited first. It returns false if the user is already a member or if
+// unexpected error occurs.
+func (room *Room) Join(user *User) bool {
+	return room.setMembership(user, Joined)
+}
+
+// Leave removes the user from the members or the invitees of the room. It returns false if the
+// user was neither or if unexpected error occurs.
+func (room *Room) Leave(user *User) bool {
+	if membership := room.GetMembership(user); membership != Joined && membership != Invited {
+		return false
+	}
+	return room.setMembership(user, Left)
+}
+
+func (room Room) getUsersByMembership(membership Membership) []*User {
+	if !room.IsPersisted() {
+		return []*User{}
+	}
+	memberModels := getRepository().FindRoomMembers(room.roomModel.ID, uint8(membership))
+	users := make([]*User, 0, len(memberModels))
+	for _, memberModel := range memberModels {
+		user := &User{}
+		populateUserFromModel(user, &memberModel.UserModel)
+		users = append(users, user)
+	}
+	return users
+}
+
+// GetMembers returns the users who joined the room
+func (room Room) GetMembers() []*User {
+	return room.getUsersByMembership(Joined)
+}
+
+// GetInvitees returns the users who are invited to but have not joined the room yet
+func (room Room) GetInvitees() []*User {
+	return room.getUsersByMembership(Invited)
+}
+
+// GetActiveSessions gets currently active sessions of every member of the room, which are the
+// sessions a post to the room is sent to
+func (room Room) GetActiveSessions() []*Session {
+	sessions := []*Session{}
+	for _, member := range room.GetMembers() {
+		sessions = append(sessions, member.GetActiveSessions()...)
+	}
+	return sessions
+}
+
+// NewRoom returns the persisted Room with the room ID, creating it with the name if it does not
+// exist yet
+func NewRoom(roomID string, name string) *Room {
+	roomMutex.Lock()
+	defer roomMutex.Unlock()
+	roomModel, found := getRoomModelByRoomID(roomID)
+	if !found {
+		roomModel.RoomID, roomModel.Name = roomID, name
+		getRepository().CreateRoom(roomModel)
+	}
+	return &Room{roomModel: roomModel}
+}
+
+func getRoomModelByRoomID(roomID string) (*s.RoomModel, bool) {
+	return getRepository().FindRoomByRoomID(roomID)
+}
+
+// GetRoomByRoomID retrieves the room signified by room ID
+func GetRoomByRoomID(roomID string) (*Room, bool) {
+	roomModel, found := getRoomModelByRoomID(roomID)
+	return &Room{roomModel: roomModel}, found
+}
+
+// ******************** Conversation ********************
+
+const (
+	// DefaultPageSize is the number of results in a page whose size is not specified
+	DefaultPageSize = 50
+	// MaxPageSize is the largest number of results returned in a page
+	MaxPageSize = 500
+	// UnknownConversationErrorMsg should be returned when the peer or the room of the conversation
+	// of a message is not known
+	UnknownConversationErrorMsg = "conversation not known"
+	// MessageSaveFailureMsg should be returned whenever saving a message to DB fails
+	MessageSaveFailureMsg = "save message failed"
+)
+
+// Page selects a page of the results, which are ordered newest first
+type Page struct {
+	Number int // Zero based index of the page
+	Size   int // Number of results in the page; DefaultPageSize if not positive
+}
+
+func (page Page) getLimitAndOffset() (int, int) {
+	size := page.Size
+	if size <= 0 {
+		size = DefaultPageSize
+	} else if size > MaxPageSize {
+		size = MaxPageSize
+	}
+	number := page.Number
+	if number < 0 {
+		number = 0
+	}
+	return size, number * size
+}
+
+var conversationMutex sync.Mutex
+
+// Conversation represents the messages exchanged with a peer user or posted in a room
+type Conversation struct {
+	conversationModel *s.ConversationModel
+}
+
+// IsRoom returns whether this is the conversation of a room rather than with a peer
+func (conversation Conversation) IsRoom() bool {
+	return conversation.conversationModel.RoomModelID != 0
+}
+
+// GetPeer returns the peer of a direct conversation
+func (conversation Conversation) GetPeer() (*User, bool) {
+	if conversation.IsRoom() {
+		return nil, false
+	}
+	userModel, found := getRepository().FindUserByID(conversation.conversationModel.PeerUserModelID)
+	if !found {
+		return nil, false
+	}
+	user := &User{}
+	populateUserFromModel(user, userModel)
+	return user, true
+}
+
+// GetRoom returns the room of a room conversation
+func (conversation Conversation) GetRoom() (*Room, bool) {
+	if !conversation.IsRoom() {
+		return nil, false
+	}
+	roomModel, found := getRepository().FindRoomByID(conversation.conversationModel.RoomModelID)
+	return &Room{roomModel: roomModel}, found
+}
+
+// GetLastMessageTime returns when the latest message of the conversation was sent
+func (conversation Conversation) GetLastMessageTime() time.Time {
+	return conversation.conversationModel.LastMessageTime
+}
+
+// GetMessages returns the page of messages of the conversation
+func (conversation Conversation) GetMessages(page Page) []*Message {
+	return FindMessages(MessageCriteria{Conversation: &conversation}, page)
+}
+
+func getOrCreateConversation(peerUserModelID uint, roomModelID uint) *Conversation {
+	conversationMutex.Lock()
+	defer conversationMutex.Unlock()
+	conversationModel, found := getRepository().FindConversation(peerUserModelID, roomModelID)
+	if !found {
+		conversationModel.PeerUserModelID, conversationModel.RoomModelID = peerUserModelID, roomModelID
+		getRepository().CreateConversation(conversationModel)
+	}
+	return &Conversation{conversationModel: conversationModel}
+}
+
+// GetDirectConversation returns the conversation with the peer, creating it if it does not exist
+// yet; a persisted user is expected to be passed in as it would panic with InvalidStateError
+// otherwise.
+func GetDirectConversation(peer *User) *Conversation {
+	if !peer.IsPersisted() {
+		panic(InvalidStateError("Conversation being retrieved before user being persisted"))
+	}
+	return getOrCreateConversation(peer.userModel.ID, 0)
+}
+
+// GetRoomConversation returns the conversation of the room, creating it if it does not exist yet;
+// a persisted room is expected to be passed in as it would panic with InvalidStateError otherwise.
+func GetRoomConversation(room *Room) *Conversation {
+	if !room.IsPersisted() {
+		panic(InvalidStateError("Conversation being retrieved before room being persisted"))
+	}
+	return getOrCreateConversation(0, room.roomModel.ID)
+}
+
+// GetConversations returns the page of conversations, the one with the latest message first
+func GetConversations(page Page) []*Conversation {
+	limit, offset := page.getLimitAndOffset()
+	conversationModels := getRepository().FindConversations(limit, offset)
+	conversations := make([]*Conversation, len(conversationModels))
+	for index, conversationModel := range conversationModels {
+		conversations[index] = &Conversation{conversationModel: conversationModel}
+	}
+	return conversations
+}
+
+// ******************** Message ********************
+
+var messageMutex sync.Mutex
+
+// Message represents a message sent or received in a conversation
+type Message struct {
+	messageModel *s.MessageModel
+}
+
+// GetConversation returns the conversation the message is in
+func (message Message) GetConversation() *Conversation {
+	conversationModel, _ := getRepository().FindConversationByID(message.messageModel.ConversationModelID)
+	return &Conversation{conversationModel: conversationModel}
+}
+
+// GetSender returns the user who sent the message
+func (message Message) GetSender() *User {
+	userModel, _ := getRepository().FindUserByID(message.messageModel.SenderUserModelID)
+	user := &User{}
+	populateUserFromModel(user, userModel)
+	return user
+}
+
+// GetSessionID returns the session the message was sent from
+func (message Message) GetSessionID() string {
+	return message.messageModel.SessionID
+}
+
+// GetPacketID returns the ID of the packet the message was sent as
+func (message Message) GetPacketID() uint64 {
+	return message.messageModel.PacketID
+}
+
+// IsOutgoing returns whether the message was sent by this user
+func (message Message) IsOutgoing() bool {
+	return message.messageModel.Outgoing
+}
+
+// GetContentType returns the content type of the message body
+func (message Message) GetContentType() string {
+	return message.messageModel.ContentType
+}
+
+// GetBody returns the body of the message
+func (message Message) GetBody() string {
+	return message.messageModel.Body
+}
+
+// GetSentTime returns when the message was sent as per its sender
+func (message Message) GetSentTime() time.Time {
+	return message.messageModel.SentTime
+}
+
+func saveMessage(sender *User, conversation *Conversation, messagePacket packet.MessagePacket,
+	outgoing bool) (*Message, error) {
+	messageMutex.Lock()
+	defer messageMutex.Unlock()
+	messageModel, found := getRepository().FindMessageByPacket(messagePacket.GetSessionID(),
+		messagePacket.GetPacketID())
+	if found {
+		// Already saved, e.g. the same message being received again
+		return &Message{messageModel: messageModel}, nil
+	}
+	messageModel.ConversationModelID = conversation.conversationModel.ID
+	messageModel.SenderUserModelID = sender.userModel.ID
+	messageModel.SessionID, messageModel.PacketID = messagePacket.GetSessionID(), messagePacket.GetPacketID()
+	messageModel.Outgoing = outgoing
+	messageModel.ContentType, messageModel.Body = messagePacket.GetContentType(), messagePacket.GetBody()
+	messageModel.SentTime = messagePacket.GetTimestamp()
+	if getRepository().CreateMessage(messageModel) != nil {
+		return nil, errors.New(MessageSaveFailureMsg)
+	}
+	if messageModel.SentTime.After(conversation.GetLastMessageTime()) &&
+		getRepository().UpdateConversationLastMessageTime(conversation.conversationModel,
+			messageModel.SentTime) == nil {
+		conversation.conversationModel.LastMessageTime = messageModel.SentTime
+	}
+	return &Message{messageModel: messageModel}, nil
+}
+
+func getRoomConversationOfMessage(messagePacket packet.MessagePacket) (*Conversation, error) {
+	room, found := GetRoomByRoomID(messagePacket.GetRoomID())
+	if !found {
+		return nil, errors.New(UnknownConversationErrorMsg)
+	}
+	return GetRoomConversation(room), nil
+}
+
+// SaveIncomingMessage saves the message received from the sender, in the conversation with the
+// sender or in the room it was posted to; a persisted user is expected to be passed in as it would
+// panic with InvalidStateError otherwise. Saving a message already saved returns it as is.
+func SaveIncomingMessage(sender *User, messagePacket packet.MessagePacket) (*Message, error) {
+	var conversation *Conversation
+	var err error
+	if messagePacket.GetRoomID() != "" {
+		conversation, err = getRoomConversationOfMessage(messagePacket)
+	} else {
+		conversation = GetDirectConversation(sender)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return saveMessage(sender, conversation, messagePacket, false)
+}
+
+// SaveOutgoingMessage saves the message sent by this user, in the conversation with its recipient
+// or in the room it was posted to. Saving a message already saved returns it as is.
+func SaveOutgoingMessage(self *User, messagePacket packet.MessagePacket) (*Message, error) {
+	var conversation *Conversation
+	var err error
+	if messagePacket.GetRoomID() != "" {
+		conversation, err = getRoomConversationOfMessage(messagePacket)
+	} else if recipient, found := GetUserByUsername(messagePacket.GetRecipientUsername()); found {
+		conversation = GetDirectConversation(recipient)
+	} else {
+		err = errors.New(UnknownConversationErrorMsg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return saveMessage(self, conversation, messagePacket, true)
+}
+
+// MessageCriteria narrows down the messages to find; criteria not set are not applied
+type MessageCriteria struct {
+	Conversation *Conversation // Messages in the conversation
+	Peer         *User         // Messages sent by the peer or in the conversation with the peer
+	From         time.Time     // Messages sent at or after the time
+	To           time.Time     // Messages sent before the time
+}
+
+// toFilter returns the storage filter of the criteria; it returns false if no message can match
+func (criteria MessageCriteria) toFilter() (s.MessageFilter, bool) {
+	filter := s.MessageFilter{From: criteria.From, To: criteria.To}
+	if criteria.Conversation != nil {
+		filter.ConversationModelID = criteria.Conversation.conversationModel.ID
+	}
+	if criteria.Peer != nil {
+		if !criteria.Peer.IsPersisted() {
+			return filter, false
+		}
+		filter.PeerUserModelID = criteria.Peer.userModel.ID
+	}
+	return filter, true
+}
+
+// FindMessages returns the page of messages matching the criteria, the latest sent first
+func FindMessages(criteria MessageCriteria, page Page) []*Message {
+	filter, matchable := criteria.toFilter()
+	if !matchable {
+		return []*Message{}
+	}
+	limit, offset := page.getLimitAndOffset()
+	messageModels := getRepository().FindMessages(filter, limit, offset)
+	messages := make([]*Message, len(messageModels))
+	for index, messageModel := range messageModels {
+		messages[index] = &Message{messageModel: messageModel}
+	}
+	return messages
+}
+
+// CountMessages returns the number of messages matching the criteria
+func CountMessages(criteria MessageCriteria) int {
+	filter, matchable := criteria.toFilter()
+	if !matchable {
+		return 0
+	}
+	return getRepository().CountMessages(filter)
+}
+
+// ******************** Search ********************
+
+const (
+	// SearchUnavailableErrorMsg should be returned when the full-text index of messages is not
+	// available
+	SearchUnavailableErrorMsg = "full-text search not available"
+	// BlankSearchQueryErrorMsg should be returned when searching without any term
+	BlankSearchQueryErrorMsg = "search query is blank"
+	snippetTokens            = 12
+	snippetEllipsis          = "..."
+	// SnippetMatchStart and SnippetMatchEnd surround the terms matched in a snippet
+	SnippetMatchStart = "["
+	SnippetMatchEnd   = "]"
+)
+
+// SearchCriteria is the query to search messages with along with the filters to narrow down the
+// hits; filters not set are not applied
+type SearchCriteria struct {
+	Query          string    // Terms every message matched contains
+	SenderUsername string    // Messages sent by the user
+	From           time.Time // Messages sent at or after the time
+	To             time.Time // Messages sent before the time
+}
+
+// SearchHit is a message matching the search with a snippet of its body around the terms matched
+type SearchHit struct {
+	Message *Message
+	Snippet string
+	Rank    float64 // Rank of the hit, e.g. BM25 in SQLite, the lower the more relevant
+}
+
+// SearchMessages returns the page of messages matching the search, the most relevant first
+func SearchMessages(criteria SearchCriteria, page Page) ([]*SearchHit, error) {
+	if !getRepository().IsSearchAvailable() {
+		return nil, errors.New(SearchUnavailableErrorMsg)
+	}
+	if utils.IsStringBlank(criteria.Query) {
+		return nil, errors.New(BlankSearchQueryErrorMsg)
+	}
+	search := s.MessageSearch{MessageFilter: s.MessageFilter{From: criteria.From, To: criteria.To},
+		Terms: strings.Fields(criteria.Query), MatchStart: SnippetMatchStart, MatchEnd: SnippetMatchEnd,
+		Ellipsis: snippetEllipsis, SnippetTokens: snippetTokens}
+	if criteria.SenderUsername != "" {
+		userModel, found := getUserModelByUsername(criteria.SenderUsername)
+		if !found {
+			return []*SearchHit{}, nil
+		}
+		search.SenderUserModelID = userModel.ID
+	}
+	limit, offset := page.getLimitAndOffset()
+	searchHits, err := getRepository().SearchMessages(search, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	hits := make([]*SearchHit, len(searchHits))
+	for index, searchHit := range searchHits {
+		hits[index] = &SearchHit{Message: &Message{messageModel: &searchHit.MessageModel},
+			Snippet: searchHit.Snippet, Rank: searchHit.Rank}
+	}
+	return hits, nil
+}
+
+// ******************** Outbox ********************
+
+// QueuedMessage represents a message waiting in the outbox for its recipient to be online
+type QueuedMessage struct {
+	outboxModel *s.OutboxModel
+}
+
+// GetRoomID returns the room the message is posted to; blank for a direct message
+func (queuedMessage QueuedMessage) GetRoomID() string {
+	return queuedMessage.outboxModel.RoomID
+}
+
+// GetContentType returns the content type of the message body
+func (queuedMessage QueuedMessage) GetContentType() string {
+	return queuedMessage.outboxModel.ContentType
+}
+
+// GetBody returns the body of the message
+func (queuedMessage QueuedMessage) GetBody() string {
+	return queuedMessage.outboxModel.Body
+}
+
+// GetExpiryTime returns the time after which the message is dropped instead of being delivered
+func (queuedMessage QueuedMessage) GetExpiryTime() time.Time {
+	return queuedMessage.outboxModel.ExpiryTime
+}
+
+// GetMessagePacket returns the packet queued, which is the one saved to the history of the sender,
+// so that it is delivered as the same message. It returns false for a message queued before packets
+// were, or by an earlier session of this user, as peers can not authenticate packets of a session
+// once it has ended.
+func (queuedMessage QueuedMessage) GetMessagePacket() (packet.MessagePacket, bool) {
+	if queuedMessage.outboxModel.Packet == "" {
+		return nil, false
+	}
+	queuedPacket, err := packet.FromJSON([]byte(queuedMessage.outboxModel.Packet), packet.MessagePacketType)
+	if err != nil || queuedPacket.GetSessionID() != packet.GetCurrentSessionID() {
+		return nil, false
+	}
+	return queuedPacket.(packet.MessagePacket), true
+}
+
+// Dequeue removes the message from the outbox. It returns false if the message was already
+// dequeued, so only one of the callers dequeuing a message concurrently delivers it.
+func (queuedMessage QueuedMessage) Dequeue() bool {
+	return getRepository().DeleteOutboxEntry(queuedMessage.outboxModel)
+}
+
+// QueueMessage queues the message in the outbox of the recipient till the expiry time; a persisted
+// user is expected to be passed in as it would panic with InvalidStateError otherwise.
+func QueueMessage(recipient *User, message packet.MessagePacket, expiryTime time.Time) (*QueuedMessage, error) {
+	if !recipient.IsPersisted() {
+		panic(InvalidStateError("Message being queued before user being persisted"))
+	}
+	if !expiryTime.After(time.Now()) {
+		return nil, errors.New(InvalidExpiryTimeErrorMsg)
+	}
+	outboxModel := &s.OutboxModel{RecipientUserModelID: recipient.userModel.ID, RoomID: message.GetRoomID(),
+		ContentType: message.GetContentType(), Body: message.GetBody(), ExpiryTime: expiryTime,
+		Packet: message.ToJSON()}
+	if getRepository().CreateOutboxEntry(outboxModel) != nil {
+		return nil, errors.New(MessageQueueFailureMsg)
+	}
+	return &QueuedMessage{outboxModel: outboxModel}, nil
+}
+
+// GetQueuedMessages returns the messages queued for the recipient, the oldest first, dropping the
+// ones expired
+func GetQueuedMessages(recipient *User) []*QueuedMessage {
+	if !recipient.IsPersisted() {
+		return []*QueuedMessage{}
+	}
+	getRepository().DeleteExpiredOutboxEntries(recipient.userModel.ID, time.Now())
+	outboxModels := getRepository().FindOutboxEntries(recipient.userModel.ID)
+	queuedMessages := make([]*QueuedMessage, len(outboxModels))
+	for index, outboxModel := range outboxModels {
+		queuedMessages[index] = &QueuedMessage{outboxModel: outboxModel}
+	}
+	return queuedMessages
+}
+
+// ******************** Routing ********************
+
+// RoutingPolicy decides which active sessions of the recipient a message is delivered to
+type RoutingPolicy int
+
+const (
+	// AllActiveSessions delivers the message to every active session of the recipient
+	AllActiveSessions RoutingPolicy = iota
+	// MainSessionOnly delivers the message to the main session of the recipient only
+	MainSessionOnly
+	// MainThenFallback delivers the message to the main session of the recipient and, if it
+	// fails, to the other active sessions one by one in the order of their device preference
+	MainThenFallback
+)
+
+func (policy RoutingPolicy) String() string {
+	switch policy {
+	case MainSessionOnly:
+		return "main"
+	case MainThenFallback:
+		return "fallback"
+	default:
+		return "all"
+	}
+}
+
+// Route is the sessions a message is delivered to as per its RoutingPolicy
+type Route struct {
+	Policy RoutingPolicy
+	// Sessions are the sessions of the recipient, the main session first
+	Sessions []*Session
+	// SyncSessions are the other active sessions of the sender, which are sent a copy of the
+	// message to keep the conversation in sync across the devices of the sender
+	SyncSessions []*Session
+}
+
+// getOtherActiveSessions returns the active sessions of the user except this session, in the order
+// of their device preference
+func getOtherActiveSessions(user *User) []*Session {
+	sessions := []*Session{}
+	for _, session := range user.GetActiveSessions() {
+		if !session.IsSelf() {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.SliceStable(sessions, func(i, j int) bool {
+		return sessions[i].devicePreferenceIndex < sessions[j].devicePreferenceIndex
+	})
+	return sessions
+}
+
+// RouteDelivery returns the sessions a message to the recipient is delivered to as per the policy,
+// without any session to sync it to, e.g. for a message queued in the outbox which was synced when
+// it was sent
+func RouteDelivery(recipient *User, policy RoutingPolicy) *Route {
+	route := &Route{Policy: policy, Sessions: getOtherActiveSessions(recipient),
+		SyncSessions: []*Session{}}
+	if policy == MainSessionOnly && len(route.Sessions) > 1 {
+		route.Sessions = route.Sessions[:1]
+	}
+	return route
+}
+
+// RouteMessage returns the sessions the message from the sender to the recipient is delivered to
+// as per the policy. Messages to oneself are only delivered to the other sessions as per the policy.
+func RouteMessage(sender *User, recipient *User, policy RoutingPolicy) *Route {
+	route := RouteDelivery(recipient, policy)
+	if sender.GetUserProfile().GetUsername() != recipient.GetUserProfile().GetUsername() {
+		route.SyncSessions = getOtherActiveSessions(sender)
+	}
+	return route
+}
@@ -1,8 +1,8 @@
 package domains
 
 import (
-	"database/sql"
 	"log"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -15,27 +15,15 @@ import (
 	"github.com/imyousuf/lan-messenger/utils"
 )
 
-const (
-	deleteUserModelsSQL          = testutils.DeleteUserModelsSQL
-	deleteSessionModelsSQL       = testutils.DeleteSessionModelsSQL
-	countUserModelsByUsernameSQL = "SELECT count(*) FROM user_models WHERE username = ?"
-)
-
-var globalDbSetupForDomainTests = sync.Once{}
+var globalConfSetupForDomainTests = sync.Once{}
 
+// setupCleanTestTablesForDomainTests starts every test with an empty in-memory repository; the
+// SQLite repository is tested in the storage package
 func setupCleanTestTablesForDomainTests() {
-	globalDbSetupForDomainTests.Do(func() {
+	globalConfSetupForDomainTests.Do(func() {
 		conf.SetupNewConfiguration(testutils.MockLoadFunc)
-		s.ReInitDBConnection()
 	})
-	s.GetDB().Exec(deleteUserModelsSQL)
-	s.GetDB().Exec(deleteSessionModelsSQL)
-}
-
-func checkRowCount(row *sql.Row, expectedRowCount uint) bool {
-	var actualCount uint
-	row.Scan(&actualCount)
-	return actualCount == expectedRowCount
+	SetRepository(s.NewMemoryRepository())
 }
 
 // **************** User ****************
@@ -52,19 +40,16 @@ func TestNewUser(t *testing.T) {
 	setupCleanTestTablesForDomainTests()
 	uProfile := profile.NewUserProfile(conf.GetUserProfile())
 	user := NewUser(uProfile)
-	if s.GetDB().NewRecord(&user.userModel) || user.userProfile == nil {
+	if !user.IsPersisted() || user.userProfile == nil {
 		t.Error("Could not persist new user")
 	}
 	assertUserProfileData(uProfile, user, t)
 	modelID := user.userModel.ID
-	if !checkRowCount(s.GetDB().Raw(countUserModelsByUsernameSQL, uProfile.GetUsername()).Row(), 1) {
-		t.Error("Could not match records in DB")
+	if userModel, found := getRepository().FindUserByUsername(uProfile.GetUsername()); !found ||
+		userModel.ID != modelID {
+		t.Error("Could not match records in repository")
 	}
-	uProfile = profile.NewUserProfile(conf.GetUserProfile())
-	if !checkRowCount(s.GetDB().Raw(countUserModelsByUsernameSQL, uProfile.GetUsername()).Row(), 1) {
-		t.Error("Could not match records in DB")
-	}
-	if modelID != user.userModel.ID {
+	if sameUser := NewUser(profile.NewUserProfile(conf.GetUserProfile())); modelID != sameUser.userModel.ID {
 		t.Error("ID did not match for the first created user")
 	}
 }
@@ -73,13 +58,13 @@ func TestGetUserByUsername(t *testing.T) {
 	setupCleanTestTablesForDomainTests()
 	uProfile := profile.NewUserProfile(conf.GetUserProfile())
 	user, found := GetUserByUsername(uProfile.GetUsername())
-	if found || !s.GetDB().NewRecord(user.userModel) {
+	if found || user.IsPersisted() {
 		t.Error("Should not have found any record!")
 	}
 	NewUser(uProfile)
 	user, found = GetUserByUsername(uProfile.GetUsername())
 	assertUserProfileData(uProfile, user, t)
-	if !found || s.GetDB().NewRecord(user.userModel) {
+	if !found || !user.IsPersisted() {
 		t.Error("Should have found record!")
 	}
 }
@@ -112,6 +97,46 @@ func TestUser_GetUserProfile(t *testing.T) {
 	}
 }
 
+func TestUser_TrustPublicKey(t *testing.T) {
+	setupCleanTestTablesForDomainTests()
+	uProfile := profile.NewUserProfile(conf.GetUserProfile())
+	if unknownUser, _ := GetUserByUsername(uProfile.GetUsername()); unknownUser.TrustPublicKey([]byte("first-key")) {
+		t.Error("Non-persisted user should not trust any key")
+	}
+	user := NewUser(uProfile)
+	if user.TrustPublicKey(nil) {
+		t.Error("Blank key should not be trusted")
+	}
+	if !user.TrustPublicKey([]byte("first-key")) || !user.TrustPublicKey([]byte("first-key")) {
+		t.Error("Key seen first should be trusted")
+	}
+	if user.TrustPublicKey([]byte("second-key")) {
+		t.Error("Key different from the one seen first should not be trusted")
+	}
+	reloadedUser, _ := GetUserByUsername(uProfile.GetUsername())
+	if string(reloadedUser.GetPublicKey()) != "first-key" || reloadedUser.TrustPublicKey([]byte("second-key")) {
+		t.Error("Trusted key was not persisted")
+	}
+}
+
+func TestUser_GetPresence(t *testing.T) {
+	setupCleanTestTablesForDomainTests()
+	user := NewUser(profile.NewUserProfile(conf.GetUserProfile()))
+	if _, online := user.GetPresence(); online {
+		t.Error("User without active session should have been offline")
+	}
+	mainSession := NewSession("A1", 1, time.Now().Add(time.Minute), "127.0.0.1:4000")
+	mainSession.UpdatePresence(profile.NewPresence(profile.Away, "Lunch"))
+	user.AddSession(mainSession)
+	otherSession := NewSession("A2", 2, time.Now().Add(time.Minute), "127.0.0.1:4001")
+	user.AddSession(otherSession)
+	otherSession.UpdatePresence(profile.NewPresence(profile.Busy, ""))
+	presence, online := user.GetPresence()
+	if !online || presence.GetState() != profile.Away || presence.GetStatusMessage() != "Lunch" {
+		t.Error("Presence of the main session should have been returned")
+	}
+}
+
 // **************** Session ****************
 
 func cloneSession(session Session) *Session {
@@ -434,3 +459,303 @@ func TestSession_SignOff(t *testing.T) {
 		}
 	})
 }
+
+// **************** Room ****************
+
+func TestNewRoom(t *testing.T) {
+	setupCleanTestTablesForDomainTests()
+	if room, found := GetRoomByRoomID("R1"); found || room.IsPersisted() {
+		t.Error("Should not have found any room!")
+	}
+	room := NewRoom("R1", "Team")
+	if !room.IsPersisted() || room.GetRoomID() != "R1" || room.GetName() != "Team" {
+		t.Error("Could not persist new room")
+	}
+	if loadedRoom := NewRoom("R1", "Other"); loadedRoom.GetName() != "Team" {
+		t.Error("Existing room should have been loaded")
+	}
+	if loadedRoom, found := GetRoomByRoomID("R1"); !found || loadedRoom.GetName() != "Team" {
+		t.Error("Should have found the room")
+	}
+}
+
+func TestRoom_Membership(t *testing.T) {
+	setupCleanTestTablesForDomainTests()
+	room := NewRoom("R1", "Team")
+	owner := NewUser(profile.NewUserProfile("a", "a", "a@a.co"))
+	invitee := NewUser(profile.NewUserProfile("b", "b", "b@b.co"))
+	if room.GetMembership(owner) != NotAMember || room.Leave(owner) {
+		t.Error("User should not have been a member yet")
+	}
+	if !room.Join(owner) || room.Join(owner) || room.Invite(owner) {
+		t.Error("Owner should have joined only once")
+	}
+	if !room.Invite(invitee) || room.GetMembership(invitee) != Invited {
+		t.Error("Invitee should have been invited")
+	}
+	if len(room.GetMembers()) != 1 || len(room.GetInvitees()) != 1 ||
+		room.GetInvitees()[0].GetUserProfile().GetUsername() != "b" {
+		t.Error("Members and invitees did not match")
+	}
+	if !room.Join(invitee) || len(room.GetMembers()) != 2 || len(room.GetInvitees()) != 0 {
+		t.Error("Invitee should have joined")
+	}
+	if !room.Leave(owner) || room.GetMembership(owner) != Left || len(room.GetMembers()) != 1 {
+		t.Error("Owner should have left")
+	}
+	unknownUser, _ := GetUserByUsername("c")
+	utils.PanicableInvocation(func() {
+		room.Invite(unknownUser)
+		t.Error("Should have paniced for non-persisted user")
+	}, func(r interface{}) {})
+}
+
+func TestRoom_GetActiveSessions(t *testing.T) {
+	setupCleanTestTablesForDomainTests()
+	room := NewRoom("R1", "Team")
+	member := NewUser(profile.NewUserProfile("a", "a", "a@a.co"))
+	invitee := NewUser(profile.NewUserProfile("b", "b", "b@b.co"))
+	member.AddSession(NewSession("A1", 1, time.Now().Add(time.Minute), "127.0.0.1:4000"))
+	member.AddSession(NewSession("A2", 2, time.Now().Add(time.Minute), "127.0.0.2:4000"))
+	member.AddSession(NewSession("A3", 3, time.Now().Add(-time.Minute), "127.0.0.3:4000"))
+	invitee.AddSession(NewSession("B1", 1, time.Now().Add(time.Minute), "127.0.0.4:4000"))
+	room.Join(member)
+	room.Invite(invitee)
+	if sessions := room.GetActiveSessions(); len(sessions) != 2 {
+		t.Error("Only active sessions of members should have been returned", len(sessions))
+	}
+}
+
+func TestSession_UpdatePresence(t *testing.T) {
+	setupCleanTestTablesForDomainTests()
+	session := NewSession("A1", 1, time.Now().Add(time.Minute), "127.0.0.1:4000")
+	if session.GetPresence().GetState() != profile.Available {
+		t.Error("New session should have been available")
+	}
+	NewUser(profile.NewUserProfile(conf.GetUserProfile())).AddSession(session)
+	if err := session.UpdatePresence(profile.NewPresence(profile.DoNotDisturb, "Focus")); err != nil {
+		t.Error("Presence should have been updated", err)
+	}
+	loadedSession, _ := GetSessionBySessionID("A1")
+	if loadedSession.GetPresence().GetState() != profile.DoNotDisturb ||
+		loadedSession.GetPresence().GetStatusMessage() != "Focus" {
+		t.Error("Presence should have been persisted")
+	}
+	session.UpdatePresence(profile.NewPresence(profile.Available, ""))
+	if loadedSession, _ = GetSessionBySessionID("A1"); loadedSession.GetPresence().GetStatusMessage() != "" {
+		t.Error("Status message should have been cleared")
+	}
+}
+
+func TestSession_UpdateReplyTo(t *testing.T) {
+	setupCleanTestTablesForDomainTests()
+	session := NewSession("A1", 1, time.Now().Add(time.Minute), "127.0.0.1:4000")
+	NewUser(profile.NewUserProfile(conf.GetUserProfile())).AddSession(session)
+	if err := session.UpdateReplyTo("[fd00::2]:4000"); err != nil {
+		t.Error("Reply-to should have been updated", err)
+	}
+	if loadedSession, _ := GetSessionBySessionID("A1"); loadedSession.GetReplyToConnectionString() != "[fd00::2]:4000" {
+		t.Error("Reply-to should have been persisted")
+	}
+}
+
+// **************** Message ****************
+
+func TestSaveMessage(t *testing.T) {
+	setupCleanTestTablesForDomainTests()
+	self := NewUser(profile.NewUserProfile(conf.GetUserProfile()))
+	peer := NewUser(profile.NewUserProfile("b", "b", "b@b.co"))
+	incoming := packet.NewBuilderFactory().Message().To(self.GetUserProfile().GetUsername()).
+		WithBody(packet.TextContentType, "Hi").BuildMessagePacket()
+	message, err := SaveIncomingMessage(peer, incoming)
+	if err != nil || message.IsOutgoing() || message.GetBody() != "Hi" ||
+		message.GetSender().GetUserProfile().GetUsername() != "b" {
+		t.Fatal("Incoming message should have been saved", err)
+	}
+	if conversationPeer, found := message.GetConversation().GetPeer(); !found ||
+		conversationPeer.GetUserProfile().GetUsername() != "b" {
+		t.Error("Incoming message should have been in the conversation with its sender")
+	}
+	if _, err := SaveIncomingMessage(peer, incoming); err != nil || CountMessages(MessageCriteria{}) != 1 {
+		t.Error("Message already saved should not have been saved again", err)
+	}
+	outgoing := packet.NewBuilderFactory().Message().To("b").WithBody(packet.TextContentType, "Hello").
+		BuildMessagePacket()
+	if message, err = SaveOutgoingMessage(self, outgoing); err != nil || !message.IsOutgoing() ||
+		message.GetConversation().IsRoom() {
+		t.Error("Outgoing message should have been saved", err)
+	}
+	if messages := GetDirectConversation(peer).GetMessages(Page{}); len(messages) != 2 ||
+		messages[0].GetBody() != "Hello" {
+		t.Error("Messages of the conversation should have been latest first")
+	}
+	post := packet.NewBuilderFactory().Message().To("b").InRoom("R1").
+		WithBody(packet.TextContentType, "Hi").BuildMessagePacket()
+	if _, err := SaveIncomingMessage(peer, post); err == nil || err.Error() != UnknownConversationErrorMsg {
+		t.Error("Post to unknown room should not have been saved", err)
+	}
+	room := NewRoom("R1", "Team")
+	if message, err = SaveIncomingMessage(peer, post); err != nil || !message.GetConversation().IsRoom() {
+		t.Error("Post should have been saved in the room conversation", err)
+	}
+	if conversations := GetConversations(Page{}); len(conversations) != 2 {
+		t.Error("Direct and room conversations should have been listed", len(conversations))
+	}
+	if conversationRoom, found := GetRoomConversation(room).GetRoom(); !found ||
+		conversationRoom.GetRoomID() != "R1" {
+		t.Error("Room of the conversation should have been found")
+	}
+}
+
+func TestFindMessages(t *testing.T) {
+	setupCleanTestTablesForDomainTests()
+	self := NewUser(profile.NewUserProfile(conf.GetUserProfile()))
+	peer := NewUser(profile.NewUserProfile("b", "b", "b@b.co"))
+	other := NewUser(profile.NewUserProfile("c", "c", "c@c.co"))
+	start := time.Now()
+	for index := 0; index < 5; index++ {
+		SaveOutgoingMessage(self, packet.NewBuilderFactory().Message().To("b").
+			WithBody(packet.TextContentType, "Hi").BuildMessagePacket())
+		SaveOutgoingMessage(self, packet.NewBuilderFactory().Message().To("c").
+			WithBody(packet.TextContentType, "Hi").BuildMessagePacket())
+	}
+	middle := time.Now()
+	SaveOutgoingMessage(self, packet.NewBuilderFactory().Message().To("c").
+		WithBody(packet.TextContentType, "Hi").BuildMessagePacket())
+	if count := CountMessages(MessageCriteria{Peer: peer}); count != 5 {
+		t.Error("Messages with the peer did not match", count)
+	}
+	if count := CountMessages(MessageCriteria{Conversation: GetDirectConversation(other)}); count != 6 {
+		t.Error("Messages of the conversation did not match", count)
+	}
+	if count := CountMessages(MessageCriteria{From: middle}); count != 1 {
+		t.Error("Messages after the time did not match", count)
+	}
+	if count := CountMessages(MessageCriteria{Peer: other, From: start, To: middle}); count != 5 {
+		t.Error("Messages with the peer in the time range did not match", count)
+	}
+	firstPage := FindMessages(MessageCriteria{}, Page{Number: 0, Size: 4})
+	lastPage := FindMessages(MessageCriteria{}, Page{Number: 2, Size: 4})
+	if len(firstPage) != 4 || len(lastPage) != 3 ||
+		firstPage[0].GetSentTime().Before(lastPage[0].GetSentTime()) {
+		t.Error("Messages should have been paginated latest first", len(firstPage), len(lastPage))
+	}
+	unknownUser, _ := GetUserByUsername("d")
+	if messages := FindMessages(MessageCriteria{Peer: unknownUser}, Page{}); len(messages) != 0 {
+		t.Error("Messages with unknown user should not have been found")
+	}
+}
+
+func TestSearchMessages(t *testing.T) {
+	setupCleanTestTablesForDomainTests()
+	self := NewUser(profile.NewUserProfile(conf.GetUserProfile()))
+	peer := NewUser(profile.NewUserProfile("b", "b", "b@b.co"))
+	selfUsername := self.GetUserProfile().GetUsername()
+	start := time.Now()
+	SaveIncomingMessage(peer, packet.NewBuilderFactory().Message().To(selfUsername).
+		WithBody(packet.TextContentType, "Shall we go for lunch today?").BuildMessagePacket())
+	SaveOutgoingMessage(self, packet.NewBuilderFactory().Message().To("b").
+		WithBody(packet.TextContentType, "Lunch sounds good, lunch at noon").BuildMessagePacket())
+	SaveIncomingMessage(peer, packet.NewBuilderFactory().Message().To(selfUsername).
+		WithBody(packet.TextContentType, "See you there").BuildMessagePacket())
+	hits, err := SearchMessages(SearchCriteria{Query: "lunch"}, Page{})
+	if err != nil || len(hits) != 2 {
+		t.Fatal("Messages containing the term should have been found", err, len(hits))
+	}
+	if hits[0].Rank > hits[1].Rank || !strings.Contains(hits[0].Snippet,
+		SnippetMatchStart+"lunch"+SnippetMatchEnd) {
+		t.Error("Hits should have been ranked with the match highlighted", hits[0].Snippet)
+	}
+	if hits, _ = SearchMessages(SearchCriteria{Query: "lunch", SenderUsername: "b"}, Page{}); len(hits) != 1 ||
+		hits[0].Message.IsOutgoing() {
+		t.Error("Hits should have been filtered by sender")
+	}
+	if hits, _ = SearchMessages(SearchCriteria{Query: "lunch", From: start.Add(time.Hour)}, Page{}); len(hits) != 0 {
+		t.Error("Hits should have been filtered by time")
+	}
+	if hits, err = SearchMessages(SearchCriteria{Query: `lunch" OR "see`}, Page{}); err != nil || len(hits) != 0 {
+		t.Error("Query should have been searched as plain terms", err)
+	}
+	if _, err = SearchMessages(SearchCriteria{Query: " "}, Page{}); err == nil ||
+		err.Error() != BlankSearchQueryErrorMsg {
+		t.Error("Blank query should not have been searched", err)
+	}
+}
+
+// **************** Outbox ****************
+
+func TestQueueMessage(t *testing.T) {
+	setupCleanTestTablesForDomainTests()
+	recipient := NewUser(profile.NewUserProfile("b", "b", "b@b.co"))
+	newMessage := func(body string) packet.MessagePacket {
+		return packet.NewBuilderFactory().Message().To("b").WithBody(packet.TextContentType, body).
+			BuildMessagePacket()
+	}
+	if _, err := QueueMessage(recipient, newMessage("Hi"),
+		time.Now().Add(-time.Minute)); err == nil || err.Error() != InvalidExpiryTimeErrorMsg {
+		t.Error("Message expiring in the past should not have been queued", err)
+	}
+	QueueMessage(recipient, newMessage("Stale"), time.Now().Add(10*time.Millisecond))
+	post := packet.NewBuilderFactory().Message().To("a").InRoom("R1").WithBody(packet.TextContentType, "Hi").
+		BuildMessagePacket()
+	queuedMessage, err := QueueMessage(recipient, post, time.Now().Add(time.Minute))
+	if err != nil || queuedMessage.GetRoomID() != "R1" || queuedMessage.GetBody() != "Hi" {
+		t.Error("Message should have been queued", err)
+	}
+	if queuedPacket, found := queuedMessage.GetMessagePacket(); !found ||
+		queuedPacket.GetPacketID() != post.GetPacketID() || queuedPacket.GetRecipientUsername() != "a" {
+		t.Error("Packet queued should have been returned as it is", queuedPacket)
+	}
+	if queued := GetQueuedMessages(recipient); len(queued) != 2 || queued[0].GetBody() != "Stale" {
+		t.Error("Queued messages should have been returned oldest first")
+	}
+	time.Sleep(20 * time.Millisecond)
+	queued := GetQueuedMessages(recipient)
+	if len(queued) != 1 || queued[0].GetBody() != "Hi" {
+		t.Fatal("Expired message should have been dropped")
+	}
+	if !queued[0].Dequeue() || queued[0].Dequeue() || len(GetQueuedMessages(recipient)) != 0 {
+		t.Error("Message should have been dequeued only once")
+	}
+	unknownUser, _ := GetUserByUsername("c")
+	utils.PanicableInvocation(func() {
+		QueueMessage(unknownUser, newMessage("Hi"), time.Now().Add(time.Minute))
+		t.Error("Should have paniced for non-persisted user")
+	}, func(r interface{}) {})
+}
+
+// **************** Routing ****************
+
+func TestRouteMessage(t *testing.T) {
+	setupCleanTestTablesForDomainTests()
+	self := NewUser(profile.NewUserProfile(conf.GetUserProfile()))
+	self.AddSession(NewSession(packet.GetCurrentSessionID(), 1, time.Now().Add(time.Minute), "127.0.0.1:4000"))
+	self.AddSession(NewSession("S2", 2, time.Now().Add(time.Minute), "127.0.0.2:4000"))
+	recipient := NewUser(profile.NewUserProfile("b", "b", "b@b.co"))
+	recipient.AddSession(NewSession("B3", 3, time.Now().Add(time.Minute), "127.0.0.5:4000"))
+	recipient.AddSession(NewSession("B1", 1, time.Now().Add(-time.Minute), "127.0.0.3:4000"))
+	recipient.AddSession(NewSession("B2", 2, time.Now().Add(time.Minute), "127.0.0.4:4000"))
+	route := RouteMessage(self, recipient, AllActiveSessions)
+	if len(route.Sessions) != 2 || route.Sessions[0].GetReplyToConnectionString() != "127.0.0.4:4000" {
+		t.Error("Active sessions should have been routed to, the main session first")
+	}
+	if len(route.SyncSessions) != 1 || route.SyncSessions[0].GetReplyToConnectionString() != "127.0.0.2:4000" {
+		t.Error("Other sessions of the sender should have been synced")
+	}
+	if route = RouteMessage(self, recipient, MainSessionOnly); len(route.Sessions) != 1 ||
+		route.Sessions[0].GetReplyToConnectionString() != "127.0.0.4:4000" {
+		t.Error("Main session only should have been routed to")
+	}
+	if route = RouteMessage(self, recipient, MainThenFallback); len(route.Sessions) != 2 ||
+		route.Policy.String() != "fallback" {
+		t.Error("Every active session should have been routed to for fallback")
+	}
+	if route = RouteMessage(self, self, AllActiveSessions); len(route.Sessions) != 1 ||
+		len(route.SyncSessions) != 0 {
+		t.Error("Message to oneself should have been routed to the other sessions only")
+	}
+	if route = RouteDelivery(recipient, MainSessionOnly); len(route.Sessions) != 1 ||
+		route.Sessions[0].GetReplyToConnectionString() != "127.0.0.4:4000" || len(route.SyncSessions) != 0 {
+		t.Error("Delivery should have been routed to the recipient only")
+	}
+}
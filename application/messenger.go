@@ -0,0 +1,458 @@
+package application
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/imyousuf/lan-messenger/application/conf"
+	d "github.com/imyousuf/lan-messenger/application/domains"
+	"github.com/imyousuf/lan-messenger/network"
+	"github.com/imyousuf/lan-messenger/packet"
+	"github.com/imyousuf/lan-messenger/profile"
+)
+
+const (
+	// UnknownUserErrorMsg is returned when a user not yet seen on the network is invited to a room
+	UnknownUserErrorMsg = "user not known"
+	// RoomNotFoundErrorMsg is returned when the room requested is not known
+	RoomNotFoundErrorMsg = "room not found"
+	// NotARoomMemberErrorMsg is returned when acting upon a room this user is not a member of
+	NotARoomMemberErrorMsg = "not a member of the room"
+	// NotInvitedToRoomErrorMsg is returned when joining a room this user is not invited to
+	NotInvitedToRoomErrorMsg = "not invited to the room"
+	// UserOfflineErrorMsg is returned when sending a file to a user without any active session
+	UserOfflineErrorMsg = "user is offline"
+	// FileOfferNotFoundErrorMsg is returned when responding to a file offer not pending anymore
+	FileOfferNotFoundErrorMsg = "file offer not found"
+	receivedFilesDirectory    = "files"
+	// DefaultQueuedMessageExpiry is how long a message to a user who is offline is kept in the outbox
+	DefaultQueuedMessageExpiry = 7 * 24 * time.Hour
+)
+
+// Messenger sends messages, rooms and their posts to peers using the Communication, saving the
+// messages sent to the history
+type Messenger interface {
+	SendMessage(username string, contentType string, body string) error
+	SendMessageWithExpiry(username string, contentType string, body string, expiry time.Duration) error
+	FlushOutbox(username string) int
+	FlushOutboxAsync(username string) <-chan int
+	WithRoutingPolicy(policy d.RoutingPolicy) Messenger
+	GetSelfProfile() profile.UserProfile
+	CreateRoom(name string, inviteeUsernames ...string) (*d.Room, error)
+	InviteToRoom(roomID string, inviteeUsernames ...string) error
+	JoinRoom(roomID string) error
+	LeaveRoom(roomID string) error
+	PostToRoom(roomID string, contentType string, body string) error
+	OfferFile(username string, filePath string, progress network.TransferProgress) (string, error)
+	AcceptFile(transferID string, progress network.TransferProgress) (string, error)
+	RejectFile(transferID string) error
+}
+
+type _Messenger struct {
+	comm          network.Communication
+	selfProfile   profile.UserProfile
+	routingPolicy d.RoutingPolicy
+}
+
+func (messenger _Messenger) getSelf() *d.User {
+	return d.NewUser(messenger.selfProfile)
+}
+
+func getUsersByUsernames(usernames []string) ([]*d.User, error) {
+	users := make([]*d.User, len(usernames))
+	for index, username := range usernames {
+		user, found := d.GetUserByUsername(username)
+		if !found {
+			return nil, errors.New(UnknownUserErrorMsg)
+		}
+		users[index] = user
+	}
+	return users, nil
+}
+
+func getUsernames(users []*d.User) []string {
+	usernames := make([]string, len(users))
+	for index, user := range users {
+		usernames[index] = user.GetUserProfile().GetUsername()
+	}
+	return usernames
+}
+
+// fanOut sends the packet to every active session of the users except this session itself. The same
+// packet is sent to every session, each acknowledging it, so that its packet ID identifies it
+// across the sessions.
+func (messenger _Messenger) fanOut(users []*d.User, payload packet.BasePacket) {
+	for _, user := range users {
+		for _, session := range user.GetActiveSessions() {
+			if session.IsSelf() {
+				continue
+			}
+			connectionStr := session.GetReplyToConnectionString()
+			status := messenger.comm.SendMessage(session.GetSessionID(), connectionStr, payload)
+			go func() {
+				for deliveryStatus := range status {
+					if deliveryStatus == network.Failed {
+						log.Println("Could not deliver to", connectionStr)
+					}
+				}
+			}()
+		}
+	}
+}
+
+// notifyRoom sends the room packet to the members and the invitees of the room
+func (messenger _Messenger) notifyRoom(room *d.Room,
+	buildRoomPacket func(builder packet.RoomActionBuilder) packet.RoomPacketBuilder) {
+	members := room.GetMembers()
+	messenger.fanOut(append(members, room.GetInvitees()...),
+		buildRoomPacket(packet.NewBuilderFactory().Room(room.GetRoomID(), room.GetName()).
+			WithMembers(getUsernames(members)...)).BuildRoomPacket())
+}
+
+// getRoomForSelf loads the room and this user, returning the error message passed if this user is
+// in none of the memberships
+func (messenger _Messenger) getRoomForSelf(roomID string, errorMsg string,
+	memberships ...d.Membership) (*d.Room, *d.User, error) {
+	room, found := d.GetRoomByRoomID(roomID)
+	if !found {
+		return nil, nil, errors.New(RoomNotFoundErrorMsg)
+	}
+	self := messenger.getSelf()
+	selfMembership := room.GetMembership(self)
+	for _, membership := range memberships {
+		if selfMembership == membership {
+			return room, self, nil
+		}
+	}
+	return nil, nil, errors.New(errorMsg)
+}
+
+func (messenger _Messenger) CreateRoom(name string, inviteeUsernames ...string) (*d.Room, error) {
+	invitees, err := getUsersByUsernames(inviteeUsernames)
+	if err != nil {
+		return nil, err
+	}
+	room := d.NewRoom(uuid.New().String(), name)
+	room.Join(messenger.getSelf())
+	for _, invitee := range invitees {
+		room.Invite(invitee)
+	}
+	messenger.notifyRoom(room, func(builder packet.RoomActionBuilder) packet.RoomPacketBuilder {
+		return builder.Create(inviteeUsernames...)
+	})
+	return room, nil
+}
+
+func (messenger _Messenger) InviteToRoom(roomID string, inviteeUsernames ...string) error {
+	room, _, err := messenger.getRoomForSelf(roomID, NotARoomMemberErrorMsg, d.Joined)
+	if err != nil {
+		return err
+	}
+	invitees, err := getUsersByUsernames(inviteeUsernames)
+	if err != nil {
+		return err
+	}
+	for _, invitee := range invitees {
+		room.Invite(invitee)
+	}
+	messenger.notifyRoom(room, func(builder packet.RoomActionBuilder) packet.RoomPacketBuilder {
+		return builder.Invite(inviteeUsernames...)
+	})
+	return nil
+}
+
+func (messenger _Messenger) JoinRoom(roomID string) error {
+	room, self, err := messenger.getRoomForSelf(roomID, NotInvitedToRoomErrorMsg, d.Invited, d.Joined)
+	if err != nil {
+		return err
+	}
+	room.Join(self)
+	messenger.notifyRoom(room, func(builder packet.RoomActionBuilder) packet.RoomPacketBuilder {
+		return builder.Join()
+	})
+	return nil
+}
+
+func (messenger _Messenger) LeaveRoom(roomID string) error {
+	room, self, err := messenger.getRoomForSelf(roomID, NotARoomMemberErrorMsg, d.Invited, d.Joined)
+	if err != nil {
+		return err
+	}
+	// Notify before leaving so that the other sessions of this user learn of it too
+	messenger.notifyRoom(room, func(builder packet.RoomActionBuilder) packet.RoomPacketBuilder {
+		return builder.Leave()
+	})
+	room.Leave(self)
+	return nil
+}
+
+// SendMessage sends the message to the sessions of the user as per the routing policy, queuing it
+// for DefaultQueuedMessageExpiry if the user is offline
+func (messenger _Messenger) SendMessage(username string, contentType string, body string) error {
+	return messenger.SendMessageWithExpiry(username, contentType, body, DefaultQueuedMessageExpiry)
+}
+
+// SendMessageWithExpiry sends the message to the sessions of the user as per the routing policy,
+// queuing it in the outbox till the expiry if the user is offline or none of its sessions received
+// it. The message saved to the history is the one sent, so it is also what is sent to the other
+// active sessions of this user and what is queued.
+func (messenger _Messenger) SendMessageWithExpiry(username string, contentType string, body string,
+	expiry time.Duration) error {
+	recipient, found := d.GetUserByUsername(username)
+	if !found {
+		return errors.New(UnknownUserErrorMsg)
+	}
+	self := messenger.getSelf()
+	message := packet.NewBuilderFactory().Message().To(username).WithBody(contentType, body).
+		BuildMessagePacket()
+	if _, err := d.SaveOutgoingMessage(self, message); err != nil {
+		return err
+	}
+	route := d.RouteMessage(self, recipient, messenger.routingPolicy)
+	messenger.syncToSelf(route, message)
+	expiryTime := time.Now().Add(expiry)
+	if len(route.Sessions) == 0 {
+		_, err := d.QueueMessage(recipient, message, expiryTime)
+		return err
+	}
+	go func(delivered <-chan bool) {
+		// The sessions may not have expired yet while the user has gone offline
+		if !<-delivered {
+			log.Println("Could not deliver message to", username, "so queuing it")
+			if _, err := d.QueueMessage(recipient, message, expiryTime); err != nil {
+				log.Println(err)
+			}
+		}
+	}(messenger.deliver(route, message))
+	return nil
+}
+
+// deliver sends the packet to the sessions of the route as per its policy. The returned channel
+// publishes whether any of the sessions received the packet.
+func (messenger _Messenger) deliver(route *d.Route, payload packet.BasePacket) <-chan bool {
+	delivered := make(chan bool, 1)
+	isDelivered := func(status <-chan network.DeliveryStatus) bool {
+		received := false
+		for deliveryStatus := range status {
+			received = deliveryStatus != network.Failed
+		}
+		return received
+	}
+	if route.Policy == d.MainThenFallback {
+		go func() {
+			received := false
+			for _, session := range route.Sessions {
+				if received = isDelivered(messenger.comm.SendMessage(session.GetSessionID(),
+					session.GetReplyToConnectionString(), payload)); received {
+					break
+				}
+			}
+			delivered <- received
+		}()
+		return delivered
+	}
+	statuses := make([]<-chan network.DeliveryStatus, len(route.Sessions))
+	for index, session := range route.Sessions {
+		statuses[index] = messenger.comm.SendMessage(session.GetSessionID(),
+			session.GetReplyToConnectionString(), payload)
+	}
+	go func() {
+		received := false
+		for _, status := range statuses {
+			received = isDelivered(status) || received
+		}
+		delivered <- received
+	}()
+	return delivered
+}
+
+// syncToSelf sends a copy of the message to the other active sessions of this user, so that the
+// conversation is in sync across the devices
+func (messenger _Messenger) syncToSelf(route *d.Route, message packet.MessagePacket) {
+	for _, session := range route.SyncSessions {
+		connectionStr := session.GetReplyToConnectionString()
+		status := messenger.comm.SendMessage(session.GetSessionID(), connectionStr, message)
+		go func() {
+			for deliveryStatus := range status {
+				if deliveryStatus == network.Failed {
+					log.Println("Could not sync message to", connectionStr)
+				}
+			}
+		}()
+	}
+}
+
+// FlushOutbox sends the messages queued for the user to its sessions as per the routing policy and
+// returns the number of messages sent. Each message is sent as the packet queued, so that it is the
+// same message in the history of both ends. A message is queued again if none of the sessions
+// received it.
+func (messenger _Messenger) FlushOutbox(username string) int {
+	recipient, found := d.GetUserByUsername(username)
+	if !found {
+		return 0
+	}
+	route := d.RouteDelivery(recipient, messenger.routingPolicy)
+	if len(route.Sessions) == 0 {
+		return 0
+	}
+	flushedMessages := []*d.QueuedMessage{}
+	messages := []packet.MessagePacket{}
+	deliveries := []<-chan bool{}
+	for _, queuedMessage := range d.GetQueuedMessages(recipient) {
+		if !queuedMessage.Dequeue() {
+			continue
+		}
+		message, found := queuedMessage.GetMessagePacket()
+		if !found {
+			builder := packet.NewBuilderFactory().Message().To(username)
+			if roomID := queuedMessage.GetRoomID(); roomID != "" {
+				builder = builder.InRoom(roomID)
+			}
+			message = builder.WithBody(queuedMessage.GetContentType(), queuedMessage.GetBody()).BuildMessagePacket()
+		}
+		flushedMessages = append(flushedMessages, queuedMessage)
+		messages = append(messages, message)
+		deliveries = append(deliveries, messenger.deliver(route, message))
+	}
+	go requeueIfUndelivered(recipient, flushedMessages, messages, deliveries)
+	return len(flushedMessages)
+}
+
+// FlushOutboxAsync flushes the outbox of the user in the background, so that the caller, e.g.
+// handling a registration on the goroutine of the network, is not blocked by it. The returned
+// channel publishes the number of messages sent.
+func (messenger _Messenger) FlushOutboxAsync(username string) <-chan int {
+	flushed := make(chan int, 1)
+	go func() {
+		count := messenger.FlushOutbox(username)
+		if count > 0 {
+			log.Println("Flushed queued messages to", username, count)
+		}
+		flushed <- count
+	}()
+	return flushed
+}
+
+// requeueIfUndelivered queues the messages sent again, in the same order, unless the message was
+// delivered
+func requeueIfUndelivered(recipient *d.User, queuedMessages []*d.QueuedMessage,
+	messages []packet.MessagePacket, deliveries []<-chan bool) {
+	for index, queuedMessage := range queuedMessages {
+		if !<-deliveries[index] && queuedMessage.GetExpiryTime().After(time.Now()) {
+			log.Println("Could not deliver queued message to", recipient.GetUserProfile().GetUsername())
+			d.QueueMessage(recipient, messages[index], queuedMessage.GetExpiryTime())
+		}
+	}
+}
+
+// WithRoutingPolicy returns a copy of the messenger sending direct messages as per the policy
+func (messenger _Messenger) WithRoutingPolicy(policy d.RoutingPolicy) Messenger {
+	messenger.routingPolicy = policy
+	return messenger
+}
+
+// GetSelfProfile returns the profile of the user the messenger sends as
+func (messenger _Messenger) GetSelfProfile() profile.UserProfile {
+	return messenger.selfProfile
+}
+
+func (messenger _Messenger) PostToRoom(roomID string, contentType string, body string) error {
+	room, self, err := messenger.getRoomForSelf(roomID, NotARoomMemberErrorMsg, d.Joined)
+	if err != nil {
+		return err
+	}
+	post := packet.NewBuilderFactory().Message().To(self.GetUserProfile().GetUsername()).
+		InRoom(roomID).WithBody(contentType, body).BuildMessagePacket()
+	if _, err := d.SaveOutgoingMessage(self, post); err != nil {
+		return err
+	}
+	// The post saved is the one sent, so that it is the same post in the history of every member
+	members := room.GetMembers()
+	messenger.fanOut(members, post)
+	// Queue the post for the members who are offline
+	for _, member := range members {
+		if len(member.GetActiveSessions()) == 0 {
+			d.QueueMessage(member, post, time.Now().Add(DefaultQueuedMessageExpiry))
+		}
+	}
+	return nil
+}
+
+// OfferFile offers the file to the main session of the user and returns the transfer ID of the offer
+func (messenger _Messenger) OfferFile(username string, filePath string,
+	progress network.TransferProgress) (string, error) {
+	user, found := d.GetUserByUsername(username)
+	if !found {
+		return "", errors.New(UnknownUserErrorMsg)
+	}
+	session, online := user.GetMainSession()
+	if !online {
+		return "", errors.New(UserOfflineErrorMsg)
+	}
+	return messenger.comm.OfferFile(session.GetSessionID(), session.GetReplyToConnectionString(), filePath,
+		progress)
+}
+
+func takePendingFileOffer(transferID string) (packet.FilePacket, error) {
+	value, found := pendingFileOffers.Load(transferID)
+	if !found {
+		return nil, errors.New(FileOfferNotFoundErrorMsg)
+	}
+	pendingFileOffers.Delete(transferID)
+	return value.(packet.FilePacket), nil
+}
+
+// getReceivedFilePath returns a path for the file in the storage location not used by any file
+// received earlier
+func getReceivedFilePath(fileName string) (string, error) {
+	directory := filepath.Join(conf.GetStorageLocation(), receivedFilesDirectory)
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return "", err
+	}
+	extension := filepath.Ext(fileName)
+	baseName := strings.TrimSuffix(fileName, extension)
+	filePath := filepath.Join(directory, fileName)
+	for copyIndex := 1; ; copyIndex++ {
+		if _, err := os.Stat(filePath); os.IsNotExist(err) {
+			return filePath, nil
+		}
+		filePath = filepath.Join(directory, fmt.Sprintf("%s (%d)%s", baseName, copyIndex, extension))
+	}
+}
+
+// AcceptFile downloads the file offered to the storage location and returns where it was written
+func (messenger _Messenger) AcceptFile(transferID string,
+	progress network.TransferProgress) (string, error) {
+	offer, err := takePendingFileOffer(transferID)
+	if err != nil {
+		return "", err
+	}
+	filePath, err := getReceivedFilePath(offer.GetFileName())
+	if err == nil {
+		err = messenger.comm.AcceptFile(offer, filePath, progress)
+	}
+	if err != nil {
+		return "", err
+	}
+	return filePath, nil
+}
+
+func (messenger _Messenger) RejectFile(transferID string) error {
+	offer, err := takePendingFileOffer(transferID)
+	if err != nil {
+		return err
+	}
+	return messenger.comm.RejectFile(offer)
+}
+
+// NewMessenger creates a new instance of Messenger sending as the user with the profile, which
+// delivers direct messages to all active sessions of the recipient
+func NewMessenger(comm network.Communication, selfProfile profile.UserProfile) Messenger {
+	return _Messenger{comm: comm, selfProfile: selfProfile, routingPolicy: d.AllActiveSessions}
+}
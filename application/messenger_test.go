@@ -0,0 +1,339 @@
+package application
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/imyousuf/lan-messenger/application/conf"
+	"github.com/imyousuf/lan-messenger/application/domains"
+	"github.com/imyousuf/lan-messenger/application/testutils"
+	"github.com/imyousuf/lan-messenger/identity"
+	"github.com/imyousuf/lan-messenger/network"
+	"github.com/imyousuf/lan-messenger/packet"
+	"github.com/imyousuf/lan-messenger/profile"
+)
+
+type _MockCommunication struct {
+	mutex          sync.Mutex
+	sent           map[string][]packet.BasePacket
+	sessionIDs     map[string]string
+	failDeliveries bool
+	failingTo      string
+}
+
+func newTestEventListener(completeNotificationChannel chan int) EventListener {
+	return NewEventListener(completeNotificationChannel, NewMessenger(&_MockCommunication{},
+		profile.NewUserProfile(testutils.Username, testutils.DisplayName, testutils.Email)))
+}
+
+func (comm *_MockCommunication) SetupCommunication(ctx context.Context, config network.Config) {}
+func (comm *_MockCommunication) InitCommunication(ctx context.Context, profile profile.UserProfile,
+	selfIdentity identity.Identity) error {
+	return nil
+}
+func (comm *_MockCommunication) AddMessageListener(listener network.MessageListener) bool {
+	return true
+}
+func (comm *_MockCommunication) RemoveMessageListener(listener network.MessageListener) bool {
+	return true
+}
+func (comm *_MockCommunication) AddBroadcastListener(listener network.BroadcastListener) bool {
+	return true
+}
+func (comm *_MockCommunication) RemoveBroadcastListener(listener network.BroadcastListener) bool {
+	return true
+}
+func (comm *_MockCommunication) SendMessage(toSessionID string, toConnectionStr string,
+	payload packet.BasePacket) <-chan network.DeliveryStatus {
+	comm.mutex.Lock()
+	defer comm.mutex.Unlock()
+	if comm.sent == nil {
+		comm.sent = make(map[string][]packet.BasePacket)
+	}
+	if comm.sessionIDs == nil {
+		comm.sessionIDs = make(map[string]string)
+	}
+	comm.sent[toConnectionStr] = append(comm.sent[toConnectionStr], payload)
+	comm.sessionIDs[toConnectionStr] = toSessionID
+	status := make(chan network.DeliveryStatus, 1)
+	if comm.failDeliveries || comm.failingTo == toConnectionStr {
+		status <- network.Failed
+	} else {
+		status <- network.Delivered
+	}
+	close(status)
+	return status
+}
+func (comm *_MockCommunication) SetPresence(presence profile.Presence) {}
+func (comm *_MockCommunication) OfferFile(toSessionID string, toConnectionStr string, filePath string,
+	progress network.TransferProgress) (string, error) {
+	comm.SendMessage(toSessionID, toConnectionStr, packet.NewBuilderFactory().File("T1").
+		Offer(filepath.Base(filePath), 1, make([]byte, 32)).BuildFilePacket())
+	return "T1", nil
+}
+func (comm *_MockCommunication) AcceptFile(offer packet.FilePacket, destinationPath string,
+	progress network.TransferProgress) error {
+	return ioutil.WriteFile(destinationPath, []byte{0}, 0600)
+}
+func (comm *_MockCommunication) RejectFile(offer packet.FilePacket) error {
+	return nil
+}
+func (comm *_MockCommunication) CloseCommunication() {}
+
+func (comm *_MockCommunication) reset() map[string][]packet.BasePacket {
+	comm.mutex.Lock()
+	defer comm.mutex.Unlock()
+	sent := comm.sent
+	comm.sent = make(map[string][]packet.BasePacket)
+	return sent
+}
+
+func TestMessenger_Rooms(t *testing.T) {
+	setupCleanTestTablesForHandlerTests()
+	comm := &_MockCommunication{}
+	comm.reset()
+	selfProfile := profile.NewUserProfile(conf.GetUserProfile())
+	messenger := NewMessenger(comm, selfProfile)
+	self := domains.NewUser(selfProfile)
+	self.AddSession(domains.NewSession(packet.GetCurrentSessionID(), 1, time.Now().Add(time.Minute),
+		"127.0.0.1:30000"))
+	self.AddSession(domains.NewSession("S2", 2, time.Now().Add(time.Minute), "127.0.0.2:30000"))
+	invitee := domains.NewUser(profile.NewUserProfile("b", "b", "b@b.co"))
+	invitee.AddSession(domains.NewSession("B1", 1, time.Now().Add(time.Minute), "127.0.0.3:30000"))
+	invitee.AddSession(domains.NewSession("B2", 2, time.Now().Add(-time.Minute), "127.0.0.4:30000"))
+	if _, err := messenger.CreateRoom("Team", "c"); err == nil || err.Error() != UnknownUserErrorMsg {
+		t.Error("Unknown user should not have been invited", err)
+	}
+	room, err := messenger.CreateRoom("Team", "b")
+	if err != nil || room.GetMembership(self) != domains.Joined || room.GetMembership(invitee) != domains.Invited {
+		t.Fatal("Room should have been created", err)
+	}
+	sent := comm.reset()
+	if len(sent) != 2 || len(sent["127.0.0.2:30000"]) != 1 || len(sent["127.0.0.3:30000"]) != 1 {
+		t.Error("Room creation should have been sent to every other active session", sent)
+	}
+	if roomPacket := sent["127.0.0.3:30000"][0].(packet.RoomPacket); roomPacket.GetAction() !=
+		packet.RoomCreateAction || roomPacket.GetRoomID() != room.GetRoomID() {
+		t.Error("Room creation packet did not match")
+	}
+	messenger.PostToRoom(room.GetRoomID(), packet.TextContentType, "Hi")
+	if sent = comm.reset(); len(sent) != 1 || len(sent["127.0.0.2:30000"]) != 1 {
+		t.Error("Post should have been sent to members only", sent)
+	}
+	room.Join(invitee)
+	messenger.PostToRoom(room.GetRoomID(), packet.TextContentType, "Hi")
+	sent = comm.reset()
+	if len(sent) != 2 {
+		t.Error("Post should have been sent to every member", sent)
+	}
+	post := sent["127.0.0.3:30000"][0].(packet.MessagePacket)
+	if post.GetRoomID() != room.GetRoomID() || post.GetBody() != "Hi" {
+		t.Error("Post did not match")
+	}
+	posts := domains.GetRoomConversation(room).GetMessages(domains.Page{})
+	if sent["127.0.0.2:30000"][0].GetPacketID() != post.GetPacketID() || len(posts) != 2 ||
+		posts[0].GetPacketID() != post.GetPacketID() || posts[0].GetSessionID() != post.GetSessionID() {
+		t.Error("Post saved should have been the one sent to every member")
+	}
+	if err := messenger.LeaveRoom(room.GetRoomID()); err != nil || room.GetMembership(self) != domains.Left {
+		t.Error("Should have left the room", err)
+	}
+	if err := messenger.PostToRoom(room.GetRoomID(), packet.TextContentType, "Hi"); err == nil ||
+		err.Error() != NotARoomMemberErrorMsg {
+		t.Error("Non-member should not post to the room", err)
+	}
+	if err := messenger.JoinRoom(room.GetRoomID()); err == nil || err.Error() != NotInvitedToRoomErrorMsg {
+		t.Error("Should not join the room without being invited", err)
+	}
+	if err := messenger.InviteToRoom("R0", "b"); err == nil || err.Error() != RoomNotFoundErrorMsg {
+		t.Error("Unknown room should not have been found", err)
+	}
+	if count := domains.CountMessages(domains.MessageCriteria{
+		Conversation: domains.GetRoomConversation(room)}); count != 2 {
+		t.Error("Posts to the room should have been saved", count)
+	}
+}
+
+func TestMessenger_SendMessage(t *testing.T) {
+	setupCleanTestTablesForHandlerTests()
+	comm := &_MockCommunication{}
+	comm.reset()
+	messenger := NewMessenger(comm, profile.NewUserProfile(conf.GetUserProfile()))
+	recipient := domains.NewUser(profile.NewUserProfile("b", "b", "b@b.co"))
+	if err := messenger.SendMessage("c", packet.TextContentType, "Hi"); err == nil ||
+		err.Error() != UnknownUserErrorMsg {
+		t.Error("Message should not have been sent to unknown user", err)
+	}
+	recipient.AddSession(domains.NewSession("B1", 1, time.Now().Add(time.Minute), "127.0.0.3:30000"))
+	recipient.AddSession(domains.NewSession("B2", 2, time.Now().Add(time.Minute), "127.0.0.4:30000"))
+	err := messenger.SendMessage("b", packet.TextContentType, "Hi")
+	sent := comm.reset()
+	if err != nil || len(sent) != 2 {
+		t.Error("Message should have been sent to every active session", err)
+	}
+	if comm.sessionIDs["127.0.0.3:30000"] != "B1" || comm.sessionIDs["127.0.0.4:30000"] != "B2" {
+		t.Error("Message should have been sent for the sessions routed to", comm.sessionIDs)
+	}
+	messages := domains.GetDirectConversation(recipient).GetMessages(domains.Page{})
+	if len(messages) != 1 || !messages[0].IsOutgoing() || messages[0].GetBody() != "Hi" {
+		t.Fatal("Message sent should have been saved once")
+	}
+	for connectionStr, packets := range sent {
+		if packets[0].GetPacketID() != messages[0].GetPacketID() ||
+			packets[0].GetSessionID() != messages[0].GetSessionID() {
+			t.Error("Message saved should have been the one sent", connectionStr)
+		}
+	}
+	// The sessions have not expired yet while the user has gone offline
+	comm.failDeliveries = true
+	messenger.SendMessage("b", packet.TextContentType, "Are you there?")
+	comm.reset()
+	waitForQueuedMessages(recipient, 1)
+	queued := domains.GetQueuedMessages(recipient)
+	if len(queued) != 1 || queued[0].GetBody() != "Are you there?" {
+		t.Fatal("Message none of the sessions received should have been queued")
+	}
+	queuedPacket, found := queued[0].GetMessagePacket()
+	for _, message := range domains.GetDirectConversation(recipient).GetMessages(domains.Page{}) {
+		if message.GetBody() == "Are you there?" && (!found || queuedPacket.GetPacketID() != message.GetPacketID()) {
+			t.Error("Message queued should have been the one saved")
+		}
+	}
+}
+
+func TestMessenger_Outbox(t *testing.T) {
+	setupCleanTestTablesForHandlerTests()
+	comm := &_MockCommunication{}
+	selfProfile := profile.NewUserProfile(conf.GetUserProfile())
+	messenger := NewMessenger(comm, selfProfile)
+	recipient := domains.NewUser(profile.NewUserProfile("b", "b", "b@b.co"))
+	if err := messenger.SendMessage("b", packet.TextContentType, "Hi"); err != nil || len(comm.reset()) != 0 {
+		t.Error("Message to offline user should have been queued", err)
+	}
+	saved := domains.GetDirectConversation(recipient).GetMessages(domains.Page{})
+	room := domains.NewRoom("R1", "Team")
+	room.Join(domains.NewUser(selfProfile))
+	room.Join(recipient)
+	messenger.PostToRoom("R1", packet.TextContentType, "Hello")
+	if queued := domains.GetQueuedMessages(recipient); len(queued) != 2 || queued[1].GetRoomID() != "R1" {
+		t.Fatal("Post to offline member should have been queued")
+	}
+	if messenger.FlushOutbox("b") != 0 {
+		t.Error("Outbox should not have been flushed while the user is offline")
+	}
+	recipient.AddSession(domains.NewSession("B1", 1, time.Now().Add(time.Minute), "127.0.0.3:30000"))
+	comm.failDeliveries = true
+	if messenger.FlushOutbox("b") != 2 || len(comm.reset()["127.0.0.3:30000"]) != 2 {
+		t.Error("Queued messages should have been sent")
+	}
+	waitForQueuedMessages(recipient, 2)
+	if queued := domains.GetQueuedMessages(recipient); len(queued) != 2 {
+		t.Fatal("Messages not delivered should have been queued again", len(queued))
+	}
+	comm.failDeliveries = false
+	if flushed := <-messenger.FlushOutboxAsync("b"); flushed != 2 {
+		t.Error("Queued messages should have been flushed in the background", flushed)
+	}
+	sent := comm.reset()["127.0.0.3:30000"]
+	if len(sent) != 2 || sent[1].(packet.MessagePacket).GetRoomID() != "R1" ||
+		sent[0].(packet.MessagePacket).GetBody() != "Hi" {
+		t.Fatal("Queued messages should have been sent in order")
+	}
+	if len(saved) != 1 || sent[0].GetPacketID() != saved[0].GetPacketID() ||
+		!sent[0].(packet.MessagePacket).GetTimestamp().Equal(saved[0].GetSentTime()) {
+		t.Error("Queued message should have been sent as the message saved")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if queued := domains.GetQueuedMessages(recipient); len(queued) != 0 {
+		t.Error("Messages delivered should have been dequeued", len(queued))
+	}
+}
+
+func waitForQueuedMessages(recipient *domains.User, count int) {
+	for attempt := 0; attempt < 100 && len(domains.GetQueuedMessages(recipient)) < count; attempt++ {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMessenger_Files(t *testing.T) {
+	setupCleanTestTablesForHandlerTests()
+	os.RemoveAll(filepath.Join(conf.GetStorageLocation(), receivedFilesDirectory))
+	comm := &_MockCommunication{}
+	comm.reset()
+	messenger := NewMessenger(comm, profile.NewUserProfile(conf.GetUserProfile()))
+	// File packets built in tests are of the current session, so make it a session of the peer
+	peer := domains.NewUser(profile.NewUserProfile("b", "b", "b@b.co"))
+	peer.AddSession(domains.NewSession(packet.GetCurrentSessionID(), 1, time.Now().Add(time.Minute),
+		"127.0.0.3:30000"))
+	offline := domains.NewUser(profile.NewUserProfile("c", "c", "c@c.co"))
+	offline.AddSession(domains.NewSession("C1", 1, time.Now().Add(-time.Minute), "127.0.0.4:30000"))
+	if _, err := messenger.OfferFile("d", "notes.txt", nil); err == nil || err.Error() != UnknownUserErrorMsg {
+		t.Error("File should not have been offered to unknown user", err)
+	}
+	if _, err := messenger.OfferFile("c", "notes.txt", nil); err == nil || err.Error() != UserOfflineErrorMsg {
+		t.Error("File should not have been offered to offline user", err)
+	}
+	if transferID, err := messenger.OfferFile("b", "notes.txt", nil); err != nil || transferID != "T1" ||
+		len(comm.reset()["127.0.0.3:30000"]) != 1 {
+		t.Error("File should have been offered to the main session", err)
+	}
+	eventListener := newTestEventListener(make(chan int))
+	for _, expectedName := range []string{"notes.txt", "notes (1).txt"} {
+		eventListener.HandleFileEvent(_MockFileEvent{packet.NewBuilderFactory().File("T2").
+			Offer("notes.txt", 1, make([]byte, 32)).BuildFilePacket()})
+		filePath, err := messenger.AcceptFile("T2", nil)
+		if err != nil || filepath.Base(filePath) != expectedName {
+			t.Error("File should have been received without overwriting", filePath, err)
+		}
+		if _, err := os.Stat(filePath); err != nil {
+			t.Error("File should have been written", err)
+		}
+	}
+	if _, err := messenger.AcceptFile("T2", nil); err == nil || err.Error() != FileOfferNotFoundErrorMsg {
+		t.Error("Accepted offer should not be pending", err)
+	}
+	eventListener.HandleFileEvent(_MockFileEvent{packet.NewBuilderFactory().File("T3").
+		Offer("notes.txt", 1, make([]byte, 32)).BuildFilePacket()})
+	if err := messenger.RejectFile("T3"); err != nil {
+		t.Error("Offer should have been rejected", err)
+	}
+	if err := messenger.RejectFile("T3"); err == nil || err.Error() != FileOfferNotFoundErrorMsg {
+		t.Error("Rejected offer should not be pending", err)
+	}
+}
+
+func TestMessenger_Routing(t *testing.T) {
+	setupCleanTestTablesForHandlerTests()
+	comm := &_MockCommunication{}
+	selfProfile := profile.NewUserProfile(conf.GetUserProfile())
+	self := domains.NewUser(selfProfile)
+	self.AddSession(domains.NewSession(packet.GetCurrentSessionID(), 1, time.Now().Add(time.Minute),
+		"127.0.0.1:30000"))
+	self.AddSession(domains.NewSession("S2", 2, time.Now().Add(time.Minute), "127.0.0.2:30000"))
+	recipient := domains.NewUser(profile.NewUserProfile("b", "b", "b@b.co"))
+	recipient.AddSession(domains.NewSession("B2", 2, time.Now().Add(time.Minute), "127.0.0.4:30000"))
+	recipient.AddSession(domains.NewSession("B1", 1, time.Now().Add(time.Minute), "127.0.0.3:30000"))
+	messenger := NewMessenger(comm, selfProfile).WithRoutingPolicy(domains.MainSessionOnly)
+	messenger.SendMessage("b", packet.TextContentType, "Hi")
+	sent := comm.reset()
+	if len(sent) != 2 || len(sent["127.0.0.3:30000"]) != 1 {
+		t.Error("Message should have been sent to the main session only", sent)
+	}
+	if sync := sent["127.0.0.2:30000"]; len(sync) != 1 ||
+		sync[0].(packet.MessagePacket).GetRecipientUsername() != "b" {
+		t.Error("Copy of the message should have been sent to the other session of this user")
+	}
+	comm.failingTo = "127.0.0.3:30000"
+	messenger.WithRoutingPolicy(domains.MainThenFallback).SendMessage("b", packet.TextContentType, "Hi")
+	for attempt := 0; attempt < 100 && len(comm.reset()["127.0.0.4:30000"]) == 0; attempt++ {
+		if attempt == 99 {
+			t.Error("Message should have fallen back to the other session")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	app "github.com/imyousuf/lan-messenger/application/conf"
+	"github.com/imyousuf/lan-messenger/utils"
+	"github.com/jinzhu/gorm"
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	backupStepRetryInterval = 50 * time.Millisecond
+	maxBackupStepAttempts   = 100
+	// BackupBusyErrorMsg is the error returned when the DB stays locked by writers through the backup
+	BackupBusyErrorMsg = "DB kept busy throughout the backup"
+	// InvalidDBFileErrorMsg is the error returned when restoring a file which is not a DB of this
+	// application or is corrupted
+	InvalidDBFileErrorMsg = "not a valid lamess DB"
+)
+
+// GetDBPath returns the path of the DB file in the storage location
+func GetDBPath() string {
+	return filepath.Join(app.GetStorageLocation(), dbName)
+}
+
+func openSQLiteConn(path string) (*sqlite3.SQLiteConn, error) {
+	conn, err := (&sqlite3.SQLiteDriver{}).Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*sqlite3.SQLiteConn), nil
+}
+
+// BackupDB copies the DB to the destination using the online backup of SQLite, which copies a
+// consistent snapshot of the DB even while it is being written to. The DB is copied as it is stored,
+// i.e. encrypted if it is encrypted.
+func BackupDB(destinationPath string) error {
+	sourcePath := GetDBPath()
+	if _, err := os.Stat(sourcePath); err != nil {
+		return err
+	}
+	sourceConn, err := openSQLiteConn(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer sourceConn.Close()
+	destinationConn, err := openSQLiteConn(destinationPath)
+	if err != nil {
+		return err
+	}
+	defer destinationConn.Close()
+	backup, err := destinationConn.Backup("main", sourceConn, "main")
+	if err != nil {
+		return err
+	}
+	// Copying every page in a single step keeps the source locked for reading till it is copied
+	done := false
+	for attempt := 0; err == nil && !done && attempt < maxBackupStepAttempts; attempt++ {
+		if done, err = backup.Step(-1); err == nil && !done {
+			time.Sleep(backupStepRetryInterval)
+		}
+	}
+	if finishErr := backup.Finish(); err == nil {
+		err = finishErr
+	}
+	if err == nil && !done {
+		err = errors.New(BackupBusyErrorMsg)
+	}
+	return err
+}
+
+// ValidateDBFile checks that the file is an intact DB of this application whose schema this
+// application can migrate, returning its schema version
+func ValidateDBFile(dbPath string) (uint, error) {
+	if _, err := os.Stat(dbPath); err != nil {
+		return 0, err
+	}
+	testDB, err := gorm.Open("sqlite3", dbPath)
+	if err != nil {
+		return 0, err
+	}
+	defer testDB.Close()
+	var integrity string
+	if err := testDB.Raw("PRAGMA integrity_check").Row().Scan(&integrity); err != nil || integrity != "ok" ||
+		!testDB.HasTable(schemaVersionTableName) {
+		return 0, errors.New(InvalidDBFileErrorMsg)
+	}
+	version, err := getSchemaVersion(testDB)
+	if err != nil || version == 0 {
+		return 0, errors.New(InvalidDBFileErrorMsg)
+	}
+	if latestVersion := GetLatestSchemaVersion(); version > latestVersion {
+		return version, fmt.Errorf(SchemaTooNewErrorFmt, version, latestVersion)
+	}
+	return version, nil
+}
+
+// RestoreDB replaces the DB with the one at the path after validating it. The DB connection is
+// closed, so that the DB restored is migrated and opened on its next use.
+func RestoreDB(backupPath string) error {
+	if _, err := ValidateDBFile(backupPath); err != nil {
+		return err
+	}
+	dbPath := GetDBPath()
+	ReInitDBConnection()
+	// A journal left behind would be applied to the DB restored
+	for _, suffix := range []string{"-journal", "-wal", "-shm"} {
+		os.Remove(dbPath + suffix)
+	}
+	return utils.ReplaceFile(backupPath, dbPath, 0600)
+}
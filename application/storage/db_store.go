@@ -1,7 +1,7 @@
 package storage
 
 import (
-	"path/filepath"
+	"log"
 	"sync"
 
 	app "github.com/imyousuf/lan-messenger/application/conf"
@@ -19,6 +19,8 @@ var (
 	db            *gorm.DB
 	dbInitializer sync.Once
 	successful    = false
+	// connectionError is the reason the DB connection could not be opened
+	connectionError error
 )
 
 // openDBConnection opens the DB connection pool and should called from application
@@ -26,11 +28,27 @@ func openDBConnection() bool {
 	if !successful {
 		var err error
 		dbInitializer.Do(func() {
-			db, err = gorm.Open("sqlite3", filepath.Join(app.GetStorageLocation(), dbName))
+			db, err = gorm.Open("sqlite3", GetDBPath())
+			if err != nil {
+				log.Println("DB connection could not be opened:", err)
+				connectionError = err
+				return
+			}
+			err = runMigrations(db, schemaMigrations)
+			if err == nil {
+				var secret []byte
+				if secret, err = LoadEncryptionSecret(app.GetStorageEncryptionConfig()); err == nil {
+					columnCipher, err = setupEncryption(db, secret)
+				}
+			}
 			if err == nil {
 				successful = true
-				db.AutoMigrate(&UserModel{}, &SessionModel{})
+				searchIndexAvailable = setupMessageSearch(db, columnCipher, app.IsBlindSearchEnabled())
+			} else {
+				db.Close()
+				log.Println("DB connection could not be opened:", err)
 			}
+			connectionError = err
 		})
 	}
 	return successful
@@ -42,6 +60,13 @@ func IsDBConnectionAvailable() bool {
 	return openDBConnection()
 }
 
+// GetDBConnectionError returns why the DB connection is not available, e.g. the schema of the DB
+// being newer than this application supports
+func GetDBConnectionError() error {
+	openDBConnection()
+	return connectionError
+}
+
 // GetDB retrieve the DB connection pool
 func GetDB() *gorm.DB {
 	if ok := openDBConnection(); !ok {
@@ -64,4 +89,7 @@ func ReInitDBConnection() {
 	CloseDB()
 	dbInitializer = sync.Once{}
 	successful = false
+	connectionError = nil
+	searchIndexAvailable = false
+	columnCipher = nil
 }
@@ -29,7 +29,9 @@ func TestAutoMigration(t *testing.T) {
 	if err != nil {
 		t.Error("Could not run SQL against connection retrieved")
 	}
-	expectedTableNames := []string{"user_models", "session_models"}
+	expectedTableNames := []string{"user_models", "session_models", "room_models",
+		"room_member_models", "conversation_models", "message_models",
+		"outbox_models", "encryption_settings"}
 	expectedTableNameAssertions := make(map[string]bool)
 	for rows.Next() {
 		var tableName string
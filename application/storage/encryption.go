@@ -0,0 +1,401 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+
+	app "github.com/imyousuf/lan-messenger/application/conf"
+	"github.com/jinzhu/gorm"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	encryptionSettingsTableName = "encryption_settings"
+	// encryptedValuePrefix marks a value encrypted by a column cipher, so that values stored before
+	// encryption was enabled are still read as they are
+	encryptedValuePrefix = "lamess-enc:1:"
+	encryptionKeyCheck   = "lamess encryption key check"
+	encryptionSaltSize   = 16
+	// blindIndexKeyInfo tells apart the key of the blind search index derived from the key of the
+	// columns
+	blindIndexKeyInfo = "lamess blind search index"
+	// nonceKeyInfo tells apart the key of the nonces of values encrypted deterministically derived
+	// from the key of the columns
+	nonceKeyInfo = "lamess deterministic nonce"
+	// blindWordSize is the number of bytes of the keyed hash of a word kept in the blind index
+	blindWordSize = 16
+	// scrypt parameters recommended for interactive use
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+	// EncryptionKeyMissingErrorMsg is the error returned when opening an encrypted DB without a
+	// passphrase or key file configured
+	EncryptionKeyMissingErrorMsg = "DB is encrypted but no passphrase or key file is configured"
+	// EncryptionKeyMismatchErrorMsg is the error returned when the passphrase or the key file
+	// configured is not the one the DB is encrypted with
+	EncryptionKeyMismatchErrorMsg = "passphrase or key file does not match the one the DB is encrypted with"
+	// AmbiguousEncryptionSecretErrorMsg is the error returned when both a passphrase and a key file
+	// are configured
+	AmbiguousEncryptionSecretErrorMsg = "only one of passphrase and key file can be configured"
+	// BlankEncryptionSecretErrorMsg is the error returned when the key file is blank
+	BlankEncryptionSecretErrorMsg = "key file is blank"
+	// InvalidEncryptedValueErrorMsg is the error returned when a value can not be decrypted
+	InvalidEncryptedValueErrorMsg = "encrypted value could not be decrypted"
+)
+
+// _EncryptionSettings records the salt the key of an encrypted DB is derived with and a value
+// encrypted with the key, to tell whether the key configured is the right one
+type _EncryptionSettings struct {
+	ID       uint `gorm:"primary_key"`
+	Salt     []byte
+	KeyCheck string
+}
+
+func (_EncryptionSettings) TableName() string {
+	return encryptionSettingsTableName
+}
+
+// _EncryptedColumn is a column holding sensitive data which is encrypted in an encrypted DB. A
+// column with a unique constraint is encrypted deterministically, so that the constraint is
+// enforced on the encrypted values.
+type _EncryptedColumn struct {
+	tableName     string
+	columnName    string
+	binary        bool
+	deterministic bool
+}
+
+var (
+	encryptedColumns = []_EncryptedColumn{
+		{tableName: "user_models", columnName: "email", deterministic: true},
+		{tableName: "user_models", columnName: "public_key", binary: true},
+		{tableName: "message_models", columnName: "body"},
+		{tableName: "outbox_models", columnName: "body"},
+		{tableName: "outbox_models", columnName: "packet"},
+	}
+	// columnCipher encrypts the sensitive columns; nil when the DB is not encrypted
+	columnCipher *_ColumnCipher
+)
+
+// _ColumnCipher encrypts values with XChaCha20-Poly1305 into text prefixed with
+// encryptedValuePrefix. Encryption is randomized, so that equal values are not told apart, except
+// for values of columns with a unique constraint, whose nonce is keyed by the value. It also blinds
+// the words of messages for the blind search index. The keys of the nonces and the index are
+// derived from the key of the columns.
+type _ColumnCipher struct {
+	aead     cipher.AEAD
+	salt     []byte
+	nonceKey []byte
+	indexKey []byte
+}
+
+func deriveKey(key []byte, salt []byte, info string) ([]byte, error) {
+	derivedKey := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, salt, []byte(info)), derivedKey); err != nil {
+		return nil, err
+	}
+	return derivedKey, nil
+}
+
+// newColumnCipher derives the key from the secret, i.e. a passphrase or the content of a key file,
+// using scrypt
+func newColumnCipher(secret []byte, salt []byte) (*_ColumnCipher, error) {
+	key, err := scrypt.Key(secret, salt, scryptN, scryptR, scryptP, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	nonceKey, err := deriveKey(key, salt, nonceKeyInfo)
+	if err != nil {
+		return nil, err
+	}
+	indexKey, err := deriveKey(key, salt, blindIndexKeyInfo)
+	if err != nil {
+		return nil, err
+	}
+	return &_ColumnCipher{aead: aead, salt: salt, nonceKey: nonceKey, indexKey: indexKey}, nil
+}
+
+// newRandomColumnCipher derives the key from the secret with a new random salt; nil is returned for
+// a nil secret, i.e. no encryption
+func newRandomColumnCipher(secret []byte) (*_ColumnCipher, error) {
+	if secret == nil {
+		return nil, nil
+	}
+	salt := make([]byte, encryptionSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return newColumnCipher(secret, salt)
+}
+
+func (aCipher *_ColumnCipher) encrypt(value []byte) (string, error) {
+	nonce := make([]byte, aCipher.aead.NonceSize(), aCipher.aead.NonceSize()+len(value)+aCipher.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return aCipher.seal(nonce, value), nil
+}
+
+// encryptDeterministically encrypts the value with a nonce keyed by the value, so that equal values
+// are encrypted alike
+func (aCipher *_ColumnCipher) encryptDeterministically(value []byte) string {
+	mac := hmac.New(sha256.New, aCipher.nonceKey)
+	mac.Write(value)
+	nonce := make([]byte, aCipher.aead.NonceSize(), aCipher.aead.NonceSize()+len(value)+aCipher.aead.Overhead())
+	copy(nonce, mac.Sum(nil))
+	return aCipher.seal(nonce, value)
+}
+
+func (aCipher *_ColumnCipher) seal(nonce []byte, value []byte) string {
+	sealed := aCipher.aead.Seal(nonce, nonce, value, nil)
+	return encryptedValuePrefix + base64.StdEncoding.EncodeToString(sealed)
+}
+
+func (aCipher *_ColumnCipher) decrypt(value string) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedValuePrefix))
+	if err != nil || len(sealed) < aCipher.aead.NonceSize() {
+		return nil, errors.New(InvalidEncryptedValueErrorMsg)
+	}
+	nonceSize := aCipher.aead.NonceSize()
+	plaintext, err := aCipher.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return nil, errors.New(InvalidEncryptedValueErrorMsg)
+	}
+	return plaintext, nil
+}
+
+// blindWord returns the keyed hash the word is indexed by in the blind search index, so that the
+// index can be searched without holding the word
+func (aCipher *_ColumnCipher) blindWord(word string) string {
+	mac := hmac.New(sha256.New, aCipher.indexKey)
+	mac.Write([]byte(word))
+	return hex.EncodeToString(mac.Sum(nil)[:blindWordSize])
+}
+
+func isEncrypted(value []byte) bool {
+	return bytes.HasPrefix(value, []byte(encryptedValuePrefix))
+}
+
+// encryptText encrypts the value if the DB is encrypted; blank values are stored as they are
+func encryptText(value string) string {
+	if columnCipher == nil || value == "" {
+		return value
+	}
+	encrypted, err := columnCipher.encrypt([]byte(value))
+	if err != nil {
+		panic(err)
+	}
+	return encrypted
+}
+
+// encryptUniqueText encrypts the value deterministically if the DB is encrypted, as the column of
+// the value has a unique constraint; blank values are stored as they are
+func encryptUniqueText(value string) string {
+	if columnCipher == nil || value == "" {
+		return value
+	}
+	return columnCipher.encryptDeterministically([]byte(value))
+}
+
+func encryptBytes(value []byte) []byte {
+	if len(value) == 0 {
+		return value
+	}
+	return []byte(encryptText(string(value)))
+}
+
+// decryptText decrypts the value if it is encrypted; the value is returned as it is if it can not
+// be decrypted, which is not expected as the key is checked when the DB is opened
+func decryptText(value string) string {
+	return string(decryptBytes([]byte(value)))
+}
+
+func decryptBytes(value []byte) []byte {
+	if columnCipher == nil || !isEncrypted(value) {
+		return value
+	}
+	plaintext, err := columnCipher.decrypt(string(value))
+	if err != nil {
+		log.Println(err)
+		return value
+	}
+	return plaintext
+}
+
+// LoadEncryptionSecret returns the secret the key is derived from, which is the passphrase or the
+// content of the key file, whichever is given; nil is returned if neither is. The identity key file
+// is encrypted with the same secret.
+func LoadEncryptionSecret(passphrase string, keyFile string) ([]byte, error) {
+	if passphrase != "" && keyFile != "" {
+		return nil, errors.New(AmbiguousEncryptionSecretErrorMsg)
+	}
+	if passphrase != "" {
+		return []byte(passphrase), nil
+	}
+	if keyFile == "" {
+		return nil, nil
+	}
+	content, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	content = bytes.TrimSpace(content)
+	if len(content) == 0 {
+		return nil, errors.New(BlankEncryptionSecretErrorMsg)
+	}
+	return content, nil
+}
+
+// setupEncryption returns the column cipher of the DB keyed from the secret, encrypting the DB if
+// it is not encrypted yet. A DB encrypted can only be opened with the secret it is encrypted with.
+func setupEncryption(db *gorm.DB, secret []byte) (*_ColumnCipher, error) {
+	settings := &_EncryptionSettings{}
+	encrypted := !db.First(settings).RecordNotFound()
+	if secret == nil {
+		if encrypted {
+			return nil, errors.New(EncryptionKeyMissingErrorMsg)
+		}
+		return nil, nil
+	}
+	if !encrypted {
+		log.Println("Encrypting DB")
+		newCipher, err := newRandomColumnCipher(secret)
+		if err == nil {
+			err = rekey(db, nil, newCipher)
+		}
+		return newCipher, err
+	}
+	existingCipher, err := newColumnCipher(secret, settings.Salt)
+	if err != nil {
+		return nil, err
+	}
+	if keyCheck, err := existingCipher.decrypt(settings.KeyCheck); err != nil ||
+		string(keyCheck) != encryptionKeyCheck {
+		return nil, errors.New(EncryptionKeyMismatchErrorMsg)
+	}
+	return existingCipher, nil
+}
+
+// rekeyColumn decrypts every value of the column with the old cipher and encrypts it with the new
+// one; a nil cipher means the values are not encrypted
+func rekeyColumn(tx *gorm.DB, column _EncryptedColumn, oldCipher *_ColumnCipher,
+	newCipher *_ColumnCipher) error {
+	rows, err := tx.Raw("SELECT id, " + column.columnName + " FROM " + column.tableName).Rows()
+	if err != nil {
+		return err
+	}
+	values := make(map[uint][]byte)
+	for rows.Next() {
+		var id uint
+		var value []byte
+		if err := rows.Scan(&id, &value); err != nil {
+			rows.Close()
+			return err
+		}
+		values[id] = value
+	}
+	rows.Close()
+	for id, value := range values {
+		if len(value) == 0 {
+			continue
+		}
+		if isEncrypted(value) {
+			if oldCipher == nil {
+				return errors.New(InvalidEncryptedValueErrorMsg)
+			}
+			if value, err = oldCipher.decrypt(string(value)); err != nil {
+				return err
+			}
+		}
+		var newValue interface{} = string(value)
+		if newCipher != nil && column.deterministic {
+			newValue = newCipher.encryptDeterministically(value)
+		} else if newCipher != nil {
+			if newValue, err = newCipher.encrypt(value); err != nil {
+				return err
+			}
+		}
+		if column.binary {
+			newValue = []byte(newValue.(string))
+		}
+		if err := tx.Exec("UPDATE "+column.tableName+" SET "+column.columnName+" = ? WHERE id = ?",
+			newValue, id).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rekey re-encrypts the sensitive columns of the DB from the old cipher to the new one in a
+// transaction; a nil old cipher encrypts a DB not encrypted and a nil new cipher decrypts it. The
+// full-text index of messages is dropped when encrypting, as it would hold the messages in clear,
+// and the blind index is dropped as it is keyed by the old cipher; either is set up again by
+// setupMessageSearch.
+func rekey(db *gorm.DB, oldCipher *_ColumnCipher, newCipher *_ColumnCipher) error {
+	dropBlindSearchIndex(db)
+	if newCipher != nil {
+		dropSearchIndex(db)
+	}
+	tx := db.Begin()
+	var err error
+	for _, column := range encryptedColumns {
+		if err = rekeyColumn(tx, column, oldCipher, newCipher); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = tx.Exec("DELETE FROM " + encryptionSettingsTableName).Error
+	}
+	if err == nil && newCipher != nil {
+		var keyCheck string
+		if keyCheck, err = newCipher.encrypt([]byte(encryptionKeyCheck)); err == nil {
+			err = tx.Create(&_EncryptionSettings{Salt: newCipher.salt, KeyCheck: keyCheck}).Error
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// IsEncrypted checks if the sensitive data of the DB is encrypted
+func IsEncrypted() bool {
+	return openDBConnection() && columnCipher != nil
+}
+
+// Rekey re-encrypts the DB with the key derived from the new passphrase or key file, whichever is
+// given, or decrypts it if neither is. The storage config is to be changed accordingly before the
+// DB is opened again.
+func Rekey(newPassphrase string, newKeyFile string) error {
+	secret, err := LoadEncryptionSecret(newPassphrase, newKeyFile)
+	if err != nil {
+		return err
+	}
+	newCipher, err := newRandomColumnCipher(secret)
+	if err != nil {
+		return err
+	}
+	if err := rekey(GetDB(), columnCipher, newCipher); err != nil {
+		return err
+	}
+	columnCipher = newCipher
+	searchIndexAvailable = setupMessageSearch(db, newCipher, app.IsBlindSearchEnabled())
+	return nil
+}
@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-ini/ini"
+	"github.com/imyousuf/lan-messenger/application/conf"
+	"github.com/imyousuf/lan-messenger/application/testutils"
+)
+
+// openTestEncryptedDB reopens the DB in the directory with the storage encryption config given
+func openTestEncryptedDB(directory string, encryptionConfig string) error {
+	conf.SetupNewConfiguration(func() (*ini.File, error) {
+		return ini.InsensitiveLoad([]byte(fmt.Sprintf("[storage]\nlocation=%s\n%s", directory,
+			encryptionConfig)))
+	})
+	ReInitDBConnection()
+	return GetDBConnectionError()
+}
+
+func getStoredEmail(username string) string {
+	var email string
+	GetDB().Raw("SELECT email FROM user_models WHERE username = ?", username).Row().Scan(&email)
+	return email
+}
+
+func TestColumnCipher(t *testing.T) {
+	aCipher, err := newRandomColumnCipher([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := aCipher.encrypt([]byte("user@email.co"))
+	if err != nil || !isEncrypted([]byte(encrypted)) || strings.Contains(encrypted, "user@email.co") {
+		t.Error("Value should have been encrypted", encrypted, err)
+	}
+	if plaintext, err := aCipher.decrypt(encrypted); err != nil || string(plaintext) != "user@email.co" {
+		t.Error("Value should have been decrypted", err)
+	}
+	if aCipher.encryptDeterministically([]byte("user@email.co")) != aCipher.encryptDeterministically([]byte(
+		"user@email.co")) || aCipher.encryptDeterministically([]byte("user@email.co")) ==
+		aCipher.encryptDeterministically([]byte("other@email.co")) {
+		t.Error("Only equal values should have been encrypted alike")
+	}
+	if plaintext, err := aCipher.decrypt(aCipher.encryptDeterministically([]byte("user@email.co"))); err != nil ||
+		string(plaintext) != "user@email.co" {
+		t.Error("Value encrypted deterministically should have been decrypted", err)
+	}
+	otherCipher, _ := newColumnCipher([]byte("other secret"), aCipher.salt)
+	if _, err := otherCipher.decrypt(encrypted); err == nil || err.Error() != InvalidEncryptedValueErrorMsg {
+		t.Error("Value should not have been decrypted with another key", err)
+	}
+}
+
+func TestLoadEncryptionSecret(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "lamess-encryption")
+	defer os.RemoveAll(directory)
+	keyFile := filepath.Join(directory, "lamess.key")
+	ioutil.WriteFile(keyFile, []byte("key file content\n"), 0600)
+	if secret, err := LoadEncryptionSecret("", keyFile); err != nil || string(secret) != "key file content" {
+		t.Error("Secret should have been read from the key file", err)
+	}
+	if secret, err := LoadEncryptionSecret("", ""); err != nil || secret != nil {
+		t.Error("No secret should have been configured", err)
+	}
+	if _, err := LoadEncryptionSecret("secret", keyFile); err == nil ||
+		err.Error() != AmbiguousEncryptionSecretErrorMsg {
+		t.Error("Both passphrase and key file should not have been accepted", err)
+	}
+	ioutil.WriteFile(keyFile, []byte(" \n"), 0600)
+	if _, err := LoadEncryptionSecret("", keyFile); err == nil || err.Error() != BlankEncryptionSecretErrorMsg {
+		t.Error("Blank key file should not have been accepted", err)
+	}
+}
+
+func TestEncryptedDB(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "lamess-encryption")
+	defer os.RemoveAll(directory)
+	defer func() {
+		conf.SetupNewConfiguration(testutils.MockLoadFunc)
+		ReInitDBConnection()
+	}()
+	if err := openTestEncryptedDB(directory, ""); err != nil || IsEncrypted() {
+		t.Fatal("DB should have been opened without encryption", err)
+	}
+	repo := NewGormRepository()
+	repo.CreateUser(&UserModel{Username: "a", Email: "a@email.co"})
+	if err := openTestEncryptedDB(directory, "passphrase=secret"); err != nil || !IsEncrypted() {
+		t.Fatal("DB should have been encrypted", err)
+	}
+	if stored := getStoredEmail("a"); !strings.HasPrefix(stored, encryptedValuePrefix) {
+		t.Error("Existing data should have been encrypted", stored)
+	}
+	userModel := &UserModel{Username: "b", Email: "b@email.co"}
+	repo.CreateUser(userModel)
+	repo.UpdateUserPublicKey(userModel, []byte("key"))
+	if stored := getStoredEmail("b"); !strings.HasPrefix(stored, encryptedValuePrefix) ||
+		userModel.Email != "b@email.co" {
+		t.Error("New data should have been encrypted", stored)
+	}
+	if found, _ := repo.FindUserByUsername("b"); found.Email != "b@email.co" || string(found.PublicKey) != "key" {
+		t.Error("Data should have been decrypted when found", found.Email)
+	}
+	if err := repo.CreateUser(&UserModel{Username: "c", Email: "a@email.co"}); err == nil {
+		t.Error("Email should have been unique in the encrypted DB")
+	}
+	if err := openTestEncryptedDB(directory, ""); err == nil || err.Error() != EncryptionKeyMissingErrorMsg {
+		t.Error("Encrypted DB should not have been opened without a key", err)
+	}
+	if err := openTestEncryptedDB(directory, "passphrase=wrong"); err == nil ||
+		err.Error() != EncryptionKeyMismatchErrorMsg {
+		t.Error("Encrypted DB should not have been opened with a wrong key", err)
+	}
+	keyFile := filepath.Join(directory, "lamess.key")
+	ioutil.WriteFile(keyFile, []byte("key file content"), 0600)
+	openTestEncryptedDB(directory, "passphrase=secret")
+	if err := Rekey("", keyFile); err != nil {
+		t.Fatal("DB should have been re-keyed", err)
+	}
+	if err := openTestEncryptedDB(directory, "keyfile="+keyFile); err != nil {
+		t.Fatal("DB should have been opened with the new key", err)
+	}
+	if found, _ := repo.FindUserByUsername("a"); found.Email != "a@email.co" {
+		t.Error("Re-keyed data should have been decrypted", found.Email)
+	}
+	if err := repo.CreateUser(&UserModel{Username: "c", Email: "b@email.co"}); err == nil {
+		t.Error("Email should have been unique in the re-keyed DB")
+	}
+	if err := Rekey("", ""); err != nil || IsEncrypted() || getStoredEmail("a") != "a@email.co" {
+		t.Error("DB should have been decrypted", err)
+	}
+	if err := openTestEncryptedDB(directory, ""); err != nil {
+		t.Error("Decrypted DB should have been opened without a key", err)
+	}
+}
+
+func TestEncryptedDB_search(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "lamess-encryption")
+	defer os.RemoveAll(directory)
+	defer func() {
+		conf.SetupNewConfiguration(testutils.MockLoadFunc)
+		ReInitDBConnection()
+	}()
+	if err := openTestEncryptedDB(directory, ""); err != nil {
+		t.Fatal("DB should have been opened without encryption", err)
+	}
+	if !IsSearchIndexAvailable() {
+		t.Skip("SQLite is built without FTS5")
+	}
+	repo := NewGormRepository()
+	userModel := createTestUser(t, repo, "a")
+	conversationModel := &ConversationModel{PeerUserModelID: userModel.ID}
+	repo.CreateConversation(conversationModel)
+	createTestMessage(t, repo, conversationModel, userModel, 1, "Shall we go for lunch today?", time.Now())
+	search := MessageSearch{Terms: []string{"Lunch"}, MatchStart: "<", MatchEnd: ">", Ellipsis: "...",
+		SnippetTokens: 3}
+	assertFound := func(message string, packetIDs ...uint64) {
+		hits, err := repo.SearchMessages(search, 10, 0)
+		if err != nil || len(hits) != len(packetIDs) {
+			t.Fatal(message, err, len(hits))
+		}
+		for index, hit := range hits {
+			if hit.PacketID != packetIDs[index] || !strings.Contains(strings.ToLower(hit.Snippet), "<lunch>") ||
+				strings.Contains(hit.Body, encryptedValuePrefix) {
+				t.Error(message, hit.PacketID, hit.Snippet)
+			}
+		}
+	}
+	if err := openTestEncryptedDB(directory, "passphrase=secret"); err != nil || !IsSearchIndexAvailable() {
+		t.Fatal("Encrypted DB should have been searchable", err)
+	}
+	createTestMessage(t, repo, conversationModel, userModel, 2, "Lunch sounds good, lunch at noon", time.Now())
+	createTestMessage(t, repo, conversationModel, userModel, 3, "See you there", time.Now())
+	assertFound("Messages of the encrypted DB should have been found", 2, 1)
+	if hits, _ := repo.SearchMessages(search, 10, 0); hits[1].Snippet != "...for <lunch> today?" {
+		t.Error("Snippet should have been made of the decrypted body", hits[1].Snippet)
+	}
+	search.Terms = []string{"lunch today"}
+	assertFound("Terms should have been matched as phrases", 1)
+	search.Terms = []string{"lunch"}
+	var indexed string
+	GetDB().Raw("SELECT group_concat(body, ' ') FROM " + blindSearchTableName).Row().Scan(&indexed)
+	if strings.Contains(indexed, "lunch") || strings.Contains(indexed, "noon") {
+		t.Error("Blind index should not have held the words", indexed)
+	}
+	keyFile := filepath.Join(directory, "lamess.key")
+	ioutil.WriteFile(keyFile, []byte("key file content"), 0600)
+	if err := Rekey("", keyFile); err != nil {
+		t.Fatal("DB should have been re-keyed", err)
+	}
+	assertFound("Blind index should have been rebuilt with the new key", 2, 1)
+	if err := openTestEncryptedDB(directory, "keyfile="+keyFile+"\nblindsearch=false"); err != nil ||
+		IsSearchIndexAvailable() {
+		t.Fatal("Search should not have been available with blind search disabled", err)
+	}
+	createTestMessage(t, repo, conversationModel, userModel, 4, "Lunch is on me", time.Now())
+	if err := openTestEncryptedDB(directory, "keyfile="+keyFile); err != nil || !IsSearchIndexAvailable() {
+		t.Fatal("Search should have been available with blind search enabled again", err)
+	}
+	assertFound("Messages saved without the blind index should have been indexed", 2, 4, 1)
+	if err := Rekey("", ""); err != nil {
+		t.Fatal("DB should have been decrypted", err)
+	}
+	assertFound("Decrypted DB should have been searchable", 2, 4, 1)
+}
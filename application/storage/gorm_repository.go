@@ -0,0 +1,364 @@
+package storage
+
+import (
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// _GormRepository is the Repository storing the models in the SQLite DB of the application
+type _GormRepository struct{}
+
+// NewGormRepository returns the Repository storing the models in the SQLite DB of the application.
+// The DB connection is retrieved on every call, so that the repository survives ReInitDBConnection.
+func NewGormRepository() Repository {
+	return &_GormRepository{}
+}
+
+// ******************** User ********************
+
+// decryptUserModel decrypts the sensitive fields of the user found, if the DB is encrypted
+func decryptUserModel(userModel *UserModel) {
+	userModel.Email, userModel.PublicKey = decryptText(userModel.Email), decryptBytes(userModel.PublicKey)
+}
+
+func (repo *_GormRepository) CreateUser(userModel *UserModel) error {
+	email, publicKey := userModel.Email, userModel.PublicKey
+	userModel.Email, userModel.PublicKey = encryptUniqueText(email), encryptBytes(publicKey)
+	err := GetDB().Create(userModel).Error
+	userModel.Email, userModel.PublicKey = email, publicKey
+	return err
+}
+
+func (repo *_GormRepository) FindUserByID(id uint) (*UserModel, bool) {
+	userModel := &UserModel{}
+	newDB := GetDB().First(userModel, id)
+	decryptUserModel(userModel)
+	return userModel, !newDB.RecordNotFound()
+}
+
+func (repo *_GormRepository) FindUserByUsername(username string) (*UserModel, bool) {
+	userModel := &UserModel{}
+	newDB := GetDB().Where("username = ?", username).First(userModel)
+	decryptUserModel(userModel)
+	return userModel, !newDB.RecordNotFound()
+}
+
+func (repo *_GormRepository) UpdateUserPublicKey(userModel *UserModel, publicKey []byte) error {
+	return GetDB().Model(userModel).Update("public_key", encryptBytes(publicKey)).Error
+}
+
+// ******************** Session ********************
+
+func (repo *_GormRepository) SaveSession(sessionModel *SessionModel) error {
+	err := GetDB().Save(sessionModel).Error
+	if err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed") {
+		return DuplicateError(err.Error())
+	}
+	return err
+}
+
+func (repo *_GormRepository) FindSessionBySessionID(sessionID string) (*SessionModel, bool) {
+	sessionModel := &SessionModel{}
+	newDB := GetDB().Where(SessionModel{SessionID: sessionID}).First(sessionModel)
+	if newDB.RecordNotFound() {
+		return sessionModel, false
+	}
+	GetDB().Model(sessionModel).Related(&sessionModel.UserModel)
+	decryptUserModel(&sessionModel.UserModel)
+	return sessionModel, true
+}
+
+func (repo *_GormRepository) FindSessionsByUser(userModelID uint) []*SessionModel {
+	sessionModels := []SessionModel{}
+	GetDB().Find(&sessionModels, SessionModel{UserModelID: userModelID})
+	result := make([]*SessionModel, len(sessionModels))
+	for index := range sessionModels {
+		result[index] = &sessionModels[index]
+	}
+	return result
+}
+
+// UpdateSessionExpiryTime does not update a session not saved, as gorm would update every session
+func (repo *_GormRepository) UpdateSessionExpiryTime(sessionModel *SessionModel, expiryTime time.Time) int64 {
+	if sessionModel.ID == 0 {
+		return 0
+	}
+	return GetDB().Model(sessionModel).Updates(SessionModel{ExpiryTime: expiryTime}).RowsAffected
+}
+
+// UpdateSessionPresence does not update a session not saved, as gorm would update every session
+func (repo *_GormRepository) UpdateSessionPresence(sessionModel *SessionModel, presenceState string,
+	statusMessage string) int64 {
+	if sessionModel.ID == 0 {
+		return 0
+	}
+	return GetDB().Model(sessionModel).Updates(map[string]interface{}{
+		"presence_state": presenceState, "status_message": statusMessage}).RowsAffected
+}
+
+// UpdateSessionReplyTo does not update a session not saved, as gorm would update every session
+func (repo *_GormRepository) UpdateSessionReplyTo(sessionModel *SessionModel, replyTo string) int64 {
+	if sessionModel.ID == 0 {
+		return 0
+	}
+	return GetDB().Model(sessionModel).Updates(SessionModel{ReplyToConnectionString: replyTo}).RowsAffected
+}
+
+// ******************** Room ********************
+
+func (repo *_GormRepository) CreateRoom(roomModel *RoomModel) error {
+	return GetDB().Create(roomModel).Error
+}
+
+func (repo *_GormRepository) FindRoomByID(id uint) (*RoomModel, bool) {
+	roomModel := &RoomModel{}
+	newDB := GetDB().First(roomModel, id)
+	return roomModel, !newDB.RecordNotFound()
+}
+
+func (repo *_GormRepository) FindRoomByRoomID(roomID string) (*RoomModel, bool) {
+	roomModel := &RoomModel{}
+	newDB := GetDB().Where(RoomModel{RoomID: roomID}).First(roomModel)
+	return roomModel, !newDB.RecordNotFound()
+}
+
+func (repo *_GormRepository) FindRoomMember(roomModelID uint, userModelID uint) (*RoomMemberModel, bool) {
+	memberModel := &RoomMemberModel{}
+	newDB := GetDB().Where(RoomMemberModel{RoomModelID: roomModelID, UserModelID: userModelID}).
+		First(memberModel)
+	return memberModel, !newDB.RecordNotFound()
+}
+
+func (repo *_GormRepository) SaveRoomMember(memberModel *RoomMemberModel) error {
+	return GetDB().Save(memberModel).Error
+}
+
+func (repo *_GormRepository) FindRoomMembers(roomModelID uint, membership uint8) []*RoomMemberModel {
+	memberModels := []RoomMemberModel{}
+	GetDB().Find(&memberModels, RoomMemberModel{RoomModelID: roomModelID, Membership: membership})
+	result := make([]*RoomMemberModel, len(memberModels))
+	for index := range memberModels {
+		memberModel := &memberModels[index]
+		GetDB().Model(memberModel).Related(&memberModel.UserModel)
+		decryptUserModel(&memberModel.UserModel)
+		result[index] = memberModel
+	}
+	return result
+}
+
+// ******************** Conversation ********************
+
+func (repo *_GormRepository) CreateConversation(conversationModel *ConversationModel) error {
+	return GetDB().Create(conversationModel).Error
+}
+
+func (repo *_GormRepository) FindConversation(peerUserModelID uint, roomModelID uint) (*ConversationModel,
+	bool) {
+	conversationModel := &ConversationModel{}
+	newDB := GetDB().Where(map[string]interface{}{"peer_user_model_id": peerUserModelID,
+		"room_model_id": roomModelID}).First(conversationModel)
+	return conversationModel, !newDB.RecordNotFound()
+}
+
+func (repo *_GormRepository) FindConversationByID(id uint) (*ConversationModel, bool) {
+	conversationModel := &ConversationModel{}
+	newDB := GetDB().First(conversationModel, id)
+	return conversationModel, !newDB.RecordNotFound()
+}
+
+func (repo *_GormRepository) FindConversations(limit int, offset int) []*ConversationModel {
+	conversationModels := []ConversationModel{}
+	GetDB().Order("last_message_time desc, id desc").Limit(limit).Offset(offset).Find(&conversationModels)
+	result := make([]*ConversationModel, len(conversationModels))
+	for index := range conversationModels {
+		result[index] = &conversationModels[index]
+	}
+	return result
+}
+
+func (repo *_GormRepository) UpdateConversationLastMessageTime(conversationModel *ConversationModel,
+	lastMessageTime time.Time) error {
+	return GetDB().Model(conversationModel).
+		Updates(map[string]interface{}{"last_message_time": lastMessageTime}).Error
+}
+
+// ******************** Message ********************
+
+func (repo *_GormRepository) CreateMessage(messageModel *MessageModel) error {
+	body := messageModel.Body
+	messageModel.Body = encryptText(body)
+	var err error
+	if isBlindlyIndexed() {
+		tx := GetDB().Begin()
+		if err = tx.Create(messageModel).Error; err == nil {
+			err = indexBlindly(tx, columnCipher, messageModel.ID, body)
+		}
+		if err == nil {
+			err = tx.Commit().Error
+		} else {
+			tx.Rollback()
+		}
+	} else {
+		err = GetDB().Create(messageModel).Error
+	}
+	messageModel.Body = body
+	return err
+}
+
+func (repo *_GormRepository) FindMessageByPacket(sessionID string, packetID uint64) (*MessageModel, bool) {
+	messageModel := &MessageModel{}
+	newDB := GetDB().Where(map[string]interface{}{"session_id": sessionID, "packet_id": packetID}).
+		First(messageModel)
+	messageModel.Body = decryptText(messageModel.Body)
+	return messageModel, !newDB.RecordNotFound()
+}
+
+// apply narrows down the query of message_models using the filter
+func (filter MessageFilter) apply(db *gorm.DB) *gorm.DB {
+	if filter.ConversationModelID != 0 {
+		db = db.Where("message_models.conversation_model_id = ?", filter.ConversationModelID)
+	}
+	if filter.PeerUserModelID != 0 {
+		db = db.Where("message_models.sender_user_model_id = ? OR message_models.conversation_model_id IN "+
+			"(SELECT id FROM conversation_models WHERE peer_user_model_id = ?)",
+			filter.PeerUserModelID, filter.PeerUserModelID)
+	}
+	if filter.SenderUserModelID != 0 {
+		db = db.Where("message_models.sender_user_model_id = ?", filter.SenderUserModelID)
+	}
+	if !filter.From.IsZero() {
+		db = db.Where("message_models.sent_time >= ?", filter.From)
+	}
+	if !filter.To.IsZero() {
+		db = db.Where("message_models.sent_time < ?", filter.To)
+	}
+	return db
+}
+
+func (repo *_GormRepository) FindMessages(filter MessageFilter, limit int, offset int) []*MessageModel {
+	messageModels := []MessageModel{}
+	filter.apply(GetDB()).Order("sent_time desc, id desc").Limit(limit).Offset(offset).Find(&messageModels)
+	result := make([]*MessageModel, len(messageModels))
+	for index := range messageModels {
+		messageModels[index].Body = decryptText(messageModels[index].Body)
+		result[index] = &messageModels[index]
+	}
+	return result
+}
+
+func (repo *_GormRepository) CountMessages(filter MessageFilter) int {
+	count := 0
+	filter.apply(GetDB().Model(&MessageModel{})).Count(&count)
+	return count
+}
+
+func (repo *_GormRepository) IsSearchAvailable() bool {
+	return IsSearchIndexAvailable()
+}
+
+// toMatchExpression quotes each term, so that the terms are matched as plain terms rather than FTS5
+// syntax
+func toMatchExpression(terms []string) string {
+	quotedTerms := make([]string, len(terms))
+	for index, term := range terms {
+		quotedTerms[index] = `"` + strings.Replace(term, `"`, `""`, -1) + `"`
+	}
+	return strings.Join(quotedTerms, " ")
+}
+
+// searchMessagesBlindly searches the blind index with the keyed hashes of the words of the terms;
+// snippets are made of the decrypted bodies, as the index does not hold the words
+func (repo *_GormRepository) searchMessagesBlindly(search MessageSearch, limit int, offset int) (
+	[]*MessageSearchHit, error) {
+	words := make(map[string]bool)
+	blindTerms := make([]string, len(search.Terms))
+	for index, term := range search.Terms {
+		for _, token := range tokenize(term) {
+			words[token.word] = true
+		}
+		blindTerms[index] = blindText(columnCipher, term)
+	}
+	if len(words) == 0 {
+		return []*MessageSearchHit{}, nil
+	}
+	db := GetDB().Table(blindSearchTableName).
+		Select("message_models.*, bm25("+blindSearchTableName+") AS rank").
+		Joins("JOIN message_models ON message_models.id = "+blindSearchTableName+".rowid").
+		Where(blindSearchTableName+" MATCH ?", toMatchExpression(blindTerms)).
+		Where("message_models.deleted_at IS NULL")
+	hits := []MessageSearchHit{}
+	if err := search.MessageFilter.apply(db).Order("rank").Limit(limit).Offset(offset).
+		Scan(&hits).Error; err != nil {
+		return nil, err
+	}
+	result := make([]*MessageSearchHit, len(hits))
+	for index := range hits {
+		hit := &hits[index]
+		hit.Body = decryptText(hit.Body)
+		tokens := tokenize(hit.Body)
+		matched := make([]bool, len(tokens))
+		for tokenIndex, token := range tokens {
+			matched[tokenIndex] = words[token.word]
+		}
+		hit.Snippet = snippet(search, hit.Body, tokens, matched)
+		result[index] = hit
+	}
+	return result, nil
+}
+
+func (repo *_GormRepository) SearchMessages(search MessageSearch, limit int, offset int) ([]*MessageSearchHit,
+	error) {
+	if columnCipher != nil {
+		return repo.searchMessagesBlindly(search, limit, offset)
+	}
+	db := GetDB().Table(MessageSearchTableName).
+		Select("message_models.*, snippet("+MessageSearchTableName+", 0, ?, ?, ?, ?) AS snippet, "+
+			"bm25("+MessageSearchTableName+") AS rank",
+			search.MatchStart, search.MatchEnd, search.Ellipsis, search.SnippetTokens).
+		Joins("JOIN message_models ON message_models.id = "+MessageSearchTableName+".rowid").
+		Where(MessageSearchTableName+" MATCH ?", toMatchExpression(search.Terms)).
+		Where("message_models.deleted_at IS NULL")
+	hits := []MessageSearchHit{}
+	if err := search.MessageFilter.apply(db).Order("rank").Limit(limit).Offset(offset).
+		Scan(&hits).Error; err != nil {
+		return nil, err
+	}
+	result := make([]*MessageSearchHit, len(hits))
+	for index := range hits {
+		result[index] = &hits[index]
+	}
+	return result, nil
+}
+
+// ******************** Outbox ********************
+
+func (repo *_GormRepository) CreateOutboxEntry(outboxModel *OutboxModel) error {
+	body, queuedPacket := outboxModel.Body, outboxModel.Packet
+	outboxModel.Body, outboxModel.Packet = encryptText(body), encryptText(queuedPacket)
+	err := GetDB().Create(outboxModel).Error
+	outboxModel.Body, outboxModel.Packet = body, queuedPacket
+	return err
+}
+
+func (repo *_GormRepository) DeleteOutboxEntry(outboxModel *OutboxModel) bool {
+	return GetDB().Unscoped().Delete(outboxModel).RowsAffected > 0
+}
+
+func (repo *_GormRepository) DeleteExpiredOutboxEntries(recipientUserModelID uint, now time.Time) {
+	GetDB().Unscoped().Where("recipient_user_model_id = ? AND expiry_time <= ?", recipientUserModelID, now).
+		Delete(&OutboxModel{})
+}
+
+func (repo *_GormRepository) FindOutboxEntries(recipientUserModelID uint) []*OutboxModel {
+	outboxModels := []OutboxModel{}
+	GetDB().Where("recipient_user_model_id = ?", recipientUserModelID).Order("id").Find(&outboxModels)
+	result := make([]*OutboxModel, len(outboxModels))
+	for index := range outboxModels {
+		outboxModels[index].Body = decryptText(outboxModels[index].Body)
+		outboxModels[index].Packet = decryptText(outboxModels[index].Packet)
+		result[index] = &outboxModels[index]
+	}
+	return result
+}
@@ -0,0 +1,526 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// _MemoryRepository is the Repository keeping the models in memory only, which is meant for tests
+// and for running without a DB. Models are copied in and out, so that changing a model found does
+// not change it in the repository till it is saved.
+type _MemoryRepository struct {
+	mutex         sync.RWMutex
+	lastID        uint
+	users         map[uint]UserModel
+	sessions      map[uint]SessionModel
+	rooms         map[uint]RoomModel
+	roomMembers   map[uint]RoomMemberModel
+	conversations map[uint]ConversationModel
+	messages      map[uint]MessageModel
+	outbox        map[uint]OutboxModel
+}
+
+// NewMemoryRepository returns an empty Repository keeping the models in memory only. Its search
+// matches whole terms case insensitively and ranks the hits by the number of terms matched.
+func NewMemoryRepository() Repository {
+	return &_MemoryRepository{users: make(map[uint]UserModel), sessions: make(map[uint]SessionModel),
+		rooms: make(map[uint]RoomModel), roomMembers: make(map[uint]RoomMemberModel),
+		conversations: make(map[uint]ConversationModel), messages: make(map[uint]MessageModel),
+		outbox: make(map[uint]OutboxModel)}
+}
+
+func newDuplicateError(tableName string, columns string) DuplicateError {
+	return DuplicateError(fmt.Sprintf("UNIQUE constraint failed: %s.%s", tableName, columns))
+}
+
+// nextID returns the ID of a model being created; IDs are unique across the models, which keeps
+// them increasing in the order of creation for every kind of model
+func (repo *_MemoryRepository) nextID() uint {
+	repo.lastID++
+	return repo.lastID
+}
+
+// sortedIDs returns the IDs in the order of creation
+func sortedIDs(ids []uint) []uint {
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+// page returns the part of the models in the page of limit and offset
+func page(length int, limit int, offset int) (int, int) {
+	if offset > length {
+		offset = length
+	}
+	end := length
+	if limit >= 0 && offset+limit < length {
+		end = offset + limit
+	}
+	return offset, end
+}
+
+// ******************** User ********************
+
+func (repo *_MemoryRepository) CreateUser(userModel *UserModel) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	for _, existingModel := range repo.users {
+		if existingModel.Username == userModel.Username || existingModel.Email == userModel.Email {
+			return newDuplicateError("user_models", "username")
+		}
+	}
+	userModel.ID = repo.nextID()
+	userModel.CreatedAt, userModel.UpdatedAt = time.Now(), time.Now()
+	repo.users[userModel.ID] = *userModel
+	return nil
+}
+
+func (repo *_MemoryRepository) FindUserByID(id uint) (*UserModel, bool) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+	userModel, found := repo.users[id]
+	return &userModel, found
+}
+
+func (repo *_MemoryRepository) FindUserByUsername(username string) (*UserModel, bool) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+	for _, userModel := range repo.users {
+		if userModel.Username == username {
+			return &userModel, true
+		}
+	}
+	return &UserModel{}, false
+}
+
+func (repo *_MemoryRepository) UpdateUserPublicKey(userModel *UserModel, publicKey []byte) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	storedModel, found := repo.users[userModel.ID]
+	if !found {
+		return fmt.Errorf("user %d not found", userModel.ID)
+	}
+	storedModel.PublicKey, storedModel.UpdatedAt = publicKey, time.Now()
+	repo.users[userModel.ID] = storedModel
+	return nil
+}
+
+// ******************** Session ********************
+
+func (repo *_MemoryRepository) SaveSession(sessionModel *SessionModel) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	for id, existingModel := range repo.sessions {
+		if id != sessionModel.ID && existingModel.SessionID == sessionModel.SessionID {
+			return newDuplicateError("session_models", "session_id")
+		}
+	}
+	if sessionModel.ID == 0 {
+		sessionModel.ID = repo.nextID()
+		sessionModel.CreatedAt = time.Now()
+	}
+	sessionModel.UpdatedAt = time.Now()
+	storedModel := *sessionModel
+	storedModel.UserModel = UserModel{}
+	repo.sessions[sessionModel.ID] = storedModel
+	return nil
+}
+
+func (repo *_MemoryRepository) FindSessionBySessionID(sessionID string) (*SessionModel, bool) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+	for _, sessionModel := range repo.sessions {
+		if sessionModel.SessionID == sessionID {
+			sessionModel.UserModel = repo.users[sessionModel.UserModelID]
+			return &sessionModel, true
+		}
+	}
+	return &SessionModel{}, false
+}
+
+func (repo *_MemoryRepository) FindSessionsByUser(userModelID uint) []*SessionModel {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+	ids := []uint{}
+	for id, sessionModel := range repo.sessions {
+		if sessionModel.UserModelID == userModelID {
+			ids = append(ids, id)
+		}
+	}
+	result := make([]*SessionModel, 0, len(ids))
+	for _, id := range sortedIDs(ids) {
+		sessionModel := repo.sessions[id]
+		result = append(result, &sessionModel)
+	}
+	return result
+}
+
+func (repo *_MemoryRepository) updateSession(sessionModel *SessionModel, update func(*SessionModel)) int64 {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	storedModel, found := repo.sessions[sessionModel.ID]
+	if !found {
+		return 0
+	}
+	update(&storedModel)
+	storedModel.UpdatedAt = time.Now()
+	repo.sessions[sessionModel.ID] = storedModel
+	return 1
+}
+
+func (repo *_MemoryRepository) UpdateSessionExpiryTime(sessionModel *SessionModel, expiryTime time.Time) int64 {
+	return repo.updateSession(sessionModel, func(storedModel *SessionModel) {
+		storedModel.ExpiryTime = expiryTime
+	})
+}
+
+func (repo *_MemoryRepository) UpdateSessionPresence(sessionModel *SessionModel, presenceState string,
+	statusMessage string) int64 {
+	return repo.updateSession(sessionModel, func(storedModel *SessionModel) {
+		storedModel.PresenceState, storedModel.StatusMessage = presenceState, statusMessage
+	})
+}
+
+func (repo *_MemoryRepository) UpdateSessionReplyTo(sessionModel *SessionModel, replyTo string) int64 {
+	return repo.updateSession(sessionModel, func(storedModel *SessionModel) {
+		storedModel.ReplyToConnectionString = replyTo
+	})
+}
+
+// ******************** Room ********************
+
+func (repo *_MemoryRepository) CreateRoom(roomModel *RoomModel) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	for _, existingModel := range repo.rooms {
+		if existingModel.RoomID == roomModel.RoomID {
+			return newDuplicateError("room_models", "room_id")
+		}
+	}
+	roomModel.ID = repo.nextID()
+	roomModel.CreatedAt, roomModel.UpdatedAt = time.Now(), time.Now()
+	repo.rooms[roomModel.ID] = *roomModel
+	return nil
+}
+
+func (repo *_MemoryRepository) FindRoomByID(id uint) (*RoomModel, bool) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+	roomModel, found := repo.rooms[id]
+	return &roomModel, found
+}
+
+func (repo *_MemoryRepository) FindRoomByRoomID(roomID string) (*RoomModel, bool) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+	for _, roomModel := range repo.rooms {
+		if roomModel.RoomID == roomID {
+			return &roomModel, true
+		}
+	}
+	return &RoomModel{}, false
+}
+
+func (repo *_MemoryRepository) FindRoomMember(roomModelID uint, userModelID uint) (*RoomMemberModel, bool) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+	for _, memberModel := range repo.roomMembers {
+		if memberModel.RoomModelID == roomModelID && memberModel.UserModelID == userModelID {
+			return &memberModel, true
+		}
+	}
+	return &RoomMemberModel{}, false
+}
+
+func (repo *_MemoryRepository) SaveRoomMember(memberModel *RoomMemberModel) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	for id, existingModel := range repo.roomMembers {
+		if id != memberModel.ID && existingModel.RoomModelID == memberModel.RoomModelID &&
+			existingModel.UserModelID == memberModel.UserModelID {
+			return newDuplicateError("room_member_models", "room_model_id, room_member_models.user_model_id")
+		}
+	}
+	if memberModel.ID == 0 {
+		memberModel.ID = repo.nextID()
+		memberModel.CreatedAt = time.Now()
+	}
+	memberModel.UpdatedAt = time.Now()
+	storedModel := *memberModel
+	storedModel.UserModel = UserModel{}
+	repo.roomMembers[memberModel.ID] = storedModel
+	return nil
+}
+
+func (repo *_MemoryRepository) FindRoomMembers(roomModelID uint, membership uint8) []*RoomMemberModel {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+	ids := []uint{}
+	for id, memberModel := range repo.roomMembers {
+		if memberModel.RoomModelID == roomModelID && memberModel.Membership == membership {
+			ids = append(ids, id)
+		}
+	}
+	result := make([]*RoomMemberModel, 0, len(ids))
+	for _, id := range sortedIDs(ids) {
+		memberModel := repo.roomMembers[id]
+		memberModel.UserModel = repo.users[memberModel.UserModelID]
+		result = append(result, &memberModel)
+	}
+	return result
+}
+
+// ******************** Conversation ********************
+
+func (repo *_MemoryRepository) CreateConversation(conversationModel *ConversationModel) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	for _, existingModel := range repo.conversations {
+		if existingModel.PeerUserModelID == conversationModel.PeerUserModelID &&
+			existingModel.RoomModelID == conversationModel.RoomModelID {
+			return newDuplicateError("conversation_models",
+				"peer_user_model_id, conversation_models.room_model_id")
+		}
+	}
+	conversationModel.ID = repo.nextID()
+	conversationModel.CreatedAt, conversationModel.UpdatedAt = time.Now(), time.Now()
+	repo.conversations[conversationModel.ID] = *conversationModel
+	return nil
+}
+
+func (repo *_MemoryRepository) FindConversation(peerUserModelID uint, roomModelID uint) (*ConversationModel,
+	bool) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+	for _, conversationModel := range repo.conversations {
+		if conversationModel.PeerUserModelID == peerUserModelID && conversationModel.RoomModelID == roomModelID {
+			return &conversationModel, true
+		}
+	}
+	return &ConversationModel{}, false
+}
+
+func (repo *_MemoryRepository) FindConversationByID(id uint) (*ConversationModel, bool) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+	conversationModel, found := repo.conversations[id]
+	return &conversationModel, found
+}
+
+func (repo *_MemoryRepository) FindConversations(limit int, offset int) []*ConversationModel {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+	conversationModels := make([]ConversationModel, 0, len(repo.conversations))
+	for _, conversationModel := range repo.conversations {
+		conversationModels = append(conversationModels, conversationModel)
+	}
+	sort.Slice(conversationModels, func(i, j int) bool {
+		if !conversationModels[i].LastMessageTime.Equal(conversationModels[j].LastMessageTime) {
+			return conversationModels[i].LastMessageTime.After(conversationModels[j].LastMessageTime)
+		}
+		return conversationModels[i].ID > conversationModels[j].ID
+	})
+	start, end := page(len(conversationModels), limit, offset)
+	result := make([]*ConversationModel, 0, end-start)
+	for index := start; index < end; index++ {
+		result = append(result, &conversationModels[index])
+	}
+	return result
+}
+
+func (repo *_MemoryRepository) UpdateConversationLastMessageTime(conversationModel *ConversationModel,
+	lastMessageTime time.Time) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	storedModel, found := repo.conversations[conversationModel.ID]
+	if !found {
+		return fmt.Errorf("conversation %d not found", conversationModel.ID)
+	}
+	storedModel.LastMessageTime, storedModel.UpdatedAt = lastMessageTime, time.Now()
+	repo.conversations[conversationModel.ID] = storedModel
+	return nil
+}
+
+// ******************** Message ********************
+
+func (repo *_MemoryRepository) CreateMessage(messageModel *MessageModel) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	for _, existingModel := range repo.messages {
+		if existingModel.SessionID == messageModel.SessionID && existingModel.PacketID == messageModel.PacketID {
+			return newDuplicateError("message_models", "session_id, message_models.packet_id")
+		}
+	}
+	messageModel.ID = repo.nextID()
+	messageModel.CreatedAt, messageModel.UpdatedAt = time.Now(), time.Now()
+	repo.messages[messageModel.ID] = *messageModel
+	return nil
+}
+
+func (repo *_MemoryRepository) FindMessageByPacket(sessionID string, packetID uint64) (*MessageModel, bool) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+	for _, messageModel := range repo.messages {
+		if messageModel.SessionID == sessionID && messageModel.PacketID == packetID {
+			return &messageModel, true
+		}
+	}
+	return &MessageModel{}, false
+}
+
+// matches returns whether the message matches the filter
+func (repo *_MemoryRepository) matches(filter MessageFilter, messageModel MessageModel) bool {
+	if filter.ConversationModelID != 0 && messageModel.ConversationModelID != filter.ConversationModelID {
+		return false
+	}
+	if filter.PeerUserModelID != 0 && messageModel.SenderUserModelID != filter.PeerUserModelID &&
+		repo.conversations[messageModel.ConversationModelID].PeerUserModelID != filter.PeerUserModelID {
+		return false
+	}
+	if filter.SenderUserModelID != 0 && messageModel.SenderUserModelID != filter.SenderUserModelID {
+		return false
+	}
+	if !filter.From.IsZero() && messageModel.SentTime.Before(filter.From) {
+		return false
+	}
+	return filter.To.IsZero() || messageModel.SentTime.Before(filter.To)
+}
+
+// filterMessages returns the messages matching the filter, the latest sent first
+func (repo *_MemoryRepository) filterMessages(filter MessageFilter) []MessageModel {
+	messageModels := []MessageModel{}
+	for _, messageModel := range repo.messages {
+		if repo.matches(filter, messageModel) {
+			messageModels = append(messageModels, messageModel)
+		}
+	}
+	sort.Slice(messageModels, func(i, j int) bool {
+		if !messageModels[i].SentTime.Equal(messageModels[j].SentTime) {
+			return messageModels[i].SentTime.After(messageModels[j].SentTime)
+		}
+		return messageModels[i].ID > messageModels[j].ID
+	})
+	return messageModels
+}
+
+func (repo *_MemoryRepository) FindMessages(filter MessageFilter, limit int, offset int) []*MessageModel {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+	messageModels := repo.filterMessages(filter)
+	start, end := page(len(messageModels), limit, offset)
+	result := make([]*MessageModel, 0, end-start)
+	for index := start; index < end; index++ {
+		result = append(result, &messageModels[index])
+	}
+	return result
+}
+
+func (repo *_MemoryRepository) CountMessages(filter MessageFilter) int {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+	return len(repo.filterMessages(filter))
+}
+
+func (repo *_MemoryRepository) IsSearchAvailable() bool {
+	return true
+}
+
+// searchMessage returns the hit if the message contains every word of the terms
+func searchMessage(search MessageSearch, words []string, messageModel MessageModel) (*MessageSearchHit, bool) {
+	tokens := tokenize(messageModel.Body)
+	matched := make([]bool, len(tokens))
+	matchCount := 0
+	for _, word := range words {
+		found := false
+		for index, token := range tokens {
+			if token.word == word {
+				if !matched[index] {
+					matchCount++
+				}
+				matched[index], found = true, true
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+	return &MessageSearchHit{MessageModel: messageModel, Rank: -float64(matchCount),
+		Snippet: snippet(search, messageModel.Body, tokens, matched)}, true
+}
+
+func (repo *_MemoryRepository) SearchMessages(search MessageSearch, limit int, offset int) ([]*MessageSearchHit,
+	error) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+	words := []string{}
+	for _, term := range search.Terms {
+		for _, token := range tokenize(term) {
+			words = append(words, token.word)
+		}
+	}
+	hits := []*MessageSearchHit{}
+	if len(words) == 0 {
+		return hits, nil
+	}
+	for _, messageModel := range repo.filterMessages(search.MessageFilter) {
+		if hit, found := searchMessage(search, words, messageModel); found {
+			hits = append(hits, hit)
+		}
+	}
+	sort.SliceStable(hits, func(i, j int) bool {
+		return hits[i].Rank < hits[j].Rank
+	})
+	start, end := page(len(hits), limit, offset)
+	return hits[start:end], nil
+}
+
+// ******************** Outbox ********************
+
+func (repo *_MemoryRepository) CreateOutboxEntry(outboxModel *OutboxModel) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	outboxModel.ID = repo.nextID()
+	outboxModel.CreatedAt, outboxModel.UpdatedAt = time.Now(), time.Now()
+	repo.outbox[outboxModel.ID] = *outboxModel
+	return nil
+}
+
+func (repo *_MemoryRepository) DeleteOutboxEntry(outboxModel *OutboxModel) bool {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	if _, found := repo.outbox[outboxModel.ID]; !found {
+		return false
+	}
+	delete(repo.outbox, outboxModel.ID)
+	return true
+}
+
+func (repo *_MemoryRepository) DeleteExpiredOutboxEntries(recipientUserModelID uint, now time.Time) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	for id, outboxModel := range repo.outbox {
+		if outboxModel.RecipientUserModelID == recipientUserModelID && !outboxModel.ExpiryTime.After(now) {
+			delete(repo.outbox, id)
+		}
+	}
+}
+
+func (repo *_MemoryRepository) FindOutboxEntries(recipientUserModelID uint) []*OutboxModel {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+	ids := []uint{}
+	for id, outboxModel := range repo.outbox {
+		if outboxModel.RecipientUserModelID == recipientUserModelID {
+			ids = append(ids, id)
+		}
+	}
+	result := make([]*OutboxModel, 0, len(ids))
+	for _, id := range sortedIDs(ids) {
+		outboxModel := repo.outbox[id]
+		result = append(result, &outboxModel)
+	}
+	return result
+}
@@ -0,0 +1,246 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	schemaVersionTableName = "schema_version"
+	// SchemaTooNewErrorFmt is the error returned when the DB has been migrated by a newer version of
+	// the application than this one
+	SchemaTooNewErrorFmt = "schema version %d of the DB is newer than the latest known version %d"
+	// MigrationFailedErrorFmt is the error returned when a migration fails, after rolling it back
+	MigrationFailedErrorFmt = "migration %d (%s) failed: %v"
+)
+
+// Migration is a numbered change to the schema. Migrations are applied in the order of their
+// version inside a transaction each, and are never to be changed once released; add a new one
+// instead. Models are snapshotted in the migration creating them, so that the current models do
+// not change what an old migration does.
+type Migration struct {
+	Version     uint
+	Description string
+	Migrate     func(tx *gorm.DB) error
+}
+
+// _SchemaVersion records a migration applied to the DB
+type _SchemaVersion struct {
+	Version     uint `gorm:"primary_key;auto_increment:false"`
+	Description string
+	AppliedAt   time.Time
+}
+
+func (_SchemaVersion) TableName() string {
+	return schemaVersionTableName
+}
+
+// ******************** Migration 1 ********************
+
+type _UserModelV1 struct {
+	gorm.Model
+	Username    string `gorm:"not null;unique"`
+	DisplayName string
+	Email       string `gorm:"not null;unique"`
+	PublicKey   []byte
+}
+
+func (_UserModelV1) TableName() string {
+	return "user_models"
+}
+
+type _SessionModelV1 struct {
+	gorm.Model
+	UserModelID             uint
+	SessionID               string `gorm:"not null;unique"`
+	DevicePreferenceIndex   uint8
+	ExpiryTime              time.Time
+	ReplyToConnectionString string
+	PresenceState           string
+	StatusMessage           string
+}
+
+func (_SessionModelV1) TableName() string {
+	return "session_models"
+}
+
+// ******************** Migration 2 ********************
+
+type _RoomModelV2 struct {
+	gorm.Model
+	RoomID string `gorm:"not null;unique"`
+	Name   string
+}
+
+func (_RoomModelV2) TableName() string {
+	return "room_models"
+}
+
+type _RoomMemberModelV2 struct {
+	gorm.Model
+	RoomModelID uint `gorm:"unique_index:idx_room_member"`
+	UserModelID uint `gorm:"unique_index:idx_room_member"`
+	Membership  uint8
+}
+
+func (_RoomMemberModelV2) TableName() string {
+	return "room_member_models"
+}
+
+// ******************** Migration 3 ********************
+
+type _ConversationModelV3 struct {
+	gorm.Model
+	PeerUserModelID uint `gorm:"unique_index:idx_conversation"`
+	RoomModelID     uint `gorm:"unique_index:idx_conversation"`
+	LastMessageTime time.Time
+}
+
+func (_ConversationModelV3) TableName() string {
+	return "conversation_models"
+}
+
+type _MessageModelV3 struct {
+	gorm.Model
+	ConversationModelID uint   `gorm:"index"`
+	SenderUserModelID   uint   `gorm:"index"`
+	SessionID           string `gorm:"not null;unique_index:idx_message_packet"`
+	PacketID            uint64 `gorm:"unique_index:idx_message_packet"`
+	Outgoing            bool
+	ContentType         string
+	Body                string
+	SentTime            time.Time `gorm:"index"`
+}
+
+func (_MessageModelV3) TableName() string {
+	return "message_models"
+}
+
+// ******************** Migration 4 ********************
+
+type _OutboxModelV4 struct {
+	gorm.Model
+	RecipientUserModelID uint `gorm:"index"`
+	RoomID               string
+	ContentType          string
+	Body                 string
+	ExpiryTime           time.Time
+}
+
+func (_OutboxModelV4) TableName() string {
+	return "outbox_models"
+}
+
+// ******************** Migration 5 ********************
+
+type _EncryptionSettingsV5 struct {
+	ID       uint `gorm:"primary_key"`
+	Salt     []byte
+	KeyCheck string
+}
+
+func (_EncryptionSettingsV5) TableName() string {
+	return "encryption_settings"
+}
+
+// ******************** Migration 6 ********************
+
+type _OutboxModelV6 struct {
+	gorm.Model
+	RecipientUserModelID uint `gorm:"index"`
+	RoomID               string
+	ContentType          string
+	Body                 string
+	ExpiryTime           time.Time
+	Packet               string
+}
+
+func (_OutboxModelV6) TableName() string {
+	return "outbox_models"
+}
+
+// ******************** Migrations ********************
+
+// schemaMigrations are the migrations of the schema in the order of their version. The first ones
+// only create what is missing, as DBs created before versioning was introduced have no version.
+var schemaMigrations = []Migration{
+	{Version: 1, Description: "create users and sessions", Migrate: func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&_UserModelV1{}, &_SessionModelV1{}).Error
+	}},
+	{Version: 2, Description: "create rooms and their members", Migrate: func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&_RoomModelV2{}, &_RoomMemberModelV2{}).Error
+	}},
+	{Version: 3, Description: "create conversations and messages", Migrate: func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&_ConversationModelV3{}, &_MessageModelV3{}).Error
+	}},
+	{Version: 4, Description: "create outbox", Migrate: func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&_OutboxModelV4{}).Error
+	}},
+	{Version: 5, Description: "create encryption settings", Migrate: func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&_EncryptionSettingsV5{}).Error
+	}},
+	{Version: 6, Description: "store the packet queued in the outbox", Migrate: func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&_OutboxModelV6{}).Error
+	}},
+}
+
+// getSchemaVersion returns the version of the latest migration applied to the DB
+func getSchemaVersion(db *gorm.DB) (uint, error) {
+	var version uint
+	err := db.Raw("SELECT coalesce(max(version), 0) FROM " + schemaVersionTableName).Row().Scan(&version)
+	return version, err
+}
+
+// GetSchemaVersion returns the version of the latest migration applied to the DB
+func GetSchemaVersion() uint {
+	version, err := getSchemaVersion(GetDB())
+	if err != nil {
+		log.Println(err)
+	}
+	return version
+}
+
+// GetLatestSchemaVersion returns the version of the latest migration known to this application
+func GetLatestSchemaVersion() uint {
+	return schemaMigrations[len(schemaMigrations)-1].Version
+}
+
+// runMigrations applies the migrations newer than the version of the DB, each in a transaction
+// recording its version along with its changes. It refuses to touch the DB if it has been migrated
+// to a version newer than the latest migration.
+func runMigrations(db *gorm.DB, migrations []Migration) error {
+	if err := db.AutoMigrate(&_SchemaVersion{}).Error; err != nil {
+		return err
+	}
+	currentVersion, err := getSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if latestVersion := migrations[len(migrations)-1].Version; currentVersion > latestVersion {
+		return fmt.Errorf(SchemaTooNewErrorFmt, currentVersion, latestVersion)
+	}
+	for _, migration := range migrations {
+		if migration.Version <= currentVersion {
+			continue
+		}
+		log.Println("Migrating schema to version", migration.Version, migration.Description)
+		tx := db.Begin()
+		err := migration.Migrate(tx)
+		if err == nil {
+			err = tx.Create(&_SchemaVersion{Version: migration.Version, Description: migration.Description,
+				AppliedAt: time.Now()}).Error
+		}
+		if err == nil {
+			err = tx.Commit().Error
+		} else {
+			tx.Rollback()
+		}
+		if err != nil {
+			return fmt.Errorf(MigrationFailedErrorFmt, migration.Version, migration.Description, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/imyousuf/lan-messenger/application/conf"
+	"github.com/imyousuf/lan-messenger/application/testutils"
+	"github.com/jinzhu/gorm"
+)
+
+type _MigrationTestModel struct {
+	ID   uint
+	Name string
+}
+
+func openTestDB(t *testing.T) (*gorm.DB, func()) {
+	directory, err := ioutil.TempDir("", "lamess-migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDB, err := gorm.Open("sqlite3", filepath.Join(directory, dbName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testDB, func() {
+		testDB.Close()
+		os.RemoveAll(directory)
+	}
+}
+
+func TestSchemaMigrations(t *testing.T) {
+	conf.SetupNewConfiguration(testutils.MockLoadFunc)
+	ReInitDBConnection()
+	if GetDBConnectionError() != nil || GetSchemaVersion() != GetLatestSchemaVersion() {
+		t.Error("DB should have been migrated to the latest version", GetDBConnectionError())
+	}
+	for index, migration := range schemaMigrations {
+		if migration.Version != uint(index+1) {
+			t.Error("Migrations should have been numbered in order", migration.Version)
+		}
+	}
+	testDB, closeTestDB := openTestDB(t)
+	defer closeTestDB()
+	// Tables created before versioning was introduced are adopted as is
+	testDB.AutoMigrate(&UserModel{}, &SessionModel{})
+	testDB.Exec("ALTER TABLE user_models DROP COLUMN public_key")
+	if err := runMigrations(testDB, schemaMigrations); err != nil {
+		t.Fatal("Unversioned DB should have been migrated", err)
+	}
+	if !testDB.Dialect().HasColumn("outbox_models", "packet") ||
+		!testDB.Dialect().HasColumn("user_models", "public_key") {
+		t.Error("Unversioned DB should have been brought up to date")
+	}
+	if err := runMigrations(testDB, schemaMigrations); err != nil {
+		t.Error("Migrating the latest version again should have been a no-op", err)
+	}
+}
+
+func TestRunMigrations(t *testing.T) {
+	testDB, closeTestDB := openTestDB(t)
+	defer closeTestDB()
+	migrations := []Migration{
+		{Version: 1, Description: "create table", Migrate: func(tx *gorm.DB) error {
+			return tx.CreateTable(&_MigrationTestModel{}).Error
+		}},
+		{Version: 2, Description: "backfill", Migrate: func(tx *gorm.DB) error {
+			tx.Create(&_MigrationTestModel{Name: "backfilled"})
+			return errors.New("backfill failed")
+		}},
+	}
+	err := runMigrations(testDB, migrations)
+	if err == nil || err.Error() != fmt.Sprintf(MigrationFailedErrorFmt, 2, "backfill", "backfill failed") {
+		t.Error("Failing migration should have been reported", err)
+	}
+	count := 0
+	testDB.Model(&_MigrationTestModel{}).Count(&count)
+	if version, _ := getSchemaVersion(testDB); version != 1 || count != 0 {
+		t.Error("Failing migration should have been rolled back", version, count)
+	}
+	migrations[1].Migrate = func(tx *gorm.DB) error {
+		return tx.Create(&_MigrationTestModel{Name: "backfilled"}).Error
+	}
+	if err := runMigrations(testDB, migrations); err != nil {
+		t.Error("Fixed migration should have been applied", err)
+	}
+	err = runMigrations(testDB, migrations[:1])
+	if err == nil || err.Error() != fmt.Sprintf(SchemaTooNewErrorFmt, 2, 1) {
+		t.Error("Newer schema than known should have been refused", err)
+	}
+}
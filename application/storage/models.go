@@ -12,6 +12,7 @@ type UserModel struct {
 	Username    string `gorm:"not null;unique"`
 	DisplayName string
 	Email       string `gorm:"not null;unique"`
+	PublicKey   []byte // Identity key the user was first seen with
 }
 
 // SessionModel represents a Session of a User
@@ -23,4 +24,55 @@ type SessionModel struct {
 	DevicePreferenceIndex   uint8
 	ExpiryTime              time.Time
 	ReplyToConnectionString string
+	PresenceState           string // Latest presence state announced by the session
+	StatusMessage           string // Latest status message announced by the session
+}
+
+// RoomModel represents a chat Room
+type RoomModel struct {
+	gorm.Model
+	RoomID string `gorm:"not null;unique"`
+	Name   string
+}
+
+// RoomMemberModel represents the membership of a User in a Room
+type RoomMemberModel struct {
+	gorm.Model
+	RoomModelID uint      `gorm:"unique_index:idx_room_member"` // Foreign Key to RoomModel
+	UserModelID uint      `gorm:"unique_index:idx_room_member"` // Foreign Key to UserModel
+	UserModel   UserModel // Convenient Method for load related user from model directly
+	Membership  uint8
+}
+
+// ConversationModel represents the conversation with a peer User or in a Room, only one of which is
+// set for a conversation
+type ConversationModel struct {
+	gorm.Model
+	PeerUserModelID uint `gorm:"unique_index:idx_conversation"` // Foreign Key to UserModel
+	RoomModelID     uint `gorm:"unique_index:idx_conversation"` // Foreign Key to RoomModel
+	LastMessageTime time.Time
+}
+
+// MessageModel represents a message sent or received in a Conversation
+type MessageModel struct {
+	gorm.Model
+	ConversationModelID uint   `gorm:"index"` // Foreign Key to ConversationModel
+	SenderUserModelID   uint   `gorm:"index"` // Foreign Key to UserModel
+	SessionID           string `gorm:"not null;unique_index:idx_message_packet"`
+	PacketID            uint64 `gorm:"unique_index:idx_message_packet"`
+	Outgoing            bool
+	ContentType         string
+	Body                string
+	SentTime            time.Time `gorm:"index"` // Time the message was sent at as per its sender
+}
+
+// OutboxModel represents a message queued for a User without any active session till it expires
+type OutboxModel struct {
+	gorm.Model
+	RecipientUserModelID uint   `gorm:"index"` // Foreign Key to UserModel
+	RoomID               string // Set for a post to a room
+	ContentType          string
+	Body                 string
+	ExpiryTime           time.Time
+	Packet               string // The MessagePacket queued, as saved to the history of the sender
 }
@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"time"
+)
+
+// DuplicateError is returned when saving a model violates a unique constraint
+type DuplicateError string
+
+func (err DuplicateError) Error() string {
+	return string(err)
+}
+
+// MessageFilter narrows down the messages found; zero valued fields are not applied
+type MessageFilter struct {
+	ConversationModelID uint
+	// PeerUserModelID filters the messages sent by the user or in the direct conversation with it
+	PeerUserModelID   uint
+	SenderUserModelID uint
+	From              time.Time // Messages sent at or after the time
+	To                time.Time // Messages sent before the time
+}
+
+// MessageSearch is the full-text search of the messages narrowed down by the filter
+type MessageSearch struct {
+	MessageFilter
+	Terms         []string // Terms every message matched contains
+	MatchStart    string   // Inserted before the terms matched in a snippet
+	MatchEnd      string   // Inserted after the terms matched in a snippet
+	Ellipsis      string   // Marks the text left out of a snippet
+	SnippetTokens int      // Maximum number of tokens in a snippet
+}
+
+// MessageSearchHit is a message matching the search with a snippet of its body
+type MessageSearchHit struct {
+	MessageModel
+	Snippet string
+	Rank    float64 // Rank of the hit, the lower the more relevant
+}
+
+// UserRepository persists UserModel
+type UserRepository interface {
+	CreateUser(userModel *UserModel) error
+	FindUserByID(id uint) (*UserModel, bool)
+	FindUserByUsername(username string) (*UserModel, bool)
+	UpdateUserPublicKey(userModel *UserModel, publicKey []byte) error
+}
+
+// SessionRepository persists SessionModel
+type SessionRepository interface {
+	// SaveSession creates or updates the session, returning DuplicateError if another session with
+	// the session ID exists
+	SaveSession(sessionModel *SessionModel) error
+	// FindSessionBySessionID finds the session along with the UserModel it belongs to
+	FindSessionBySessionID(sessionID string) (*SessionModel, bool)
+	FindSessionsByUser(userModelID uint) []*SessionModel
+	// UpdateSessionExpiryTime returns the number of sessions updated
+	UpdateSessionExpiryTime(sessionModel *SessionModel, expiryTime time.Time) int64
+	// UpdateSessionPresence returns the number of sessions updated
+	UpdateSessionPresence(sessionModel *SessionModel, presenceState string, statusMessage string) int64
+	// UpdateSessionReplyTo returns the number of sessions updated
+	UpdateSessionReplyTo(sessionModel *SessionModel, replyTo string) int64
+}
+
+// RoomRepository persists RoomModel and RoomMemberModel
+type RoomRepository interface {
+	CreateRoom(roomModel *RoomModel) error
+	FindRoomByID(id uint) (*RoomModel, bool)
+	FindRoomByRoomID(roomID string) (*RoomModel, bool)
+	FindRoomMember(roomModelID uint, userModelID uint) (*RoomMemberModel, bool)
+	SaveRoomMember(memberModel *RoomMemberModel) error
+	// FindRoomMembers finds the members in the membership along with their UserModel
+	FindRoomMembers(roomModelID uint, membership uint8) []*RoomMemberModel
+}
+
+// ConversationRepository persists ConversationModel
+type ConversationRepository interface {
+	CreateConversation(conversationModel *ConversationModel) error
+	FindConversation(peerUserModelID uint, roomModelID uint) (*ConversationModel, bool)
+	FindConversationByID(id uint) (*ConversationModel, bool)
+	// FindConversations finds the conversations, the one with the latest message first
+	FindConversations(limit int, offset int) []*ConversationModel
+	UpdateConversationLastMessageTime(conversationModel *ConversationModel, lastMessageTime time.Time) error
+}
+
+// MessageRepository persists MessageModel
+type MessageRepository interface {
+	CreateMessage(messageModel *MessageModel) error
+	FindMessageByPacket(sessionID string, packetID uint64) (*MessageModel, bool)
+	// FindMessages finds the messages matching the filter, the latest sent first
+	FindMessages(filter MessageFilter, limit int, offset int) []*MessageModel
+	CountMessages(filter MessageFilter) int
+	IsSearchAvailable() bool
+	// SearchMessages finds the messages matching the search, the most relevant first
+	SearchMessages(search MessageSearch, limit int, offset int) ([]*MessageSearchHit, error)
+}
+
+// OutboxRepository persists OutboxModel
+type OutboxRepository interface {
+	CreateOutboxEntry(outboxModel *OutboxModel) error
+	// DeleteOutboxEntry returns false if the entry was already deleted
+	DeleteOutboxEntry(outboxModel *OutboxModel) bool
+	DeleteExpiredOutboxEntries(recipientUserModelID uint, now time.Time)
+	// FindOutboxEntries finds the entries of the recipient, the oldest first
+	FindOutboxEntries(recipientUserModelID uint) []*OutboxModel
+}
+
+// Repository persists and retrieves the models of the application; the domain layer accesses
+// storage through it only. Finding a single model returns an empty model along with false when it
+// is not found.
+type Repository interface {
+	UserRepository
+	SessionRepository
+	RoomRepository
+	ConversationRepository
+	MessageRepository
+	OutboxRepository
+}
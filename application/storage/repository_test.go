@@ -0,0 +1,267 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/imyousuf/lan-messenger/application/conf"
+	"github.com/imyousuf/lan-messenger/application/testutils"
+)
+
+func newCleanGormRepository() Repository {
+	conf.SetupNewConfiguration(testutils.MockLoadFunc)
+	ReInitDBConnection()
+	for _, deleteSQL := range []string{testutils.DeleteUserModelsSQL, testutils.DeleteSessionModelsSQL,
+		testutils.DeleteRoomModelsSQL, testutils.DeleteRoomMemberModelsSQL,
+		testutils.DeleteConversationModelsSQL, testutils.DeleteMessageModelsSQL,
+		testutils.DeleteOutboxModelsSQL} {
+		GetDB().Exec(deleteSQL)
+	}
+	return NewGormRepository()
+}
+
+// forEachRepository runs the test against an empty repository of every implementation, as they are
+// expected to behave the same
+func forEachRepository(t *testing.T, test func(t *testing.T, repo Repository)) {
+	t.Run("gorm", func(t *testing.T) {
+		test(t, newCleanGormRepository())
+	})
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemoryRepository())
+	})
+}
+
+func createTestUser(t *testing.T, repo Repository, username string) *UserModel {
+	userModel := &UserModel{Username: username, DisplayName: username, Email: username + "@email.co"}
+	if err := repo.CreateUser(userModel); err != nil || userModel.ID == 0 {
+		t.Fatal("User should have been created", err)
+	}
+	return userModel
+}
+
+func createTestMessage(t *testing.T, repo Repository, conversationModel *ConversationModel,
+	sender *UserModel, packetID uint64, body string, sentTime time.Time) *MessageModel {
+	messageModel := &MessageModel{ConversationModelID: conversationModel.ID, SenderUserModelID: sender.ID,
+		SessionID: "S1", PacketID: packetID, ContentType: "text/plain", Body: body, SentTime: sentTime}
+	if err := repo.CreateMessage(messageModel); err != nil {
+		t.Fatal("Message should have been created", err)
+	}
+	return messageModel
+}
+
+func TestRepository_Users(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo Repository) {
+		userModel := createTestUser(t, repo, "a")
+		if err := repo.CreateUser(&UserModel{Username: "a", Email: "other@email.co"}); err == nil {
+			t.Error("User with the same username should not have been created")
+		}
+		if found, ok := repo.FindUserByUsername("a"); !ok || found.ID != userModel.ID {
+			t.Error("User should have been found by username")
+		}
+		if found, ok := repo.FindUserByUsername("b"); ok || found == nil || found.ID != 0 {
+			t.Error("Unknown user should not have been found")
+		}
+		if err := repo.UpdateUserPublicKey(userModel, []byte("key")); err != nil {
+			t.Error("Public key should have been updated", err)
+		}
+		if found, ok := repo.FindUserByID(userModel.ID); !ok || string(found.PublicKey) != "key" {
+			t.Error("User should have been found by ID with its public key")
+		}
+	})
+}
+
+func TestRepository_Sessions(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo Repository) {
+		userModel := createTestUser(t, repo, "a")
+		sessionModel := &SessionModel{UserModelID: userModel.ID, SessionID: "S1",
+			ExpiryTime: time.Now().Add(time.Minute)}
+		if err := repo.SaveSession(sessionModel); err != nil || sessionModel.ID == 0 {
+			t.Fatal("Session should have been saved", err)
+		}
+		err := repo.SaveSession(&SessionModel{UserModelID: userModel.ID, SessionID: "S1"})
+		if _, duplicate := err.(DuplicateError); !duplicate {
+			t.Error("Session with the same session ID should have been a duplicate", err)
+		}
+		repo.SaveSession(&SessionModel{UserModelID: userModel.ID, SessionID: "S2"})
+		found, ok := repo.FindSessionBySessionID("S1")
+		if !ok || found.ID != sessionModel.ID || found.UserModel.Username != "a" {
+			t.Error("Session should have been found along with its user")
+		}
+		if sessions := repo.FindSessionsByUser(userModel.ID); len(sessions) != 2 {
+			t.Error("Sessions of the user should have been found", len(sessions))
+		}
+		expiryTime := time.Now().Add(time.Hour)
+		if repo.UpdateSessionExpiryTime(sessionModel, expiryTime) != 1 ||
+			repo.UpdateSessionPresence(sessionModel, "away", "Lunch") != 1 ||
+			repo.UpdateSessionReplyTo(sessionModel, "[fd00::2]:30000") != 1 {
+			t.Error("Session should have been updated")
+		}
+		if found, _ = repo.FindSessionBySessionID("S1"); !found.ExpiryTime.Equal(expiryTime) ||
+			found.PresenceState != "away" || found.StatusMessage != "Lunch" ||
+			found.ReplyToConnectionString != "[fd00::2]:30000" {
+			t.Error("Updates of the session should have been found")
+		}
+		if repo.UpdateSessionExpiryTime(&SessionModel{}, expiryTime) != 0 {
+			t.Error("Session not saved should not have been updated")
+		}
+	})
+}
+
+func TestRepository_Rooms(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo Repository) {
+		userModel := createTestUser(t, repo, "a")
+		roomModel := &RoomModel{RoomID: "R1", Name: "Team"}
+		if err := repo.CreateRoom(roomModel); err != nil {
+			t.Fatal("Room should have been created", err)
+		}
+		if found, ok := repo.FindRoomByRoomID("R1"); !ok || found.ID != roomModel.ID {
+			t.Error("Room should have been found by room ID")
+		}
+		if found, ok := repo.FindRoomByID(roomModel.ID); !ok || found.Name != "Team" {
+			t.Error("Room should have been found by ID")
+		}
+		memberModel, found := repo.FindRoomMember(roomModel.ID, userModel.ID)
+		if found {
+			t.Error("User should not have been a member yet")
+		}
+		memberModel.RoomModelID, memberModel.UserModelID, memberModel.Membership = roomModel.ID, userModel.ID, 1
+		repo.SaveRoomMember(memberModel)
+		memberModel.Membership = 2
+		if err := repo.SaveRoomMember(memberModel); err != nil {
+			t.Error("Membership should have been updated", err)
+		}
+		if members := repo.FindRoomMembers(roomModel.ID, 1); len(members) != 0 {
+			t.Error("Membership should have been replaced")
+		}
+		if members := repo.FindRoomMembers(roomModel.ID, 2); len(members) != 1 ||
+			members[0].UserModel.Username != "a" {
+			t.Error("Members should have been found along with their user")
+		}
+	})
+}
+
+func TestRepository_Messages(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo Repository) {
+		self, peer := createTestUser(t, repo, "a"), createTestUser(t, repo, "b")
+		direct := &ConversationModel{PeerUserModelID: peer.ID}
+		room := &ConversationModel{RoomModelID: 1}
+		repo.CreateConversation(direct)
+		repo.CreateConversation(room)
+		if found, ok := repo.FindConversation(peer.ID, 0); !ok || found.ID != direct.ID {
+			t.Error("Direct conversation should have been found")
+		}
+		start := time.Now().Add(-time.Hour)
+		for index := 0; index < 4; index++ {
+			createTestMessage(t, repo, direct, self, uint64(index), "Hi", start.Add(time.Duration(index)*time.Minute))
+		}
+		createTestMessage(t, repo, room, peer, 4, "Hi", start.Add(10*time.Minute))
+		duplicate := &MessageModel{ConversationModelID: direct.ID, SessionID: "S1", PacketID: 1}
+		if repo.CreateMessage(duplicate) == nil {
+			t.Error("Message of the same packet should not have been created again")
+		}
+		if found, ok := repo.FindMessageByPacket("S1", 2); !ok || !found.SentTime.Equal(start.Add(2*time.Minute)) {
+			t.Error("Message should have been found by packet")
+		}
+		if count := repo.CountMessages(MessageFilter{PeerUserModelID: peer.ID}); count != 5 {
+			t.Error("Messages sent by or in the conversation with the peer should have been counted", count)
+		}
+		if count := repo.CountMessages(MessageFilter{ConversationModelID: direct.ID, From: start.Add(time.Minute),
+			To: start.Add(3 * time.Minute)}); count != 2 {
+			t.Error("Messages in the time range should have been counted", count)
+		}
+		messages := repo.FindMessages(MessageFilter{SenderUserModelID: self.ID}, 3, 1)
+		if len(messages) != 3 || messages[0].PacketID != 2 || messages[2].PacketID != 0 {
+			t.Error("Messages should have been paginated latest first", len(messages))
+		}
+		repo.UpdateConversationLastMessageTime(direct, start)
+		repo.UpdateConversationLastMessageTime(room, start.Add(time.Minute))
+		if conversations := repo.FindConversations(10, 0); len(conversations) != 2 ||
+			conversations[0].ID != room.ID {
+			t.Error("Conversations should have been found latest message first")
+		}
+		if conversations := repo.FindConversations(10, 1); len(conversations) != 1 {
+			t.Error("Conversations should have been paginated")
+		}
+	})
+}
+
+func TestRepository_SearchMessages(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo Repository) {
+		if !repo.IsSearchAvailable() {
+			t.Skip("SQLite is built without FTS5")
+		}
+		self, peer := createTestUser(t, repo, "a"), createTestUser(t, repo, "b")
+		conversationModel := &ConversationModel{PeerUserModelID: peer.ID}
+		repo.CreateConversation(conversationModel)
+		createTestMessage(t, repo, conversationModel, peer, 1, "Shall we go for lunch today?", time.Now())
+		createTestMessage(t, repo, conversationModel, self, 2, "Lunch sounds good, lunch at noon", time.Now())
+		createTestMessage(t, repo, conversationModel, peer, 3, "See you there", time.Now())
+		search := MessageSearch{Terms: []string{"lunch"}, MatchStart: "<", MatchEnd: ">", Ellipsis: "...",
+			SnippetTokens: 4}
+		hits, err := repo.SearchMessages(search, 10, 0)
+		if err != nil || len(hits) != 2 {
+			t.Fatal("Messages containing the term should have been found", err, len(hits))
+		}
+		if hits[0].PacketID != 2 || hits[0].Rank > hits[1].Rank || !strings.Contains(hits[0].Snippet, "<lunch>") ||
+			!strings.HasSuffix(hits[0].Snippet, "...") {
+			t.Error("Hits should have been ranked with the match highlighted", hits[0].Snippet)
+		}
+		search.SenderUserModelID = peer.ID
+		if hits, _ = repo.SearchMessages(search, 10, 0); len(hits) != 1 || hits[0].PacketID != 1 {
+			t.Error("Hits should have been filtered")
+		}
+		search.SenderUserModelID, search.Terms = 0, []string{"lunch", "today"}
+		if hits, _ = repo.SearchMessages(search, 10, 0); len(hits) != 1 {
+			t.Error("Hits should have contained every term")
+		}
+	})
+}
+
+func TestGormRepository_searchIndex(t *testing.T) {
+	repo := newCleanGormRepository()
+	if !repo.IsSearchAvailable() {
+		t.Skip("SQLite is built without FTS5")
+	}
+	userModel := createTestUser(t, repo, "a")
+	conversationModel := &ConversationModel{PeerUserModelID: userModel.ID}
+	repo.CreateConversation(conversationModel)
+	messageModel := createTestMessage(t, repo, conversationModel, userModel, 1, "lunch", time.Now())
+	search := MessageSearch{Terms: []string{"lunch"}}
+	GetDB().Model(messageModel).Update("body", "dinner")
+	if hits, _ := repo.SearchMessages(search, 10, 0); len(hits) != 0 {
+		t.Error("Index should have been updated along with the message")
+	}
+	GetDB().Exec(testutils.DeleteMessageModelsSQL)
+	if hits, _ := repo.SearchMessages(MessageSearch{Terms: []string{"dinner"}}, 10, 0); len(hits) != 0 {
+		t.Error("Index should have been maintained along with the messages")
+	}
+}
+
+func TestRepository_Outbox(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo Repository) {
+		userModel := createTestUser(t, repo, "a")
+		now := time.Now()
+		expired := &OutboxModel{RecipientUserModelID: userModel.ID, Body: "Stale", ExpiryTime: now}
+		first := &OutboxModel{RecipientUserModelID: userModel.ID, Body: "1", ExpiryTime: now.Add(time.Minute),
+			Packet: `{"Body":"1"}`}
+		second := &OutboxModel{RecipientUserModelID: userModel.ID, Body: "2", ExpiryTime: now.Add(time.Minute)}
+		for _, outboxModel := range []*OutboxModel{expired, first, second} {
+			if err := repo.CreateOutboxEntry(outboxModel); err != nil {
+				t.Fatal("Outbox entry should have been created", err)
+			}
+		}
+		repo.DeleteExpiredOutboxEntries(userModel.ID, now)
+		entries := repo.FindOutboxEntries(userModel.ID)
+		if len(entries) != 2 || entries[0].Body != "1" || entries[0].Packet != `{"Body":"1"}` ||
+			entries[1].Body != "2" {
+			t.Fatal("Entries not expired should have been found oldest first", len(entries))
+		}
+		if !repo.DeleteOutboxEntry(entries[0]) || repo.DeleteOutboxEntry(entries[0]) {
+			t.Error("Entry should have been deleted only once")
+		}
+		if entries = repo.FindOutboxEntries(userModel.ID); len(entries) != 1 {
+			t.Error("Deleted entry should not have been found")
+		}
+	})
+}
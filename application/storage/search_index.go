@@ -0,0 +1,272 @@
+package storage
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+	"unicode"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// MessageSearchTableName is the FTS5 table indexing the body of the rows of MessageModel
+	MessageSearchTableName       = "message_search"
+	searchIndexInsertTriggerName = "message_search_insert"
+	searchIndexDeleteTriggerName = "message_search_delete"
+	searchIndexUpdateTriggerName = "message_search_update"
+	// blindSearchTableName is the FTS5 table indexing the blinded words of the body of the rows of
+	// MessageModel in an encrypted DB
+	blindSearchTableName              = "message_blind_search"
+	blindSearchIndexDeleteTriggerName = "message_blind_search_delete"
+)
+
+var (
+	searchIndexStatements = []string{
+		`CREATE VIRTUAL TABLE IF NOT EXISTS message_search USING fts5(body, content='message_models',
+			content_rowid='id')`,
+		`CREATE TRIGGER IF NOT EXISTS message_search_insert AFTER INSERT ON message_models BEGIN
+			INSERT INTO message_search(rowid, body) VALUES (new.id, new.body);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS message_search_delete AFTER DELETE ON message_models BEGIN
+			INSERT INTO message_search(message_search, rowid, body) VALUES ('delete', old.id, old.body);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS message_search_update AFTER UPDATE OF body ON message_models BEGIN
+			INSERT INTO message_search(message_search, rowid, body) VALUES ('delete', old.id, old.body);
+			INSERT INTO message_search(rowid, body) VALUES (new.id, new.body);
+		END`,
+	}
+	blindSearchIndexStatements = []string{
+		`CREATE VIRTUAL TABLE IF NOT EXISTS message_blind_search USING fts5(body)`,
+		`CREATE TRIGGER IF NOT EXISTS message_blind_search_delete AFTER DELETE ON message_models BEGIN
+			DELETE FROM message_blind_search WHERE rowid = old.id;
+		END`,
+	}
+	searchIndexAvailable = false
+)
+
+// isFTS5Enabled checks if SQLite is built with FTS5, i.e. with the fts5 tag
+func isFTS5Enabled(db *gorm.DB) bool {
+	fts5Enabled := false
+	db.Raw("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Row().Scan(&fts5Enabled)
+	return fts5Enabled
+}
+
+// setupSearchIndex creates the full-text index of messages and the triggers maintaining it along
+// with the message rows. The index is rebuilt whenever the triggers are created, as messages saved
+// without them are not indexed. It returns false if SQLite is built without FTS5, i.e. without the
+// fts5 tag, in which case the triggers are dropped so that messages can still be saved.
+func setupSearchIndex(db *gorm.DB) bool {
+	triggerCount := 0
+	db.Raw("SELECT count(*) FROM sqlite_master WHERE type = 'trigger' AND name = ?",
+		searchIndexInsertTriggerName).Row().Scan(&triggerCount)
+	fts5Enabled := isFTS5Enabled(db)
+	var err error
+	for index := 0; fts5Enabled && err == nil && index < len(searchIndexStatements); index++ {
+		err = db.Exec(searchIndexStatements[index]).Error
+	}
+	if !fts5Enabled || err != nil {
+		log.Println("Full-text search not available:", err)
+		dropSearchIndexTriggers(db)
+		return false
+	}
+	if triggerCount == 0 {
+		db.Exec("INSERT INTO message_search(message_search) VALUES ('rebuild')")
+	}
+	return true
+}
+
+func dropSearchIndexTriggers(db *gorm.DB) {
+	for _, triggerName := range []string{searchIndexInsertTriggerName, searchIndexDeleteTriggerName,
+		searchIndexUpdateTriggerName} {
+		db.Exec("DROP TRIGGER IF EXISTS " + triggerName)
+	}
+}
+
+// dropSearchIndex drops the full-text index of messages along with the triggers maintaining it
+func dropSearchIndex(db *gorm.DB) {
+	dropSearchIndexTriggers(db)
+	if err := db.Exec("DROP TABLE IF EXISTS " + MessageSearchTableName).Error; err != nil {
+		log.Println("Full-text index could not be dropped:", err)
+	}
+}
+
+// setupBlindSearchIndex creates the blind index of messages of an encrypted DB, which indexes the
+// keyed hashes of the words of the bodies instead of the words. Messages are indexed as they are
+// saved, so the index is rebuilt whenever it does not index every message, e.g. when messages were
+// saved without FTS5. Deleting messages is left to a trigger, which is dropped without FTS5.
+func setupBlindSearchIndex(db *gorm.DB, aCipher *_ColumnCipher) bool {
+	var err error
+	fts5Enabled := isFTS5Enabled(db)
+	for index := 0; fts5Enabled && err == nil && index < len(blindSearchIndexStatements); index++ {
+		err = db.Exec(blindSearchIndexStatements[index]).Error
+	}
+	indexedCount, messageCount, missingCount := 0, 0, 0
+	if fts5Enabled && err == nil {
+		err = db.Raw("SELECT count(*), (SELECT count(*) FROM message_models), (SELECT count(*) FROM "+
+			"message_models WHERE id NOT IN (SELECT rowid FROM message_blind_search)) FROM message_blind_search").
+			Row().Scan(&indexedCount, &messageCount, &missingCount)
+	}
+	if fts5Enabled && err == nil && (indexedCount != messageCount || missingCount > 0) {
+		err = rebuildBlindSearchIndex(db, aCipher)
+	}
+	if !fts5Enabled || err != nil {
+		log.Println("Full-text search not available:", err)
+		db.Exec("DROP TRIGGER IF EXISTS " + blindSearchIndexDeleteTriggerName)
+		return false
+	}
+	return true
+}
+
+// blindText returns the keyed hashes of the words of the text, in the order of the words
+func blindText(aCipher *_ColumnCipher, text string) string {
+	tokens := tokenize(text)
+	blindWords := make([]string, len(tokens))
+	for index, token := range tokens {
+		blindWords[index] = aCipher.blindWord(token.word)
+	}
+	return strings.Join(blindWords, " ")
+}
+
+// indexBlindly adds the body of the message to the blind index
+func indexBlindly(db *gorm.DB, aCipher *_ColumnCipher, messageModelID uint, body string) error {
+	return db.Exec("INSERT INTO "+blindSearchTableName+"(rowid, body) VALUES (?, ?)", messageModelID,
+		blindText(aCipher, body)).Error
+}
+
+// rebuildBlindSearchIndex indexes the decrypted body of every message in a transaction
+func rebuildBlindSearchIndex(db *gorm.DB, aCipher *_ColumnCipher) error {
+	log.Println("Rebuilding blind search index")
+	tx := db.Begin()
+	err := tx.Exec("DELETE FROM " + blindSearchTableName).Error
+	var rows *sql.Rows
+	if err == nil {
+		rows, err = tx.Raw("SELECT id, body FROM message_models").Rows()
+	}
+	bodies := make(map[uint]string)
+	for err == nil && rows.Next() {
+		var id uint
+		var body string
+		if err = rows.Scan(&id, &body); err == nil {
+			bodies[id] = body
+		}
+	}
+	if rows != nil {
+		rows.Close()
+	}
+	for id, body := range bodies {
+		if err != nil {
+			break
+		}
+		if isEncrypted([]byte(body)) {
+			var plaintext []byte
+			if plaintext, err = aCipher.decrypt(body); err != nil {
+				break
+			}
+			body = string(plaintext)
+		}
+		err = indexBlindly(tx, aCipher, id, body)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// dropBlindSearchIndex drops the blind index of messages along with the trigger maintaining it
+func dropBlindSearchIndex(db *gorm.DB) {
+	db.Exec("DROP TRIGGER IF EXISTS " + blindSearchIndexDeleteTriggerName)
+	if err := db.Exec("DROP TABLE IF EXISTS " + blindSearchTableName).Error; err != nil {
+		log.Println("Blind search index could not be dropped:", err)
+	}
+}
+
+// setupMessageSearch sets up the index messages are searched with, which is the full-text index of
+// the bodies in a DB not encrypted and the blind index in an encrypted one. As the blind index
+// reveals which messages share words, it can be disabled, leaving search unavailable while the DB
+// is encrypted.
+func setupMessageSearch(db *gorm.DB, aCipher *_ColumnCipher, blindSearch bool) bool {
+	if aCipher == nil {
+		dropBlindSearchIndex(db)
+		return setupSearchIndex(db)
+	}
+	if !blindSearch {
+		log.Println("Full-text search not available: blind search of the encrypted DB is disabled")
+		dropBlindSearchIndex(db)
+		return false
+	}
+	return setupBlindSearchIndex(db, aCipher)
+}
+
+// isBlindlyIndexed checks if messages are to be added to the blind index as they are saved
+func isBlindlyIndexed() bool {
+	return searchIndexAvailable && columnCipher != nil
+}
+
+// _Token is a word of a text, i.e. a run of letters and digits, located by its byte offsets
+type _Token struct {
+	word       string
+	start, end int
+}
+
+func tokenize(text string) []_Token {
+	tokens := []_Token{}
+	start := -1
+	for index, char := range text + " " {
+		isWordChar := unicode.IsLetter(char) || unicode.IsDigit(char)
+		if isWordChar && start < 0 {
+			start = index
+		} else if !isWordChar && start >= 0 {
+			tokens = append(tokens, _Token{word: strings.ToLower(text[start:index]), start: start, end: index})
+			start = -1
+		}
+	}
+	return tokens
+}
+
+// snippet highlights the matched tokens of the body in the window of tokens starting at the first
+// match
+func snippet(search MessageSearch, body string, tokens []_Token, matched []bool) string {
+	first := 0
+	for first < len(matched) && !matched[first] {
+		first++
+	}
+	size := search.SnippetTokens
+	if size <= 0 || size > len(tokens) {
+		size = len(tokens)
+	}
+	start := first
+	if start+size > len(tokens) {
+		start = len(tokens) - size
+	}
+	end := start + size
+	result := []string{}
+	position := tokens[start].start
+	if start > 0 {
+		result = append(result, search.Ellipsis)
+	} else {
+		position = 0
+	}
+	for index := start; index < end; index++ {
+		token := tokens[index]
+		result = append(result, body[position:token.start])
+		if matched[index] {
+			result = append(result, search.MatchStart, body[token.start:token.end], search.MatchEnd)
+		} else {
+			result = append(result, body[token.start:token.end])
+		}
+		position = token.end
+	}
+	if end < len(tokens) {
+		result = append(result, search.Ellipsis)
+	} else {
+		result = append(result, body[position:])
+	}
+	return strings.Join(result, "")
+}
+
+// IsSearchIndexAvailable checks if the full-text index of messages is available
+func IsSearchIndexAvailable() bool {
+	return openDBConnection() && searchIndexAvailable
+}
@@ -41,6 +41,16 @@ const (
 	DeleteUserModelsSQL = "DELETE FROM user_models"
 	// DeleteSessionModelsSQL - The SQL for deleting all session
 	DeleteSessionModelsSQL = "DELETE FROM session_models"
+	// DeleteRoomModelsSQL - The SQL for deleting all room model rows
+	DeleteRoomModelsSQL = "DELETE FROM room_models"
+	// DeleteRoomMemberModelsSQL - The SQL for deleting all room member model rows
+	DeleteRoomMemberModelsSQL = "DELETE FROM room_member_models"
+	// DeleteConversationModelsSQL - The SQL for deleting all conversation model rows
+	DeleteConversationModelsSQL = "DELETE FROM conversation_models"
+	// DeleteMessageModelsSQL - The SQL for deleting all message model rows
+	DeleteMessageModelsSQL = "DELETE FROM message_models"
+	// DeleteOutboxModelsSQL - The SQL for deleting all outbox model rows
+	DeleteOutboxModelsSQL = "DELETE FROM outbox_models"
 )
 
 // MockLoadFunc for a test load func
@@ -0,0 +1,79 @@
+package identity
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	cipherKeyInfo = "LAMESS X25519 XCHACHA20-POLY1305"
+	// InvalidCiphertextErrorMsg is returned when a ciphertext can not be opened, either because it
+	// was tampered with or because it was not sealed for this pair of agreement keys
+	InvalidCiphertextErrorMsg = "ciphertext could not be opened"
+)
+
+// Cipher seals and opens data exchanged with a single peer; the key is agreed upon from the
+// agreement keys of both ends so only the two of them can open what either of them seals
+type Cipher interface {
+	Seal(plaintext []byte, additionalData []byte) ([]byte, error)
+	Open(ciphertext []byte, additionalData []byte) ([]byte, error)
+}
+
+type _Cipher struct {
+	aead cipher.AEAD
+}
+
+// Seal encrypts and authenticates the plaintext along with the additional data, prefixing the
+// random nonce used to the ciphertext returned
+func (aCipher _Cipher) Seal(plaintext []byte, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aCipher.aead.NonceSize(), aCipher.aead.NonceSize()+len(plaintext)+
+		aCipher.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aCipher.aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func (aCipher _Cipher) Open(ciphertext []byte, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < aCipher.aead.NonceSize() {
+		return nil, errors.New(InvalidCiphertextErrorMsg)
+	}
+	nonce, sealed := ciphertext[:aCipher.aead.NonceSize()], ciphertext[aCipher.aead.NonceSize():]
+	plaintext, err := aCipher.aead.Open(nil, nonce, sealed, additionalData)
+	if err != nil {
+		return nil, errors.New(InvalidCiphertextErrorMsg)
+	}
+	return plaintext, nil
+}
+
+// newCipher derives the key from the X25519 shared secret using HKDF, binding both public keys
+// in a fixed order so that both peers derive the same key
+func newCipher(agreementKey []byte, selfAgreementKey []byte, peerAgreementKey []byte) (Cipher, error) {
+	sharedSecret, err := curve25519.X25519(agreementKey, peerAgreementKey)
+	if err != nil {
+		return nil, err
+	}
+	info := []byte(cipherKeyInfo)
+	if bytes.Compare(selfAgreementKey, peerAgreementKey) < 0 {
+		info = append(append(info, selfAgreementKey...), peerAgreementKey...)
+	} else {
+		info = append(append(info, peerAgreementKey...), selfAgreementKey...)
+	}
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, sharedSecret, nil, info), key); err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	return _Cipher{aead: aead}, nil
+}
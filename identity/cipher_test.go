@@ -0,0 +1,48 @@
+package identity
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCipherSealAndOpen(t *testing.T) {
+	id, _ := NewIdentity()
+	peerID, _ := NewIdentity()
+	aCipher, err := id.NewCipher(peerID.GetAgreementKey())
+	if err != nil {
+		t.Fatal("Could not agree upon cipher", err)
+	}
+	peerCipher, _ := peerID.NewCipher(id.GetAgreementKey())
+	plaintext, additionalData := []byte("Hi"), []byte("S1\n1")
+	ciphertext, err := aCipher.Seal(plaintext, additionalData)
+	if err != nil || bytes.Contains(ciphertext, plaintext) {
+		t.Fatal("Plaintext should have been sealed", err)
+	}
+	if opened, err := peerCipher.Open(ciphertext, additionalData); err != nil ||
+		!bytes.Equal(opened, plaintext) {
+		t.Error("Peer should have opened the ciphertext", err)
+	}
+	if otherCiphertext, _ := aCipher.Seal(plaintext, additionalData); bytes.Equal(ciphertext, otherCiphertext) {
+		t.Error("Each seal should use a different nonce")
+	}
+	if _, err := peerCipher.Open(ciphertext, []byte("S1\n2")); err == nil ||
+		err.Error() != InvalidCiphertextErrorMsg {
+		t.Error("Ciphertext should not have been opened with different additional data", err)
+	}
+	tampered := append([]byte{}, ciphertext...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := peerCipher.Open(tampered, additionalData); err == nil {
+		t.Error("Tampered ciphertext should not have been opened")
+	}
+	if _, err := peerCipher.Open(ciphertext[:3], additionalData); err == nil {
+		t.Error("Truncated ciphertext should not have been opened")
+	}
+	otherID, _ := NewIdentity()
+	otherCipher, _ := otherID.NewCipher(id.GetAgreementKey())
+	if _, err := otherCipher.Open(ciphertext, additionalData); err == nil {
+		t.Error("Ciphertext should not have been opened by a third party")
+	}
+	if _, err := id.NewCipher(make([]byte, 32)); err == nil {
+		t.Error("Low order agreement key should have been rejected")
+	}
+}
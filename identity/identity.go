@@ -0,0 +1,241 @@
+package identity
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// KeyFileName is the name of the file in the storage location holding the identity keys
+	KeyFileName         = "identity.key"
+	signingKeyPEMType   = "LAMESS ED25519 PRIVATE KEY"
+	agreementKeyPEMType = "LAMESS X25519 PRIVATE KEY"
+	wrappedKeysPEMType  = "LAMESS ENCRYPTED IDENTITY KEYS"
+	saltPEMHeader       = "Salt"
+	wrappingSaltSize    = 16
+	// scrypt parameters recommended for interactive use
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+	// InvalidKeyFileErrorMsg is returned when the identity key file can not be parsed
+	InvalidKeyFileErrorMsg = "identity key file is not valid"
+	// WrappedKeyFileErrorMsg is returned when the identity key file is encrypted but no secret is
+	// given to decrypt it with
+	WrappedKeyFileErrorMsg = "identity key file is encrypted but no passphrase or key file is configured"
+	// KeyFileSecretMismatchErrorMsg is returned when the identity key file is not encrypted with the
+	// secret given
+	KeyFileSecretMismatchErrorMsg = "passphrase or key file does not match the one the identity key file is " +
+		"encrypted with"
+)
+
+// Identity represents the long-term key pairs of this installation; the signing key pair is used
+// to sign every packet sent so that peers can tell it apart from others claiming to be the same
+// user and the agreement key pair is used to agree upon the Cipher with a peer
+type Identity interface {
+	GetPublicKey() []byte
+	Sign(data []byte) []byte
+	GetAgreementKey() []byte
+	NewCipher(peerAgreementKey []byte) (Cipher, error)
+}
+
+type _Identity struct {
+	privateKey   ed25519.PrivateKey
+	agreementKey []byte
+}
+
+func (id _Identity) GetPublicKey() []byte {
+	return []byte(id.privateKey.Public().(ed25519.PublicKey))
+}
+
+func (id _Identity) Sign(data []byte) []byte {
+	return ed25519.Sign(id.privateKey, data)
+}
+
+func (id _Identity) GetAgreementKey() []byte {
+	publicKey, _ := curve25519.X25519(id.agreementKey, curve25519.Basepoint)
+	return publicKey
+}
+
+func (id _Identity) NewCipher(peerAgreementKey []byte) (Cipher, error) {
+	return newCipher(id.agreementKey, id.GetAgreementKey(), peerAgreementKey)
+}
+
+// Verify checks whether the signature of the data is by the owner of the public key
+func Verify(publicKey []byte, data []byte, signature []byte) bool {
+	if len(publicKey) != ed25519.PublicKeySize || len(signature) != ed25519.SignatureSize {
+		return false
+	}
+	return ed25519.Verify(ed25519.PublicKey(publicKey), data, signature)
+}
+
+func newAgreementKey() ([]byte, error) {
+	agreementKey := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(agreementKey); err != nil {
+		return nil, err
+	}
+	return agreementKey, nil
+}
+
+// NewIdentity generates a new Identity which is not persisted
+func NewIdentity() (Identity, error) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	agreementKey, err := newAgreementKey()
+	if err != nil {
+		return nil, err
+	}
+	return _Identity{privateKey: privateKey, agreementKey: agreementKey}, nil
+}
+
+func newWrappingCipher(secret []byte, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(secret, salt, scryptN, scryptR, scryptP, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.NewX(key)
+}
+
+// wrapKeys encrypts the content of the key file with a key derived from the secret into a PEM block
+// holding the salt of the key
+func wrapKeys(keyFileContent []byte, secret []byte) ([]byte, error) {
+	salt := make([]byte, wrappingSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := newWrappingCipher(secret, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(keyFileContent)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: wrappedKeysPEMType,
+		Headers: map[string]string{saltPEMHeader: base64.StdEncoding.EncodeToString(salt)},
+		Bytes:   aead.Seal(nonce, nonce, keyFileContent, []byte(wrappedKeysPEMType))}), nil
+}
+
+// unwrapKeys decrypts the content of the key file wrapped by wrapKeys with the secret; the content
+// is checked to be well formed even when there is no secret to decrypt it with
+func unwrapKeys(block *pem.Block, secret []byte) ([]byte, error) {
+	salt, err := base64.StdEncoding.DecodeString(block.Headers[saltPEMHeader])
+	if err != nil || len(salt) != wrappingSaltSize ||
+		len(block.Bytes) < chacha20poly1305.NonceSizeX+chacha20poly1305.Overhead {
+		return nil, errors.New(InvalidKeyFileErrorMsg)
+	}
+	if secret == nil {
+		return nil, errors.New(WrappedKeyFileErrorMsg)
+	}
+	aead, err := newWrappingCipher(secret, salt)
+	if err != nil {
+		return nil, err
+	}
+	keyFileContent, err := aead.Open(nil, block.Bytes[:aead.NonceSize()], block.Bytes[aead.NonceSize():],
+		[]byte(wrappedKeysPEMType))
+	if err != nil {
+		return nil, errors.New(KeyFileSecretMismatchErrorMsg)
+	}
+	return keyFileContent, nil
+}
+
+// loadIdentity parses the key file, decrypting it with the secret if it is encrypted. Key files
+// stored before agreement keys were introduced only have the signing key, so an agreement key is
+// generated and stored for them, and key files not encrypted yet are stored encrypted if a secret
+// is given.
+func loadIdentity(keyFilePath string, secret []byte) (Identity, error) {
+	keyFileContent, err := ioutil.ReadFile(keyFilePath)
+	if err != nil {
+		return nil, err
+	}
+	block, rest := pem.Decode(keyFileContent)
+	wrapped := block != nil && block.Type == wrappedKeysPEMType
+	if wrapped {
+		if keyFileContent, err = unwrapKeys(block, secret); err != nil {
+			return nil, err
+		}
+		block, rest = pem.Decode(keyFileContent)
+	}
+	if block == nil || block.Type != signingKeyPEMType || len(block.Bytes) != ed25519.SeedSize {
+		return nil, errors.New(InvalidKeyFileErrorMsg)
+	}
+	id := _Identity{privateKey: ed25519.NewKeyFromSeed(block.Bytes)}
+	if block, _ = pem.Decode(rest); block == nil {
+		if id.agreementKey, err = newAgreementKey(); err != nil {
+			return nil, err
+		}
+		return id, storeIdentity(keyFilePath, id, secret)
+	}
+	if block.Type != agreementKeyPEMType || len(block.Bytes) != curve25519.ScalarSize {
+		return nil, errors.New(InvalidKeyFileErrorMsg)
+	}
+	id.agreementKey = block.Bytes
+	if !wrapped && secret != nil {
+		return id, storeIdentity(keyFilePath, id, secret)
+	}
+	return id, nil
+}
+
+// storeIdentity writes the key file, encrypted with a key derived from the secret unless it is nil.
+// The key file is either left as it was or replaced as a whole.
+func storeIdentity(keyFilePath string, id _Identity, secret []byte) error {
+	keyFileContent := pem.EncodeToMemory(&pem.Block{Type: signingKeyPEMType,
+		Bytes: id.privateKey.Seed()})
+	keyFileContent = append(keyFileContent, pem.EncodeToMemory(&pem.Block{Type: agreementKeyPEMType,
+		Bytes: id.agreementKey})...)
+	if secret != nil {
+		var err error
+		if keyFileContent, err = wrapKeys(keyFileContent, secret); err != nil {
+			return err
+		}
+	}
+	replacingPath := keyFilePath + ".replacing"
+	if err := ioutil.WriteFile(replacingPath, keyFileContent, 0600); err != nil {
+		os.Remove(replacingPath)
+		return err
+	}
+	return os.Rename(replacingPath, keyFilePath)
+}
+
+// LoadOrCreateIdentity loads the Identity stored in the location, generating and storing a new
+// one if the location does not have any yet. The secret is the one storage is encrypted with, i.e.
+// the passphrase or the content of the key file configured, which the identity keys are encrypted
+// with too; it is nil when storage is not encrypted.
+func LoadOrCreateIdentity(location string, secret []byte) (Identity, error) {
+	keyFilePath := filepath.Join(location, KeyFileName)
+	if _, err := os.Stat(keyFilePath); err == nil {
+		return loadIdentity(keyFilePath, secret)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	id, err := NewIdentity()
+	if err != nil {
+		return nil, err
+	}
+	if err := storeIdentity(keyFilePath, id.(_Identity), secret); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// RewrapIdentity re-encrypts the identity keys stored in the location from the old secret to the
+// new one, where a nil secret means the keys are not encrypted
+func RewrapIdentity(location string, oldSecret []byte, newSecret []byte) error {
+	id, err := LoadOrCreateIdentity(location, oldSecret)
+	if err != nil {
+		return err
+	}
+	return storeIdentity(filepath.Join(location, KeyFileName), id.(_Identity), newSecret)
+}
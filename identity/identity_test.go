@@ -0,0 +1,123 @@
+package identity
+
+import (
+	"bytes"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	id, err := NewIdentity()
+	if err != nil {
+		t.Fatal("Could not generate identity", err)
+	}
+	data := []byte("PING\n{}")
+	signature := id.Sign(data)
+	if !Verify(id.GetPublicKey(), data, signature) {
+		t.Error("Signature should have been verified")
+	}
+	if Verify(id.GetPublicKey(), []byte("PING\n{ }"), signature) {
+		t.Error("Signature of tampered data should not have been verified")
+	}
+	otherID, _ := NewIdentity()
+	if Verify(otherID.GetPublicKey(), data, signature) {
+		t.Error("Signature should not have been verified with another key")
+	}
+	if Verify(id.GetPublicKey()[1:], data, signature) || Verify(id.GetPublicKey(), data, nil) {
+		t.Error("Malformed key or signature should not have been verified")
+	}
+}
+
+func TestLoadOrCreateIdentity(t *testing.T) {
+	location, err := ioutil.TempDir("", "lamess-identity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(location)
+	id, err := LoadOrCreateIdentity(location, nil)
+	if err != nil {
+		t.Fatal("Could not create identity", err)
+	}
+	if info, err := os.Stat(filepath.Join(location, KeyFileName)); err != nil ||
+		info.Mode().Perm() != 0600 {
+		t.Error("Identity key file should have been stored readable by owner only")
+	}
+	loadedID, err := LoadOrCreateIdentity(location, nil)
+	if err != nil || !bytes.Equal(id.GetPublicKey(), loadedID.GetPublicKey()) {
+		t.Error("Stored identity should have been loaded", err)
+	}
+	if !bytes.Equal(id.GetAgreementKey(), loadedID.GetAgreementKey()) {
+		t.Error("Stored agreement key should have been loaded")
+	}
+	keyFileContent, _ := ioutil.ReadFile(filepath.Join(location, KeyFileName))
+	signingKeyBlock, _ := pem.Decode(keyFileContent)
+	ioutil.WriteFile(filepath.Join(location, KeyFileName), pem.EncodeToMemory(signingKeyBlock), 0600)
+	upgradedID, err := LoadOrCreateIdentity(location, nil)
+	if err != nil || !bytes.Equal(id.GetPublicKey(), upgradedID.GetPublicKey()) ||
+		len(upgradedID.GetAgreementKey()) == 0 {
+		t.Error("Agreement key should have been generated for key file without one", err)
+	}
+	if reloadedID, err := LoadOrCreateIdentity(location, nil); err != nil ||
+		!bytes.Equal(upgradedID.GetAgreementKey(), reloadedID.GetAgreementKey()) {
+		t.Error("Generated agreement key should have been stored", err)
+	}
+	ioutil.WriteFile(filepath.Join(location, KeyFileName), []byte("garbage"), 0600)
+	if _, err := LoadOrCreateIdentity(location, nil); err == nil || err.Error() != InvalidKeyFileErrorMsg {
+		t.Error("Invalid key file should not have been loaded", err)
+	}
+}
+
+func TestLoadOrCreateIdentity_encrypted(t *testing.T) {
+	location, err := ioutil.TempDir("", "lamess-identity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(location)
+	keyFilePath := filepath.Join(location, KeyFileName)
+	id, err := LoadOrCreateIdentity(location, nil)
+	if err != nil {
+		t.Fatal("Could not create identity", err)
+	}
+	if _, err := LoadOrCreateIdentity(location, []byte("secret")); err != nil {
+		t.Fatal("Key file not encrypted should have been loaded with a secret", err)
+	}
+	keyFileContent, _ := ioutil.ReadFile(keyFilePath)
+	if block, _ := pem.Decode(keyFileContent); block == nil || block.Type != wrappedKeysPEMType ||
+		bytes.Contains(keyFileContent, []byte(signingKeyPEMType)) {
+		t.Error("Key file should have been encrypted once loaded with a secret")
+	}
+	if _, err := LoadOrCreateIdentity(location, nil); err == nil || err.Error() != WrappedKeyFileErrorMsg {
+		t.Error("Encrypted key file should not have been loaded without a secret", err)
+	}
+	if _, err := LoadOrCreateIdentity(location, []byte("wrong")); err == nil ||
+		err.Error() != KeyFileSecretMismatchErrorMsg {
+		t.Error("Encrypted key file should not have been loaded with a wrong secret", err)
+	}
+	if loadedID, err := LoadOrCreateIdentity(location, []byte("secret")); err != nil ||
+		!bytes.Equal(id.GetPublicKey(), loadedID.GetPublicKey()) ||
+		!bytes.Equal(id.GetAgreementKey(), loadedID.GetAgreementKey()) {
+		t.Error("Encrypted key file should have been loaded with its secret", err)
+	}
+	if err := RewrapIdentity(location, []byte("secret"), []byte("new secret")); err != nil {
+		t.Fatal("Key file should have been re-encrypted", err)
+	}
+	if loadedID, err := LoadOrCreateIdentity(location, []byte("new secret")); err != nil ||
+		!bytes.Equal(id.GetPublicKey(), loadedID.GetPublicKey()) {
+		t.Error("Re-encrypted key file should have been loaded with the new secret", err)
+	}
+	if err := RewrapIdentity(location, []byte("new secret"), nil); err != nil {
+		t.Fatal("Key file should have been decrypted", err)
+	}
+	if loadedID, err := LoadOrCreateIdentity(location, nil); err != nil ||
+		!bytes.Equal(id.GetPublicKey(), loadedID.GetPublicKey()) {
+		t.Error("Decrypted key file should have been loaded without a secret", err)
+	}
+	ioutil.WriteFile(keyFilePath, pem.EncodeToMemory(&pem.Block{Type: wrappedKeysPEMType, Bytes: []byte("x")}),
+		0600)
+	if _, err := LoadOrCreateIdentity(location, nil); err == nil || err.Error() != InvalidKeyFileErrorMsg {
+		t.Error("Malformed encrypted key file should not have been loaded", err)
+	}
+}
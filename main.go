@@ -1,34 +1,149 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
 	"os"
 	"os/signal"
+	"strings"
 
 	app "github.com/imyousuf/lan-messenger/application"
+	"github.com/imyousuf/lan-messenger/application/backup"
 	conf "github.com/imyousuf/lan-messenger/application/conf"
+	"github.com/imyousuf/lan-messenger/application/storage"
+	"github.com/imyousuf/lan-messenger/identity"
 	"github.com/imyousuf/lan-messenger/network"
 	"github.com/imyousuf/lan-messenger/profile"
 )
 
-func exit(udpComm network.Communication) {
+// exit returns the context done on interrupt, which closes the communication
+func exit() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	go func() {
 		<-c
-		udpComm.CloseCommunication()
+		cancel()
 	}()
+	return ctx
+}
+
+// readPassphrase reads the passphrase from the first line of stdin, prompting for it if stdin is a
+// terminal, so that it is not exposed in the arguments of the process
+func readPassphrase() string {
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		fmt.Fprint(os.Stderr, "New passphrase: ")
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		log.Fatal(err)
+	}
+	passphrase := strings.TrimRight(line, "\r\n")
+	if passphrase == "" {
+		log.Fatal("new passphrase is blank")
+	}
+	return passphrase
+}
+
+// loadSecret returns the secret the DB and the identity keys are encrypted with, nil if they are not
+func loadSecret() []byte {
+	secret, err := storage.LoadEncryptionSecret(conf.GetStorageEncryptionConfig())
+	if err != nil {
+		log.Fatal(err)
+	}
+	return secret
+}
+
+// rekey re-encrypts the DB and the identity keys with the new passphrase or key file, or decrypts
+// them if neither is given
+func rekey(newPassphrase string, newKeyFile string) {
+	oldSecret := loadSecret()
+	newSecret, err := storage.LoadEncryptionSecret(newPassphrase, newKeyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// The identity keys are checked to be decrypted before the DB is re-keyed
+	if _, err := identity.LoadOrCreateIdentity(conf.GetStorageLocation(), oldSecret); err != nil {
+		log.Fatal(err)
+	}
+	if !storage.IsDBConnectionAvailable() {
+		log.Fatal(storage.GetDBConnectionError())
+	}
+	if err := storage.Rekey(newPassphrase, newKeyFile); err != nil {
+		log.Fatal(err)
+	}
+	if err := identity.RewrapIdentity(conf.GetStorageLocation(), oldSecret, newSecret); err != nil {
+		log.Fatal(err)
+	}
+	if storage.IsEncrypted() {
+		log.Println("DB re-encrypted; set the new passphrase or key file in the [storage] config")
+	} else {
+		log.Println("DB decrypted; remove the passphrase and key file from the [storage] config")
+	}
+}
+
+// backupOrRestore archives the local store to the archive, or restores it from the archive
+func backupOrRestore(backupArchive string, restoreArchive string) {
+	if backupArchive != "" && restoreArchive != "" {
+		log.Fatal("only one of -backup and -restore can be given")
+	}
+	if backupArchive != "" {
+		if err := backup.Backup(backupArchive); err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Local store archived to", backupArchive)
+	} else if err := backup.Restore(restoreArchive); err != nil {
+		log.Fatal(err)
+	}
 }
 
 func main() {
+	rekeyDB := flag.Bool("rekey", false, "re-encrypt the DB with -new-passphrase-stdin or -new-keyfile, "+
+		"or decrypt it if neither is given, and exit")
+	newPassphraseFromStdin := flag.Bool("new-passphrase-stdin", false, "read the passphrase to re-encrypt "+
+		"the DB with from stdin")
+	newKeyFile := flag.String("new-keyfile", "", "key file to re-encrypt the DB with")
+	backupArchive := flag.String("backup", "", "archive the DB, identity keys and config to the file and exit")
+	restoreArchive := flag.String("restore", "", "restore the DB, identity keys and config from the archive "+
+		"and exit")
+	flag.Parse()
+	if *backupArchive != "" || *restoreArchive != "" {
+		backupOrRestore(*backupArchive, *restoreArchive)
+		return
+	}
+	if *rekeyDB {
+		newPassphrase := ""
+		if *newPassphraseFromStdin {
+			newPassphrase = readPassphrase()
+		}
+		rekey(newPassphrase, *newKeyFile)
+		return
+	}
+	selfIdentity, err := identity.LoadOrCreateIdentity(conf.GetStorageLocation(), loadSecret())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !storage.IsDBConnectionAvailable() {
+		log.Fatal(storage.GetDBConnectionError())
+	}
+	selfProfile := profile.NewUserProfile(conf.GetUserProfile())
 	completeNotificationChannel := make(chan int)
-	messageListener := app.NewEventListener(completeNotificationChannel)
 	udpComm := network.NewUDPCommunication()
-	config := network.NewConfig(conf.GetNetworkConfig())
-	exit(udpComm)
+	messageListener := app.NewEventListener(completeNotificationChannel,
+		app.NewMessenger(udpComm, selfProfile))
+	port, interfaceNames := conf.GetNetworkConfig()
+	config := network.NewConfigWithDiscovery(port, interfaceNames,
+		network.ParseDiscoveryMode(conf.GetDiscoveryMode()), network.NewMulticastConfig(conf.GetMulticastConfig()),
+		conf.IsMDNSEnabled(), conf.GetDeviceConfig())
+	ctx := exit()
 	udpComm.AddMessageListener(messageListener)
 	udpComm.AddBroadcastListener(messageListener)
-	udpComm.SetupCommunication(config)
-	udpComm.InitCommunication(profile.NewUserProfile(conf.GetUserProfile()))
+	udpComm.SetupCommunication(ctx, config)
+	udpComm.InitCommunication(ctx, selfProfile, selfIdentity)
 	<-completeNotificationChannel
 	<-completeNotificationChannel
 }
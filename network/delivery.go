@@ -0,0 +1,123 @@
+package network
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// _RetransmitPolicy configures how long to wait for an acknowledgement before sending a packet
+// again and when to give up on it altogether
+type _RetransmitPolicy struct {
+	initialInterval time.Duration
+	maxInterval     time.Duration
+	timeout         time.Duration
+}
+
+var defaultRetransmitPolicy = _RetransmitPolicy{
+	initialInterval: 500 * time.Millisecond,
+	maxInterval:     8 * time.Second,
+	timeout:         30 * time.Second,
+}
+
+// nextInterval doubles the interval without exceeding the policy's max interval
+func (policy _RetransmitPolicy) nextInterval(interval time.Duration) time.Duration {
+	interval *= 2
+	if interval > policy.maxInterval {
+		interval = policy.maxInterval
+	}
+	return interval
+}
+
+// _PacketKey identifies the delivery of a packet to a recipient session, as the same packet may be
+// delivered to several sessions, each acknowledging it
+type _PacketKey struct {
+	sessionID          string
+	packetID           uint64
+	recipientSessionID string
+}
+
+type _PendingDelivery struct {
+	acked       chan struct{}
+	ackNotifier sync.Once
+}
+
+func (delivery *_PendingDelivery) acknowledge() {
+	delivery.ackNotifier.Do(func() {
+		close(delivery.acked)
+	})
+}
+
+// _PendingDeliveries is the table of packets sent but not yet acknowledged by the peer
+type _PendingDeliveries struct {
+	mutex      sync.Mutex
+	deliveries map[_PacketKey]*_PendingDelivery
+}
+
+func (table *_PendingDeliveries) add(key _PacketKey) *_PendingDelivery {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	delivery := &_PendingDelivery{acked: make(chan struct{})}
+	table.deliveries[key] = delivery
+	return delivery
+}
+
+func (table *_PendingDeliveries) remove(key _PacketKey) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	delete(table.deliveries, key)
+}
+
+// acknowledge marks the pending delivery as acknowledged and returns false if no delivery for
+// the key was pending
+func (table *_PendingDeliveries) acknowledge(key _PacketKey) bool {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	delivery, found := table.deliveries[key]
+	if found {
+		delivery.acknowledge()
+	}
+	return found
+}
+
+func newPendingDeliveries() *_PendingDeliveries {
+	return &_PendingDeliveries{deliveries: make(map[_PacketKey]*_PendingDelivery)}
+}
+
+// deliver keeps invoking send with exponential backoff till the delivery is acknowledged or the
+// policy's timeout elapses, failing it if the context is done first. send should return true if
+// the packet was written successfully. The status updates are published to the status channel
+// which is closed before returning.
+func (table *_PendingDeliveries) deliver(ctx context.Context, key _PacketKey, policy _RetransmitPolicy,
+	send func() bool, status chan<- DeliveryStatus) {
+	delivery := table.add(key)
+	defer close(status)
+	defer table.remove(key)
+	giveUp := time.NewTimer(policy.timeout)
+	defer giveUp.Stop()
+	sent := false
+	interval := policy.initialInterval
+	for {
+		if send() && !sent {
+			sent = true
+			status <- Sent
+		}
+		retry := time.NewTimer(interval)
+		select {
+		case <-delivery.acked:
+			retry.Stop()
+			status <- Delivered
+			return
+		case <-giveUp.C:
+			retry.Stop()
+			status <- Failed
+			return
+		case <-ctx.Done():
+			retry.Stop()
+			status <- Failed
+			return
+		case <-retry.C:
+			interval = policy.nextInterval(interval)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package network
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+var testRetransmitPolicy = _RetransmitPolicy{
+	initialInterval: 5 * time.Millisecond,
+	maxInterval:     20 * time.Millisecond,
+	timeout:         200 * time.Millisecond,
+}
+
+func collectStatuses(status <-chan DeliveryStatus) []DeliveryStatus {
+	statuses := make([]DeliveryStatus, 0, 2)
+	for aStatus := range status {
+		statuses = append(statuses, aStatus)
+	}
+	return statuses
+}
+
+func TestRetransmitPolicy_nextInterval(t *testing.T) {
+	interval := testRetransmitPolicy.initialInterval
+	expectedIntervals := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond,
+		20 * time.Millisecond}
+	for _, expectedInterval := range expectedIntervals {
+		interval = testRetransmitPolicy.nextInterval(interval)
+		if interval != expectedInterval {
+			t.Error("Expected interval", expectedInterval, "but got", interval)
+		}
+	}
+}
+
+func TestPendingDeliveries_deliverAcknowledged(t *testing.T) {
+	table := newPendingDeliveries()
+	key := _PacketKey{sessionID: "A1", packetID: 1}
+	status := make(chan DeliveryStatus, 2)
+	attempts := 0
+	go table.deliver(context.Background(), key, testRetransmitPolicy, func() bool {
+		attempts++
+		if attempts == 3 {
+			table.acknowledge(key)
+		}
+		return true
+	}, status)
+	statuses := collectStatuses(status)
+	if len(statuses) != 2 || statuses[0] != Sent || statuses[1] != Delivered {
+		t.Error("Unexpected delivery statuses", statuses)
+	}
+	if attempts != 3 {
+		t.Error("Packet should have been retransmitted till acknowledged", attempts)
+	}
+	if table.acknowledge(key) {
+		t.Error("Delivery should not be pending after being acknowledged")
+	}
+}
+
+func TestPendingDeliveries_deliverFailed(t *testing.T) {
+	table := newPendingDeliveries()
+	key := _PacketKey{sessionID: "A1", packetID: 2}
+	status := make(chan DeliveryStatus, 2)
+	go table.deliver(context.Background(), key, testRetransmitPolicy, func() bool {
+		return false
+	}, status)
+	statuses := collectStatuses(status)
+	if len(statuses) != 1 || statuses[0] != Failed {
+		t.Error("Unexpected delivery statuses", statuses)
+	}
+}
+
+func TestPendingDeliveries_deliverTimedOut(t *testing.T) {
+	table := newPendingDeliveries()
+	key := _PacketKey{sessionID: "A1", packetID: 3}
+	status := make(chan DeliveryStatus, 2)
+	start := time.Now()
+	go table.deliver(context.Background(), key, testRetransmitPolicy, func() bool {
+		return true
+	}, status)
+	statuses := collectStatuses(status)
+	if len(statuses) != 2 || statuses[0] != Sent || statuses[1] != Failed {
+		t.Error("Unexpected delivery statuses", statuses)
+	}
+	if time.Since(start) < testRetransmitPolicy.timeout {
+		t.Error("Gave up before the timeout")
+	}
+}
+
+func TestPendingDeliveries_deliverCancelled(t *testing.T) {
+	table := newPendingDeliveries()
+	key := _PacketKey{sessionID: "A1", packetID: 4}
+	status := make(chan DeliveryStatus, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	go table.deliver(ctx, key, testRetransmitPolicy, func() bool {
+		cancel()
+		return true
+	}, status)
+	statuses := collectStatuses(status)
+	if len(statuses) != 2 || statuses[0] != Sent || statuses[1] != Failed {
+		t.Error("Delivery should have failed once cancelled", statuses)
+	}
+}
+
+func TestPendingDeliveries_deliverToSeveralSessions(t *testing.T) {
+	table := newPendingDeliveries()
+	firstKey := _PacketKey{sessionID: "A1", packetID: 5, recipientSessionID: "B1"}
+	secondKey := _PacketKey{sessionID: "A1", packetID: 5, recipientSessionID: "B2"}
+	firstStatus, secondStatus := make(chan DeliveryStatus, 2), make(chan DeliveryStatus, 2)
+	sent := make(chan bool, 2)
+	send := func() bool {
+		select {
+		case sent <- true:
+		default:
+		}
+		return true
+	}
+	go table.deliver(context.Background(), firstKey, testRetransmitPolicy, send, firstStatus)
+	go table.deliver(context.Background(), secondKey, testRetransmitPolicy, send, secondStatus)
+	<-sent
+	<-sent
+	table.acknowledge(firstKey)
+	if statuses := collectStatuses(firstStatus); len(statuses) != 2 || statuses[1] != Delivered {
+		t.Error("Delivery acknowledged by its session should have been delivered", statuses)
+	}
+	if statuses := collectStatuses(secondStatus); len(statuses) != 2 || statuses[1] != Failed {
+		t.Error("Delivery not acknowledged by its session should have failed", statuses)
+	}
+}
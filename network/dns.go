@@ -0,0 +1,228 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+const (
+	dnsTypeA    uint16 = 1
+	dnsTypePTR  uint16 = 12
+	dnsTypeTXT  uint16 = 16
+	dnsTypeAAAA uint16 = 28
+	dnsTypeSRV  uint16 = 33
+	dnsTypeANY  uint16 = 255
+	dnsClassIN  uint16 = 1
+	// dnsClassCacheFlush is the top bit of the class mDNS uses to have caches replace the records
+	// they hold of the name and type rather than add to them
+	dnsClassCacheFlush uint16 = 0x8000
+	// dnsFlagsResponse marks an authoritative response
+	dnsFlagsResponse uint16 = 0x8400
+	dnsFlagResponse  uint16 = 0x8000
+	dnsHeaderSize           = 12
+	// maxDNSNamePointers bounds the compression pointers followed, so that loops are not followed
+	// forever
+	maxDNSNamePointers = 16
+	// InvalidDNSMessageErrorMsg is the error returned when a DNS message can not be parsed
+	InvalidDNSMessageErrorMsg = "invalid DNS message"
+)
+
+// _DNSQuestion is a question of a DNS message
+type _DNSQuestion struct {
+	name  string
+	qtype uint16
+}
+
+// _DNSRecord is a resource record of a DNS message of the types mDNS service discovery uses
+type _DNSRecord struct {
+	name   string
+	rtype  uint16
+	class  uint16
+	ttl    uint32
+	target string   // PTR and SRV
+	port   uint16   // SRV
+	txt    []string // TXT
+	ip     net.IP   // A and AAAA
+}
+
+// _DNSMessage is a DNS message just as much as mDNS service discovery needs; the records of the
+// answer, authority and additional sections are all parsed into the answers
+type _DNSMessage struct {
+	id        uint16
+	flags     uint16
+	questions []_DNSQuestion
+	answers   []_DNSRecord
+}
+
+func (msg *_DNSMessage) isResponse() bool {
+	return msg.flags&dnsFlagResponse != 0
+}
+
+// appendDNSName appends the name uncompressed; names with labels containing dots are not supported
+func appendDNSName(buf []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 {
+			continue
+		}
+		if len(label) > 63 {
+			label = label[:63]
+		}
+		buf = append(buf, byte(len(label)))
+		buf = append(buf, label...)
+	}
+	return append(buf, 0)
+}
+
+func appendUint16(buf []byte, value uint16) []byte {
+	return append(buf, byte(value>>8), byte(value))
+}
+
+func appendRecordData(buf []byte, record _DNSRecord) []byte {
+	switch record.rtype {
+	case dnsTypePTR:
+		return appendDNSName(buf, record.target)
+	case dnsTypeSRV:
+		// Priority and weight are of no use on a LAN
+		buf = appendUint16(appendUint16(buf, 0), 0)
+		return appendDNSName(appendUint16(buf, record.port), record.target)
+	case dnsTypeTXT:
+		for _, entry := range record.txt {
+			if len(entry) > 255 {
+				entry = entry[:255]
+			}
+			buf = append(append(buf, byte(len(entry))), entry...)
+		}
+		return buf
+	case dnsTypeA:
+		return append(buf, record.ip.To4()...)
+	case dnsTypeAAAA:
+		return append(buf, record.ip.To16()...)
+	}
+	return buf
+}
+
+// pack encodes the message, putting all the records in the answer section
+func (msg *_DNSMessage) pack() []byte {
+	buf := make([]byte, 0, 512)
+	buf = appendUint16(appendUint16(buf, msg.id), msg.flags)
+	buf = appendUint16(appendUint16(buf, uint16(len(msg.questions))), uint16(len(msg.answers)))
+	buf = appendUint16(appendUint16(buf, 0), 0)
+	for _, question := range msg.questions {
+		buf = appendUint16(appendUint16(appendDNSName(buf, question.name), question.qtype), dnsClassIN)
+	}
+	for _, record := range msg.answers {
+		buf = appendUint16(appendUint16(appendDNSName(buf, record.name), record.rtype), record.class)
+		buf = append(buf, byte(record.ttl>>24), byte(record.ttl>>16), byte(record.ttl>>8), byte(record.ttl))
+		lengthOffset := len(buf)
+		buf = appendRecordData(appendUint16(buf, 0), record)
+		binary.BigEndian.PutUint16(buf[lengthOffset:], uint16(len(buf)-lengthOffset-2))
+	}
+	return buf
+}
+
+// parseDNSName parses the possibly compressed name at the offset, returning it along with the
+// offset following it
+func parseDNSName(data []byte, offset int) (string, int, error) {
+	var labels []string
+	next, pointers := -1, 0
+	for {
+		if offset >= len(data) {
+			return "", 0, errors.New(InvalidDNSMessageErrorMsg)
+		}
+		length := int(data[offset])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = offset + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case length&0xc0 == 0xc0:
+			if offset+1 >= len(data) || pointers >= maxDNSNamePointers {
+				return "", 0, errors.New(InvalidDNSMessageErrorMsg)
+			}
+			if next < 0 {
+				next = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(data[offset:]) & 0x3fff)
+			pointers++
+		case length&0xc0 != 0 || offset+1+length > len(data):
+			return "", 0, errors.New(InvalidDNSMessageErrorMsg)
+		default:
+			labels = append(labels, string(data[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+}
+
+func parseRecordData(data []byte, offset int, length int, record *_DNSRecord) error {
+	var err error
+	switch record.rtype {
+	case dnsTypePTR:
+		record.target, _, err = parseDNSName(data, offset)
+	case dnsTypeSRV:
+		if length < 7 {
+			return errors.New(InvalidDNSMessageErrorMsg)
+		}
+		record.port = binary.BigEndian.Uint16(data[offset+4:])
+		record.target, _, err = parseDNSName(data, offset+6)
+	case dnsTypeTXT:
+		for index := offset; index < offset+length; {
+			entryLength := int(data[index])
+			if index+1+entryLength > offset+length {
+				return errors.New(InvalidDNSMessageErrorMsg)
+			}
+			record.txt = append(record.txt, string(data[index+1:index+1+entryLength]))
+			index += 1 + entryLength
+		}
+	case dnsTypeA, dnsTypeAAAA:
+		if (record.rtype == dnsTypeA && length != net.IPv4len) ||
+			(record.rtype == dnsTypeAAAA && length != net.IPv6len) {
+			return errors.New(InvalidDNSMessageErrorMsg)
+		}
+		record.ip = net.IP(append([]byte(nil), data[offset:offset+length]...))
+	}
+	return err
+}
+
+// parseDNSMessage parses the message; records of types other than the ones mDNS service discovery
+// uses are parsed without their data
+func parseDNSMessage(data []byte) (*_DNSMessage, error) {
+	if len(data) < dnsHeaderSize {
+		return nil, errors.New(InvalidDNSMessageErrorMsg)
+	}
+	msg := &_DNSMessage{id: binary.BigEndian.Uint16(data), flags: binary.BigEndian.Uint16(data[2:])}
+	questionCount := int(binary.BigEndian.Uint16(data[4:]))
+	recordCount := int(binary.BigEndian.Uint16(data[6:])) + int(binary.BigEndian.Uint16(data[8:])) +
+		int(binary.BigEndian.Uint16(data[10:]))
+	offset := dnsHeaderSize
+	for index := 0; index < questionCount; index++ {
+		name, next, err := parseDNSName(data, offset)
+		if err != nil || next+4 > len(data) {
+			return nil, errors.New(InvalidDNSMessageErrorMsg)
+		}
+		msg.questions = append(msg.questions, _DNSQuestion{name: name,
+			qtype: binary.BigEndian.Uint16(data[next:])})
+		offset = next + 4
+	}
+	for index := 0; index < recordCount; index++ {
+		name, next, err := parseDNSName(data, offset)
+		if err != nil || next+10 > len(data) {
+			return nil, errors.New(InvalidDNSMessageErrorMsg)
+		}
+		record := _DNSRecord{name: name, rtype: binary.BigEndian.Uint16(data[next:]),
+			class: binary.BigEndian.Uint16(data[next+2:]), ttl: binary.BigEndian.Uint32(data[next+4:])}
+		length := int(binary.BigEndian.Uint16(data[next+8:]))
+		offset = next + 10
+		if offset+length > len(data) {
+			return nil, errors.New(InvalidDNSMessageErrorMsg)
+		}
+		if err := parseRecordData(data, offset, length, &record); err != nil {
+			return nil, err
+		}
+		msg.answers = append(msg.answers, record)
+		offset += length
+	}
+	return msg, nil
+}
@@ -1,7 +1,15 @@
 package network
 
-import "github.com/imyousuf/lan-messenger/packet"
-import "strings"
+import (
+	"bytes"
+	"encoding/base64"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/imyousuf/lan-messenger/identity"
+	"github.com/imyousuf/lan-messenger/packet"
+)
 
 const (
 	// RegisterEventName is the name of event type that represents the RegisterEvent
@@ -10,11 +18,43 @@ const (
 	PingEventName = "PING"
 	// SignOffEventName is the name of event type that represents the SignOffEvent
 	SignOffEventName = "SIGNOFF"
+	// MessageEventName is the name of event type that represents the MessageEvent
+	MessageEventName = "MESSAGE"
+	// AckEventName is the name of event type that represents the AckEvent
+	AckEventName = "ACK"
+	// RoomEventName is the name of event type that represents the RoomEvent
+	RoomEventName = "ROOM"
+	// FileEventName is the name of event type that represents the FileEvent
+	FileEventName = "FILE"
 	// UnknownEventName represents all event name not explicitly supported by this network layer
 	UnknownEventName = "UNKNOWN"
 	newline          = "\n"
+	protocolPrefix   = "LAMESS/"
+	codecAttribute   = "codec"
+	// signatureAttribute carries the signature of getSignedData by the sender's identity
+	signatureAttribute = "sig"
+	// ProtocolVersion is the version of the wire format this network layer produces. It is only
+	// bumped for changes that older peers can not parse safely; compatible additions are announced
+	// using capabilities in RegisterPacket instead.
+	ProtocolVersion = 1
+)
+
+const (
+	// AckCapability signifies that the peer acknowledges packets sent to it
+	AckCapability = "ack"
+	// FragmentCapability signifies that the peer reassembles fragmented event data; broadcasts are only
+	// fragmented if every registered peer announced it
+	FragmentCapability = "fragment"
+	// BinaryCodecCapability signifies that the peer decodes packets encoded by packet.NewBinaryCodec
+	BinaryCodecCapability = "codec:" + packet.BinaryCodecName
+	// FileTransferCapability signifies that the peer streams and downloads files offered over TCP
+	FileTransferCapability = "file:tcp"
 )
 
+// supportedCapabilities are the capabilities this network layer announces to its peers
+var supportedCapabilities = []string{AckCapability, FragmentCapability, BinaryCodecCapability,
+	FileTransferCapability}
+
 // Event presents an event being sent and/or received
 type Event interface {
 	GetName() string
@@ -40,9 +80,49 @@ type SignOffEvent interface {
 	GetSignOffPacket() packet.SignOffPacket
 }
 
+// MessageEvent represents an event with MessagePacket
+type MessageEvent interface {
+	Event
+	GetMessagePacket() packet.MessagePacket
+}
+
+// AckEvent represents an event with AckPacket
+type AckEvent interface {
+	Event
+	GetAckPacket() packet.AckPacket
+}
+
+// RoomEvent represents an event with RoomPacket
+type RoomEvent interface {
+	Event
+	GetRoomPacket() packet.RoomPacket
+}
+
+// FileEvent represents an event with FilePacket
+type FileEvent interface {
+	Event
+	GetFilePacket() packet.FilePacket
+}
+
+// _SignedEvent is implemented by events to expose the signature they were received with
+type _SignedEvent interface {
+	getSignature() []byte
+	getSignedData() []byte
+}
+
 type _Event struct {
-	Name    string
-	RawData []byte
+	Name       string
+	RawData    []byte
+	signature  []byte
+	signedData []byte
+}
+
+func (event _Event) getSignature() []byte {
+	return event.signature
+}
+
+func (event _Event) getSignedData() []byte {
+	return event.signedData
 }
 
 func (event _Event) GetName() string {
@@ -96,50 +176,244 @@ func (event _SignOffEvent) GetEventIdentifier() (string, uint64) {
 	return event.packet.GetSessionID(), event.packet.GetPacketID()
 }
 
-// convertPacketToEventData converts a packet to a byte data format that can be transported
-func convertPacketToEventData(pPacket packet.BasePacket) []byte {
+type _MessageEvent struct {
+	_Event
+	packet packet.MessagePacket
+}
+
+func (event _MessageEvent) GetMessagePacket() packet.MessagePacket {
+	return event.packet
+}
+
+func (event _MessageEvent) GetEventIdentifier() (string, uint64) {
+	return event.packet.GetSessionID(), event.packet.GetPacketID()
+}
+
+type _AckEvent struct {
+	_Event
+	packet packet.AckPacket
+}
+
+func (event _AckEvent) GetAckPacket() packet.AckPacket {
+	return event.packet
+}
+
+func (event _AckEvent) GetEventIdentifier() (string, uint64) {
+	return event.packet.GetSessionID(), event.packet.GetPacketID()
+}
+
+type _RoomEvent struct {
+	_Event
+	packet packet.RoomPacket
+}
+
+func (event _RoomEvent) GetRoomPacket() packet.RoomPacket {
+	return event.packet
+}
+
+func (event _RoomEvent) GetEventIdentifier() (string, uint64) {
+	return event.packet.GetSessionID(), event.packet.GetPacketID()
+}
+
+type _FileEvent struct {
+	_Event
+	packet packet.FilePacket
+}
+
+func (event _FileEvent) GetFilePacket() packet.FilePacket {
+	return event.packet
+}
+
+func (event _FileEvent) GetEventIdentifier() (string, uint64) {
+	return event.packet.GetSessionID(), event.packet.GetPacketID()
+}
+
+// _Envelope is the versioned header and the payload of the event data. The header is of the form
+// `LAMESS/<version> <NAME> [key=value ...]` followed by a newline; attributes not understood by
+// a peer are ignored by it.
+type _Envelope struct {
+	version    int
+	eventName  string
+	attributes map[string]string
+	payload    []byte
+}
+
+func (envelope _Envelope) getSignature() []byte {
+	signature, err := base64.RawURLEncoding.DecodeString(envelope.attributes[signatureAttribute])
+	if err != nil {
+		return nil
+	}
+	return signature
+}
+
+func (envelope _Envelope) getCodecName() string {
+	if codecName, found := envelope.attributes[codecAttribute]; found {
+		return codecName
+	}
+	return packet.JSONCodecName
+}
+
+// encodeEnvelope prefixes the payload with the versioned header carrying the attributes
+func encodeEnvelope(eventName string, payload []byte, attributes map[string]string) []byte {
+	header := protocolPrefix + strconv.Itoa(ProtocolVersion) + " " + eventName
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		header += " " + key + "=" + attributes[key]
+	}
+	header += newline
+	eventData := make([]byte, 0, len(header)+len(payload))
+	eventData = append(eventData, header...)
+	return append(eventData, payload...)
+}
+
+// parseEnvelope parses the envelope of the event data. Event data without the versioned header is
+// from peers predating versioning and is reported as version 0; header that can not be parsed is
+// reported as an UnknownEventName.
+func parseEnvelope(eventData []byte) _Envelope {
+	header, payload := eventData, []byte{}
+	if headerEnd := bytes.Index(eventData, []byte(newline)); headerEnd >= 0 {
+		header, payload = eventData[:headerEnd], eventData[headerEnd+len(newline):]
+	}
+	envelope := _Envelope{eventName: UnknownEventName, attributes: make(map[string]string),
+		payload: payload}
+	if !bytes.HasPrefix(header, []byte(protocolPrefix)) {
+		envelope.eventName = string(header)
+		return envelope
+	}
+	fields := strings.Fields(string(header[len(protocolPrefix):]))
+	if len(fields) < 2 {
+		return envelope
+	}
+	version, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return envelope
+	}
+	envelope.version, envelope.eventName = version, fields[1]
+	for _, field := range fields[2:] {
+		if separator := strings.Index(field, "="); separator > 0 {
+			envelope.attributes[field[:separator]] = field[separator+1:]
+		}
+	}
+	return envelope
+}
+
+// getEventNameForPacket returns the name of the event the packet is transported as
+func getEventNameForPacket(pPacket packet.BasePacket) string {
 	switch pPacket.(type) {
 	case packet.RegisterPacket:
-		regPacket := pPacket.(packet.RegisterPacket)
-		return []byte(RegisterEventName + "\n" + regPacket.ToJSON())
+		return RegisterEventName
 	case packet.PingPacket:
-		pingPacket := pPacket.(packet.PingPacket)
-		return []byte(PingEventName + "\n" + pingPacket.ToJSON())
+		return PingEventName
+	case packet.MessagePacket:
+		return MessageEventName
+	case packet.AckPacket:
+		return AckEventName
+	case packet.RoomPacket:
+		return RoomEventName
+	case packet.FilePacket:
+		return FileEventName
 	case packet.SignOffPacket:
-		signOffPacket := pPacket.(packet.SignOffPacket)
-		return []byte(SignOffEventName + "\n" + signOffPacket.ToJSON())
+		return SignOffEventName
 	default:
 		panic("Converting unsupported packet to data buffer")
 	}
 }
 
+// getSignedData returns the part of the event data that is signed, which is the event name and
+// the payload but not the rest of the header
+func getSignedData(eventName string, payload []byte) []byte {
+	signedData := make([]byte, 0, len(eventName)+len(newline)+len(payload))
+	signedData = append(signedData, eventName+newline...)
+	return append(signedData, payload...)
+}
+
+// convertPacketToEventData converts a packet to a byte data format that can be transported
+func convertPacketToEventData(pPacket packet.BasePacket) []byte {
+	return encodePacketToEventData(pPacket, packet.NewJSONCodec(), nil)
+}
+
+// encodePacketToEventData converts a packet to transportable byte data using the codec and signs
+// it using the signer unless the signer is nil
+func encodePacketToEventData(pPacket packet.BasePacket, codec packet.Codec,
+	signer identity.Identity) []byte {
+	payload, err := codec.Encode(pPacket)
+	if err != nil {
+		panic(err)
+	}
+	eventName := getEventNameForPacket(pPacket)
+	attributes := make(map[string]string)
+	if codec.GetName() != packet.JSONCodecName {
+		attributes[codecAttribute] = codec.GetName()
+	}
+	if signer != nil {
+		attributes[signatureAttribute] = base64.RawURLEncoding.EncodeToString(
+			signer.Sign(getSignedData(eventName, payload)))
+	}
+	return encodeEnvelope(eventName, payload, attributes)
+}
+
 // createEventFromEventData helps consume data received from communication so that app can
-// consume and work with the data
+// consume and work with the data. Events from a newer protocol version or that fail to parse are
+// returned as UnknownEventName event so that they get ignored instead of being misinterpreted.
 func createEventFromEventData(eventData []byte) Event {
-	data := string(eventData)
-	switch strings.Split(data, newline)[0] {
+	unknownEvent := _Event{Name: UnknownEventName, RawData: eventData}
+	envelope := parseEnvelope(eventData)
+	codec, codecFound := packet.GetCodec(envelope.getCodecName())
+	if envelope.version > ProtocolVersion || !codecFound {
+		return unknownEvent
+	}
+	baseEvent := _Event{Name: envelope.eventName, RawData: eventData,
+		signature: envelope.getSignature(), signedData: getSignedData(envelope.eventName, envelope.payload)}
+	packetData := envelope.payload
+	switch envelope.eventName {
 	case RegisterEventName:
-		packetData := eventData[len([]byte(RegisterEventName+newline)):]
-		parsedPacket, _ := packet.FromJSON(packetData, packet.RegisterPacketType)
-		regEvent := _RegisterEvent{}
-		regEvent.Name, regEvent.RawData, regEvent.packet = RegisterEventName, eventData,
-			parsedPacket.(packet.RegisterPacket)
-		return regEvent
+		parsedPacket, err := codec.Decode(packetData, packet.RegisterPacketType)
+		if err != nil {
+			return unknownEvent
+		}
+		return _RegisterEvent{_Event: baseEvent, packet: parsedPacket.(packet.RegisterPacket)}
 	case PingEventName:
-		packetData := eventData[len([]byte(PingEventName+newline)):]
-		parsedPacket, _ := packet.FromJSON(packetData, packet.PingPacketType)
-		pingEvent := _PingEvent{}
-		pingEvent.Name, pingEvent.RawData, pingEvent.packet = PingEventName, eventData,
-			parsedPacket.(packet.PingPacket)
-		return pingEvent
+		parsedPacket, err := codec.Decode(packetData, packet.PingPacketType)
+		if err != nil {
+			return unknownEvent
+		}
+		return _PingEvent{_Event: baseEvent, packet: parsedPacket.(packet.PingPacket)}
 	case SignOffEventName:
-		packetData := eventData[len([]byte(SignOffEventName+newline)):]
-		parsedPacket, _ := packet.FromJSON(packetData, packet.SignOffPacketType)
-		signOffEvent := _SignOffEvent{}
-		signOffEvent.Name, signOffEvent.RawData, signOffEvent.packet = SignOffEventName, eventData,
-			parsedPacket
-		return signOffEvent
+		parsedPacket, err := codec.Decode(packetData, packet.SignOffPacketType)
+		if err != nil {
+			return unknownEvent
+		}
+		return _SignOffEvent{_Event: baseEvent, packet: parsedPacket}
+	case MessageEventName:
+		parsedPacket, err := codec.Decode(packetData, packet.MessagePacketType)
+		if err != nil {
+			// Messages failing validation are not delivered to the application
+			return unknownEvent
+		}
+		return _MessageEvent{_Event: baseEvent, packet: parsedPacket.(packet.MessagePacket)}
+	case AckEventName:
+		parsedPacket, err := codec.Decode(packetData, packet.AckPacketType)
+		if err != nil {
+			return unknownEvent
+		}
+		return _AckEvent{_Event: baseEvent, packet: parsedPacket.(packet.AckPacket)}
+	case RoomEventName:
+		parsedPacket, err := codec.Decode(packetData, packet.RoomPacketType)
+		if err != nil {
+			return unknownEvent
+		}
+		return _RoomEvent{_Event: baseEvent, packet: parsedPacket.(packet.RoomPacket)}
+	case FileEventName:
+		parsedPacket, err := codec.Decode(packetData, packet.FilePacketType)
+		if err != nil {
+			return unknownEvent
+		}
+		return _FileEvent{_Event: baseEvent, packet: parsedPacket.(packet.FilePacket)}
 	default:
-		return _Event{Name: UnknownEventName, RawData: eventData}
+		return unknownEvent
 	}
 }
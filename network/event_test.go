@@ -19,10 +19,24 @@ func Example_convertPacketToEventData() {
 	fmt.Println(strings.Split(string(writeBuf), "\n")[0])
 	writeBuf = convertPacketToEventData(packet.NewBuilderFactory().SignOff().BuildSignOffPacket())
 	fmt.Println(strings.Split(string(writeBuf), "\n")[0])
+	writeBuf = convertPacketToEventData(packet.NewBuilderFactory().Message().To("a").
+		WithBody(packet.TextContentType, "Hello").BuildMessagePacket())
+	fmt.Println(strings.Split(string(writeBuf), "\n")[0])
+	writeBuf = convertPacketToEventData(packet.NewBuilderFactory().Acknowledge("A1", 1).BuildAckPacket())
+	fmt.Println(strings.Split(string(writeBuf), "\n")[0])
+	writeBuf = convertPacketToEventData(packet.NewBuilderFactory().Room("R1", "Team").WithMembers("a").
+		Join().BuildRoomPacket())
+	fmt.Println(strings.Split(string(writeBuf), "\n")[0])
+	writeBuf = convertPacketToEventData(packet.NewBuilderFactory().File("T1").Reject().BuildFilePacket())
+	fmt.Println(strings.Split(string(writeBuf), "\n")[0])
 	// Output:
-	// REGISTER
-	// PING
-	// SIGNOFF
+	// LAMESS/1 REGISTER
+	// LAMESS/1 PING
+	// LAMESS/1 SIGNOFF
+	// LAMESS/1 MESSAGE
+	// LAMESS/1 ACK
+	// LAMESS/1 ROOM
+	// LAMESS/1 FILE
 }
 func Example_createEventFromEventData() {
 	regPacket := packet.NewBuilderFactory().CreateNewSession().CreateSession(5*time.Minute).
@@ -42,6 +56,29 @@ func Example_createEventFromEventData() {
 	fmt.Println(parsedSignOffEvent.GetName())
 	fmt.Println(signoffPacket.GetPacketID() == parsedSignOffEvent.GetSignOffPacket().GetPacketID())
 	fmt.Println(signoffPacket.GetSessionID() == parsedSignOffEvent.GetSignOffPacket().GetSessionID())
+	messagePacket := packet.NewBuilderFactory().Message().To("a").
+		WithBody(packet.TextContentType, "Hello").BuildMessagePacket()
+	parsedMessageEvent := createEventFromEventData(convertPacketToEventData(messagePacket)).(MessageEvent)
+	fmt.Println(parsedMessageEvent.GetName())
+	fmt.Println(messagePacket.GetPacketID() == parsedMessageEvent.GetMessagePacket().GetPacketID())
+	fmt.Println(parsedMessageEvent.GetMessagePacket().GetBody())
+	invalidMessage := encodeEnvelope(MessageEventName, []byte(`{"PacketID":1,"SessionID":"s"}`), nil)
+	fmt.Println(createEventFromEventData(invalidMessage).GetName())
+	ackPacket := packet.NewBuilderFactory().Acknowledge(messagePacket.GetSessionID(),
+		messagePacket.GetPacketID()).BuildAckPacket()
+	parsedAckEvent := createEventFromEventData(convertPacketToEventData(ackPacket)).(AckEvent)
+	fmt.Println(parsedAckEvent.GetName())
+	fmt.Println(messagePacket.GetPacketID() == parsedAckEvent.GetAckPacket().GetAcknowledgedPacketID())
+	roomPacket := packet.NewBuilderFactory().Room("R1", "Team").WithMembers("a").Invite("b").
+		BuildRoomPacket()
+	parsedRoomEvent := createEventFromEventData(convertPacketToEventData(roomPacket)).(RoomEvent)
+	fmt.Println(parsedRoomEvent.GetName())
+	fmt.Println(parsedRoomEvent.GetRoomPacket().GetAction(), parsedRoomEvent.GetRoomPacket().GetInviteeUsernames())
+	filePacket := packet.NewBuilderFactory().File("T1").Offer("notes.txt", 5, make([]byte, 32)).
+		BuildFilePacket()
+	parsedFileEvent := createEventFromEventData(convertPacketToEventData(filePacket)).(FileEvent)
+	fmt.Println(parsedFileEvent.GetName())
+	fmt.Println(parsedFileEvent.GetFilePacket().GetAction(), parsedFileEvent.GetFilePacket().GetFileName())
 	// Output:
 	// REGISTER
 	// true
@@ -52,4 +89,76 @@ func Example_createEventFromEventData() {
 	// SIGNOFF
 	// true
 	// true
+	// MESSAGE
+	// true
+	// Hello
+	// UNKNOWN
+	// ACK
+	// true
+	// ROOM
+	// invite [b]
+	// FILE
+	// offer notes.txt
+}
+
+func Example_parseEnvelope() {
+	envelope := parseEnvelope([]byte("LAMESS/1 PING\n{}"))
+	fmt.Println(envelope.version, envelope.eventName, envelope.getCodecName(), string(envelope.payload))
+	envelope = parseEnvelope([]byte("LAMESS/3 PING codec=binary future=header\n{}"))
+	fmt.Println(envelope.version, envelope.eventName, envelope.getCodecName(), string(envelope.payload))
+	envelope = parseEnvelope([]byte("PING\n{}"))
+	fmt.Println(envelope.version, envelope.eventName, envelope.getCodecName(), string(envelope.payload))
+	envelope = parseEnvelope([]byte("LAMESS/x PING\n{}"))
+	fmt.Println(envelope.version, envelope.eventName)
+	fmt.Println(string(encodeEnvelope(PingEventName, []byte("{}"),
+		map[string]string{"b": "2", codecAttribute: packet.JSONCodecName})))
+	// Output:
+	// 1 PING json {}
+	// 3 PING binary {}
+	// 0 PING json {}
+	// 0 UNKNOWN
+	// LAMESS/1 PING b=2 codec=json
+	// {}
+}
+
+func Example_encodePacketToEventData() {
+	binaryCodec := packet.NewBinaryCodec()
+	for _, aPacket := range []packet.BasePacket{
+		packet.NewBuilderFactory().Ping().RenewSession(5 * time.Minute).BuildPingPacket(),
+		packet.NewBuilderFactory().SignOff().BuildSignOffPacket(),
+		packet.NewBuilderFactory().Message().To("a").WithBody(packet.TextContentType, "Hi").
+			BuildMessagePacket(),
+		packet.NewBuilderFactory().Acknowledge("A1", 1).BuildAckPacket(),
+	} {
+		eventData := encodePacketToEventData(aPacket, binaryCodec, nil)
+		event := createEventFromEventData(eventData)
+		sessionID, packetID := event.GetEventIdentifier()
+		fmt.Println(strings.Split(string(eventData), newline)[0], event.GetName(),
+			sessionID == aPacket.GetSessionID() && packetID == aPacket.GetPacketID())
+	}
+	unknownCodecData := []byte(protocolPrefix + "1 " + PingEventName + " codec=xml\n<ping/>")
+	fmt.Println(createEventFromEventData(unknownCodecData).GetName())
+	// Output:
+	// LAMESS/1 PING codec=binary PING true
+	// LAMESS/1 SIGNOFF codec=binary SIGNOFF true
+	// LAMESS/1 MESSAGE codec=binary MESSAGE true
+	// LAMESS/1 ACK codec=binary ACK true
+	// UNKNOWN
+}
+
+func Example_createEventFromEventData_versions() {
+	pingPacket := packet.NewBuilderFactory().Ping().RenewSession(5 * time.Minute).BuildPingPacket()
+	legacyEventData := []byte(PingEventName + newline + pingPacket.ToJSON())
+	fmt.Println(createEventFromEventData(legacyEventData).GetName())
+	futureEventData := []byte(protocolPrefix + "2 " + PingEventName + newline + pingPacket.ToJSON())
+	fmt.Println(createEventFromEventData(futureEventData).GetName())
+	extendedEventData := []byte(protocolPrefix + "1 " + PingEventName + newline +
+		`{"PacketID":1,"SessionID":"s","ExpiryTime":"2017-09-01T10:00:00Z","NewField":true}`)
+	fmt.Println(createEventFromEventData(extendedEventData).GetName())
+	fmt.Println(createEventFromEventData(encodeEnvelope(PingEventName, []byte("{"), nil)).GetName())
+	// Output:
+	// PING
+	// UNKNOWN
+	// PING
+	// UNKNOWN
 }
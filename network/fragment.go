@@ -0,0 +1,166 @@
+package network
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	fragmentEventName = "FRAGMENT"
+	// maxDatagramSize keeps every datagram within the common 1280 bytes IPv6 minimum MTU
+	maxDatagramSize = 1200
+	// maxFragmentHeaderSize is the room left in a datagram for the fragment envelope header
+	maxFragmentHeaderSize    = 128
+	maxFragmentsPerMessage   = 4096
+	fragmentReassemblyExpiry = 30 * time.Second
+	maxReassemblyBufferSize  = 4 * 1024 * 1024
+)
+
+// _FragmentHeader is the envelope of each chunk of an event data too large for a datagram
+type _FragmentHeader struct {
+	MessageID string
+	Index     int
+	Total     int
+}
+
+func (header _FragmentHeader) isValid() bool {
+	return len(header.MessageID) > 0 && header.Total > 0 && header.Total <= maxFragmentsPerMessage &&
+		header.Index >= 0 && header.Index < header.Total
+}
+
+// fragmentEventData splits the event data into datagrams no larger than maxDatagramSize. Event data
+// that fits in a single datagram is returned as is.
+func fragmentEventData(eventData []byte) [][]byte {
+	if len(eventData) <= maxDatagramSize {
+		return [][]byte{eventData}
+	}
+	chunkSize := maxDatagramSize - maxFragmentHeaderSize
+	total := (len(eventData) + chunkSize - 1) / chunkSize
+	messageID := uuid.New().String()
+	fragments := make([][]byte, 0, total)
+	for index := 0; index < total; index++ {
+		end := (index + 1) * chunkSize
+		if end > len(eventData) {
+			end = len(eventData)
+		}
+		header, _ := json.Marshal(_FragmentHeader{MessageID: messageID, Index: index, Total: total})
+		fragment := make([]byte, 0, len(fragmentEventName)+len(header)+2+end-index*chunkSize)
+		fragment = append(fragment, fragmentEventName+newline...)
+		fragment = append(fragment, header...)
+		fragment = append(fragment, newline...)
+		fragment = append(fragment, eventData[index*chunkSize:end]...)
+		fragments = append(fragments, fragment)
+	}
+	return fragments
+}
+
+// parseFragment returns the header and chunk of a fragment datagram; false is returned if the
+// datagram is not a well formed fragment
+func parseFragment(datagram []byte) (_FragmentHeader, []byte, bool) {
+	header := _FragmentHeader{}
+	prefix := []byte(fragmentEventName + newline)
+	if !bytes.HasPrefix(datagram, prefix) {
+		return header, nil, false
+	}
+	rest := datagram[len(prefix):]
+	headerEnd := bytes.Index(rest, []byte(newline))
+	if headerEnd < 0 || json.Unmarshal(rest[:headerEnd], &header) != nil || !header.isValid() {
+		return header, nil, false
+	}
+	return header, rest[headerEnd+1:], true
+}
+
+type _FragmentSet struct {
+	chunks    [][]byte
+	received  int
+	size      int
+	firstSeen time.Time
+}
+
+// _Reassembler collects fragments till all chunks of an event data are received. Incomplete sets
+// are discarded once they expire or when buffering a new chunk would exceed the memory cap.
+type _Reassembler struct {
+	mutex         sync.Mutex
+	sets          map[string]*_FragmentSet
+	bufferedBytes int
+	expiry        time.Duration
+	maxBytes      int
+}
+
+func newReassembler(expiry time.Duration, maxBytes int) *_Reassembler {
+	return &_Reassembler{sets: make(map[string]*_FragmentSet), expiry: expiry, maxBytes: maxBytes}
+}
+
+func (reassembler *_Reassembler) discard(messageID string) {
+	if set, found := reassembler.sets[messageID]; found {
+		reassembler.bufferedBytes -= set.size
+		delete(reassembler.sets, messageID)
+	}
+}
+
+func (reassembler *_Reassembler) discardExpired(now time.Time) {
+	for messageID, set := range reassembler.sets {
+		if now.Sub(set.firstSeen) > reassembler.expiry {
+			reassembler.discard(messageID)
+		}
+	}
+}
+
+func (reassembler *_Reassembler) discardOldest() {
+	oldestID := ""
+	var oldest time.Time
+	for messageID, set := range reassembler.sets {
+		if oldestID == "" || set.firstSeen.Before(oldest) {
+			oldestID, oldest = messageID, set.firstSeen
+		}
+	}
+	reassembler.discard(oldestID)
+}
+
+// accept consumes a datagram and returns the complete event data once available. Datagrams that
+// are not fragments are complete by themselves and returned as is.
+func (reassembler *_Reassembler) accept(datagram []byte) ([]byte, bool) {
+	if !bytes.HasPrefix(datagram, []byte(fragmentEventName+newline)) {
+		return datagram, true
+	}
+	header, chunk, ok := parseFragment(datagram)
+	if !ok || len(chunk) > reassembler.maxBytes {
+		log.Println("Dropping malformed fragment")
+		return nil, false
+	}
+	reassembler.mutex.Lock()
+	defer reassembler.mutex.Unlock()
+	now := time.Now()
+	reassembler.discardExpired(now)
+	set, found := reassembler.sets[header.MessageID]
+	if found && len(set.chunks) != header.Total {
+		log.Println("Dropping fragment inconsistent with its set", header.MessageID)
+		return nil, false
+	}
+	if found && set.chunks[header.Index] != nil {
+		return nil, false
+	}
+	for reassembler.bufferedBytes+len(chunk) > reassembler.maxBytes && len(reassembler.sets) > 0 {
+		reassembler.discardOldest()
+		set, found = reassembler.sets[header.MessageID]
+	}
+	if !found {
+		set = &_FragmentSet{chunks: make([][]byte, header.Total), firstSeen: now}
+		reassembler.sets[header.MessageID] = set
+	}
+	set.chunks[header.Index] = append([]byte(nil), chunk...)
+	set.received++
+	set.size += len(chunk)
+	reassembler.bufferedBytes += len(chunk)
+	if set.received < header.Total {
+		return nil, false
+	}
+	eventData := bytes.Join(set.chunks, nil)
+	reassembler.discard(header.MessageID)
+	return eventData, true
+}
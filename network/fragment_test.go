@@ -0,0 +1,105 @@
+package network
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func createTestEventData(size int) []byte {
+	eventData := make([]byte, size)
+	for index := range eventData {
+		eventData[index] = byte('a' + index%26)
+	}
+	return eventData
+}
+
+func TestFragmentEventData(t *testing.T) {
+	smallEventData := createTestEventData(maxDatagramSize)
+	if fragments := fragmentEventData(smallEventData); len(fragments) != 1 ||
+		!bytes.Equal(fragments[0], smallEventData) {
+		t.Error("Event data fitting a datagram should not be fragmented")
+	}
+	largeEventData := createTestEventData(50 * 1024)
+	fragments := fragmentEventData(largeEventData)
+	if len(fragments) < 2 {
+		t.Error("Large event data should have been fragmented")
+	}
+	for _, fragment := range fragments {
+		if len(fragment) > maxDatagramSize {
+			t.Error("Fragment larger than datagram size", len(fragment))
+		}
+		if _, _, ok := parseFragment(fragment); !ok {
+			t.Error("Fragment could not be parsed")
+		}
+	}
+}
+
+func TestReassembler_accept(t *testing.T) {
+	reassembler := newReassembler(time.Minute, maxReassemblyBufferSize)
+	t.Run("Non fragment", func(t *testing.T) {
+		eventData := []byte(PingEventName + newline + "{}")
+		if data, complete := reassembler.accept(eventData); !complete || !bytes.Equal(data, eventData) {
+			t.Error("Non fragmented datagram should be returned as is")
+		}
+	})
+	t.Run("Out of order with duplicates", func(t *testing.T) {
+		eventData := createTestEventData(20 * 1024)
+		fragments := fragmentEventData(eventData)
+		last := len(fragments) - 1
+		ordered := append([][]byte{fragments[last], fragments[0], fragments[0]}, fragments[1:last]...)
+		for index, fragment := range ordered {
+			data, complete := reassembler.accept(fragment)
+			if complete != (index == len(ordered)-1) {
+				t.Error("Unexpected completion at fragment", index)
+			}
+			if complete && !bytes.Equal(data, eventData) {
+				t.Error("Reassembled data did not match")
+			}
+		}
+		if len(reassembler.sets) != 0 || reassembler.bufferedBytes != 0 {
+			t.Error("Completed set should not be buffered anymore")
+		}
+	})
+	t.Run("Malformed fragment", func(t *testing.T) {
+		if _, complete := reassembler.accept([]byte(fragmentEventName + newline + "{}\nabc")); complete {
+			t.Error("Malformed fragment should have been dropped")
+		}
+	})
+}
+
+func TestReassembler_expiry(t *testing.T) {
+	reassembler := newReassembler(10*time.Millisecond, maxReassemblyBufferSize)
+	fragments := fragmentEventData(createTestEventData(5 * 1024))
+	reassembler.accept(fragments[0])
+	time.Sleep(20 * time.Millisecond)
+	for _, fragment := range fragments[1:] {
+		if _, complete := reassembler.accept(fragment); complete {
+			t.Error("Expired set should not have been completed")
+		}
+	}
+}
+
+func TestReassembler_memoryCap(t *testing.T) {
+	chunkSize := maxDatagramSize - maxFragmentHeaderSize
+	reassembler := newReassembler(time.Minute, 3*chunkSize)
+	firstFragments := fragmentEventData(createTestEventData(5 * 1024))
+	secondEventData := createTestEventData(3 * chunkSize)
+	secondFragments := fragmentEventData(secondEventData)
+	reassembler.accept(firstFragments[0])
+	reassembler.accept(firstFragments[1])
+	var data []byte
+	complete := false
+	for _, fragment := range secondFragments {
+		data, complete = reassembler.accept(fragment)
+	}
+	if !complete || !bytes.Equal(data, secondEventData) {
+		t.Error("Older incomplete set should have been evicted for the newer set")
+	}
+	if reassembler.bufferedBytes > reassembler.maxBytes {
+		t.Error("Buffered bytes exceeded memory cap", reassembler.bufferedBytes)
+	}
+	if _, complete := reassembler.accept(firstFragments[2]); complete {
+		t.Error("Evicted set should not complete")
+	}
+}
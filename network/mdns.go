@@ -0,0 +1,263 @@
+package network
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/imyousuf/lan-messenger/utils"
+)
+
+const (
+	mdnsPort = 5353
+	// MDNSServiceName is the DNS-SD service type lamess instances advertise and browse for
+	MDNSServiceName = "_lamess._udp.local"
+	// mdnsRecordTTL is the TTL in seconds of the records advertised, which outlives the ping interval
+	// the records are re-announced at
+	mdnsRecordTTL uint32 = 300
+	// mdnsMulticastTTL is the IP TTL mDNS requires, which receivers check to drop off-link packets
+	mdnsMulticastTTL = 255
+	// maxMDNSMessageSize is the largest mDNS message, which unlike unicast DNS is not bound to 512
+	// bytes
+	maxMDNSMessageSize = 9000
+	// mdnsInstanceIDLength is how much of the session ID the instance and host names are made unique
+	// with
+	mdnsInstanceIDLength = 8
+	txtUsernameKey       = "username"
+	txtSessionKey        = "session"
+	txtDeviceKey         = "device"
+	txtVersionKey        = "version"
+)
+
+var (
+	mdnsIPv4Group = net.IPv4(224, 0, 0, 251)
+	mdnsIPv6Group = net.ParseIP("ff02::fb")
+)
+
+// _MDNSPeer is a lamess instance found browsing the service over mDNS
+type _MDNSPeer struct {
+	instance    string
+	username    string
+	sessionID   string
+	deviceIndex uint8
+	version     int
+	replyTo     string
+}
+
+// _MDNSProvider advertises this session as an instance of the lamess service over mDNS on the
+// interface and address family of a listener, and browses for the other instances. The records are
+// not authenticated, so peers found are only where the signed REGISTER is sent to.
+type _MDNSProvider struct {
+	listener    _ListenerConfig
+	conn        *net.UDPConn
+	groupAddr   *net.UDPAddr
+	username    string
+	sessionID   string
+	deviceIndex uint8
+	peerFound   func(_MDNSPeer)
+	closeOnce   sync.Once
+}
+
+// newMDNSProvider joins the mDNS group on the interface of the listener; peerFound is called for
+// every instance of other sessions found in the responses received. The session is advertised with
+// the device index it registers with.
+func newMDNSProvider(listener _ListenerConfig, username string, sessionID string, deviceIndex uint8,
+	peerFound func(_MDNSPeer)) (*_MDNSProvider, error) {
+	mdnsListener := listener
+	mdnsListener.group = mdnsIPv4Group
+	if listener.group.To4() == nil {
+		mdnsListener.group = mdnsIPv6Group
+	}
+	// Groups are joined on the port following the one of the listener
+	mdnsListener.port = mdnsPort - 1
+	mdnsListener.multicast = _MulticastConfig{TTL: mdnsMulticastTTL, Loopback: true}
+	conn, err := mdnsListener.joinGroup()
+	if err != nil {
+		return nil, err
+	}
+	if err := setMulticastOptions(conn, mdnsListener); err != nil {
+		log.Println("Could not set multicast options for mDNS on", listener.zone, err)
+	}
+	return &_MDNSProvider{listener: listener, conn: conn, groupAddr: mdnsListener.getGroupAddr(),
+		username: username, sessionID: sessionID, deviceIndex: deviceIndex, peerFound: peerFound}, nil
+}
+
+// getInstanceName returns the name of the service instance of this session
+func (provider *_MDNSProvider) getInstanceName() string {
+	return getMDNSInstance(provider.username, provider.sessionID) + "." + MDNSServiceName
+}
+
+func getMDNSInstance(username string, sessionID string) string {
+	instance := strings.Map(func(r rune) rune {
+		if r == '.' || r <= ' ' {
+			return '-'
+		}
+		return r
+	}, username)
+	if len(sessionID) > mdnsInstanceIDLength {
+		sessionID = sessionID[:mdnsInstanceIDLength]
+	}
+	return instance + "-" + sessionID
+}
+
+func getMDNSHostName(sessionID string) string {
+	if len(sessionID) > mdnsInstanceIDLength {
+		sessionID = sessionID[:mdnsInstanceIDLength]
+	}
+	return "lamess-" + sessionID + ".local"
+}
+
+// getRecords returns the records advertising this session with the TTL; the SRV port is the port
+// of the reply-to, broadcasts being received on the next one
+func (provider *_MDNSProvider) getRecords(ttl uint32) []_DNSRecord {
+	instanceName, hostName := provider.getInstanceName(), getMDNSHostName(provider.sessionID)
+	records := []_DNSRecord{
+		{name: MDNSServiceName, rtype: dnsTypePTR, class: dnsClassIN, ttl: ttl, target: instanceName},
+		{name: instanceName, rtype: dnsTypeSRV, class: dnsClassIN | dnsClassCacheFlush, ttl: ttl,
+			target: hostName, port: uint16(provider.listener.port)},
+		{name: instanceName, rtype: dnsTypeTXT, class: dnsClassIN | dnsClassCacheFlush, ttl: ttl,
+			txt: []string{txtUsernameKey + "=" + provider.username, txtSessionKey + "=" + provider.sessionID,
+				txtDeviceKey + "=" + strconv.Itoa(int(provider.deviceIndex)),
+				txtVersionKey + "=" + strconv.Itoa(ProtocolVersion)}},
+	}
+	for _, unicast := range provider.listener.unicasts {
+		ip, rtype := getIP(unicast), dnsTypeAAAA
+		if ip.To4() != nil {
+			rtype = dnsTypeA
+		}
+		records = append(records, _DNSRecord{name: hostName, rtype: rtype,
+			class: dnsClassIN | dnsClassCacheFlush, ttl: ttl, ip: ip})
+	}
+	return records
+}
+
+func (provider *_MDNSProvider) send(msg *_DNSMessage) {
+	if _, err := provider.conn.WriteToUDP(msg.pack(), provider.groupAddr); err != nil {
+		log.Println("Could not send mDNS message on", provider.listener.zone, err)
+	}
+}
+
+// announce multicasts the records of this session unsolicited
+func (provider *_MDNSProvider) announce() {
+	provider.send(&_DNSMessage{flags: dnsFlagsResponse, answers: provider.getRecords(mdnsRecordTTL)})
+}
+
+// browse queries for the instances of the service, whose responses are handled as they come in
+func (provider *_MDNSProvider) browse() {
+	provider.send(&_DNSMessage{questions: []_DNSQuestion{{name: MDNSServiceName, qtype: dnsTypePTR}}})
+}
+
+// listen handles queries and responses till the provider is closed
+func (provider *_MDNSProvider) listen() {
+	buf := make([]byte, maxMDNSMessageSize)
+	for {
+		n, addr, err := provider.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		msg, err := parseDNSMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		if !msg.isResponse() {
+			if isServiceQueried(msg) {
+				provider.announce()
+			}
+			continue
+		}
+		for _, peer := range parseMDNSPeers(msg, addr.IP) {
+			if peer.sessionID != provider.sessionID {
+				provider.peerFound(peer)
+			}
+		}
+	}
+}
+
+func isServiceQueried(msg *_DNSMessage) bool {
+	for _, question := range msg.questions {
+		if strings.EqualFold(question.name, MDNSServiceName) &&
+			(question.qtype == dnsTypePTR || question.qtype == dnsTypeANY) {
+			return true
+		}
+	}
+	return false
+}
+
+// close sends the goodbye, i.e. the records with zero TTL, and stops listening
+func (provider *_MDNSProvider) close() {
+	provider.closeOnce.Do(func() {
+		provider.send(&_DNSMessage{flags: dnsFlagsResponse, answers: provider.getRecords(0)})
+		provider.conn.Close()
+	})
+}
+
+// parseMDNSPeers returns the instances of the service in the response. An instance is reached at
+// the address of its SRV target of the family of the source, falling back to the source address.
+// Instances saying goodbye or lacking any of their records are skipped.
+func parseMDNSPeers(msg *_DNSMessage, source net.IP) []_MDNSPeer {
+	var peers []_MDNSPeer
+	for _, pointer := range msg.answers {
+		if pointer.rtype != dnsTypePTR || pointer.ttl == 0 || !strings.EqualFold(pointer.name, MDNSServiceName) {
+			continue
+		}
+		var srv, txt *_DNSRecord
+		for index := range msg.answers {
+			record := &msg.answers[index]
+			if !strings.EqualFold(record.name, pointer.target) {
+				continue
+			}
+			if record.rtype == dnsTypeSRV {
+				srv = record
+			} else if record.rtype == dnsTypeTXT {
+				txt = record
+			}
+		}
+		if srv == nil || txt == nil {
+			continue
+		}
+		peer, valid := parseTXT(txt.txt)
+		if !valid {
+			continue
+		}
+		peer.instance = strings.TrimSuffix(pointer.target, "."+MDNSServiceName)
+		ip := source
+		for _, record := range msg.answers {
+			if strings.EqualFold(record.name, srv.target) && record.ip != nil &&
+				getFamily(record.ip) == getFamily(source) {
+				ip = record.ip
+				break
+			}
+		}
+		peer.replyTo = net.JoinHostPort(ip.String(), strconv.Itoa(int(srv.port)))
+		if utils.IsValidConnectionString(peer.replyTo) {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+func parseTXT(entries []string) (_MDNSPeer, bool) {
+	peer := _MDNSPeer{}
+	for _, entry := range entries {
+		separatorIndex := strings.Index(entry, "=")
+		if separatorIndex < 0 {
+			continue
+		}
+		key, value := strings.ToLower(entry[:separatorIndex]), entry[separatorIndex+1:]
+		switch key {
+		case txtUsernameKey:
+			peer.username = value
+		case txtSessionKey:
+			peer.sessionID = value
+		case txtDeviceKey:
+			if deviceIndex, err := strconv.ParseUint(value, 10, 8); err == nil {
+				peer.deviceIndex = uint8(deviceIndex)
+			}
+		case txtVersionKey:
+			peer.version, _ = strconv.Atoi(value)
+		}
+	}
+	return peer, !utils.IsStringBlank(peer.sessionID) && peer.version > 0
+}
@@ -0,0 +1,105 @@
+package network
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDNSMessage_packAndParse(t *testing.T) {
+	msg := &_DNSMessage{id: 7, flags: dnsFlagsResponse,
+		questions: []_DNSQuestion{{name: MDNSServiceName, qtype: dnsTypePTR}},
+		answers: []_DNSRecord{
+			{name: MDNSServiceName, rtype: dnsTypePTR, class: dnsClassIN, ttl: 120, target: "a." + MDNSServiceName},
+			{name: "a." + MDNSServiceName, rtype: dnsTypeSRV, class: dnsClassIN | dnsClassCacheFlush, ttl: 120,
+				target: "host.local", port: 30000},
+			{name: "a." + MDNSServiceName, rtype: dnsTypeTXT, class: dnsClassIN, ttl: 120,
+				txt: []string{"username=a", "version=1"}},
+			{name: "host.local", rtype: dnsTypeA, class: dnsClassIN, ttl: 120, ip: net.ParseIP("192.168.1.2").To4()},
+			{name: "host.local", rtype: dnsTypeAAAA, class: dnsClassIN, ttl: 120, ip: net.ParseIP("fe80::1")},
+		}}
+	parsedMsg, err := parseDNSMessage(msg.pack())
+	if err != nil {
+		t.Fatal("Message packed should have been parsed", err)
+	}
+	if !reflect.DeepEqual(msg, parsedMsg) {
+		t.Error("Message parsed does not match the one packed", parsedMsg)
+	}
+	// The SRV target points back to the name of the PTR target
+	compressed := []byte{0, 0, 0x84, 0, 0, 0, 0, 2, 0, 0, 0, 0,
+		1, 'a', 5, 'l', 'o', 'c', 'a', 'l', 0, 0, 12, 0, 1, 0, 0, 0, 120, 0, 2, 0xc0, 12,
+		0xc0, 12, 0, 33, 0, 1, 0, 0, 0, 120, 0, 8, 0, 0, 0, 0, 0x75, 0x30, 0xc0, 14}
+	if parsedMsg, err = parseDNSMessage(compressed); err != nil || parsedMsg.answers[0].target != "a.local" ||
+		parsedMsg.answers[1].name != "a.local" || parsedMsg.answers[1].target != "local" ||
+		parsedMsg.answers[1].port != 30000 {
+		t.Error("Compressed names should have been parsed", parsedMsg, err)
+	}
+	looping := []byte{0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0xc0, 12, 0, 12, 0, 1}
+	if _, err := parseDNSMessage(looping); err == nil || err.Error() != InvalidDNSMessageErrorMsg {
+		t.Error("Looping name pointers should have made the message invalid", err)
+	}
+	if _, err := parseDNSMessage(compressed[:40]); err == nil {
+		t.Error("Truncated message should have been invalid")
+	}
+}
+
+func TestParseMDNSPeers(t *testing.T) {
+	provider := &_MDNSProvider{username: "some user", sessionID: "0123456789abcdef", deviceIndex: 2,
+		listener: _ListenerConfig{port: 30000, unicasts: []net.Addr{
+			&net.IPNet{IP: net.ParseIP("192.168.1.2").To4(), Mask: net.CIDRMask(24, 32)}}}}
+	if instanceName := provider.getInstanceName(); instanceName != "some-user-01234567."+MDNSServiceName {
+		t.Error("Instance name should have been made of the username and session", instanceName)
+	}
+	msg := &_DNSMessage{flags: dnsFlagsResponse, answers: provider.getRecords(mdnsRecordTTL)}
+	parsedMsg, _ := parseDNSMessage(msg.pack())
+	peers := parseMDNSPeers(parsedMsg, net.ParseIP("192.168.1.9"))
+	expectedPeer := _MDNSPeer{instance: "some-user-01234567", username: "some user",
+		sessionID: "0123456789abcdef", deviceIndex: 2, version: ProtocolVersion,
+		replyTo: "192.168.1.2:30000"}
+	if len(peers) != 1 || peers[0] != expectedPeer {
+		t.Error("Peer should have been parsed from the records", peers)
+	}
+	if peers := parseMDNSPeers(parsedMsg, net.ParseIP("fe80::9")); len(peers) != 1 ||
+		peers[0].replyTo != "[fe80::9]:30000" {
+		t.Error("Peer should have been reached at the source without an address of its family", peers)
+	}
+	goodbye, _ := parseDNSMessage((&_DNSMessage{flags: dnsFlagsResponse, answers: provider.getRecords(0)}).pack())
+	if peers := parseMDNSPeers(goodbye, net.ParseIP("192.168.1.9")); len(peers) != 0 {
+		t.Error("Peer saying goodbye should not have been found", peers)
+	}
+}
+
+func TestMDNSProvider_browse(t *testing.T) {
+	loopback, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip("No loopback interface supporting multicast")
+	}
+	lc := _ListenerConfig{port: 34700, zone: loopback.Name, interfaceIndex: loopback.Index,
+		unicasts: []net.Addr{&net.IPNet{IP: net.ParseIP("127.0.0.1").To4(), Mask: net.CIDRMask(8, 32)}},
+		group:    net.ParseIP(DefaultIPv4MulticastGroup)}
+	peers := make(chan _MDNSPeer, 4)
+	advertiser, err := newMDNSProvider(lc, "advertiser", "advertiser-session", 3, func(peer _MDNSPeer) {})
+	if err != nil {
+		t.Skip("Could not join mDNS group on loopback", err)
+	}
+	defer advertiser.close()
+	browser, err := newMDNSProvider(lc, "browser", "browser-session", 1, func(peer _MDNSPeer) {
+		peers <- peer
+	})
+	if err != nil {
+		t.Fatal("mDNS group should have been joined again", err)
+	}
+	defer browser.close()
+	go advertiser.listen()
+	go browser.listen()
+	browser.browse()
+	select {
+	case peer := <-peers:
+		if peer.sessionID != "advertiser-session" || peer.deviceIndex != 3 || peer.replyTo != "127.0.0.1:34700" {
+			t.Error("Advertiser should have been found browsing", peer)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Advertiser should have answered the query")
+	}
+}
@@ -1,20 +1,139 @@
 package network
 
 import (
+	"context"
+	"net"
+	"path"
+	"strings"
+
+	"github.com/imyousuf/lan-messenger/identity"
 	"github.com/imyousuf/lan-messenger/packet"
 	"github.com/imyousuf/lan-messenger/profile"
 )
 
+const (
+	// DefaultIPv4MulticastGroup is the administratively scoped group peers are discovered through
+	// over IPv4
+	DefaultIPv4MulticastGroup = "239.255.76.77"
+	// DefaultIPv6MulticastGroup is the link-local group peers are discovered through over IPv6
+	DefaultIPv6MulticastGroup = "ff02::4c4d"
+	// DefaultMulticastTTL keeps multicasts within the LAN
+	DefaultMulticastTTL = 1
+	// DefaultDeviceIndex is the device preference index of a session not configured with one
+	DefaultDeviceIndex uint8 = 1
+)
+
+// MulticastConfig represents the groups peers are discovered through, which are joined on every
+// interface listened to, and how multicasts are sent to them
+type MulticastConfig interface {
+	GetIPv4Group() net.IP
+	GetIPv6Group() net.IP
+	GetTTL() int
+	IsLoopback() bool
+}
+
+type _MulticastConfig struct {
+	IPv4Group net.IP
+	IPv6Group net.IP
+	TTL       int
+	Loopback  bool
+}
+
+func (conf _MulticastConfig) GetIPv4Group() net.IP {
+	return conf.IPv4Group
+}
+
+func (conf _MulticastConfig) GetIPv6Group() net.IP {
+	return conf.IPv6Group
+}
+
+func (conf _MulticastConfig) GetTTL() int {
+	return conf.TTL
+}
+
+func (conf _MulticastConfig) IsLoopback() bool {
+	return conf.Loopback
+}
+
+// getMulticastGroup returns the group of the family, i.e. "ipv4" or "ipv6"
+func getMulticastGroup(conf MulticastConfig, family string) net.IP {
+	if family == ipv4Family {
+		return conf.GetIPv4Group()
+	}
+	return conf.GetIPv6Group()
+}
+
+func parseMulticastGroup(group string, defaultGroup string, ipv4 bool) net.IP {
+	if len(group) <= 0 {
+		group = defaultGroup
+	}
+	ip := net.ParseIP(group)
+	if ip == nil || !ip.IsMulticast() || (ip.To4() != nil) != ipv4 {
+		panic("Not a multicast group of the address family: " + group)
+	}
+	return ip
+}
+
+// NewMulticastConfig initializes and returns the multicast configuration; blank groups and
+// non-positive TTL are replaced by the defaults. It panics if a group is not a multicast address of
+// its family.
+func NewMulticastConfig(ipv4Group string, ipv6Group string, ttl int, loopback bool) MulticastConfig {
+	if ttl <= 0 {
+		ttl = DefaultMulticastTTL
+	}
+	return _MulticastConfig{IPv4Group: parseMulticastGroup(ipv4Group, DefaultIPv4MulticastGroup, true),
+		IPv6Group: parseMulticastGroup(ipv6Group, DefaultIPv6MulticastGroup, false),
+		TTL:       ttl, Loopback: loopback}
+}
+
+// DiscoveryMode represents how discovery broadcasts, i.e. REGISTER, PING and SIGNOFF, reach peers
+type DiscoveryMode int
+
+const (
+	// AutoDiscovery multicasts to the group and falls back to BroadcastDiscovery on the IPv4
+	// interfaces where no peer is found within a window, as switches may filter multicast
+	AutoDiscovery DiscoveryMode = iota
+	// MulticastDiscovery only multicasts to the group
+	MulticastDiscovery
+	// BroadcastDiscovery sends to the directed broadcast address of each IPv4 subnet of the
+	// interface; IPv6, having no broadcast, still multicasts
+	BroadcastDiscovery
+)
+
+var discoveryModeNames = []string{"auto", "multicast", "broadcast"}
+
+func (mode DiscoveryMode) String() string {
+	return discoveryModeNames[mode]
+}
+
+// ParseDiscoveryMode returns the discovery mode of the name, panicking if there is no such mode
+func ParseDiscoveryMode(name string) DiscoveryMode {
+	for index, modeName := range discoveryModeNames {
+		if modeName == name {
+			return DiscoveryMode(index)
+		}
+	}
+	panic("Unknown discovery mode: " + name)
+}
+
 // Config represents configuration for the application to inform which interfaces
 // to listen and broadcast to and also which port to bind to.
 type Config interface {
 	GetInterfaces() []string
 	GetPort() int
+	GetDiscoveryMode() DiscoveryMode
+	GetMulticastConfig() MulticastConfig
+	IsMDNSEnabled() bool
+	GetDeviceIndex() uint8
 }
 
 type _Config struct {
-	Interfaces []string
-	Port       int
+	Interfaces      []string
+	Port            int
+	DiscoveryMode   DiscoveryMode
+	MulticastConfig MulticastConfig
+	MDNSEnabled     bool
+	DeviceIndex     uint8
 }
 
 func (conf _Config) GetInterfaces() []string {
@@ -25,15 +144,56 @@ func (conf _Config) GetPort() int {
 	return conf.Port
 }
 
+func (conf _Config) GetDiscoveryMode() DiscoveryMode {
+	return conf.DiscoveryMode
+}
+
+func (conf _Config) GetMulticastConfig() MulticastConfig {
+	return conf.MulticastConfig
+}
+
+func (conf _Config) IsMDNSEnabled() bool {
+	return conf.MDNSEnabled
+}
+
+func (conf _Config) GetDeviceIndex() uint8 {
+	return conf.DeviceIndex
+}
+
 // NewConfig initializes and returns a network configuration to be used for listening and
-// broadcasting
-func NewConfig(port int, interfaceName string) Config {
-	return _Config{Port: port, Interfaces: []string{interfaceName}}
+// broadcasting, discovering peers through the default multicast groups with broadcast fallback and
+// through mDNS, and registering this session with the default device index
+func NewConfig(port int, interfaceNames ...string) Config {
+	return NewConfigWithDiscovery(port, interfaceNames, AutoDiscovery, NewMulticastConfig("", "", 0, true),
+		true, DefaultDeviceIndex)
 }
 
-// MessageEvent is the event interface that MessageListener should expect
-type MessageEvent interface {
-	GetMessage() string
+// NewConfigWithDiscovery initializes and returns a network configuration to be used for listening
+// and broadcasting, discovering peers as configured. Every interface matching any of the interface
+// names, which may be wildcards such as `en*`, is listened to; no names stand for every interface.
+// Blank names are ignored, while malformed wildcards panic. With mDNS enabled this session is also
+// advertised as an instance of the _lamess._udp.local service, and peers browsed for are sent the
+// REGISTER directly, for networks where multicast to the group or broadcast does not get through.
+// This session registers with the device index, peers preferring the sessions of a user with lower
+// indexes; 0 stands for the default index.
+func NewConfigWithDiscovery(port int, interfaceNames []string, discoveryMode DiscoveryMode,
+	multicastConfig MulticastConfig, mdnsEnabled bool, deviceIndex uint8) Config {
+	interfaces := make([]string, 0, len(interfaceNames))
+	for _, interfaceName := range interfaceNames {
+		interfaceName = strings.TrimSpace(interfaceName)
+		if len(interfaceName) <= 0 {
+			continue
+		}
+		if _, err := path.Match(interfaceName, ""); err != nil {
+			panic("Invalid interface name: " + interfaceName)
+		}
+		interfaces = append(interfaces, interfaceName)
+	}
+	if deviceIndex <= 0 {
+		deviceIndex = DefaultDeviceIndex
+	}
+	return _Config{Port: port, Interfaces: interfaces, DiscoveryMode: discoveryMode,
+		MulticastConfig: multicastConfig, MDNSEnabled: mdnsEnabled, DeviceIndex: deviceIndex}
 }
 
 type iListener interface {
@@ -43,6 +203,8 @@ type iListener interface {
 type MessageListener interface {
 	iListener
 	HandleMessageReceived(event MessageEvent)
+	HandleRoomEvent(event RoomEvent)
+	HandleFileEvent(event FileEvent)
 	HandleEndOfMessages()
 }
 
@@ -55,23 +217,62 @@ type BroadcastListener interface {
 	HandleEndOfBroadcasts()
 }
 
-type _MessageEvent struct {
-	message string
-}
+// DeliveryStatus represents the state of delivery of a packet sent using Communication
+type DeliveryStatus int
+
+const (
+	// Sent signifies that the packet has been written to the network
+	Sent DeliveryStatus = iota
+	// Delivered signifies that the peer acknowledged receiving the packet
+	Delivered
+	// Failed signifies that the packet could not be delivered before giving up
+	Failed
+)
 
-func (msgEvent _MessageEvent) GetMessage() string {
-	return msgEvent.message
+func (status DeliveryStatus) String() string {
+	switch status {
+	case Sent:
+		return "sent"
+	case Delivered:
+		return "delivered"
+	default:
+		return "failed"
+	}
 }
 
 // Communication defines the interface the application uses to communicate between
 // nodes
 type Communication interface {
-	SetupCommunication(config Config)
-	InitCommunication(profile profile.UserProfile) error
+	// SetupCommunication listens as configured till the context is done or the communication is
+	// closed
+	SetupCommunication(ctx context.Context, config Config)
+	// InitCommunication registers this session with peers, closing the communication once the
+	// context is done
+	InitCommunication(ctx context.Context, profile profile.UserProfile, selfIdentity identity.Identity) error
 	AddMessageListener(listener MessageListener) bool
 	RemoveMessageListener(listener MessageListener) bool
 	AddBroadcastListener(listener BroadcastListener) bool
 	RemoveBroadcastListener(listener BroadcastListener) bool
-	SendMessage(toConnectionStr string, payload packet.BasePacket)
+	// SendMessage sends the payload to the peer session listening at toConnectionStr and retransmits
+	// it till the peer acknowledges it. The returned channel publishes the DeliveryStatus updates and
+	// is closed once the status is final, i.e. Delivered or Failed. A MessagePacket is encrypted for
+	// the session toSessionID, so it fails right away if that session has not published its agreement
+	// key. The same packet may be sent to several sessions, each delivery being acknowledged by its
+	// session.
+	SendMessage(toSessionID string, toConnectionStr string, payload packet.BasePacket) <-chan DeliveryStatus
+	// SetPresence changes the presence announced to peers and pings them with it right away
+	SetPresence(presence profile.Presence)
+	// OfferFile offers the file to the peer session listening at toConnectionStr and returns the
+	// transfer ID of the offer. The file is served over TCP to that session only till it is rejected
+	// or expires, sealed with the cipher agreed upon with the session like direct messages.
+	OfferFile(toSessionID string, toConnectionStr string, filePath string,
+		progress TransferProgress) (string, error)
+	// AcceptFile accepts the file offered and downloads it to destinationPath, resuming the
+	// download if interrupted. The file is only written to destinationPath if its checksum matches.
+	AcceptFile(offer packet.FilePacket, destinationPath string, progress TransferProgress) error
+	// RejectFile lets the peer offering the file know it will not be downloaded
+	RejectFile(offer packet.FilePacket) error
+	// CloseCommunication signs off and closes every socket, blocking till every goroutine of the
+	// communication has returned and the listeners have been notified of the end
 	CloseCommunication()
 }
@@ -3,10 +3,14 @@ package network
 import (
 	"fmt"
 	"net"
+	"reflect"
 	"testing"
+	"time"
+
+	"github.com/imyousuf/lan-messenger/utils"
 )
 
-func printIPv4Addresses(t *testing.T, netInterface net.Interface, unicast bool) {
+func printIPAddresses(t *testing.T, netInterface net.Interface, unicast bool) {
 	netType := "Multicast"
 	if unicast {
 		netType = "Unicast"
@@ -15,7 +19,10 @@ func printIPv4Addresses(t *testing.T, netInterface net.Interface, unicast bool)
 		fmt.Println("Flags for ", netInterface.Name, " ", netInterface.Flags.String(), ", ", netInterface.HardwareAddr)
 		return
 	}
-	addresses := getUpIPV4Addresses(netInterface, unicast)
+	addresses := getUpIPAddresses(netInterface)
+	if !unicast {
+		addresses, _ = netInterface.MulticastAddrs()
+	}
 	fmt.Println(netInterface.Name, fmt.Sprintf(" has %s addresses - ", netType), addresses)
 	staticTestIP := "172.16.2.6"
 	thatIP := net.ParseIP(staticTestIP)
@@ -33,9 +40,182 @@ func TestInterfaces(t *testing.T) {
 	if err == nil {
 		for _, netInterface := range interfaces {
 			// Unicast addresses
-			printIPv4Addresses(t, netInterface, true)
+			printIPAddresses(t, netInterface, true)
 			// Multicast addresses
-			printIPv4Addresses(t, netInterface, false)
+			printIPAddresses(t, netInterface, false)
+		}
+	}
+}
+
+func TestAddressFiltering(t *testing.T) {
+	parseIPNet := func(cidr string) net.Addr {
+		ip, ipNet, _ := net.ParseCIDR(cidr)
+		ipNet.IP = ip
+		return ipNet
+	}
+	unicasts := filterAddresses([]net.Addr{parseIPNet("192.168.1.250/24"), parseIPNet("fe80::1/64"),
+		parseIPNet("fd12:3456::1/64"), parseIPNet("2001:db8::1/64")}, isUsableUnicast)
+	if len(unicasts) != 3 || getIP(unicasts[2]).String() != "fd12:3456::1" {
+		t.Error("IPv4, link-local and unique local addresses should have been usable", unicasts)
+	}
+	if groups := groupByFamily(unicasts); len(groups[ipv4Family]) != 1 || len(groups[ipv6Family]) != 2 {
+		t.Error("Addresses should have been grouped by family", groups)
+	}
+}
+
+func TestIPv6ConnectionStrings(t *testing.T) {
+	linkLocal := &net.IPNet{IP: net.ParseIP("fe80::1"), Mask: net.CIDRMask(64, 128)}
+	uniqueLocal := &net.IPNet{IP: net.ParseIP("fd12:3456::1"), Mask: net.CIDRMask(64, 128)}
+	if str := getHostPortFromNetAddr(3000, linkLocal, "eth0"); str != "[fe80::1%eth0]:3000" {
+		t.Error("Link-local address should have been qualified with the zone", str)
+	}
+	if str := getHostPortFromNetAddr(3000, uniqueLocal, "eth0"); str != "[fd12:3456::1]:3000" {
+		t.Error("Unique local address should not have been qualified with the zone", str)
+	}
+	lc := _ListenerConfig{port: 3000, zone: "eth0", unicasts: []net.Addr{linkLocal, uniqueLocal}}
+	if replyTo := lc.getReplyTo(); replyTo != "[fd12:3456::1]:3000" {
+		t.Error("Reply-to should have preferred the address not link-scoped", replyTo)
+	}
+	lc.unicasts = []net.Addr{linkLocal}
+	if replyTo := lc.getReplyTo(); replyTo != "[fe80::1]:3000" {
+		t.Error("Link-local reply-to should have been advertised without the zone", replyTo)
+	}
+	compatibility := map[string]bool{"[fe80::2]:3000": true, "[fe80::2%eth0]:3000": true,
+		"[fe80::2%wlan0]:3000": false, "[fd12:3456::2]:3000": false, "192.168.1.2:3000": false}
+	for connectionStr, compatible := range compatibility {
+		if lc.isCompatible(connectionStr) != compatible {
+			t.Error("Compatibility not as expected", connectionStr, compatible)
+		}
+	}
+	zoned := map[string]string{"[fe80::2]:3000": "[fe80::2%eth0]:3000",
+		"[fe80::2%wlan0]:3000": "[fe80::2%wlan0]:3000", "[fd12:3456::2]:3000": "[fd12:3456::2]:3000",
+		"192.168.1.2:3000": "192.168.1.2:3000"}
+	actual := make(map[string]string)
+	for connectionStr := range zoned {
+		actual[connectionStr] = withZone(connectionStr, "eth0")
+	}
+	if !reflect.DeepEqual(zoned, actual) {
+		t.Error("Only link-local hosts without a zone should have been qualified", actual)
+	}
+}
+
+func TestNewMulticastConfig(t *testing.T) {
+	defaultConfig := NewConfig(30000, "eth0").GetMulticastConfig()
+	if defaultConfig.GetIPv4Group().String() != DefaultIPv4MulticastGroup ||
+		defaultConfig.GetIPv6Group().String() != DefaultIPv6MulticastGroup ||
+		defaultConfig.GetTTL() != DefaultMulticastTTL || !defaultConfig.IsLoopback() {
+		t.Error("Default multicast config not as expected", defaultConfig)
+	}
+	if NewConfig(30000).GetDeviceIndex() != DefaultDeviceIndex {
+		t.Error("Default device index should have been configured")
+	}
+	multicastConfig := NewMulticastConfig("239.1.2.3", "ff02::1234", 4, false)
+	if getMulticastGroup(multicastConfig, ipv4Family).String() != "239.1.2.3" ||
+		getMulticastGroup(multicastConfig, ipv6Family).String() != "ff02::1234" ||
+		multicastConfig.GetTTL() != 4 || multicastConfig.IsLoopback() {
+		t.Error("Multicast config not as expected", multicastConfig)
+	}
+	for _, groups := range [][]string{{"192.168.1.1", ""}, {"ff02::1234", ""}, {"", "239.1.2.3"},
+		{"", "fe80::1"}} {
+		panicked := false
+		utils.PanicableInvocation(func() {
+			NewMulticastConfig(groups[0], groups[1], 1, true)
+		}, func(interface{}) {
+			panicked = true
+		})
+		if !panicked {
+			t.Error("Groups not multicast addresses of their family should not have been accepted", groups)
 		}
 	}
 }
+
+func TestListenerConfig_multicast(t *testing.T) {
+	loopback, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip("No loopback interface supporting multicast")
+	}
+	lc := _ListenerConfig{port: 34600, zone: loopback.Name, interfaceIndex: loopback.Index,
+		unicasts: []net.Addr{&net.IPNet{IP: net.ParseIP("127.0.0.1").To4(), Mask: net.CIDRMask(8, 32)}},
+		group:    net.ParseIP(DefaultIPv4MulticastGroup), multicast: NewMulticastConfig("", "", 0, true)}
+	groupConn, err := lc.joinGroup()
+	if err != nil {
+		t.Skip("Could not join multicast group on loopback", err)
+	}
+	defer groupConn.Close()
+	sendConn, err := lc.dialDiscovery(lc.getGroupAddr())
+	if err != nil {
+		t.Fatal("Multicast group should have been dialed", err)
+	}
+	sendConn.Write([]byte("lamess"))
+	// Discovery broadcasts are all sent from the same port, one connection at a time
+	sendConn.Close()
+	groupConn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 16)
+	if n, _, err := groupConn.ReadFromUDP(buf); err != nil || string(buf[:n]) != "lamess" {
+		t.Error("Multicast should have been looped back to the group joined", err)
+	}
+	lc.discovery = &_DiscoveryState{broadcasting: true}
+	discoveryAddrs := lc.getDiscoveryAddrs()
+	if len(discoveryAddrs) != 1 || discoveryAddrs[0].String() != "127.255.255.255:34601" {
+		t.Fatal("Discovery should have been through the directed broadcast address", discoveryAddrs)
+	}
+	broadcastConn, err := lc.dialDiscovery(discoveryAddrs[0])
+	if err != nil {
+		t.Fatal("Directed broadcast address should have been dialed", err)
+	}
+	broadcastConn.Write([]byte("broadcast"))
+	broadcastConn.Close()
+	groupConn.SetReadDeadline(time.Now().Add(time.Second))
+	if n, _, err := groupConn.ReadFromUDP(buf); err != nil || string(buf[:n]) != "broadcast" {
+		t.Error("Directed broadcast should have been received through the group joined", err)
+	}
+}
+
+func TestIsListenable(t *testing.T) {
+	config := NewConfig(30000, "eth0", " en* ", "")
+	if !reflect.DeepEqual(config.GetInterfaces(), []string{"eth0", "en*"}) {
+		t.Error("Blank interface names should have been dropped", config.GetInterfaces())
+	}
+	for name, expected := range map[string]bool{"eth0": true, "enp0s3": true, "en0": true, "eth1": false,
+		"wlan0": false} {
+		if isListenable(net.Interface{Name: name}, config) != expected {
+			t.Error("Interface should have been listenable if matching any name", name, expected)
+		}
+	}
+	if !isListenable(net.Interface{Name: "wlan0"}, NewConfig(30000)) {
+		t.Error("Every interface should have been listenable with none configured")
+	}
+	utils.PanicableInvocation(func() {
+		NewConfig(30000, "en[")
+		t.Error("Malformed wildcard should have panicked")
+	}, func(panicReason interface{}) {})
+}
+
+func TestParseDiscoveryMode(t *testing.T) {
+	for _, mode := range []DiscoveryMode{AutoDiscovery, MulticastDiscovery, BroadcastDiscovery} {
+		if ParseDiscoveryMode(mode.String()) != mode {
+			t.Error("Discovery mode should have been parsed from its name", mode)
+		}
+	}
+	utils.PanicableInvocation(func() {
+		ParseDiscoveryMode("anycast")
+		t.Error("Unknown discovery mode should not have been parsed")
+	}, func(interface{}) {})
+}
+
+func TestListenerConfig_getDirectedBroadcastAddrs(t *testing.T) {
+	lc := _ListenerConfig{port: 30000, unicasts: []net.Addr{
+		&net.IPNet{IP: net.ParseIP("192.168.1.7"), Mask: net.CIDRMask(24, 32)},
+		&net.IPNet{IP: net.ParseIP("192.168.1.8").To4(), Mask: net.CIDRMask(24, 32)},
+		&net.IPNet{IP: net.ParseIP("10.1.2.3"), Mask: net.CIDRMask(8, 32)},
+		&net.IPNet{IP: net.ParseIP("10.9.9.9"), Mask: net.CIDRMask(32, 32)},
+		&net.IPNet{IP: net.ParseIP("fd12:3456::1"), Mask: net.CIDRMask(64, 128)}}}
+	broadcastAddrs := lc.getDirectedBroadcastAddrs()
+	if len(broadcastAddrs) != 2 || broadcastAddrs[0].String() != "192.168.1.255:30001" ||
+		broadcastAddrs[1].String() != "10.255.255.255:30001" {
+		t.Error("Directed broadcast address of each IPv4 subnet should have been returned once", broadcastAddrs)
+	}
+	if discoveryAddrs := lc.getDiscoveryAddrs(); len(discoveryAddrs) != 1 || discoveryAddrs[0].IP != nil {
+		t.Error("Discovery should have been through the group unless broadcasting", discoveryAddrs)
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !darwin && !freebsd && !linux
+// +build !darwin,!freebsd,!linux
+
+package network
+
+import (
+	"log"
+	"net"
+	"sync"
+)
+
+var unsupportedMulticastOptions sync.Once
+
+// setMulticastOptions leaves the multicast options to the defaults of the OS, as setting them is
+// not supported on it
+func setMulticastOptions(conn *net.UDPConn, lc _ListenerConfig) error {
+	unsupportedMulticastOptions.Do(func() {
+		log.Println("Multicast TTL and loopback are not configurable on this OS; using its defaults")
+	})
+	return nil
+}
@@ -0,0 +1,54 @@
+//go:build darwin || freebsd || linux
+// +build darwin freebsd linux
+
+package network
+
+import (
+	"net"
+	"syscall"
+)
+
+// setMulticastOptions sets the interface multicasts on the connection are sent out of, their TTL and
+// whether they are looped back to this host, rather than relying on the defaults of the OS
+func setMulticastOptions(conn *net.UDPConn, lc _ListenerConfig) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockoptErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		sockoptErr = setMulticastSockopts(int(fd), lc)
+	}); err != nil {
+		return err
+	}
+	return sockoptErr
+}
+
+func setMulticastSockopts(fd int, lc _ListenerConfig) error {
+	loopback := 0
+	if lc.multicast.IsLoopback() {
+		loopback = 1
+	}
+	if lc.group.To4() != nil {
+		var interfaceAddr [4]byte
+		copy(interfaceAddr[:], getIP(lc.unicasts[0]).To4())
+		if err := syscall.SetsockoptInet4Addr(fd, syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF,
+			interfaceAddr); err != nil {
+			return err
+		}
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL,
+			lc.multicast.GetTTL()); err != nil {
+			return err
+		}
+		return syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MULTICAST_LOOP, loopback)
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF,
+		lc.interfaceIndex); err != nil {
+		return err
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS,
+		lc.multicast.GetTTL()); err != nil {
+		return err
+	}
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_LOOP, loopback)
+}
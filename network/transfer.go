@@ -0,0 +1,450 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/imyousuf/lan-messenger/identity"
+	"github.com/imyousuf/lan-messenger/packet"
+)
+
+const (
+	// fileTransferProtocol prefixes every line exchanged over TCP before the file is streamed
+	fileTransferProtocol       = "LAMESS-FILE/1"
+	fileTransferOK             = "OK"
+	fileTransferError          = "ERR"
+	fileOfferExpiry            = time.Hour
+	fileTransferRequestTimeout = 10 * time.Second
+	maxFileTransferAttempts    = 3
+	partialFileSuffix          = ".part"
+	// maxSealedChunkSize bounds the length of a sealed chunk of the file stream read
+	maxSealedChunkSize = 64 * 1024
+	// FileOfferNotFoundErrorMsg is sent to the peer requesting a file not offered to it
+	FileOfferNotFoundErrorMsg = "file offer not found"
+	// FileChecksumMismatchErrorMsg is returned when the file received does not match its offer
+	FileChecksumMismatchErrorMsg = "file checksum did not match"
+	// FileTransferPeerNotFoundErrorMsg is returned when the peer session of a transfer is not known
+	FileTransferPeerNotFoundErrorMsg = "file transfer peer not known"
+	// FileTransferNotSupportedErrorMsg is returned when offering a file to a peer not supporting it
+	FileTransferNotSupportedErrorMsg = "file transfer not supported by peer"
+	// InvalidFileChunkErrorMsg is returned when a chunk of the file stream is too long to be one
+	InvalidFileChunkErrorMsg = "file chunk is not valid"
+)
+
+// FileTransferRefusedError represents the peer refusing to stream a file, in which case the
+// transfer is not retried
+type FileTransferRefusedError string
+
+func (err FileTransferRefusedError) Error() string {
+	return string(err)
+}
+
+// TransferProgress is called as a file is being transferred with the number of bytes of the file
+// transferred so far and the size of the file
+type TransferProgress func(transferred int64, total int64)
+
+// _ProgressWriter reports the bytes written through it to the progress
+type _ProgressWriter struct {
+	transferred int64
+	total       int64
+	progress    TransferProgress
+}
+
+func (writer *_ProgressWriter) Write(buf []byte) (int, error) {
+	writer.transferred += int64(len(buf))
+	if writer.progress != nil {
+		writer.progress(writer.transferred, writer.total)
+	}
+	return len(buf), nil
+}
+
+// _FileOffer is a file offered to the peer session at recipientHost, which is served till it
+// expires
+type _FileOffer struct {
+	filePath           string
+	fileSize           int64
+	recipientSessionID string
+	recipientHost      string
+	expiryTime         time.Time
+	progress           TransferProgress
+}
+
+// _SealingWriter seals every buffer written through it with the cipher, writing it as a chunk
+// prefixed with its length. Each chunk is bound to the transfer and the offset of the file it
+// starts at, so that chunks can neither be reordered nor moved between transfers.
+type _SealingWriter struct {
+	writer     io.Writer
+	cipher     identity.Cipher
+	transferID string
+	offset     int64
+}
+
+func (writer *_SealingWriter) Write(buf []byte) (int, error) {
+	sealed, err := writer.cipher.Seal(buf, getChunkAdditionalData(writer.transferID, writer.offset))
+	if err != nil {
+		return 0, err
+	}
+	chunk := make([]byte, 4, 4+len(sealed))
+	binary.BigEndian.PutUint32(chunk, uint32(len(sealed)))
+	if _, err := writer.writer.Write(append(chunk, sealed...)); err != nil {
+		return 0, err
+	}
+	writer.offset += int64(len(buf))
+	return len(buf), nil
+}
+
+func getChunkAdditionalData(transferID string, offset int64) []byte {
+	return []byte(transferID + " " + strconv.FormatInt(offset, 10))
+}
+
+// readSealedChunk reads the chunk of the file stream starting at the offset and opens it
+func readSealedChunk(reader io.Reader, cipher identity.Cipher, transferID string,
+	offset int64) ([]byte, error) {
+	length := make([]byte, 4)
+	if _, err := io.ReadFull(reader, length); err != nil {
+		return nil, err
+	}
+	chunkSize := binary.BigEndian.Uint32(length)
+	if chunkSize > maxSealedChunkSize {
+		return nil, errors.New(InvalidFileChunkErrorMsg)
+	}
+	sealed := make([]byte, chunkSize)
+	if _, err := io.ReadFull(reader, sealed); err != nil {
+		return nil, err
+	}
+	return cipher.Open(sealed, getChunkAdditionalData(transferID, offset))
+}
+
+// sealFileRequest returns the proof that the request for the transfer from the offset is made by
+// the session the file was offered to, as only the two ends can seal with their cipher
+func sealFileRequest(cipher identity.Cipher, transferID string, offset int64) (string, error) {
+	proof, err := cipher.Seal(getChunkAdditionalData(transferID, offset), []byte(fileTransferProtocol))
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(proof), nil
+}
+
+func openFileRequest(cipher identity.Cipher, transferID string, offset int64, proof string) bool {
+	sealed, err := base64.StdEncoding.DecodeString(proof)
+	if err != nil {
+		return false
+	}
+	request, err := cipher.Open(sealed, []byte(fileTransferProtocol))
+	return err == nil && bytes.Equal(request, getChunkAdditionalData(transferID, offset))
+}
+
+// _FileTransfers serves the files offered to peers over TCP listeners on the unicast addresses,
+// sealing them with the cipher of the session each is offered to
+type _FileTransfers struct {
+	getCipher   func(sessionID string) (identity.Cipher, error)
+	offers      sync.Map
+	mutex       sync.Mutex
+	listeners   []net.Listener
+	connections map[net.Conn]bool
+	routines    sync.WaitGroup
+	closed      bool
+}
+
+func newFileTransfers(getCipher func(sessionID string) (identity.Cipher, error)) *_FileTransfers {
+	return &_FileTransfers{getCipher: getCipher, connections: make(map[net.Conn]bool)}
+}
+
+func (transfers *_FileTransfers) offer(transferID string, offer *_FileOffer) {
+	transfers.offers.Store(transferID, offer)
+}
+
+func (transfers *_FileTransfers) withdraw(transferID string) {
+	transfers.offers.Delete(transferID)
+}
+
+// withdrawFor withdraws the offer only if it was made to the peer session
+func (transfers *_FileTransfers) withdrawFor(transferID string, recipientSessionID string) {
+	if value, found := transfers.offers.Load(transferID); found &&
+		value.(*_FileOffer).recipientSessionID == recipientSessionID {
+		transfers.withdraw(transferID)
+	}
+}
+
+func (transfers *_FileTransfers) cleanExpiredOffers() {
+	now := time.Now()
+	transfers.offers.Range(func(key interface{}, value interface{}) bool {
+		if value.(*_FileOffer).expiryTime.Before(now) {
+			transfers.offers.Delete(key)
+		}
+		return true
+	})
+}
+
+func (transfers *_FileTransfers) listen(listeningStr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", listeningStr)
+	if err != nil {
+		return nil, err
+	}
+	transfers.mutex.Lock()
+	defer transfers.mutex.Unlock()
+	if transfers.closed {
+		listener.Close()
+		return nil, errors.New(CommunicationClosedErrorMsg)
+	}
+	transfers.listeners = append(transfers.listeners, listener)
+	transfers.routines.Add(1)
+	go func() {
+		defer transfers.routines.Done()
+		for {
+			connection, err := listener.Accept()
+			if err != nil {
+				// Listener is closed
+				return
+			}
+			transfers.startServing(connection)
+		}
+	}()
+	return listener, nil
+}
+
+// startServing serves the connection unless the transfers are closed
+func (transfers *_FileTransfers) startServing(connection net.Conn) {
+	transfers.mutex.Lock()
+	defer transfers.mutex.Unlock()
+	if transfers.closed {
+		connection.Close()
+		return
+	}
+	transfers.connections[connection] = true
+	transfers.routines.Add(1)
+	go func() {
+		defer transfers.routines.Done()
+		transfers.serve(connection)
+		transfers.mutex.Lock()
+		delete(transfers.connections, connection)
+		transfers.mutex.Unlock()
+	}()
+}
+
+// unlisten closes the listener, for when the address it listens on is gone
+func (transfers *_FileTransfers) unlisten(listener net.Listener) {
+	transfers.mutex.Lock()
+	defer transfers.mutex.Unlock()
+	for index, aListener := range transfers.listeners {
+		if aListener == listener {
+			transfers.listeners = append(transfers.listeners[:index], transfers.listeners[index+1:]...)
+			break
+		}
+	}
+	listener.Close()
+}
+
+// close stops listening and interrupts the files being served, returning once they have stopped
+func (transfers *_FileTransfers) close() {
+	transfers.mutex.Lock()
+	transfers.closed = true
+	for _, listener := range transfers.listeners {
+		listener.Close()
+	}
+	transfers.listeners = nil
+	for connection := range transfers.connections {
+		connection.Close()
+	}
+	transfers.mutex.Unlock()
+	transfers.routines.Wait()
+}
+
+// parseFileRequest parses the request line
+// `LAMESS-FILE/1 <transfer ID> <session ID> <offset> <proof>`, where the session is the one
+// requesting the file and the proof is as sealed by sealFileRequest
+func parseFileRequest(request string) (string, string, int64, string, bool) {
+	fields := strings.Fields(request)
+	if len(fields) != 5 || fields[0] != fileTransferProtocol {
+		return "", "", 0, "", false
+	}
+	offset, err := strconv.ParseInt(fields[3], 10, 64)
+	return fields[1], fields[2], offset, fields[4], err == nil && offset >= 0
+}
+
+// findOffer returns the offer if it was made to the session requesting it and the host connecting
+// is the one of the session
+func (transfers *_FileTransfers) findOffer(transferID string, sessionID string,
+	remoteAddr net.Addr) (*_FileOffer, bool) {
+	value, found := transfers.offers.Load(transferID)
+	if !found {
+		return nil, false
+	}
+	offer := value.(*_FileOffer)
+	remoteHost, _, err := net.SplitHostPort(remoteAddr.String())
+	// Peers connecting over a link-local address are seen with the zone of this end
+	remoteHost, _ = splitZone(remoteHost)
+	if err != nil || sessionID != offer.recipientSessionID || remoteHost != offer.recipientHost ||
+		offer.expiryTime.Before(time.Now()) {
+		return nil, false
+	}
+	return offer, true
+}
+
+// authenticate returns the cipher of the session the offer was made to if the request was sealed
+// with it
+func (transfers *_FileTransfers) authenticate(offer *_FileOffer, transferID string, offset int64,
+	proof string) (identity.Cipher, bool) {
+	cipher, err := transfers.getCipher(offer.recipientSessionID)
+	if err != nil || !openFileRequest(cipher, transferID, offset, proof) {
+		return nil, false
+	}
+	return cipher, true
+}
+
+// serve streams the file requested from the offset requested, if it was offered to the session
+// requesting it from the host connecting and the request is sealed by that session. The file is
+// streamed sealed with the cipher of the session.
+func (transfers *_FileTransfers) serve(connection net.Conn) {
+	defer connection.Close()
+	connection.SetDeadline(time.Now().Add(fileTransferRequestTimeout))
+	request, err := bufio.NewReader(connection).ReadString('\n')
+	if err != nil {
+		return
+	}
+	transferID, sessionID, offset, proof, valid := parseFileRequest(request)
+	offer, found := transfers.findOffer(transferID, sessionID, connection.RemoteAddr())
+	var cipher identity.Cipher
+	if valid && found {
+		cipher, found = transfers.authenticate(offer, transferID, offset, proof)
+	}
+	if !valid || !found || offset > offer.fileSize {
+		fmt.Fprintln(connection, fileTransferProtocol, fileTransferError, FileOfferNotFoundErrorMsg)
+		return
+	}
+	file, err := os.Open(offer.filePath)
+	if err == nil {
+		defer file.Close()
+		_, err = file.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		log.Println("Could not serve file", transferID, err)
+		fmt.Fprintln(connection, fileTransferProtocol, fileTransferError, err)
+		return
+	}
+	connection.SetDeadline(time.Time{})
+	fmt.Fprintln(connection, fileTransferProtocol, fileTransferOK, offer.fileSize-offset)
+	progressWriter := &_ProgressWriter{transferred: offset, total: offer.fileSize, progress: offer.progress}
+	sealingWriter := &_SealingWriter{writer: connection, cipher: cipher, transferID: transferID, offset: offset}
+	if _, err := io.CopyN(io.MultiWriter(sealingWriter, progressWriter), file,
+		offer.fileSize-offset); err != nil {
+		log.Println("File transfer interrupted", transferID, err)
+	}
+}
+
+// getFileChecksum returns the SHA-256 checksum and the size of the file
+func getFileChecksum(filePath string) ([]byte, int64, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return nil, 0, err
+	}
+	return hash.Sum(nil), size, nil
+}
+
+// resumeDownload appends the part of the file not downloaded yet to the partial file, opening the
+// stream with the cipher of the session offering it
+func resumeDownload(connectionStr string, offer packet.FilePacket, partialPath string, cipher identity.Cipher,
+	progress TransferProgress) error {
+	file, err := os.OpenFile(partialPath, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if offset > offer.GetFileSize() {
+		// Not a part of this file, so start over
+		if err := file.Truncate(0); err != nil {
+			return err
+		}
+		offset, _ = file.Seek(0, io.SeekStart)
+	}
+	if offset == offer.GetFileSize() {
+		return nil
+	}
+	connection, err := net.DialTimeout("tcp", connectionStr, fileTransferRequestTimeout)
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+	proof, err := sealFileRequest(cipher, offer.GetTransferID(), offset)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(connection, fileTransferProtocol, offer.GetTransferID(), packet.GetCurrentSessionID(), offset,
+		proof)
+	reader := bufio.NewReader(connection)
+	connection.SetReadDeadline(time.Now().Add(fileTransferRequestTimeout))
+	response, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	fields := strings.SplitN(strings.TrimSpace(response), " ", 3)
+	if len(fields) != 3 || fields[0] != fileTransferProtocol || fields[1] != fileTransferOK {
+		return FileTransferRefusedError(strings.TrimSpace(response))
+	}
+	connection.SetReadDeadline(time.Time{})
+	progressWriter := &_ProgressWriter{transferred: offset, total: offer.GetFileSize(), progress: progress}
+	for offset < offer.GetFileSize() {
+		chunk, err := readSealedChunk(reader, cipher, offer.GetTransferID(), offset)
+		if err == nil {
+			_, err = io.MultiWriter(file, progressWriter).Write(chunk)
+		}
+		if err != nil {
+			return err
+		}
+		offset += int64(len(chunk))
+	}
+	return nil
+}
+
+// downloadFile downloads the file offered from the peer at connectionStr to destinationPath, the
+// cipher being the one of the session offering it. The file is downloaded to a partial file next
+// to the destination, so that an interrupted transfer resumes from where it stopped, and is only
+// moved to the destination once its checksum matches.
+func downloadFile(connectionStr string, offer packet.FilePacket, destinationPath string, cipher identity.Cipher,
+	progress TransferProgress) error {
+	partialPath := destinationPath + partialFileSuffix
+	var err error
+	for attempt := 1; attempt <= maxFileTransferAttempts; attempt++ {
+		err = resumeDownload(connectionStr, offer, partialPath, cipher, progress)
+		if _, refused := err.(FileTransferRefusedError); err == nil || refused {
+			break
+		}
+		log.Println("File transfer interrupted", offer.GetTransferID(), err)
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+	if err != nil {
+		return err
+	}
+	checksum, _, err := getFileChecksum(partialPath)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(checksum, offer.GetChecksum()) {
+		os.Remove(partialPath)
+		return errors.New(FileChecksumMismatchErrorMsg)
+	}
+	return os.Rename(partialPath, destinationPath)
+}
@@ -0,0 +1,195 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/imyousuf/lan-messenger/identity"
+	"github.com/imyousuf/lan-messenger/packet"
+)
+
+// newTestTransferCiphers returns the ciphers the end offering and the end downloading agree upon
+func newTestTransferCiphers(t *testing.T) (identity.Cipher, identity.Cipher) {
+	offering, _ := identity.NewIdentity()
+	downloading, _ := identity.NewIdentity()
+	offeringCipher, err := offering.NewCipher(downloading.GetAgreementKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloadingCipher, err := downloading.NewCipher(offering.GetAgreementKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return offeringCipher, downloadingCipher
+}
+
+func setupTestFileTransfer(t *testing.T, recipientSessionID string,
+	recipientHost string) (*_FileTransfers, string, packet.FilePacket, []byte, string, identity.Cipher) {
+	directory, err := ioutil.TempDir("", "lamess-transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	filePath := filepath.Join(directory, "data.bin")
+	if err := ioutil.WriteFile(filePath, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	checksum, fileSize, err := getFileChecksum(filePath)
+	if err != nil || fileSize != int64(len(content)) {
+		t.Fatal("Checksum could not be computed", err)
+	}
+	offeringCipher, downloadingCipher := newTestTransferCiphers(t)
+	transfers := newFileTransfers(func(sessionID string) (identity.Cipher, error) {
+		return offeringCipher, nil
+	})
+	if _, err := transfers.listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	transfers.offer("T1", &_FileOffer{filePath: filePath, fileSize: fileSize,
+		recipientSessionID: recipientSessionID, recipientHost: recipientHost,
+		expiryTime: time.Now().Add(time.Minute)})
+	offer := packet.NewBuilderFactory().File("T1").Offer("data.bin", fileSize, checksum).BuildFilePacket()
+	return transfers, transfers.listeners[0].Addr().String(), offer, content,
+		filepath.Join(directory, "received.bin"), downloadingCipher
+}
+
+func TestFileTransfer_download(t *testing.T) {
+	transfers, connectionStr, offer, content, destinationPath, cipher := setupTestFileTransfer(t,
+		packet.GetCurrentSessionID(), "127.0.0.1")
+	defer transfers.close()
+	defer os.RemoveAll(filepath.Dir(destinationPath))
+	var lastTransferred, lastTotal int64
+	err := downloadFile(connectionStr, offer, destinationPath, cipher, func(transferred int64, total int64) {
+		lastTransferred, lastTotal = transferred, total
+	})
+	if received, _ := ioutil.ReadFile(destinationPath); err != nil || !bytes.Equal(received, content) {
+		t.Error("File should have been downloaded", err)
+	}
+	if lastTransferred != offer.GetFileSize() || lastTotal != offer.GetFileSize() {
+		t.Error("Progress should have been reported till completion", lastTransferred, lastTotal)
+	}
+	if _, err := os.Stat(destinationPath + partialFileSuffix); !os.IsNotExist(err) {
+		t.Error("Partial file should have been moved to destination")
+	}
+}
+
+func TestFileTransfer_resume(t *testing.T) {
+	transfers, connectionStr, offer, content, destinationPath, cipher := setupTestFileTransfer(t,
+		packet.GetCurrentSessionID(), "127.0.0.1")
+	defer transfers.close()
+	defer os.RemoveAll(filepath.Dir(destinationPath))
+	half := int64(len(content) / 2)
+	if err := ioutil.WriteFile(destinationPath+partialFileSuffix, content[:half], 0600); err != nil {
+		t.Fatal(err)
+	}
+	var firstTransferred int64
+	err := downloadFile(connectionStr, offer, destinationPath, cipher, func(transferred int64, total int64) {
+		if firstTransferred == 0 {
+			firstTransferred = transferred
+		}
+	})
+	if received, _ := ioutil.ReadFile(destinationPath); err != nil || !bytes.Equal(received, content) {
+		t.Error("File should have been downloaded", err)
+	}
+	if firstTransferred <= half {
+		t.Error("Download should have resumed from the partial file", firstTransferred)
+	}
+}
+
+func TestFileTransfer_checksumMismatch(t *testing.T) {
+	transfers, connectionStr, offer, _, destinationPath, cipher := setupTestFileTransfer(t,
+		packet.GetCurrentSessionID(), "127.0.0.1")
+	defer transfers.close()
+	defer os.RemoveAll(filepath.Dir(destinationPath))
+	tamperedOffer := packet.NewBuilderFactory().File(offer.GetTransferID()).
+		Offer(offer.GetFileName(), offer.GetFileSize(), make([]byte, 32)).BuildFilePacket()
+	err := downloadFile(connectionStr, tamperedOffer, destinationPath, cipher, nil)
+	if err == nil || err.Error() != FileChecksumMismatchErrorMsg {
+		t.Error("Checksum mismatch should have failed the download", err)
+	}
+	for _, path := range []string{destinationPath, destinationPath + partialFileSuffix} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Error("File failing checksum should have been removed", path)
+		}
+	}
+}
+
+func TestFileTransfer_refused(t *testing.T) {
+	transfers, connectionStr, offer, _, destinationPath, cipher := setupTestFileTransfer(t, packet.GetCurrentSessionID(),
+		"127.0.0.2")
+	defer transfers.close()
+	defer os.RemoveAll(filepath.Dir(destinationPath))
+	err := downloadFile(connectionStr, offer, destinationPath, cipher, nil)
+	if _, refused := err.(FileTransferRefusedError); !refused {
+		t.Error("File should not have been served to a host it was not offered to", err)
+	}
+	transfers.withdrawFor("T1", "other-session")
+	if _, found := transfers.offers.Load("T1"); !found {
+		t.Error("Offer should not have been withdrawn by a session it was not offered to")
+	}
+	transfers.withdrawFor("T1", packet.GetCurrentSessionID())
+	if _, found := transfers.offers.Load("T1"); found {
+		t.Error("Offer should have been withdrawn")
+	}
+}
+
+func TestFileTransfer_refusedToOtherSession(t *testing.T) {
+	// Another session on the host the file was offered to, e.g. of another user
+	transfers, connectionStr, offer, _, destinationPath, cipher := setupTestFileTransfer(t, "other-session", "127.0.0.1")
+	defer transfers.close()
+	defer os.RemoveAll(filepath.Dir(destinationPath))
+	err := downloadFile(connectionStr, offer, destinationPath, cipher, nil)
+	if _, refused := err.(FileTransferRefusedError); !refused {
+		t.Error("File should not have been served to a session it was not offered to", err)
+	}
+}
+
+func TestFileTransfer_refusedUnauthenticated(t *testing.T) {
+	transfers, connectionStr, offer, _, destinationPath, _ := setupTestFileTransfer(t,
+		packet.GetCurrentSessionID(), "127.0.0.1")
+	defer transfers.close()
+	defer os.RemoveAll(filepath.Dir(destinationPath))
+	// Claiming the session the file was offered to without its agreement key
+	_, otherCipher := newTestTransferCiphers(t)
+	err := downloadFile(connectionStr, offer, destinationPath, otherCipher, nil)
+	if _, refused := err.(FileTransferRefusedError); !refused {
+		t.Error("File should not have been served to a request not sealed by the session", err)
+	}
+}
+
+func TestFileTransfer_sealedStream(t *testing.T) {
+	transfers, connectionStr, offer, content, destinationPath, cipher := setupTestFileTransfer(t,
+		packet.GetCurrentSessionID(), "127.0.0.1")
+	defer transfers.close()
+	defer os.RemoveAll(filepath.Dir(destinationPath))
+	connection, err := net.Dial("tcp", connectionStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Close()
+	proof, _ := sealFileRequest(cipher, offer.GetTransferID(), 0)
+	fmt.Fprintln(connection, fileTransferProtocol, offer.GetTransferID(), packet.GetCurrentSessionID(), 0, proof)
+	reader := bufio.NewReader(connection)
+	if response, _ := reader.ReadString('\n'); response != fmt.Sprintln(fileTransferProtocol, fileTransferOK,
+		len(content)) {
+		t.Fatal("File should have been served", response)
+	}
+	stream, _ := ioutil.ReadAll(reader)
+	if bytes.Contains(stream, content[:100]) {
+		t.Error("File should not have been streamed in plaintext")
+	}
+	chunk, err := readSealedChunk(bytes.NewReader(stream), cipher, offer.GetTransferID(), 0)
+	if err != nil || !bytes.Equal(chunk, content[:len(chunk)]) {
+		t.Error("First chunk should have been opened with the cipher of the session", err)
+	}
+	if _, err := readSealedChunk(bytes.NewReader(stream), cipher, offer.GetTransferID(), 1); err == nil {
+		t.Error("Chunk should not have been opened at another offset")
+	}
+}
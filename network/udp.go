@@ -1,11 +1,19 @@
 package network
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"log"
 	"net"
+	"path/filepath"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/google/uuid"
+
+	"github.com/imyousuf/lan-messenger/identity"
 	"github.com/imyousuf/lan-messenger/packet"
 	"github.com/imyousuf/lan-messenger/profile"
 	"github.com/imyousuf/lan-messenger/utils"
@@ -14,18 +22,53 @@ import (
 const (
 	sessionTimeout = 5 * time.Minute
 	pingInterval   = 2 * time.Minute
+	// discoveryFallbackWindow is how long AutoDiscovery waits for a peer to be found through
+	// multicast before falling back to broadcast
+	discoveryFallbackWindow = 10 * time.Second
+	// maxRegisterAttempts and registerRetryInterval bound how long a REGISTER is retried, the interval
+	// growing with every attempt
+	maxRegisterAttempts   = 10
+	registerRetryInterval = 500 * time.Millisecond
+	// interfaceWatchInterval is how often the addresses of the interfaces are checked for changes
+	interfaceWatchInterval = 10 * time.Second
+	// CommunicationClosedErrorMsg is the error returned when listening once the communication is
+	// closing
+	CommunicationClosedErrorMsg = "communication closed"
 )
 
 // UDPCommunication is a concrete implementation of Communication interface
 type _UDPCommunication struct {
+	config Config
+	ctx    context.Context
+	cancel context.CancelFunc
+	// listenersMutex also guards started and closing, so that nothing is listened to or spawned once
+	// closing
+	listenersMutex     sync.RWMutex
 	listeners          map[string]_ListenerConfig
+	listenerSockets    map[string]*_ListenerSockets
+	started            bool
+	closing            bool
+	routines           sync.WaitGroup
+	handlers           sync.WaitGroup
+	drainer            sync.WaitGroup
 	messageChannel     chan []byte
 	broadcastChannel   chan []byte
 	messageListeners   []MessageListener
 	broadcastListeners []BroadcastListener
-	pingQuit           chan int
 	selfProfile        profile.UserProfile
+	selfIdentity       identity.Identity
 	sessionRegistry    sync.Map
+	pendingDeliveries  *_PendingDeliveries
+	retransmitPolicy   _RetransmitPolicy
+	reassembler        *_Reassembler
+	presenceMutex      sync.Mutex
+	presence           profile.Presence
+	fileTransfers      *_FileTransfers
+	discoveryMode      DiscoveryMode
+	fallbackWindow     time.Duration
+	watchInterval      time.Duration
+	mdnsEnabled        bool
+	deviceIndex        uint8
 }
 
 func (comm *_UDPCommunication) isNotDuplicate(event Event) bool {
@@ -34,12 +77,14 @@ func (comm *_UDPCommunication) isNotDuplicate(event Event) bool {
 		return false
 	}
 	if value, ok := comm.sessionRegistry.Load(sessionID); ok {
-		registryEntry := value.(_RegistryEntry)
-		if _, packetExists := registryEntry.packetRegistry[packetID]; packetExists {
-			registryEntry.packetRegistry[packetID]++
+		entry := value.(*_RegistryEntry)
+		if !entry.registerPacket(packetID) {
 			return false
 		}
-		registryEntry.packetRegistry[packetID] = 1
+		if registerEvent, eventOk := event.(RegisterEvent); eventOk {
+			// Registering again, e.g. from a new address
+			entry.reregister(registerEvent)
+		}
 		return true
 	} else if registerEvent, eventOk := event.(RegisterEvent); eventOk {
 		comm.sessionRegistry.Store(sessionID, newRegistryEntry(registerEvent))
@@ -49,20 +94,47 @@ func (comm *_UDPCommunication) isNotDuplicate(event Event) bool {
 	}
 }
 
+// isAuthentic verifies the signature of the event against the identity key bound to its session.
+// A RegisterEvent binds the key it publishes to its session, so it is verified using that key,
+// unless the session is already bound to a different key.
+func (comm *_UDPCommunication) isAuthentic(event Event) bool {
+	signedEvent, ok := event.(_SignedEvent)
+	if !ok {
+		return false
+	}
+	sessionID, _ := event.GetEventIdentifier()
+	var publicKey []byte
+	if value, found := comm.sessionRegistry.Load(sessionID); found {
+		publicKey = value.(*_RegistryEntry).publicKey
+	}
+	if registerEvent, isRegisterEvent := event.(RegisterEvent); isRegisterEvent {
+		publishedKey := registerEvent.GetRegisterPacket().GetPublicKey()
+		if publicKey != nil && !bytes.Equal(publicKey, publishedKey) {
+			log.Println("Dropping register event rebinding identity key of session", sessionID)
+			return false
+		}
+		publicKey = publishedKey
+	}
+	if !identity.Verify(publicKey, signedEvent.getSignedData(), signedEvent.getSignature()) {
+		log.Println("Dropping event failing signature verification", event.GetName(), sessionID)
+		return false
+	}
+	return true
+}
+
 func (comm *_UDPCommunication) renewRegistryEntry(event PingEvent) {
 	sessionID, _ := event.GetEventIdentifier()
 	if value, ok := comm.sessionRegistry.Load(sessionID); ok {
-		registryEntry := value.(_RegistryEntry)
-		registryEntry.expiryTime = event.GetPingPacket().GetExpiryTime()
+		value.(*_RegistryEntry).renew(event.GetPingPacket().GetExpiryTime())
 	}
 }
 
 func (comm *_UDPCommunication) cleanExpiredRegistryEntries() {
 	comm.sessionRegistry.Range(func(key interface{}, value interface{}) bool {
 		sessionID := key.(string)
-		registryEvent := value.(_RegistryEntry)
+		registryEvent := value.(*_RegistryEntry)
 		now := time.Now()
-		if registryEvent.expiryTime.Before(now) {
+		if registryEvent.getExpiryTime().Before(now) {
 			comm.sessionRegistry.Delete(sessionID)
 		}
 		return true
@@ -70,10 +142,62 @@ func (comm *_UDPCommunication) cleanExpiredRegistryEntries() {
 }
 
 func (comm *_UDPCommunication) handleRawMessages() {
-	for message := range comm.messageChannel {
-		event := _MessageEvent{message: string(message)}
-		for _, listener := range comm.messageListeners {
-			listener.HandleMessageReceived(event)
+	for datagram := range comm.messageChannel {
+		message, complete := comm.reassembler.accept(datagram)
+		if !complete {
+			continue
+		}
+		anEvent := createEventFromEventData(message)
+		if !comm.isAuthentic(anEvent) {
+			continue
+		}
+		switch event := anEvent.(type) {
+		case RegisterEvent:
+			// A peer replying to the REGISTER broadcast of this session
+			if !comm.isNotDuplicate(event) {
+				continue
+			}
+			comm.markPeerFound(event)
+			for _, listener := range comm.broadcastListeners {
+				// Replying to a reply would have the peers reply to each other endlessly
+				if _, isInternal := listener.(_InnerListener); !isInternal {
+					listener.HandleRegisterEvent(event)
+				}
+			}
+		case AckEvent:
+			ackPacket := event.GetAckPacket()
+			comm.pendingDeliveries.acknowledge(_PacketKey{sessionID: ackPacket.GetAcknowledgedSessionID(),
+				packetID: ackPacket.GetAcknowledgedPacketID(), recipientSessionID: ackPacket.GetSessionID()})
+		case MessageEvent:
+			decryptedEvent, decrypted := comm.decryptMessage(event)
+			if !decrypted {
+				continue
+			}
+			// Acknowledge even duplicates as retransmission means our last ACK got lost
+			comm.acknowledge(event)
+			if !comm.isNotDuplicate(event) {
+				continue
+			}
+			for _, listener := range comm.messageListeners {
+				listener.HandleMessageReceived(decryptedEvent)
+			}
+		case RoomEvent:
+			comm.acknowledge(event)
+			if !comm.isNotDuplicate(event) {
+				continue
+			}
+			for _, listener := range comm.messageListeners {
+				listener.HandleRoomEvent(event)
+			}
+		case FileEvent:
+			comm.acknowledge(event)
+			if !comm.isNotDuplicate(event) {
+				continue
+			}
+			comm.handleFileEvent(event)
+			for _, listener := range comm.messageListeners {
+				listener.HandleFileEvent(event)
+			}
 		}
 	}
 	for _, listener := range comm.messageListeners {
@@ -82,9 +206,21 @@ func (comm *_UDPCommunication) handleRawMessages() {
 }
 
 func (comm *_UDPCommunication) handleRawBroadcasts() {
-	for message := range comm.broadcastChannel {
+	for datagram := range comm.broadcastChannel {
+		message, complete := comm.reassembler.accept(datagram)
+		if !complete {
+			continue
+		}
 		event := createEventFromEventData(message)
-		if comm.isNotDuplicate(event) {
+		// Multicasts are looped back to this host, so that instances on the same host discover each
+		// other, which brings back the broadcasts of this session too
+		if sessionID, _ := event.GetEventIdentifier(); sessionID == packet.GetCurrentSessionID() {
+			continue
+		}
+		if comm.isAuthentic(event) && comm.isNotDuplicate(event) {
+			if registerEvent, isRegisterEvent := event.(RegisterEvent); isRegisterEvent {
+				comm.markPeerFound(registerEvent)
+			}
 			for _, listener := range comm.broadcastListeners {
 				switch event.(type) {
 				case RegisterEvent:
@@ -94,7 +230,7 @@ func (comm *_UDPCommunication) handleRawBroadcasts() {
 				case SignOffEvent:
 					listener.HandleSignOffEvent(event.(SignOffEvent))
 				default:
-					panic("Event type not supported for broadcast consumption")
+					log.Println("Ignoring event not supported for broadcast consumption", event.GetName())
 				}
 			}
 		}
@@ -148,107 +284,467 @@ func (comm *_UDPCommunication) RemoveBroadcastListener(listener BroadcastListene
 	return oldLen > len(comm.broadcastListeners)
 }
 
-func (comm *_UDPCommunication) listen(config Config) error {
-	port := config.GetPort()
+// getListenerConfigs returns a listener per family, i.e. IPv4 and IPv6, of every interface listenable
+// as configured, keyed by the name of the interface and the family
+func getListenerConfigs(config Config) (map[string]_ListenerConfig, error) {
 	listeners := make(map[string]_ListenerConfig)
 	interfaces, err := net.Interfaces()
-	messageChannel := make(chan []byte)
-	broadcastChannel := make(chan []byte)
-	if err == nil {
-		for _, netInterface := range interfaces {
-			if isInterfaceIgnorable(netInterface) {
-				continue
-			}
-			if !isListenable(netInterface, config) {
+	if err != nil {
+		return listeners, err
+	}
+	for _, netInterface := range interfaces {
+		if isInterfaceIgnorable(netInterface) {
+			continue
+		}
+		if !isListenable(netInterface, config) {
+			continue
+		}
+		unicastsByFamily := groupByFamily(getUpIPAddresses(netInterface))
+		for _, family := range []string{ipv4Family, ipv6Family} {
+			addresses := unicastsByFamily[family]
+			if len(addresses) == 0 {
 				continue
 			}
-			// Loop for message interfaces
-			addresses := getUpIPV4Addresses(netInterface, true)
-			for _, address := range addresses {
-				go listenForMessage(port, &address, messageChannel)
-			}
-			// Loop for broadcast interfaces but listen to the next port from
-			// the port requested for
-			mAddresses := getUpIPV4Addresses(netInterface, false)
-			for _, address := range mAddresses {
-				go listenForMessage(port+1, &address, broadcastChannel)
-			}
-			// Add _ListenerConfig
-			listeners[netInterface.Name] = _ListenerConfig{
-				unicasts:   addresses,
-				multicasts: mAddresses,
-				port:       port}
+			// Add _ListenerConfig per family, as each family is broadcast to separately
+			listeners[netInterface.Name+"/"+family] = _ListenerConfig{
+				zone:           netInterface.Name,
+				interfaceIndex: netInterface.Index,
+				unicasts:       addresses,
+				group:          getMulticastGroup(config.GetMulticastConfig(), family),
+				multicast:      config.GetMulticastConfig(),
+				discovery: &_DiscoveryState{
+					broadcasting: config.GetDiscoveryMode() == BroadcastDiscovery},
+				port: config.GetPort()}
 		}
-	} else {
-		// Since nothing will be listened to just close them
-		close(messageChannel)
-		close(broadcastChannel)
-	}
-	comm.listeners = listeners
-	comm.messageChannel = messageChannel
-	comm.broadcastChannel = broadcastChannel
-	go comm.handleRawMessages()
-	go comm.handleRawBroadcasts()
+	}
+	return listeners, nil
+}
+
+func (comm *_UDPCommunication) listen(config Config) error {
+	listeners, err := getListenerConfigs(config)
+	comm.config = config
+	comm.discoveryMode = config.GetDiscoveryMode()
+	comm.mdnsEnabled = config.IsMDNSEnabled()
+	comm.deviceIndex = config.GetDeviceIndex()
+	comm.messageChannel = make(chan []byte)
+	comm.broadcastChannel = make(chan []byte)
+	comm.listeners = make(map[string]_ListenerConfig)
+	comm.listenerSockets = make(map[string]*_ListenerSockets)
+	for key, listener := range listeners {
+		if startErr := comm.startListener(key, listener); startErr != nil {
+			log.Println("Could not listen on", key, startErr)
+		}
+	}
+	comm.handlers.Add(2)
+	go func() {
+		defer comm.handlers.Done()
+		comm.handleRawMessages()
+	}()
+	go func() {
+		defer comm.handlers.Done()
+		comm.handleRawBroadcasts()
+	}()
 	return err
 }
 
-func (comm _UDPCommunication) broadcastMessage(listener _ListenerConfig,
+// spawn runs the routine in a goroutine which closing waits for, unless the communication is
+// closing already
+func (comm *_UDPCommunication) spawn(routine func()) bool {
+	comm.listenersMutex.Lock()
+	defer comm.listenersMutex.Unlock()
+	if comm.closing {
+		return false
+	}
+	comm.routines.Add(1)
+	go func() {
+		defer comm.routines.Done()
+		routine()
+	}()
+	return true
+}
+
+// startListener listens on the unicasts of the listener for messages and file transfers, and to
+// the multicast group for broadcasts. Nothing is listened to unless every unicast could be.
+func (comm *_UDPCommunication) startListener(key string, listener _ListenerConfig) error {
+	sockets := &_ListenerSockets{}
+	for _, address := range listener.unicasts {
+		listeningStr := getHostPortFromNetAddr(listener.port, address, listener.zone)
+		conn, err := listenUDP(listeningStr)
+		if err != nil {
+			sockets.close(comm.fileTransfers)
+			return err
+		}
+		sockets.conns = append(sockets.conns, conn)
+		if !comm.spawn(func() { listenForMessage(conn, comm.messageChannel) }) {
+			sockets.close(comm.fileTransfers)
+			return errors.New(CommunicationClosedErrorMsg)
+		}
+		if fileListener, tcpErr := comm.fileTransfers.listen(listeningStr); tcpErr == nil {
+			sockets.fileListeners = append(sockets.fileListeners, fileListener)
+		} else {
+			log.Println("Could not listen for file transfers", tcpErr)
+		}
+	}
+	// Broadcasts are received on the next port from the port requested for. The group is listened
+	// to on the wildcard address, so directed broadcasts are received through it too, whichever way
+	// peers discover.
+	if groupConn, joinErr := listener.joinGroup(); joinErr == nil {
+		sockets.conns = append(sockets.conns, groupConn)
+		comm.spawn(func() { listenForMessage(groupConn, comm.broadcastChannel) })
+	} else {
+		log.Println("Could not join multicast group", listener.group, "on", listener.zone, joinErr)
+		sockets.conns = append(sockets.conns, comm.listenForDirectedBroadcasts(listener)...)
+	}
+	comm.listenersMutex.Lock()
+	defer comm.listenersMutex.Unlock()
+	if comm.closing {
+		sockets.close(comm.fileTransfers)
+		return errors.New(CommunicationClosedErrorMsg)
+	}
+	comm.listeners[key] = listener
+	comm.listenerSockets[key] = sockets
+	return nil
+}
+
+// stopListener closes everything listened to and sent from for the listener
+func (comm *_UDPCommunication) stopListener(key string) {
+	comm.listenersMutex.Lock()
+	sockets := comm.listenerSockets[key]
+	delete(comm.listeners, key)
+	delete(comm.listenerSockets, key)
+	comm.listenersMutex.Unlock()
+	if sockets != nil {
+		sockets.close(comm.fileTransfers)
+	}
+}
+
+// getListeners returns the listeners currently listened on, keyed as by getListenerConfigs
+func (comm *_UDPCommunication) getListeners() map[string]_ListenerConfig {
+	comm.listenersMutex.RLock()
+	defer comm.listenersMutex.RUnlock()
+	listeners := make(map[string]_ListenerConfig, len(comm.listeners))
+	for key, listener := range comm.listeners {
+		listeners[key] = listener
+	}
+	return listeners
+}
+
+// watchInterfaces checks the interfaces for addresses gone or new, e.g. on a DHCP lease renewed to
+// another address, a Wi-Fi reconnecting or a VPN coming up
+func (comm *_UDPCommunication) watchInterfaces() {
+	listeners, err := getListenerConfigs(comm.config)
+	if err != nil {
+		log.Println("Could not check interfaces for changes", err)
+		return
+	}
+	comm.updateListeners(listeners)
+}
+
+// updateListeners stops the listeners not among the ones given or of changed addresses, and starts
+// the ones not listened on yet, registering this session through them so that peers learn of the
+// new reply-to. Listeners that could not be started are retried on the next update.
+func (comm *_UDPCommunication) updateListeners(listeners map[string]_ListenerConfig) {
+	currentListeners := comm.getListeners()
+	for key, currentListener := range currentListeners {
+		if listener, found := listeners[key]; !found || listener.isChanged(currentListener) {
+			log.Println("Addresses of", key, "changed from", currentListener.unicasts, "so no longer listening")
+			comm.stopListener(key)
+		}
+	}
+	for key, listener := range listeners {
+		if currentListener, found := currentListeners[key]; found && !listener.isChanged(currentListener) {
+			continue
+		}
+		if err := comm.startListener(key, listener); err != nil {
+			log.Println("Could not listen on", key, err)
+			continue
+		}
+		log.Println("Listening on", key, "replying to", listener.getReplyTo())
+		comm.joinListener(key, listener)
+	}
+}
+
+// listenForDirectedBroadcasts listens to the directed broadcast addresses of the listener, for when
+// the multicast group could not be joined
+func (comm *_UDPCommunication) listenForDirectedBroadcasts(listener _ListenerConfig) []*net.UDPConn {
+	var conns []*net.UDPConn
+	for _, broadcastAddr := range listener.getDirectedBroadcastAddrs() {
+		if conn, err := net.ListenUDP("udp", broadcastAddr); err == nil {
+			conns = append(conns, conn)
+			comm.spawn(func() { listenForMessage(conn, comm.broadcastChannel) })
+		} else {
+			log.Println("Could not listen for broadcasts on", broadcastAddr, err)
+		}
+	}
+	return conns
+}
+
+func (comm *_UDPCommunication) broadcastMessage(listener _ListenerConfig,
 	message packet.BasePacket) bool {
-	connections := listener.GetMultiCastConnections()
-	anyError := len(connections) == 0
-	for _, connection := range connections {
-		buf := convertPacketToEventData(message)
-		_, err := connection.Write(buf)
+	anyError := false
+	datagrams := comm.getBroadcastDatagrams(message)
+	for _, discoveryAddr := range listener.getDiscoveryAddrs() {
+		connection, err := listener.dialDiscovery(discoveryAddr)
 		if err != nil {
 			anyError = true
-			log.Println("1: ", err)
+			log.Println("2: ", err)
+			continue
+		}
+		for _, buf := range datagrams {
+			_, err := connection.Write(buf)
+			if err != nil {
+				anyError = true
+				log.Println("1: ", err)
+			}
 		}
 		connection.Close()
 	}
 	return anyError
 }
 
-func (comm _UDPCommunication) getSelfRegisterPacket(listener _ListenerConfig) packet.RegisterPacket {
+// getBroadcastDatagrams encodes the message for broadcasting. Peers not supporting fragmentation
+// drop fragments, so a message larger than a datagram is only fragmented if every registered peer
+// announced FragmentCapability, and is otherwise sent whole, relying on IP fragmentation.
+func (comm *_UDPCommunication) getBroadcastDatagrams(message packet.BasePacket) [][]byte {
+	eventData := encodePacketToEventData(message, comm.selectBroadcastCodec(message), comm.selfIdentity)
+	if comm.areAllPeersCapableOf(FragmentCapability) {
+		return fragmentEventData(eventData)
+	}
+	return [][]byte{eventData}
+}
+
+// markPeerFound records that discovery found a peer through the listener the peer is reachable
+// through, so that AutoDiscovery keeps multicasting on it
+func (comm *_UDPCommunication) markPeerFound(event RegisterEvent) {
+	replyTo := event.GetRegisterPacket().GetReplyTo()
+	for _, listener := range comm.getListeners() {
+		if listener.discovery != nil && listener.isCompatible(replyTo) {
+			listener.discovery.markPeerFound()
+		}
+	}
+}
+
+// fallBackToBroadcast switches the listener to broadcast discovery, unless a peer has been found
+// through multicast, and broadcasts the REGISTER of this session again
+func (comm *_UDPCommunication) fallBackToBroadcast(listener _ListenerConfig) {
+	if comm.ctx.Err() != nil || !listener.discovery.fallBackToBroadcast() {
+		return
+	}
+	log.Println("No peer found through multicast on", listener.zone, "so falling back to broadcast")
+	comm.broadcastRegister(listener)
+}
+
+func (comm *_UDPCommunication) getSelfRegisterPacket(listener _ListenerConfig) packet.RegisterPacket {
 	return packet.NewBuilderFactory().CreateNewSession().CreateSession(sessionTimeout).
 		CreateUserProfile(comm.selfProfile).
-		RegisterDevice(listener.GetResolvedUnicastAddr().String(), 1).BuildRegisterPacket()
+		RegisterDevice(listener.getReplyTo(), comm.deviceIndex).
+		AnnounceCapabilities(supportedCapabilities...).
+		PublishIdentityKey(comm.selfIdentity.GetPublicKey()).
+		PublishAgreementKey(comm.selfIdentity.GetAgreementKey()).
+		AnnouncePresence(comm.getPresence()).BuildRegisterPacket()
+}
+
+// retryRegister retries sending the REGISTER till send reports no error, backing off longer after
+// every attempt. It gives up after a while, as the addresses sent from or to may have gone
+// meanwhile, or once the communication is closing, returning whether the REGISTER was sent.
+func (comm *_UDPCommunication) retryRegister(send func() bool) bool {
+	anyError := true
+	for attempt := 0; anyError && attempt < maxRegisterAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-comm.ctx.Done():
+				return false
+			case <-time.After(time.Duration(attempt) * registerRetryInterval):
+			}
+		}
+		anyError = send()
+	}
+	return !anyError
+}
+
+// broadcastRegister retries the REGISTER till it is sent
+func (comm *_UDPCommunication) broadcastRegister(listener _ListenerConfig) {
+	regPacket := comm.getSelfRegisterPacket(listener)
+	if !comm.retryRegister(func() bool {
+		return comm.broadcastMessage(listener, regPacket)
+	}) && comm.ctx.Err() == nil {
+		log.Println("Could not broadcast REGISTER on", listener.zone)
+	}
+}
+
+// replyRegister retries sending the REGISTER to the peer session just registered, in the background
+// so that the broadcasts received meanwhile are not held up
+func (comm *_UDPCommunication) replyRegister(replyTo string) {
+	comm.spawn(func() {
+		utils.PanicableInvocation(func() {
+			config := comm.findAppropriateListenerConfig(replyTo)
+			regPacket := comm.getSelfRegisterPacket(config)
+			if !comm.retryRegister(func() bool {
+				return comm.sendMessage(config, replyTo, regPacket)
+			}) && comm.ctx.Err() == nil {
+				log.Println("Could not reply REGISTER to", replyTo)
+			}
+		}, func(panicReason interface{}) {
+			log.Println(panicReason)
+		})
+	})
+}
+
+func (comm *_UDPCommunication) broadcastJoin() {
+	for key, listener := range comm.getListeners() {
+		comm.joinListener(key, listener)
+	}
+}
+
+// joinListener registers this session through the listener and, if enabled, advertises it over
+// mDNS
+func (comm *_UDPCommunication) joinListener(key string, listener _ListenerConfig) {
+	if comm.discoveryMode == AutoDiscovery && len(listener.getDirectedBroadcastAddrs()) > 0 {
+		// Started beforehand, as the multicast is retried till it is sent
+		fallbackTimer := time.AfterFunc(comm.fallbackWindow, func() {
+			comm.fallBackToBroadcast(listener)
+		})
+		comm.attachToListener(key, func(sockets *_ListenerSockets) {
+			sockets.fallbackTimer = fallbackTimer
+		}, func() {
+			fallbackTimer.Stop()
+		})
+	}
+	comm.broadcastRegister(listener)
+	if comm.mdnsEnabled {
+		comm.startMDNS(key, listener)
+	}
+}
+
+// attachToListener attaches to the sockets of the listener, or detaches if it has been stopped
+// meanwhile
+func (comm *_UDPCommunication) attachToListener(key string, attach func(sockets *_ListenerSockets),
+	detach func()) {
+	comm.listenersMutex.Lock()
+	defer comm.listenersMutex.Unlock()
+	if sockets, found := comm.listenerSockets[key]; found {
+		attach(sockets)
+	} else {
+		detach()
+	}
+}
+
+// startMDNS advertises this session over mDNS on the listener and browses for peers
+func (comm *_UDPCommunication) startMDNS(key string, listener _ListenerConfig) {
+	provider, err := newMDNSProvider(listener, comm.selfProfile.GetUsername(), packet.GetCurrentSessionID(),
+		comm.deviceIndex, comm.handleMDNSPeer)
+	if err != nil {
+		log.Println("Could not start mDNS on", listener.zone, err)
+		return
+	}
+	if !comm.spawn(provider.listen) {
+		provider.close()
+		return
+	}
+	provider.announce()
+	provider.browse()
+	comm.attachToListener(key, func(sockets *_ListenerSockets) {
+		sockets.mdnsProvider = provider
+	}, provider.close)
+}
+
+// handleMDNSPeer sends the REGISTER of this session to the port the peer found over mDNS receives
+// broadcasts on, unless its session is already registered. The peer replies with its own REGISTER
+// just as if the REGISTER was broadcast, so that peers are only registered once authenticated.
+func (comm *_UDPCommunication) handleMDNSPeer(peer _MDNSPeer) {
+	if _, registered := comm.sessionRegistry.Load(peer.sessionID); registered {
+		return
+	}
+	host, port, err := net.SplitHostPort(peer.replyTo)
+	if err != nil {
+		return
+	}
+	portNumber, _ := strconv.Atoi(port)
+	receiverStr := net.JoinHostPort(host, strconv.Itoa(portNumber+1))
+	utils.PanicableInvocation(func() {
+		config := comm.findAppropriateListenerConfig(peer.replyTo)
+		comm.sendMessage(config, receiverStr, comm.getSelfRegisterPacket(config))
+	}, func(panicReason interface{}) {
+		log.Println(panicReason)
+	})
 }
 
-func (comm _UDPCommunication) broadcastJoin() {
-	for _, listener := range comm.listeners {
-		regPacket := comm.getSelfRegisterPacket(listener)
-		anyError := true
-		for anyError {
-			anyError = comm.broadcastMessage(listener, regPacket)
+// getMDNSProviders returns the mDNS providers of the listeners
+func (comm *_UDPCommunication) getMDNSProviders() []*_MDNSProvider {
+	comm.listenersMutex.RLock()
+	defer comm.listenersMutex.RUnlock()
+	var providers []*_MDNSProvider
+	for _, sockets := range comm.listenerSockets {
+		if sockets.mdnsProvider != nil {
+			providers = append(providers, sockets.mdnsProvider)
 		}
 	}
+	return providers
+}
+
+// browseMDNS queries for peers over mDNS again, also re-announcing this session before its records
+// expire
+func (comm *_UDPCommunication) browseMDNS() {
+	for _, provider := range comm.getMDNSProviders() {
+		provider.announce()
+		provider.browse()
+	}
 }
 
-func (comm _UDPCommunication) broadcastPing() {
-	for _, listener := range comm.listeners {
-		pingPacket := packet.NewBuilderFactory().Ping().RenewSession(sessionTimeout).BuildPingPacket()
+func (comm *_UDPCommunication) broadcastPing() {
+	for _, listener := range comm.getListeners() {
+		pingPacket := packet.NewBuilderFactory().Ping().RenewSession(sessionTimeout).
+			UpdatePresence(comm.getPresence()).BuildPingPacket()
 		comm.broadcastMessage(listener, pingPacket)
 	}
 }
 
-func (comm _UDPCommunication) setupPingBroadcast() {
-	ticker := time.NewTicker(pingInterval)
-	go func() {
+// broadcastSignOff lets peers know this session is over, so that they need not wait for it to expire
+func (comm *_UDPCommunication) broadcastSignOff() {
+	for _, listener := range comm.getListeners() {
+		comm.broadcastMessage(listener, packet.NewBuilderFactory().SignOff().BuildSignOffPacket())
+	}
+}
+
+func (comm *_UDPCommunication) getPresence() profile.Presence {
+	comm.presenceMutex.Lock()
+	defer comm.presenceMutex.Unlock()
+	return comm.presence
+}
+
+func (comm *_UDPCommunication) SetPresence(presence profile.Presence) {
+	if presence == nil {
+		panic("No presence provided")
+	}
+	comm.presenceMutex.Lock()
+	comm.presence = presence
+	comm.presenceMutex.Unlock()
+	comm.broadcastPing()
+}
+
+func (comm *_UDPCommunication) setupPingBroadcast() {
+	comm.spawn(func() {
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+		watchTicker := time.NewTicker(comm.watchInterval)
+		defer watchTicker.Stop()
 		for {
 			select {
+			case <-watchTicker.C:
+				comm.watchInterfaces()
 			case <-ticker.C:
 				comm.broadcastPing()
+				comm.browseMDNS()
 				comm.cleanExpiredRegistryEntries()
-			case <-comm.pingQuit:
-				ticker.Stop()
-				comm.pingQuit <- 1
+				comm.fileTransfers.cleanExpiredOffers()
+			case <-comm.ctx.Done():
 				return
 			}
 		}
-	}()
+	})
 }
 
-func (comm _UDPCommunication) broadcast() error {
+func (comm *_UDPCommunication) broadcast() error {
 	log.Println("Sending initial broadcasts")
 	var err error
 	comm.broadcastJoin()
@@ -256,32 +752,81 @@ func (comm _UDPCommunication) broadcast() error {
 	return err
 }
 
-func (comm *_UDPCommunication) InitCommunication(profile profile.UserProfile) error {
+// InitCommunication registers this session with peers. The communication is closed once the context
+// is done, just as once the context it was set up with is.
+func (comm *_UDPCommunication) InitCommunication(ctx context.Context, profile profile.UserProfile,
+	selfIdentity identity.Identity) error {
 	comm.selfProfile = profile
-	comm.pingQuit = make(chan int)
+	comm.selfIdentity = selfIdentity
+	comm.spawn(func() {
+		select {
+		case <-ctx.Done():
+			comm.cancel()
+		case <-comm.ctx.Done():
+		}
+	})
 	return comm.broadcast()
 }
 
 // SetupCommunication will multicast the existence of this client to the world in an orderly
-// fashion
-func (comm *_UDPCommunication) SetupCommunication(config Config) {
+// fashion. The communication is closed once the context is done.
+func (comm *_UDPCommunication) SetupCommunication(ctx context.Context, config Config) {
 	comm.sessionRegistry = sync.Map{}
 	err := comm.listen(config)
 	if err != nil {
 		log.Fatal(err)
 	}
+	comm.listenersMutex.Lock()
+	comm.started = true
+	comm.drainer.Add(1)
+	comm.listenersMutex.Unlock()
+	go func() {
+		defer comm.drainer.Done()
+		select {
+		case <-ctx.Done():
+			comm.cancel()
+		case <-comm.ctx.Done():
+		}
+		comm.drain()
+	}()
 }
 
-func (comm _UDPCommunication) CloseCommunication() {
+// drain signs off and closes everything listened to and sent from. Once the goroutines reading and
+// sending have returned, the channels are closed so that the listeners are notified of the end.
+func (comm *_UDPCommunication) drain() {
 	log.Println("Closing listener channels")
-	comm.pingQuit <- 1
+	comm.broadcastSignOff()
+	comm.listenersMutex.Lock()
+	comm.closing = true
+	keys := make([]string, 0, len(comm.listeners))
+	for key := range comm.listeners {
+		keys = append(keys, key)
+	}
+	comm.listenersMutex.Unlock()
+	for _, key := range keys {
+		comm.stopListener(key)
+	}
+	comm.fileTransfers.close()
+	comm.routines.Wait()
 	close(comm.messageChannel)
 	close(comm.broadcastChannel)
-	<-comm.pingQuit
+	comm.handlers.Wait()
+}
+
+// CloseCommunication closes the communication and blocks till everything has drained, if it was
+// set up
+func (comm *_UDPCommunication) CloseCommunication() {
+	comm.cancel()
+	comm.listenersMutex.RLock()
+	started := comm.started
+	comm.listenersMutex.RUnlock()
+	if started {
+		comm.drainer.Wait()
+	}
 }
 
-func (comm _UDPCommunication) findAppropriateListenerConfig(connectionStr string) _ListenerConfig {
-	for _, lc := range comm.listeners {
+func (comm *_UDPCommunication) findAppropriateListenerConfig(connectionStr string) _ListenerConfig {
+	for _, lc := range comm.getListeners() {
 		if lc.isCompatible(connectionStr) {
 			return lc
 		}
@@ -289,35 +834,292 @@ func (comm _UDPCommunication) findAppropriateListenerConfig(connectionStr string
 	panic("No interface found for connection string: " + connectionStr)
 }
 
-func (comm _UDPCommunication) SendMessage(toConnectionStr string, payload packet.BasePacket) {
+// withListenerZone qualifies the link-scoped host of the connection string with the zone of the
+// listener the peer is reachable through
+func (comm *_UDPCommunication) withListenerZone(connectionStr string) string {
+	for _, lc := range comm.getListeners() {
+		if lc.isCompatible(connectionStr) {
+			return withZone(connectionStr, lc.zone)
+		}
+	}
+	return connectionStr
+}
+
+func (comm *_UDPCommunication) SendMessage(toSessionID string, toConnectionStr string,
+	payload packet.BasePacket) <-chan DeliveryStatus {
+	status := make(chan DeliveryStatus, 2)
+	var config _ListenerConfig
+	configFound := false
 	utils.PanicableInvocation(func() {
-		config := comm.findAppropriateListenerConfig(toConnectionStr)
-		comm.sendMessage(config, toConnectionStr, payload)
+		config = comm.findAppropriateListenerConfig(toConnectionStr)
+		configFound = true
 	}, func(panicReason interface{}) {
 		log.Println(panicReason)
 	})
+	if message, isMessage := payload.(packet.MessagePacket); isMessage && configFound {
+		payload, configFound = comm.encryptMessage(toSessionID, message)
+	}
+	if !configFound {
+		status <- Failed
+		close(status)
+		return status
+	}
+	if !comm.isCapableOf(toConnectionStr, AckCapability) {
+		// Peer will not acknowledge, so the best we can do is to send it once
+		if !comm.sendMessage(config, toConnectionStr, payload) {
+			status <- Sent
+		} else {
+			status <- Failed
+		}
+		close(status)
+		return status
+	}
+	key := _PacketKey{sessionID: payload.GetSessionID(), packetID: payload.GetPacketID(),
+		recipientSessionID: toSessionID}
+	if !comm.spawn(func() {
+		comm.pendingDeliveries.deliver(comm.ctx, key, comm.retransmitPolicy, func() bool {
+			return !comm.sendMessage(config, toConnectionStr, payload)
+		}, status)
+	}) {
+		status <- Failed
+		close(status)
+	}
+	return status
 }
 
-func (comm _UDPCommunication) sendMessage(lc _ListenerConfig,
+func (comm *_UDPCommunication) OfferFile(toSessionID string, toConnectionStr string, filePath string,
+	progress TransferProgress) (string, error) {
+	if !comm.isCapableOf(toConnectionStr, FileTransferCapability) {
+		return "", errors.New(FileTransferNotSupportedErrorMsg)
+	}
+	recipientHost, _, err := net.SplitHostPort(toConnectionStr)
+	if err != nil {
+		return "", err
+	}
+	checksum, fileSize, err := getFileChecksum(filePath)
+	if err != nil {
+		return "", err
+	}
+	transferID := uuid.New().String()
+	comm.fileTransfers.offer(transferID, &_FileOffer{filePath: filePath, fileSize: fileSize,
+		recipientSessionID: toSessionID, recipientHost: recipientHost,
+		expiryTime: time.Now().Add(fileOfferExpiry), progress: progress})
+	offerPacket := packet.NewBuilderFactory().File(transferID).
+		Offer(filepath.Base(filePath), fileSize, checksum).BuildFilePacket()
+	status := comm.SendMessage(toSessionID, toConnectionStr, offerPacket)
+	comm.spawn(func() {
+		for deliveryStatus := range status {
+			if deliveryStatus == Failed {
+				comm.fileTransfers.withdraw(transferID)
+			}
+		}
+	})
+	return transferID, nil
+}
+
+func (comm *_UDPCommunication) AcceptFile(offer packet.FilePacket, destinationPath string,
+	progress TransferProgress) error {
+	cipher, err := comm.getSessionCipher(offer.GetSessionID())
+	if err != nil {
+		return err
+	}
+	replyTo, err := comm.respondToFileOffer(offer, packet.NewBuilderFactory().
+		File(offer.GetTransferID()).Accept().BuildFilePacket())
+	if err != nil {
+		return err
+	}
+	return downloadFile(comm.withListenerZone(replyTo), offer, destinationPath, cipher, progress)
+}
+
+func (comm *_UDPCommunication) RejectFile(offer packet.FilePacket) error {
+	_, err := comm.respondToFileOffer(offer, packet.NewBuilderFactory().
+		File(offer.GetTransferID()).Reject().BuildFilePacket())
+	return err
+}
+
+// respondToFileOffer sends the response to the reply-to of the session that offered the file and
+// returns the reply-to, which is also where the file is served from
+func (comm *_UDPCommunication) respondToFileOffer(offer packet.FilePacket,
+	response packet.FilePacket) (string, error) {
+	value, found := comm.sessionRegistry.Load(offer.GetSessionID())
+	if !found {
+		return "", errors.New(FileTransferPeerNotFoundErrorMsg)
+	}
+	replyTo := value.(*_RegistryEntry).getReplyTo()
+	// Not waiting for the delivery as the download does not depend on it
+	status := comm.SendMessage(offer.GetSessionID(), replyTo, response)
+	comm.spawn(func() {
+		for range status {
+		}
+	})
+	return replyTo, nil
+}
+
+// handleFileEvent withdraws the offer the peer rejected, so that it is no longer served
+func (comm *_UDPCommunication) handleFileEvent(event FileEvent) {
+	filePacket := event.GetFilePacket()
+	if filePacket.GetAction() != packet.FileRejectAction {
+		return
+	}
+	comm.fileTransfers.withdrawFor(filePacket.GetTransferID(), filePacket.GetSessionID())
+}
+
+// getSessionCipher returns the cipher agreed upon with the session, which file transfers with it
+// are sealed with
+func (comm *_UDPCommunication) getSessionCipher(sessionID string) (identity.Cipher, error) {
+	value, found := comm.sessionRegistry.Load(sessionID)
+	if !found || len(value.(*_RegistryEntry).agreementKey) == 0 {
+		return nil, errors.New(FileTransferPeerNotFoundErrorMsg)
+	}
+	return comm.selfIdentity.NewCipher(value.(*_RegistryEntry).agreementKey)
+}
+
+// encryptMessage encrypts the message body for the session, using the agreement key it published
+// when registering. The session is looked up by its ID rather than its reply-to, as a stale or
+// forged registration may claim the same reply-to.
+func (comm *_UDPCommunication) encryptMessage(sessionID string,
+	message packet.MessagePacket) (packet.MessagePacket, bool) {
+	value, found := comm.sessionRegistry.Load(sessionID)
+	if !found || len(value.(*_RegistryEntry).agreementKey) == 0 {
+		log.Println("No agreement key known to encrypt message for", sessionID)
+		return nil, false
+	}
+	cipher, err := comm.selfIdentity.NewCipher(value.(*_RegistryEntry).agreementKey)
+	if err == nil {
+		message, err = message.Encrypt(sessionID, cipher)
+	}
+	if err != nil {
+		log.Println("Could not encrypt message for", sessionID, err)
+		return nil, false
+	}
+	return message, true
+}
+
+// decryptMessage decrypts the message body using the agreement key of the sender session. Messages
+// not encrypted or encrypted for any other session are dropped.
+func (comm *_UDPCommunication) decryptMessage(event MessageEvent) (MessageEvent, bool) {
+	sessionID, _ := event.GetEventIdentifier()
+	message := event.GetMessagePacket()
+	if !message.IsEncrypted() || message.GetRecipientSessionID() != packet.GetCurrentSessionID() {
+		log.Println("Dropping message not encrypted for this session from", sessionID)
+		return nil, false
+	}
+	value, found := comm.sessionRegistry.Load(sessionID)
+	if !found {
+		return nil, false
+	}
+	cipher, err := comm.selfIdentity.NewCipher(value.(*_RegistryEntry).agreementKey)
+	if err == nil {
+		message, err = message.Decrypt(cipher)
+	}
+	if err != nil {
+		log.Println("Dropping message that could not be decrypted from", sessionID, err)
+		return nil, false
+	}
+	return _MessageEvent{_Event: event.(_MessageEvent)._Event, packet: message}, true
+}
+
+// findRegistryEntryByReplyTo finds the registry entry of the session with the reply-to
+func (comm *_UDPCommunication) findRegistryEntryByReplyTo(connectionStr string) (*_RegistryEntry, bool) {
+	var foundEntry *_RegistryEntry
+	comm.sessionRegistry.Range(func(key interface{}, value interface{}) bool {
+		if entry := value.(*_RegistryEntry); entry.getReplyTo() == connectionStr {
+			foundEntry = entry
+			return false
+		}
+		return true
+	})
+	return foundEntry, foundEntry != nil
+}
+
+// isCapableOf negotiates the capability with the peer listening at connectionStr. Peers yet to be
+// registered are assumed to be as capable as this network layer.
+func (comm *_UDPCommunication) isCapableOf(connectionStr string, capability string) bool {
+	if entry, found := comm.findRegistryEntryByReplyTo(connectionStr); found {
+		return entry.hasCapability(capability)
+	}
+	return true
+}
+
+// selectCodec negotiates the codec for the peer listening at connectionStr. Unlike other
+// capabilities, JSON is used unless the peer is known to support the binary codec.
+func (comm *_UDPCommunication) selectCodec(connectionStr string) packet.Codec {
+	if entry, found := comm.findRegistryEntryByReplyTo(connectionStr); found &&
+		entry.hasCapability(BinaryCodecCapability) {
+		return packet.NewBinaryCodec()
+	}
+	return packet.NewJSONCodec()
+}
+
+// selectBroadcastCodec picks the binary codec only if every registered peer supports it. The
+// RegisterPacket is always sent as JSON as it is how peers learn of each other's capabilities.
+func (comm *_UDPCommunication) selectBroadcastCodec(message packet.BasePacket) packet.Codec {
+	if _, isRegisterPacket := message.(packet.RegisterPacket); isRegisterPacket {
+		return packet.NewJSONCodec()
+	}
+	if comm.areAllPeersCapableOf(BinaryCodecCapability) {
+		return packet.NewBinaryCodec()
+	}
+	return packet.NewJSONCodec()
+}
+
+// areAllPeersCapableOf returns true only if any peer is registered and every registered peer
+// announced the capability, as broadcasts reach every peer
+func (comm *_UDPCommunication) areAllPeersCapableOf(capability string) bool {
+	anyPeer, allCapable := false, true
+	comm.sessionRegistry.Range(func(key interface{}, value interface{}) bool {
+		anyPeer = true
+		allCapable = value.(*_RegistryEntry).hasCapability(capability)
+		return allCapable
+	})
+	return anyPeer && allCapable
+}
+
+// acknowledge sends an AckPacket for the event to the reply-to of the session that sent it
+func (comm *_UDPCommunication) acknowledge(event Event) {
+	sessionID, packetID := event.GetEventIdentifier()
+	value, found := comm.sessionRegistry.Load(sessionID)
+	if !found {
+		return
+	}
+	replyTo := value.(*_RegistryEntry).getReplyTo()
+	utils.PanicableInvocation(func() {
+		config := comm.findAppropriateListenerConfig(replyTo)
+		comm.sendMessage(config, replyTo,
+			packet.NewBuilderFactory().Acknowledge(sessionID, packetID).BuildAckPacket())
+	}, func(panicReason interface{}) {
+		log.Println(panicReason)
+	})
+}
+
+// sendMessage sends the payload to the peer listening at toConnectionStr, returning true if any of
+// it could not be sent, including when the address could not be resolved or dialed
+func (comm *_UDPCommunication) sendMessage(lc _ListenerConfig,
 	toConnectionStr string, payload packet.BasePacket) bool {
 	receiver := lc.getResolvedBroadcastReceiverAddr()
+	udpAddr, err := net.ResolveUDPAddr("udp", withZone(toConnectionStr, lc.zone))
+	if err != nil {
+		log.Println("5: ", err)
+		return true
+	}
+	connection, err := net.DialUDP("udp", receiver, udpAddr)
+	if err != nil {
+		log.Println("4: ", err)
+		return true
+	}
+	defer connection.Close()
 	anyError := false
-	udpAddr, err := net.ResolveUDPAddr("udp", toConnectionStr)
-	if err == nil {
-		connection, err := net.DialUDP("udp", receiver, udpAddr)
-		if err != nil {
-			log.Println("4: ", err)
-			return anyError
-		}
-		buf := convertPacketToEventData(payload)
+	datagrams := [][]byte{encodePacketToEventData(payload, comm.selectCodec(toConnectionStr),
+		comm.selfIdentity)}
+	if comm.isCapableOf(toConnectionStr, FragmentCapability) {
+		datagrams = fragmentEventData(datagrams[0])
+	}
+	for _, buf := range datagrams {
 		_, err = connection.Write(buf)
 		if err != nil {
 			anyError = true
 			log.Println("6: ", err)
 		}
-		defer connection.Close()
-	} else {
-		log.Println("5: ", err)
 	}
 	return anyError
 }
@@ -325,16 +1127,7 @@ func (comm _UDPCommunication) sendMessage(lc _ListenerConfig,
 func (comm *_UDPCommunication) addInternalListeners() {
 	innerListener := _InnerListener{}
 	innerListener.HandleRegisterEventMethod = func(event RegisterEvent) {
-		utils.PanicableInvocation(func() {
-			replyTo := event.GetRegisterPacket().GetReplyTo()
-			config := comm.findAppropriateListenerConfig(replyTo)
-			anyError := true
-			for anyError {
-				anyError = comm.sendMessage(config, replyTo, comm.getSelfRegisterPacket(config))
-			}
-		}, func(panicReason interface{}) {
-			log.Println(panicReason)
-		})
+		comm.replyRegister(event.GetRegisterPacket().GetReplyTo())
 	}
 	innerListener.HandlePingEventMethod = func(event PingEvent) {
 		comm.renewRegistryEntry(event)
@@ -346,7 +1139,16 @@ func (comm *_UDPCommunication) addInternalListeners() {
 
 // NewUDPCommunication returns UDP implementation of communication for the application
 func NewUDPCommunication() Communication {
-	comm := &_UDPCommunication{}
+	ctx, cancel := context.WithCancel(context.Background())
+	comm := &_UDPCommunication{pendingDeliveries: newPendingDeliveries(),
+		retransmitPolicy: defaultRetransmitPolicy,
+		presence:         profile.NewPresence(profile.Available, ""),
+		fallbackWindow:   discoveryFallbackWindow,
+		watchInterval:    interfaceWatchInterval,
+		reassembler:      newReassembler(fragmentReassemblyExpiry, maxReassemblyBufferSize),
+		ctx:              ctx,
+		cancel:           cancel}
+	comm.fileTransfers = newFileTransfers(comm.getSessionCipher)
 	comm.addInternalListeners()
 	return comm
 }
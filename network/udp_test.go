@@ -0,0 +1,397 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/imyousuf/lan-messenger/identity"
+	"github.com/imyousuf/lan-messenger/packet"
+	"github.com/imyousuf/lan-messenger/profile"
+)
+
+func registerTestPeer(comm *_UDPCommunication, replyTo string, capabilities ...string) {
+	regPacket := packet.NewBuilderFactory().CreateNewSession().CreateSession(5*time.Minute).
+		CreateUserProfile(profile.NewUserProfile("a", "a", "a@a.co")).RegisterDevice(replyTo, 1).
+		AnnounceCapabilities(capabilities...).BuildRegisterPacket()
+	regEvent := _RegisterEvent{packet: regPacket}
+	// Each register packet in tests is of the same session, so use reply-to to tell them apart
+	comm.sessionRegistry.Store(replyTo, newRegistryEntry(regEvent))
+}
+
+func TestUDPCommunication_capabilityNegotiation(t *testing.T) {
+	comm := NewUDPCommunication().(*_UDPCommunication)
+	pingPacket := packet.NewBuilderFactory().Ping().RenewSession(time.Minute).BuildPingPacket()
+	if comm.selectBroadcastCodec(pingPacket).GetName() != packet.JSONCodecName {
+		t.Error("JSON should be used while no peer is known")
+	}
+	registerTestPeer(comm, "127.0.0.1:3000", supportedCapabilities...)
+	registerTestPeer(comm, "127.0.0.2:3000")
+	if !comm.isCapableOf("127.0.0.1:3000", AckCapability) || comm.isCapableOf("127.0.0.2:3000",
+		AckCapability) || !comm.isCapableOf("127.0.0.3:3000", AckCapability) {
+		t.Error("Capabilities not negotiated as expected")
+	}
+	if comm.selectCodec("127.0.0.1:3000").GetName() != packet.BinaryCodecName ||
+		comm.selectCodec("127.0.0.2:3000").GetName() != packet.JSONCodecName ||
+		comm.selectCodec("127.0.0.3:3000").GetName() != packet.JSONCodecName {
+		t.Error("Codec not negotiated as expected")
+	}
+	if comm.selectBroadcastCodec(pingPacket).GetName() != packet.JSONCodecName {
+		t.Error("JSON should be used while any peer does not support binary codec")
+	}
+	comm.sessionRegistry.Delete("127.0.0.2:3000")
+	if comm.selectBroadcastCodec(pingPacket).GetName() != packet.BinaryCodecName {
+		t.Error("Binary codec should be used when all peers support it")
+	}
+	regPacket := packet.NewBuilderFactory().CreateNewSession().CreateSession(time.Minute).
+		CreateUserProfile(profile.NewUserProfile("a", "a", "a@a.co")).RegisterDevice("127.0.0.1:3000", 1).
+		BuildRegisterPacket()
+	if comm.selectBroadcastCodec(regPacket).GetName() != packet.JSONCodecName {
+		t.Error("Register packet should always be sent as JSON")
+	}
+}
+
+func TestUDPCommunication_getBroadcastDatagrams(t *testing.T) {
+	comm := NewUDPCommunication().(*_UDPCommunication)
+	comm.selfIdentity, _ = identity.NewIdentity()
+	largeRegister := packet.NewBuilderFactory().CreateNewSession().CreateSession(time.Minute).
+		CreateUserProfile(profile.NewUserProfile("a", strings.Repeat("A ", maxDatagramSize), "a@a.co")).
+		RegisterDevice("127.0.0.1:3000", 1).BuildRegisterPacket()
+	if datagrams := comm.getBroadcastDatagrams(largeRegister); len(datagrams) != 1 {
+		t.Error("Broadcast should not have been fragmented while no peer is known", len(datagrams))
+	}
+	registerTestPeer(comm, "127.0.0.1:3000", supportedCapabilities...)
+	if datagrams := comm.getBroadcastDatagrams(largeRegister); len(datagrams) < 2 {
+		t.Error("Large broadcast should have been fragmented when all peers support it", len(datagrams))
+	}
+	smallPing := packet.NewBuilderFactory().Ping().RenewSession(time.Minute).BuildPingPacket()
+	if datagrams := comm.getBroadcastDatagrams(smallPing); len(datagrams) != 1 {
+		t.Error("Broadcast fitting a datagram should not have been fragmented", len(datagrams))
+	}
+	registerTestPeer(comm, "127.0.0.2:3000", AckCapability)
+	if datagrams := comm.getBroadcastDatagrams(largeRegister); len(datagrams) != 1 {
+		t.Error("Broadcast should have been sent whole as a peer does not support fragmentation",
+			len(datagrams))
+	}
+}
+
+func TestUDPCommunication_isAuthentic(t *testing.T) {
+	comm := NewUDPCommunication().(*_UDPCommunication)
+	peerIdentity, _ := identity.NewIdentity()
+	otherIdentity, _ := identity.NewIdentity()
+	regPacket := packet.NewBuilderFactory().CreateNewSession().CreateSession(5*time.Minute).
+		CreateUserProfile(profile.NewUserProfile("a", "a", "a@a.co")).RegisterDevice("127.0.0.1:3000", 1).
+		PublishIdentityKey(peerIdentity.GetPublicKey()).BuildRegisterPacket()
+	jsonCodec := packet.NewJSONCodec()
+	if !comm.isAuthentic(createEventFromEventData(encodePacketToEventData(regPacket, jsonCodec,
+		peerIdentity))) {
+		t.Error("Register event signed with published key should be authentic")
+	}
+	if comm.isAuthentic(createEventFromEventData(encodePacketToEventData(regPacket, jsonCodec, nil))) {
+		t.Error("Unsigned event should not be authentic")
+	}
+	if comm.isAuthentic(createEventFromEventData(encodePacketToEventData(regPacket, jsonCodec,
+		otherIdentity))) {
+		t.Error("Register event signed with a key other than the published one should not be authentic")
+	}
+	eventData := encodePacketToEventData(regPacket, jsonCodec, peerIdentity)
+	tamperedData := bytes.Replace(eventData, []byte("a@a.co"), []byte("b@a.co"), 1)
+	if comm.isAuthentic(createEventFromEventData(tamperedData)) {
+		t.Error("Tampered event should not be authentic")
+	}
+	comm.sessionRegistry.Store(regPacket.GetSessionID(),
+		newRegistryEntry(_RegisterEvent{packet: regPacket}))
+	rebindPacket := packet.NewBuilderFactory().CreateNewSession().CreateSession(5*time.Minute).
+		CreateUserProfile(profile.NewUserProfile("a", "a", "a@a.co")).RegisterDevice("127.0.0.1:3000", 1).
+		PublishIdentityKey(otherIdentity.GetPublicKey()).BuildRegisterPacket()
+	if comm.isAuthentic(createEventFromEventData(encodePacketToEventData(rebindPacket, jsonCodec,
+		otherIdentity))) {
+		t.Error("Register event rebinding the identity key of a session should not be authentic")
+	}
+}
+
+func registerTestPeerIdentity(comm *_UDPCommunication, replyTo string, peerIdentity identity.Identity) {
+	regPacket := packet.NewBuilderFactory().CreateNewSession().CreateSession(5*time.Minute).
+		CreateUserProfile(profile.NewUserProfile("a", "a", "a@a.co")).RegisterDevice(replyTo, 1).
+		PublishIdentityKey(peerIdentity.GetPublicKey()).
+		PublishAgreementKey(peerIdentity.GetAgreementKey()).BuildRegisterPacket()
+	comm.sessionRegistry.Store(regPacket.GetSessionID(), newRegistryEntry(_RegisterEvent{packet: regPacket}))
+}
+
+func TestUDPCommunication_messageEncryption(t *testing.T) {
+	senderIdentity, _ := identity.NewIdentity()
+	recipientIdentity, _ := identity.NewIdentity()
+	sender := NewUDPCommunication().(*_UDPCommunication)
+	sender.selfIdentity = senderIdentity
+	recipient := NewUDPCommunication().(*_UDPCommunication)
+	recipient.selfIdentity = recipientIdentity
+	// Both ends are of the same session in tests, so the message is encrypted for this session
+	registerTestPeerIdentity(sender, "127.0.0.1:3000", recipientIdentity)
+	registerTestPeerIdentity(recipient, "127.0.0.2:3000", senderIdentity)
+	messagePacket := packet.NewBuilderFactory().Message().To("a").WithBody(packet.TextContentType, "Hi").
+		BuildMessagePacket()
+	if _, encrypted := sender.encryptMessage("unknown-session", messagePacket); encrypted {
+		t.Error("Message should not be encrypted for unknown peer")
+	}
+	// Another registration claiming the reply-to of the recipient, e.g. stale or forged, is of no use
+	forgerIdentity, _ := identity.NewIdentity()
+	forgedPacket := packet.NewBuilderFactory().CreateNewSession().CreateSession(5*time.Minute).
+		CreateUserProfile(profile.NewUserProfile("a", "a", "a@a.co")).RegisterDevice("127.0.0.1:3000", 1).
+		PublishIdentityKey(forgerIdentity.GetPublicKey()).
+		PublishAgreementKey(forgerIdentity.GetAgreementKey()).BuildRegisterPacket()
+	sender.sessionRegistry.Store("forged-session", newRegistryEntry(_RegisterEvent{packet: forgedPacket}))
+	encryptedPacket, encrypted := sender.encryptMessage(packet.GetCurrentSessionID(), messagePacket)
+	if !encrypted || !encryptedPacket.IsEncrypted() ||
+		encryptedPacket.GetRecipientSessionID() != packet.GetCurrentSessionID() {
+		t.Fatal("Message should have been encrypted for the peer session")
+	}
+	eventData := encodePacketToEventData(encryptedPacket, packet.NewBinaryCodec(), senderIdentity)
+	if bytes.Contains(eventData, []byte("Hi")) {
+		t.Error("Message body should not travel in plain text")
+	}
+	decryptedEvent, decrypted := recipient.decryptMessage(createEventFromEventData(eventData).(MessageEvent))
+	if !decrypted || decryptedEvent.GetMessagePacket().GetBody() != "Hi" {
+		t.Error("Message should have been decrypted by the recipient")
+	}
+	plainEvent := createEventFromEventData(encodePacketToEventData(messagePacket, packet.NewJSONCodec(),
+		senderIdentity))
+	if _, decrypted := recipient.decryptMessage(plainEvent.(MessageEvent)); decrypted {
+		t.Error("Message not encrypted should have been dropped")
+	}
+	eavesdropper := NewUDPCommunication().(*_UDPCommunication)
+	eavesdropper.selfIdentity, _ = identity.NewIdentity()
+	registerTestPeerIdentity(eavesdropper, "127.0.0.2:3000", senderIdentity)
+	if _, decrypted := eavesdropper.decryptMessage(createEventFromEventData(eventData).(MessageEvent)); decrypted {
+		t.Error("Message should not be decrypted by any device other than the recipient")
+	}
+}
+
+func TestUDPCommunication_discoveryFallback(t *testing.T) {
+	comm := NewUDPCommunication().(*_UDPCommunication)
+	found := _ListenerConfig{port: 30000, zone: "eth0", discovery: &_DiscoveryState{},
+		unicasts: []net.Addr{&net.IPNet{IP: net.ParseIP("127.0.0.1"), Mask: net.CIDRMask(24, 32)}}}
+	notFound := _ListenerConfig{port: 30000, zone: "eth1", discovery: &_DiscoveryState{},
+		unicasts: []net.Addr{&net.IPNet{IP: net.ParseIP("10.0.0.1"), Mask: net.CIDRMask(24, 32)}}}
+	comm.listeners = map[string]_ListenerConfig{"eth0/ipv4": found, "eth1/ipv4": notFound}
+	regPacket := packet.NewBuilderFactory().CreateNewSession().CreateSession(5*time.Minute).
+		CreateUserProfile(profile.NewUserProfile("a", "a", "a@a.co")).RegisterDevice("127.0.0.2:3000", 1).
+		BuildRegisterPacket()
+	comm.markPeerFound(_RegisterEvent{packet: regPacket})
+	if found.discovery.fallBackToBroadcast() || found.discovery.isBroadcasting() {
+		t.Error("Listener a peer was found through should have kept multicasting")
+	}
+	if !notFound.discovery.fallBackToBroadcast() || !notFound.discovery.isBroadcasting() {
+		t.Error("Listener no peer was found through should have fallen back to broadcast")
+	}
+	if notFound.discovery.fallBackToBroadcast() {
+		t.Error("Listener should not have fallen back to broadcast twice")
+	}
+}
+
+func TestUDPCommunication_sendMessageFailure(t *testing.T) {
+	comm := NewUDPCommunication().(*_UDPCommunication)
+	comm.selfIdentity, _ = identity.NewIdentity()
+	// The address is not of this host, so sending from it can not be dialed
+	lc := _ListenerConfig{port: 34950, zone: "eth9",
+		unicasts: []net.Addr{&net.IPNet{IP: net.ParseIP("10.255.255.1").To4(), Mask: net.CIDRMask(24, 32)}}}
+	comm.listeners = map[string]_ListenerConfig{"eth9/ipv4": lc}
+	ackPacket := packet.NewBuilderFactory().Acknowledge("some-session", 1).BuildAckPacket()
+	if !comm.sendMessage(lc, "127.0.0.1:99999", ackPacket) {
+		t.Error("Address that could not be resolved should have failed the send")
+	}
+	if !comm.sendMessage(lc, "10.255.255.2:3000", ackPacket) {
+		t.Error("Address that could not be dialed should have failed the send")
+	}
+	// Peer not acknowledging, so it is sent once
+	registerTestPeer(comm, "10.255.255.2:3000")
+	if status := <-comm.SendMessage("", "10.255.255.2:3000", ackPacket); status != Failed {
+		t.Error("Message that could not be sent should have failed", status)
+	}
+}
+
+func TestUDPCommunication_selfRegisterDeviceIndex(t *testing.T) {
+	lc := _ListenerConfig{port: 34860, zone: "eth0",
+		unicasts: []net.Addr{&net.IPNet{IP: net.ParseIP("127.0.0.1").To4(), Mask: net.CIDRMask(8, 32)}}}
+	for _, deviceIndex := range []uint8{3, 2} {
+		comm := NewUDPCommunication().(*_UDPCommunication)
+		comm.listen(NewConfigWithDiscovery(34860, []string{"no-such-interface"}, AutoDiscovery,
+			NewMulticastConfig("", "", 0, true), false, deviceIndex))
+		comm.selfProfile = profile.NewUserProfile("a", "a", "a@a.co")
+		comm.selfIdentity, _ = identity.NewIdentity()
+		if index := comm.getSelfRegisterPacket(lc).GetDevicePreferenceIndex(); index != deviceIndex {
+			t.Error("Session should have registered with the device index configured", index)
+		}
+	}
+}
+
+func TestUDPCommunication_retryRegister(t *testing.T) {
+	comm := NewUDPCommunication().(*_UDPCommunication)
+	attempts := 0
+	if !comm.retryRegister(func() bool {
+		attempts++
+		return attempts < 2
+	}) || attempts != 2 {
+		t.Error("REGISTER should have been retried till sent", attempts)
+	}
+	attempts = 0
+	comm.cancel()
+	start := time.Now()
+	if comm.retryRegister(func() bool {
+		attempts++
+		return true
+	}) || attempts != 1 || time.Since(start) >= registerRetryInterval {
+		t.Error("REGISTER should not have been retried once closing", attempts)
+	}
+}
+
+func TestUDPCommunication_updateListeners(t *testing.T) {
+	loopback, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip("No loopback interface")
+	}
+	comm := NewUDPCommunication().(*_UDPCommunication)
+	comm.listen(NewConfig(34800, "no-such-interface"))
+	comm.mdnsEnabled = false
+	comm.selfProfile = profile.NewUserProfile("a", "a", "a@a.co")
+	comm.selfIdentity, _ = identity.NewIdentity()
+	if len(comm.getListeners()) != 0 {
+		t.Fatal("No interface should have been listened on")
+	}
+	lc := _ListenerConfig{port: 34800, zone: loopback.Name, interfaceIndex: loopback.Index,
+		unicasts: []net.Addr{&net.IPNet{IP: net.ParseIP("127.0.0.1").To4(), Mask: net.CIDRMask(8, 32)}},
+		group:    net.ParseIP(DefaultIPv4MulticastGroup), multicast: NewMulticastConfig("", "", 0, true),
+		discovery: &_DiscoveryState{}}
+	comm.updateListeners(map[string]_ListenerConfig{"lo/ipv4": lc})
+	if listeners := comm.getListeners(); len(listeners) != 1 || listeners["lo/ipv4"].getReplyTo() != "127.0.0.1:34800" {
+		t.Fatal("Listener of the new address should have been started", listeners)
+	}
+	changedLC := lc
+	changedLC.unicasts = []net.Addr{&net.IPNet{IP: net.ParseIP("127.0.0.2").To4(), Mask: net.CIDRMask(8, 32)}}
+	changedLC.discovery = &_DiscoveryState{}
+	comm.updateListeners(map[string]_ListenerConfig{"lo/ipv4": changedLC})
+	if listeners := comm.getListeners(); len(listeners) != 1 || listeners["lo/ipv4"].getReplyTo() != "127.0.0.2:34800" {
+		t.Error("Listener should have been restarted on the address changed", listeners)
+	}
+	if conn, err := listenUDP("127.0.0.1:34800"); err == nil {
+		conn.Close()
+	} else {
+		t.Error("Address changed should no longer have been listened on", err)
+	}
+	comm.updateListeners(map[string]_ListenerConfig{})
+	if listeners := comm.getListeners(); len(listeners) != 0 {
+		t.Error("Listener of the interface gone should have been stopped", listeners)
+	}
+	if conn, err := listenUDP("127.0.0.2:34800"); err == nil {
+		conn.Close()
+	} else {
+		t.Error("Interface gone should no longer have been listened on", err)
+	}
+}
+
+type endRecordingListener struct {
+	ended chan bool
+}
+
+func (listener *endRecordingListener) HandleMessageReceived(event MessageEvent) {}
+func (listener *endRecordingListener) HandleRoomEvent(event RoomEvent)          {}
+func (listener *endRecordingListener) HandleFileEvent(event FileEvent)          {}
+func (listener *endRecordingListener) HandleEndOfMessages() {
+	listener.ended <- true
+}
+
+func TestUDPCommunication_closeOnContextDone(t *testing.T) {
+	loopback, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip("No loopback interface")
+	}
+	comm := NewUDPCommunication().(*_UDPCommunication)
+	listener := &endRecordingListener{ended: make(chan bool, 1)}
+	comm.AddMessageListener(listener)
+	comm.selfProfile = profile.NewUserProfile("a", "a", "a@a.co")
+	comm.selfIdentity, _ = identity.NewIdentity()
+	ctx, cancel := context.WithCancel(context.Background())
+	comm.SetupCommunication(ctx, NewConfig(34900, "no-such-interface"))
+	comm.mdnsEnabled = false
+	lc := _ListenerConfig{port: 34900, zone: loopback.Name, interfaceIndex: loopback.Index,
+		unicasts: []net.Addr{&net.IPNet{IP: net.ParseIP("127.0.0.1").To4(), Mask: net.CIDRMask(8, 32)}},
+		group:    net.ParseIP(DefaultIPv4MulticastGroup), multicast: NewMulticastConfig("", "", 0, true),
+		discovery: &_DiscoveryState{}}
+	comm.updateListeners(map[string]_ListenerConfig{"lo/ipv4": lc})
+	cancel()
+	drained := make(chan struct{})
+	go func() {
+		comm.drainer.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Communication should have drained once the context was done")
+	}
+	select {
+	case <-listener.ended:
+	default:
+		t.Error("Message listener should have been notified of the end")
+	}
+	if len(comm.getListeners()) != 0 {
+		t.Error("Listeners should have been stopped", comm.getListeners())
+	}
+	if conn, err := listenUDP("127.0.0.1:34900"); err == nil {
+		conn.Close()
+	} else {
+		t.Error("Address should no longer have been listened on", err)
+	}
+	if status := <-comm.SendMessage("", "127.0.0.1:30000", packet.NewBuilderFactory().SignOff().
+		BuildSignOffPacket()); status != Failed {
+		t.Error("Message sent once closed should have failed", status)
+	}
+	// Closing again should return rather than block
+	comm.CloseCommunication()
+}
+
+func TestUDPCommunication_closeCommunication(t *testing.T) {
+	comm := NewUDPCommunication().(*_UDPCommunication)
+	// Closing before being set up should return rather than block
+	comm.CloseCommunication()
+	comm = NewUDPCommunication().(*_UDPCommunication)
+	comm.selfProfile = profile.NewUserProfile("a", "a", "a@a.co")
+	comm.selfIdentity, _ = identity.NewIdentity()
+	ctx := comm.ctx
+	comm.SetupCommunication(context.Background(), NewConfig(34901, "no-such-interface"))
+	if comm.ctx != ctx {
+		t.Error("Context of the communication should not have been replaced when set up")
+	}
+	closed := make(chan struct{})
+	go func() {
+		comm.CloseCommunication()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Communication should have drained once closed")
+	}
+	if !comm.closing {
+		t.Error("Communication should have been closing once closed")
+	}
+}
+
+func TestUDPCommunication_reregister(t *testing.T) {
+	comm := NewUDPCommunication().(*_UDPCommunication)
+	register := func(replyTo string) RegisterEvent {
+		return _RegisterEvent{packet: packet.NewBuilderFactory().CreateNewSession().CreateSession(5*time.Minute).
+			CreateUserProfile(profile.NewUserProfile("a", "a", "a@a.co")).RegisterDevice(replyTo, 1).
+			BuildRegisterPacket()}
+	}
+	comm.isNotDuplicate(register("127.0.0.1:30000"))
+	if !comm.isNotDuplicate(register("[fd00::2]:30000")) {
+		t.Error("Session registering again should not have been a duplicate")
+	}
+	if entry, found := comm.findRegistryEntryByReplyTo("[fd00::2]:30000"); !found ||
+		entry.sessionID != packet.GetCurrentSessionID() {
+		t.Error("Reply-to of the session registering again should have been updated")
+	}
+}
@@ -1,48 +1,89 @@
 package network
 
 import (
+	"errors"
 	"log"
 	"net"
+	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
-func checkError(err error) {
-	if err != nil {
-		log.Fatal("Error: ", err)
+const (
+	maxUDPPayloadSize = 65507
+	ipv4Family        = "ipv4"
+	ipv6Family        = "ipv6"
+	// NoDiscoveryAddressErrorMsg is the error returned when sending discovery broadcasts out of an
+	// interface with no address to send them from or to
+	NoDiscoveryAddressErrorMsg = "no address to send discovery broadcasts to from the interface"
+)
+
+// getIP returns the IP of the address of an interface
+func getIP(address net.Addr) net.IP {
+	switch addr := address.(type) {
+	case *net.IPNet:
+		return addr.IP
+	case *net.IPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+// getFamily returns the family, i.e. "ipv4" or "ipv6", of the IP
+func getFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return ipv4Family
 	}
+	return ipv6Family
 }
 
-func isIPv4Address(addr net.Addr) bool {
-	return strings.Contains(addr.String(), ":")
+func isUniqueLocal(ip net.IP) bool {
+	return len(ip) == net.IPv6len && ip.To4() == nil && ip[0]&0xfe == 0xfc
 }
 
-func filterIPv4(addresses []net.Addr, filter func(addr net.Addr) bool) []net.Addr {
+// isLinkScoped checks if the IP is an IPv6 address only unique on its link, which has to be
+// qualified with the zone, i.e. the interface, to be bound or dialed
+func isLinkScoped(ip net.IP) bool {
+	return ip.To4() == nil && (ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast())
+}
+
+// isUsableUnicast checks if peers on the LAN can reach the address, i.e. it is an IPv4 address or an
+// IPv6 link-local or unique local address
+func isUsableUnicast(address net.Addr) bool {
+	ip := getIP(address)
+	return ip != nil && (ip.To4() != nil || ip.IsLinkLocalUnicast() || isUniqueLocal(ip))
+}
+
+func filterAddresses(addresses []net.Addr, filter func(addr net.Addr) bool) []net.Addr {
 	var newAddresses []net.Addr
 	for _, address := range addresses {
-		if !isIPv4Address(address) {
+		if filter(address) {
 			newAddresses = append(newAddresses, address)
 		}
 	}
 	return newAddresses
 }
 
-func getUpIPV4Addresses(netInterface net.Interface, unicast bool) []net.Addr {
-	var addresses []net.Addr
-	var addrsErr error
-	if unicast {
-		addresses, addrsErr = netInterface.Addrs()
-	} else {
-		addresses, addrsErr = netInterface.MulticastAddrs()
-	}
+func getUpIPAddresses(netInterface net.Interface) []net.Addr {
+	addresses, addrsErr := netInterface.Addrs()
 	if addrsErr != nil {
 		log.Fatal(addrsErr)
-	} else {
-		filteredAddresses := filterIPv4(addresses, isIPv4Address)
-		return filteredAddresses
 	}
-	return make([]net.Addr, 0, 0)
+	return filterAddresses(addresses, isUsableUnicast)
+}
+
+// groupByFamily groups the addresses by their family, as unicasts of one family can not talk to
+// the multicast group of the other
+func groupByFamily(addresses []net.Addr) map[string][]net.Addr {
+	groups := make(map[string][]net.Addr)
+	for _, address := range addresses {
+		family := getFamily(getIP(address))
+		groups[family] = append(groups[family], address)
+	}
+	return groups
 }
 
 func isInterfaceIgnorable(netInterface net.Interface) bool {
@@ -53,124 +94,354 @@ func isInterfaceIgnorable(netInterface net.Interface) bool {
 	return false
 }
 
+// isListenable checks if the interface matches any of the interface names configured, which may be
+// wildcards such as `en*`; every interface is listenable if none is configured
 func isListenable(netInterface net.Interface, config Config) bool {
-	if len(config.GetInterfaces()) > 0 {
-		isListenable := true
-		for _, interfaceName := range config.GetInterfaces() {
-			if netInterface.Name != interfaceName {
-				isListenable = false
-			}
+	if len(config.GetInterfaces()) <= 0 {
+		return true
+	}
+	for _, interfaceName := range config.GetInterfaces() {
+		if matched, err := path.Match(interfaceName, netInterface.Name); err == nil && matched {
+			return true
 		}
-		return isListenable
 	}
-	return true
+	return false
+}
+
+// getHostPortFromNetAddr returns the connection string of the address at the port, in the
+// `[ip-address]:port` form for IPv6 addresses. Link-scoped IPv6 addresses are qualified with the
+// zone unless it is blank, which is how they are advertised to peers.
+func getHostPortFromNetAddr(port int, address net.Addr, zone string) string {
+	ip := getIP(address)
+	host := ip.String()
+	if isLinkScoped(ip) && zone != "" {
+		host += "%" + zone
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
 }
 
-func getHostPortFromNetAddr(port int, address *net.Addr) string {
-	addrStr := (*address).String()
-	endIndex := strings.Index(addrStr, "/")
-	if endIndex < 1 {
-		endIndex = len(addrStr)
+// splitZone splits the host into the IP and the zone it is qualified with, if any
+func splitZone(host string) (string, string) {
+	if zoneIndex := strings.LastIndex(host, "%"); zoneIndex >= 0 {
+		return host[:zoneIndex], host[zoneIndex+1:]
 	}
-	listeningStr := addrStr[0:endIndex] + ":" + strconv.Itoa(port)
-	return listeningStr
+	return host, ""
 }
 
-func listenForMessage(port int, address *net.Addr, channel chan []byte) {
-	serverListeningStr := getHostPortFromNetAddr(port, address)
+// withZone qualifies the link-scoped IPv6 host of the connection string with the zone, as peers
+// advertise their reply-to without the zone, which only means something to the host itself
+func withZone(connectionStr string, zone string) string {
+	host, port, err := net.SplitHostPort(connectionStr)
+	if err != nil || strings.Contains(host, "%") {
+		return connectionStr
+	}
+	if ip := net.ParseIP(host); ip != nil && isLinkScoped(ip) {
+		return net.JoinHostPort(host+"%"+zone, port)
+	}
+	return connectionStr
+}
+
+func listenUDP(serverListeningStr string) (*net.UDPConn, error) {
 	// Copied from https://varshneyabhi.wordpress.com/2014/12/23/simple-udp-clientserver-in-golang/
 	ServerAddr, err := net.ResolveUDPAddr("udp", serverListeningStr)
-	ServerConn, err := net.ListenUDP("udp", ServerAddr)
-	checkError(err)
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenUDP("udp", ServerAddr)
+}
+
+// listenForMessage passes the datagrams received on to the channel till the connection is closed
+func listenForMessage(ServerConn *net.UDPConn, channel chan []byte) {
 	defer ServerConn.Close()
-	// FIXME: We will need to track for packets larger than 10KB
-	buf := make([]byte, 1024*10)
+	// Payloads larger than a datagram arrive as fragments, see fragmentEventData
+	buf := make([]byte, maxUDPPayloadSize)
 
 	for {
 		n, addr, err := ServerConn.ReadFromUDP(buf)
-		message := buf[0:n]
-		log.Println("Received ", string(message), " from ", addr)
-		channel <- message
 		if err != nil {
-			log.Println("Error: ", err)
+			log.Println("Stopped listening on", ServerConn.LocalAddr(), err)
+			return
 		}
+		message := make([]byte, n)
+		copy(message, buf[0:n])
+		log.Println("Received ", string(message), " from ", addr)
+		channel <- message
+	}
+}
+
+// _ListenerSockets is everything listened to and sent from for a listener, which is closed once the
+// addresses of the listener change
+type _ListenerSockets struct {
+	conns         []*net.UDPConn
+	fileListeners []net.Listener
+	mdnsProvider  *_MDNSProvider
+	fallbackTimer *time.Timer
+}
+
+func (sockets *_ListenerSockets) close(fileTransfers *_FileTransfers) {
+	if sockets.fallbackTimer != nil {
+		sockets.fallbackTimer.Stop()
+	}
+	if sockets.mdnsProvider != nil {
+		sockets.mdnsProvider.close()
+	}
+	for _, conn := range sockets.conns {
+		conn.Close()
 	}
+	for _, fileListener := range sockets.fileListeners {
+		fileTransfers.unlisten(fileListener)
+	}
+}
+
+// _DiscoveryState tracks whether a peer has been found through the discovery broadcasts of a
+// listener, and whether they are sent to the directed broadcast addresses instead of the group
+type _DiscoveryState struct {
+	mutex        sync.Mutex
+	broadcasting bool
+	peerFound    bool
+}
+
+func (state *_DiscoveryState) markPeerFound() {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	state.peerFound = true
+}
+
+func (state *_DiscoveryState) isBroadcasting() bool {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	return state.broadcasting
 }
 
+// fallBackToBroadcast switches to broadcasting unless a peer has been found or it is broadcasting
+// already, returning whether it switched
+func (state *_DiscoveryState) fallBackToBroadcast() bool {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	if state.peerFound || state.broadcasting {
+		return false
+	}
+	state.broadcasting = true
+	return true
+}
+
+// _ListenerConfig is the addresses of a family, i.e. IPv4 or IPv6, of an interface, whose name is the
+// zone of its link-scoped IPv6 addresses, along with the multicast group of the family joined on it
 type _ListenerConfig struct {
-	port       int
-	unicasts   []net.Addr
-	multicasts []net.Addr
+	port           int
+	zone           string
+	interfaceIndex int
+	unicasts       []net.Addr
+	group          net.IP
+	multicast      MulticastConfig
+	discovery      *_DiscoveryState
 }
 
-func (lc _ListenerConfig) GetResolvedUnicastAddr() *net.UDPAddr {
+// isChanged checks if the listener is of another interface or addresses than the other one
+func (lc _ListenerConfig) isChanged(other _ListenerConfig) bool {
+	if lc.interfaceIndex != other.interfaceIndex || len(lc.unicasts) != len(other.unicasts) {
+		return true
+	}
+	for index, unicast := range lc.unicasts {
+		if unicast.String() != other.unicasts[index].String() {
+			return true
+		}
+	}
+	return false
+}
+
+// getReplyTo returns the connection string peers are to reply to, preferring addresses which are
+// not link-scoped, as those are ambiguous to peers on multiple links
+func (lc _ListenerConfig) getReplyTo() string {
 	if len(lc.unicasts) < 1 {
-		return nil
+		return ""
 	}
-	udpAddr, err := net.ResolveUDPAddr("udp", getHostPortFromNetAddr(lc.port, &lc.unicasts[0]))
-	if err == nil {
-		return udpAddr
+	replyTo := lc.unicasts[0]
+	for _, unicast := range lc.unicasts {
+		if !isLinkScoped(getIP(unicast)) {
+			replyTo = unicast
+			break
+		}
 	}
-	return nil
+	return getHostPortFromNetAddr(lc.port, replyTo, "")
 }
 
 func (lc _ListenerConfig) getResolvedBroadcastReceiverAddr() *net.UDPAddr {
 	if len(lc.unicasts) < 1 {
 		return nil
 	}
-	udpAddr, err := net.ResolveUDPAddr("udp", getHostPortFromNetAddr(lc.port+2, &lc.unicasts[0]))
+	udpAddr, err := net.ResolveUDPAddr("udp", getHostPortFromNetAddr(lc.port+2, lc.unicasts[0], lc.zone))
 	if err == nil {
 		return udpAddr
 	}
 	return nil
 }
 
+// isCompatible checks if the peer at the connection string is on the network of any of the
+// unicasts. A link-local peer is on the network of every interface with a link-local address, so
+// unless its zone tells the interface, the first such listener is picked.
 func (lc _ListenerConfig) isCompatible(connectionStr string) bool {
-	endIndex := strings.Index(connectionStr, ":")
-	if endIndex < 1 {
-		endIndex = len(connectionStr)
+	host, _, err := net.SplitHostPort(connectionStr)
+	if err != nil {
+		return false
+	}
+	host, zone := splitZone(host)
+	ip := net.ParseIP(host)
+	if ip == nil || (zone != "" && zone != lc.zone) {
+		return false
 	}
-	ip := net.ParseIP(connectionStr[0:endIndex])
 	for _, unicast := range lc.unicasts {
-		_, thisIPNet, _ := net.ParseCIDR(unicast.String())
-		if thisIPNet.Contains(ip) {
+		if thisIPNet, ok := unicast.(*net.IPNet); ok && thisIPNet.Contains(ip) {
 			return true
 		}
 	}
 	return false
 }
 
-func (lc _ListenerConfig) GetMultiCastConnections() []*net.UDPConn {
-	receiver := lc.getResolvedBroadcastReceiverAddr()
-	if receiver == nil {
-		return make([]*net.UDPConn, 0)
-	}
-	connections := make([]*net.UDPConn, 0, len(lc.multicasts))
-	for _, mAddress := range lc.multicasts {
-		udpAddr, err := net.ResolveUDPAddr("udp", getHostPortFromNetAddr(lc.port+1, &mAddress))
-		if err == nil {
-			conn, err := net.DialUDP("udp", receiver, udpAddr)
-			if err != nil {
-				log.Println("2: ", err)
-				continue
-			}
-			connections = connections[:len(connections)+1]
-			connections[len(connections)-1] = conn
-		} else {
-			log.Println("3: ", err)
+func (lc _ListenerConfig) getGroupAddr() *net.UDPAddr {
+	groupAddr := &net.UDPAddr{IP: lc.group, Port: lc.port + 1}
+	if isLinkScoped(lc.group) {
+		groupAddr.Zone = lc.zone
+	}
+	return groupAddr
+}
+
+// joinGroup listens to the multicast group on the interface, which makes the interface join it
+func (lc _ListenerConfig) joinGroup() (*net.UDPConn, error) {
+	netInterface := &net.Interface{Index: lc.interfaceIndex, Name: lc.zone}
+	return net.ListenMulticastUDP("udp", netInterface, lc.getGroupAddr())
+}
+
+// getDirectedBroadcastAddrs returns the directed broadcast address of each IPv4 subnet of the
+// unicasts at the port broadcasts are received on
+func (lc _ListenerConfig) getDirectedBroadcastAddrs() []*net.UDPAddr {
+	var broadcastAddrs []*net.UDPAddr
+	for _, unicast := range lc.unicasts {
+		ipNet, ok := unicast.(*net.IPNet)
+		if !ok || ipNet.IP.To4() == nil {
+			continue
+		}
+		ip, mask := ipNet.IP.To4(), ipNet.Mask
+		if len(mask) == net.IPv6len {
+			mask = mask[net.IPv6len-net.IPv4len:]
+		}
+		broadcast := make(net.IP, net.IPv4len)
+		for index := range broadcast {
+			broadcast[index] = ip[index] | ^mask[index]
+		}
+		duplicate := broadcast.Equal(ip)
+		for _, broadcastAddr := range broadcastAddrs {
+			duplicate = duplicate || broadcastAddr.IP.Equal(broadcast)
+		}
+		if !duplicate {
+			broadcastAddrs = append(broadcastAddrs, &net.UDPAddr{IP: broadcast, Port: lc.port + 1})
+		}
+	}
+	return broadcastAddrs
+}
+
+// getDiscoveryAddrs returns the addresses discovery broadcasts are sent to, i.e. the multicast group
+// or the directed broadcast addresses when broadcasting
+func (lc _ListenerConfig) getDiscoveryAddrs() []*net.UDPAddr {
+	if lc.discovery != nil && lc.discovery.isBroadcasting() {
+		if broadcastAddrs := lc.getDirectedBroadcastAddrs(); len(broadcastAddrs) > 0 {
+			return broadcastAddrs
 		}
 	}
-	return connections
+	return []*net.UDPAddr{lc.getGroupAddr()}
+}
+
+// dialDiscovery returns the connection sending discovery broadcasts to the address; multicasts are
+// sent out of the interface with the TTL and loopback configured
+func (lc _ListenerConfig) dialDiscovery(discoveryAddr *net.UDPAddr) (*net.UDPConn, error) {
+	receiver := lc.getResolvedBroadcastReceiverAddr()
+	if receiver == nil || discoveryAddr.IP == nil {
+		return nil, errors.New(NoDiscoveryAddressErrorMsg)
+	}
+	conn, err := net.DialUDP("udp", receiver, discoveryAddr)
+	if err != nil {
+		return nil, err
+	}
+	if !discoveryAddr.IP.IsMulticast() {
+		return conn, nil
+	}
+	if err := setMulticastOptions(conn, lc); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
 }
 
 type _RegistryEntry struct {
+	mutex          sync.Mutex
 	expiryTime     time.Time
 	packetRegistry map[uint64]uint8
+	sessionID      string
+	replyTo        string
+	capabilities   []string
+	publicKey      []byte
+	agreementKey   []byte
+}
+
+// registerPacket records the packet ID for the session and returns false if it was seen before
+func (entry *_RegistryEntry) registerPacket(packetID uint64) bool {
+	entry.mutex.Lock()
+	defer entry.mutex.Unlock()
+	if _, packetExists := entry.packetRegistry[packetID]; packetExists {
+		entry.packetRegistry[packetID]++
+		return false
+	}
+	entry.packetRegistry[packetID] = 1
+	return true
+}
+
+func (entry *_RegistryEntry) hasCapability(capability string) bool {
+	entry.mutex.Lock()
+	defer entry.mutex.Unlock()
+	for _, aCapability := range entry.capabilities {
+		if aCapability == capability {
+			return true
+		}
+	}
+	return false
+}
+
+func (entry *_RegistryEntry) renew(expiryTime time.Time) {
+	entry.mutex.Lock()
+	defer entry.mutex.Unlock()
+	entry.expiryTime = expiryTime
+}
+
+func (entry *_RegistryEntry) getExpiryTime() time.Time {
+	entry.mutex.Lock()
+	defer entry.mutex.Unlock()
+	return entry.expiryTime
+}
+
+func (entry *_RegistryEntry) getReplyTo() string {
+	entry.mutex.Lock()
+	defer entry.mutex.Unlock()
+	return entry.replyTo
+}
+
+// reregister updates the entry with the REGISTER the session sent again, e.g. on its address
+// changing; the keys stay bound to the session
+func (entry *_RegistryEntry) reregister(event RegisterEvent) {
+	entry.mutex.Lock()
+	defer entry.mutex.Unlock()
+	entry.expiryTime = event.GetRegisterPacket().GetExpiryTime()
+	entry.replyTo = event.GetRegisterPacket().GetReplyTo()
+	entry.capabilities = event.GetRegisterPacket().GetCapabilities()
 }
 
-func newRegistryEntry(event RegisterEvent) _RegistryEntry {
-	entry := _RegistryEntry{}
+func newRegistryEntry(event RegisterEvent) *_RegistryEntry {
+	entry := &_RegistryEntry{}
 	entry.expiryTime = event.GetRegisterPacket().GetExpiryTime()
+	entry.sessionID = event.GetRegisterPacket().GetSessionID()
+	entry.replyTo = event.GetRegisterPacket().GetReplyTo()
+	entry.capabilities = event.GetRegisterPacket().GetCapabilities()
+	entry.publicKey = event.GetRegisterPacket().GetPublicKey()
+	entry.agreementKey = event.GetRegisterPacket().GetAgreementKey()
 	entry.packetRegistry = make(map[uint64]uint8)
 	entry.packetRegistry[event.GetRegisterPacket().GetPacketID()] = 1
 	return entry
@@ -0,0 +1,185 @@
+package packet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"time"
+)
+
+// The binary format encodes a struct as the count of its fields followed by each field as a
+// length-prefixed value, in declaration order; embedded structs are encoded as nested structs.
+// Decoders skip trailing fields they do not know and leave missing ones at zero value, so fields
+// may only ever be appended to packets for the format to stay compatible.
+
+const (
+	// BinaryFormatErrorMsg is returned when the buffer is not a valid binary encoded packet
+	BinaryFormatErrorMsg = "malformed binary packet"
+	// UnsupportedBinaryKindErrorMsg is returned when a packet field can not be binary encoded
+	UnsupportedBinaryKindErrorMsg = "unsupported field kind for binary codec"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func marshalBinary(value interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	err := writeBinaryValue(buf, reflect.Indirect(reflect.ValueOf(value)))
+	return buf.Bytes(), err
+}
+
+func unmarshalBinary(buf []byte, value interface{}) error {
+	pointer := reflect.ValueOf(value)
+	if pointer.Kind() != reflect.Ptr || pointer.IsNil() {
+		return errors.New(UnsupportedBinaryKindErrorMsg)
+	}
+	return readBinaryValue(bytes.NewReader(buf), pointer.Elem())
+}
+
+func writeUvarint(buf *bytes.Buffer, value uint64) {
+	varint := make([]byte, binary.MaxVarintLen64)
+	buf.Write(varint[:binary.PutUvarint(varint, value)])
+}
+
+func writeBlob(buf *bytes.Buffer, blob []byte) {
+	writeUvarint(buf, uint64(len(blob)))
+	buf.Write(blob)
+}
+
+func binaryFields(value reflect.Value) []reflect.Value {
+	fields := make([]reflect.Value, 0, value.NumField())
+	for index := 0; index < value.NumField(); index++ {
+		field := value.Type().Field(index)
+		if field.PkgPath == "" || field.Anonymous {
+			fields = append(fields, value.Field(index))
+		}
+	}
+	return fields
+}
+
+func writeBinaryValue(buf *bytes.Buffer, value reflect.Value) error {
+	switch {
+	case value.Type() == timeType:
+		timeBytes, err := value.Interface().(time.Time).MarshalBinary()
+		buf.Write(timeBytes)
+		return err
+	case value.Kind() == reflect.Struct:
+		fields := binaryFields(value)
+		writeUvarint(buf, uint64(len(fields)))
+		for _, field := range fields {
+			fieldBuf := &bytes.Buffer{}
+			if err := writeBinaryValue(fieldBuf, field); err != nil {
+				return err
+			}
+			writeBlob(buf, fieldBuf.Bytes())
+		}
+	case value.Kind() == reflect.Slice && value.Type().Elem().Kind() == reflect.Uint8:
+		buf.Write(value.Bytes())
+	case value.Kind() == reflect.Slice:
+		writeUvarint(buf, uint64(value.Len()))
+		for index := 0; index < value.Len(); index++ {
+			elementBuf := &bytes.Buffer{}
+			if err := writeBinaryValue(elementBuf, value.Index(index)); err != nil {
+				return err
+			}
+			writeBlob(buf, elementBuf.Bytes())
+		}
+	case value.Kind() == reflect.String:
+		buf.WriteString(value.String())
+	case value.Kind() == reflect.Bool:
+		if value.Bool() {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case value.Kind() >= reflect.Uint && value.Kind() <= reflect.Uint64:
+		writeUvarint(buf, value.Uint())
+	case value.Kind() >= reflect.Int && value.Kind() <= reflect.Int64:
+		varint := make([]byte, binary.MaxVarintLen64)
+		buf.Write(varint[:binary.PutVarint(varint, value.Int())])
+	default:
+		return errors.New(UnsupportedBinaryKindErrorMsg)
+	}
+	return nil
+}
+
+func readBlob(reader *bytes.Reader) ([]byte, error) {
+	length, err := binary.ReadUvarint(reader)
+	if err != nil || length > uint64(reader.Len()) {
+		return nil, errors.New(BinaryFormatErrorMsg)
+	}
+	blob := make([]byte, length)
+	reader.Read(blob)
+	return blob, nil
+}
+
+func readBinaryValue(reader *bytes.Reader, value reflect.Value) error {
+	remaining := make([]byte, reader.Len())
+	reader.Read(remaining)
+	switch {
+	case value.Type() == timeType:
+		aTime := time.Time{}
+		if err := aTime.UnmarshalBinary(remaining); err != nil {
+			return errors.New(BinaryFormatErrorMsg)
+		}
+		value.Set(reflect.ValueOf(aTime))
+	case value.Kind() == reflect.Struct:
+		remainingReader := bytes.NewReader(remaining)
+		count, err := binary.ReadUvarint(remainingReader)
+		if err != nil {
+			return errors.New(BinaryFormatErrorMsg)
+		}
+		fields := binaryFields(value)
+		for index := uint64(0); index < count; index++ {
+			blob, err := readBlob(remainingReader)
+			if err != nil {
+				return err
+			}
+			if index < uint64(len(fields)) {
+				if err := readBinaryValue(bytes.NewReader(blob), fields[index]); err != nil {
+					return err
+				}
+			}
+		}
+	case value.Kind() == reflect.Slice && value.Type().Elem().Kind() == reflect.Uint8:
+		if len(remaining) > 0 {
+			value.SetBytes(remaining)
+		}
+	case value.Kind() == reflect.Slice:
+		remainingReader := bytes.NewReader(remaining)
+		count, err := binary.ReadUvarint(remainingReader)
+		if err != nil || count > uint64(len(remaining)) {
+			return errors.New(BinaryFormatErrorMsg)
+		}
+		slice := reflect.MakeSlice(value.Type(), int(count), int(count))
+		for index := 0; index < int(count); index++ {
+			blob, err := readBlob(remainingReader)
+			if err != nil {
+				return err
+			}
+			if err := readBinaryValue(bytes.NewReader(blob), slice.Index(index)); err != nil {
+				return err
+			}
+		}
+		value.Set(slice)
+	case value.Kind() == reflect.String:
+		value.SetString(string(remaining))
+	case value.Kind() == reflect.Bool:
+		value.SetBool(len(remaining) > 0 && remaining[0] != 0)
+	case value.Kind() >= reflect.Uint && value.Kind() <= reflect.Uint64:
+		number, err := binary.ReadUvarint(bytes.NewReader(remaining))
+		if err != nil || value.OverflowUint(number) {
+			return errors.New(BinaryFormatErrorMsg)
+		}
+		value.SetUint(number)
+	case value.Kind() >= reflect.Int && value.Kind() <= reflect.Int64:
+		number, err := binary.ReadVarint(bytes.NewReader(remaining))
+		if err != nil || value.OverflowInt(number) {
+			return errors.New(BinaryFormatErrorMsg)
+		}
+		value.SetInt(number)
+	default:
+		return errors.New(UnsupportedBinaryKindErrorMsg)
+	}
+	return nil
+}
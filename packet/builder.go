@@ -1,6 +1,7 @@
 package packet
 
 import (
+	"crypto/sha256"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -32,6 +33,10 @@ type SessionRenewBuilder interface {
 
 // RegisterPacketBuilder builds RegisterPacket for registering a peer
 type RegisterPacketBuilder interface {
+	AnnounceCapabilities(capabilities ...string) RegisterPacketBuilder
+	PublishIdentityKey(publicKey []byte) RegisterPacketBuilder
+	PublishAgreementKey(agreementKey []byte) RegisterPacketBuilder
+	AnnouncePresence(presence profile.Presence) RegisterPacketBuilder
 	BuildRegisterPacket() RegisterPacket
 }
 
@@ -42,14 +47,70 @@ type SignOffPacketBuilder interface {
 
 // PingPacketBuilder builds a PingPacket for pinging presence to peers
 type PingPacketBuilder interface {
+	UpdatePresence(presence profile.Presence) PingPacketBuilder
 	BuildPingPacket() PingPacket
 }
 
+// MessageRecipientBuilder starts building towards MessagePacket by addressing the recipient
+type MessageRecipientBuilder interface {
+	To(recipientUsername string) MessageBodyBuilder
+}
+
+// MessageBodyBuilder builds towards MessagePacket by setting the content of the message
+type MessageBodyBuilder interface {
+	InRoom(roomID string) MessageBodyBuilder
+	WithBody(contentType string, body string) MessagePacketBuilder
+}
+
+// MessagePacketBuilder builds a MessagePacket for chatting with a peer
+type MessagePacketBuilder interface {
+	BuildMessagePacket() MessagePacket
+}
+
+// AckPacketBuilder builds an AckPacket for acknowledging receipt of a packet
+type AckPacketBuilder interface {
+	BuildAckPacket() AckPacket
+}
+
+// RoomMembershipBuilder starts building towards RoomPacket by stating the members of the room
+type RoomMembershipBuilder interface {
+	WithMembers(memberUsernames ...string) RoomActionBuilder
+}
+
+// RoomActionBuilder builds towards RoomPacket by setting the change made to the room
+type RoomActionBuilder interface {
+	Create(inviteeUsernames ...string) RoomPacketBuilder
+	Invite(inviteeUsernames ...string) RoomPacketBuilder
+	Join() RoomPacketBuilder
+	Leave() RoomPacketBuilder
+}
+
+// RoomPacketBuilder builds a RoomPacket for notifying members of a change to a room
+type RoomPacketBuilder interface {
+	BuildRoomPacket() RoomPacket
+}
+
+// FileActionBuilder starts building towards FilePacket by setting the step of the transfer
+type FileActionBuilder interface {
+	Offer(fileName string, fileSize int64, checksum []byte) FilePacketBuilder
+	Accept() FilePacketBuilder
+	Reject() FilePacketBuilder
+}
+
+// FilePacketBuilder builds a FilePacket for transferring a file to a peer
+type FilePacketBuilder interface {
+	BuildFilePacket() FilePacket
+}
+
 // BuilderFactory is the central builder that allows communication to build packets
 type BuilderFactory interface {
 	CreateNewSession() SessionBuilder
 	SignOff() SignOffPacketBuilder
 	Ping() SessionRenewBuilder
+	Message() MessageRecipientBuilder
+	Room(roomID string, roomName string) RoomMembershipBuilder
+	File(transferID string) FileActionBuilder
+	Acknowledge(sessionID string, packetID uint64) AckPacketBuilder
 }
 
 type _Builder struct {
@@ -61,6 +122,25 @@ type _Builder struct {
 	devicePreferenceIndex uint8
 	replyTo               string
 	userProfile           profile.UserProfile
+	capabilities          []string
+	publicKey             []byte
+	agreementKey          []byte
+	presence              profile.Presence
+	recipientUsername     string
+	contentType           string
+	body                  string
+	roomID                string
+	roomName              string
+	roomAction            RoomAction
+	memberUsernames       []string
+	inviteeUsernames      []string
+	transferID            string
+	fileAction            FileAction
+	fileName              string
+	fileSize              int64
+	checksum              []byte
+	ackSessionID          string
+	ackPacketID           uint64
 }
 
 func (builder *_Builder) CreateNewSession() SessionBuilder {
@@ -75,6 +155,37 @@ func (builder *_Builder) Ping() SessionRenewBuilder {
 	atomic.AddUint64(&builder.packetSequenceID, 1)
 	return builder
 }
+func (builder *_Builder) Message() MessageRecipientBuilder {
+	atomic.AddUint64(&builder.packetSequenceID, 1)
+	return builder
+}
+func (builder *_Builder) Room(roomID string, roomName string) RoomMembershipBuilder {
+	if utils.IsStringBlank(roomID) || utils.IsStringBlank(roomName) {
+		panic("Room ID and name must be provided")
+	}
+	roomBuilder := *builder
+	roomBuilder.packetSequenceID = atomic.AddUint64(&builder.packetSequenceID, 1)
+	roomBuilder.roomID, roomBuilder.roomName = roomID, roomName
+	return roomBuilder
+}
+func (builder *_Builder) File(transferID string) FileActionBuilder {
+	if utils.IsStringBlank(transferID) {
+		panic("No transfer ID provided")
+	}
+	fileBuilder := *builder
+	fileBuilder.packetSequenceID = atomic.AddUint64(&builder.packetSequenceID, 1)
+	fileBuilder.transferID = transferID
+	return fileBuilder
+}
+func (builder *_Builder) Acknowledge(sessionID string, packetID uint64) AckPacketBuilder {
+	if utils.IsStringBlank(sessionID) {
+		panic("No session ID provided to acknowledge")
+	}
+	ackBuilder := *builder
+	ackBuilder.packetSequenceID = atomic.AddUint64(&builder.packetSequenceID, 1)
+	ackBuilder.ackSessionID, ackBuilder.ackPacketID = sessionID, packetID
+	return ackBuilder
+}
 func (builder _Builder) CreateSession(age time.Duration) UserProfileBuilder {
 	builder.expiryTime = time.Now().Add(age)
 	return builder
@@ -93,18 +204,134 @@ func (builder _Builder) RegisterDevice(
 		panic("No reply-to value provided")
 	}
 	if !utils.IsValidConnectionString(replyToConnectionStr) {
-		panic("reply-to not provided in `ip-address:port` format!")
+		panic("reply-to not provided in `ip-address:port` or `[ip-address]:port` format!")
 	}
 	builder.replyTo = replyToConnectionStr
 	builder.devicePreferenceIndex = devicePreference
 	return builder
 }
 
+func (builder _Builder) AnnounceCapabilities(capabilities ...string) RegisterPacketBuilder {
+	for _, capability := range capabilities {
+		if utils.IsStringBlank(capability) {
+			panic("Blank capability can not be announced")
+		}
+	}
+	builder.capabilities = append([]string{}, capabilities...)
+	return builder
+}
+func (builder _Builder) PublishIdentityKey(publicKey []byte) RegisterPacketBuilder {
+	if len(publicKey) == 0 {
+		panic("No identity key provided")
+	}
+	builder.publicKey = append([]byte{}, publicKey...)
+	return builder
+}
+func (builder _Builder) PublishAgreementKey(agreementKey []byte) RegisterPacketBuilder {
+	if len(agreementKey) == 0 {
+		panic("No agreement key provided")
+	}
+	builder.agreementKey = append([]byte{}, agreementKey...)
+	return builder
+}
+func (builder _Builder) AnnouncePresence(presence profile.Presence) RegisterPacketBuilder {
+	builder.presence = validPresence(presence)
+	return builder
+}
+func (builder _Builder) UpdatePresence(presence profile.Presence) PingPacketBuilder {
+	builder.presence = validPresence(presence)
+	return builder
+}
+
+func validPresence(presence profile.Presence) profile.Presence {
+	if presence == nil {
+		panic("No presence provided")
+	}
+	return presence
+}
+
+func (builder _Builder) To(recipientUsername string) MessageBodyBuilder {
+	if !utils.IsStringAlphaNumericWithSpace(recipientUsername) {
+		panic("Recipient username must be Alpha Numeric only")
+	}
+	builder.recipientUsername = recipientUsername
+	return builder
+}
+func (builder _Builder) InRoom(roomID string) MessageBodyBuilder {
+	if utils.IsStringBlank(roomID) {
+		panic("No room ID provided")
+	}
+	builder.roomID = roomID
+	return builder
+}
+func (builder _Builder) WithBody(contentType string, body string) MessagePacketBuilder {
+	if utils.IsStringBlank(contentType) {
+		panic("No content type provided")
+	}
+	if utils.IsStringEmpty(body) {
+		panic("No message body provided")
+	}
+	builder.contentType = contentType
+	builder.body = body
+	return builder
+}
+func (builder _Builder) WithMembers(memberUsernames ...string) RoomActionBuilder {
+	builder.memberUsernames = validUsernames(memberUsernames)
+	return builder
+}
+func (builder _Builder) Create(inviteeUsernames ...string) RoomPacketBuilder {
+	builder.roomAction, builder.inviteeUsernames = RoomCreateAction, validUsernames(inviteeUsernames)
+	return builder
+}
+func (builder _Builder) Invite(inviteeUsernames ...string) RoomPacketBuilder {
+	if len(inviteeUsernames) == 0 {
+		panic("No invitee provided")
+	}
+	builder.roomAction, builder.inviteeUsernames = RoomInviteAction, validUsernames(inviteeUsernames)
+	return builder
+}
+func (builder _Builder) Join() RoomPacketBuilder {
+	builder.roomAction = RoomJoinAction
+	return builder
+}
+func (builder _Builder) Leave() RoomPacketBuilder {
+	builder.roomAction = RoomLeaveAction
+	return builder
+}
+
+func (builder _Builder) Offer(fileName string, fileSize int64, checksum []byte) FilePacketBuilder {
+	if !isValidFileName(fileName) {
+		panic("File name must not be blank or a path")
+	}
+	if fileSize < 0 || len(checksum) != sha256.Size {
+		panic("File size and SHA-256 checksum must be provided")
+	}
+	builder.fileAction, builder.fileName, builder.fileSize = FileOfferAction, fileName, fileSize
+	builder.checksum = append([]byte{}, checksum...)
+	return builder
+}
+func (builder _Builder) Accept() FilePacketBuilder {
+	builder.fileAction = FileAcceptAction
+	return builder
+}
+func (builder _Builder) Reject() FilePacketBuilder {
+	builder.fileAction = FileRejectAction
+	return builder
+}
+
+func validUsernames(usernames []string) []string {
+	if !areValidUsernames(usernames) {
+		panic("Room member username must be Alpha Numeric only")
+	}
+	return append([]string{}, usernames...)
+}
+
 func (builder _Builder) BuildPingPacket() PingPacket {
 	packet := &_PingPacket{}
 	packet.PacketID = builder.packetSequenceID
 	packet.SessionID = builder.sessionID.String()
 	packet.ExpiryTime = builder.expiryTime
+	builder.setPresence(packet)
 	return packet
 }
 func (builder _Builder) BuildSignOffPacket() SignOffPacket {
@@ -121,6 +348,59 @@ func (builder _Builder) BuildRegisterPacket() RegisterPacket {
 	packet.ReplyTo = builder.replyTo
 	packet.DevicePreferenceIndex = builder.devicePreferenceIndex
 	packet.Username, packet.DisplayName, packet.Email = builder.userProfile.GetUsername(), builder.userProfile.GetDisplayName(), builder.userProfile.GetEmail()
+	packet.Capabilities = builder.capabilities
+	packet.PublicKey = builder.publicKey
+	packet.AgreementKey = builder.agreementKey
+	builder.setPresence(&packet._PingPacket)
+	return packet
+}
+
+// setPresence sets the presence announced, which is left blank if none was announced
+func (builder _Builder) setPresence(packet *_PingPacket) {
+	if builder.presence != nil {
+		packet.PresenceState = builder.presence.GetState()
+		packet.StatusMessage = builder.presence.GetStatusMessage()
+	}
+}
+
+func (builder _Builder) BuildMessagePacket() MessagePacket {
+	packet := &_MessagePacket{}
+	packet.PacketID = builder.packetSequenceID
+	packet.SessionID = builder.sessionID.String()
+	packet.RecipientUsername = builder.recipientUsername
+	packet.ContentType = builder.contentType
+	packet.Body = builder.body
+	packet.RoomID = builder.roomID
+	packet.Timestamp = time.Now()
+	return packet
+}
+
+func (builder _Builder) BuildRoomPacket() RoomPacket {
+	packet := &_RoomPacket{}
+	packet.PacketID = builder.packetSequenceID
+	packet.SessionID = builder.sessionID.String()
+	packet.RoomID, packet.RoomName = builder.roomID, builder.roomName
+	packet.Action = builder.roomAction
+	packet.MemberUsernames = builder.memberUsernames
+	packet.InviteeUsernames = builder.inviteeUsernames
+	return packet
+}
+
+func (builder _Builder) BuildFilePacket() FilePacket {
+	packet := &_FilePacket{}
+	packet.PacketID = builder.packetSequenceID
+	packet.SessionID = builder.sessionID.String()
+	packet.TransferID, packet.Action = builder.transferID, builder.fileAction
+	packet.FileName, packet.FileSize, packet.Checksum = builder.fileName, builder.fileSize, builder.checksum
+	return packet
+}
+
+func (builder _Builder) BuildAckPacket() AckPacket {
+	packet := &_AckPacket{}
+	packet.PacketID = builder.packetSequenceID
+	packet.SessionID = builder.sessionID.String()
+	packet.AcknowledgedSessionID = builder.ackSessionID
+	packet.AcknowledgedPacketID = builder.ackPacketID
 	return packet
 }
 
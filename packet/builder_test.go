@@ -1,6 +1,8 @@
 package packet
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"testing"
 	"time"
@@ -62,9 +64,11 @@ func ExampleNewBuilderFactory_withPanic() {
 	}, panicHandler)
 	NewBuilderFactory().CreateNewSession().CreateSession(5*time.Minute).
 		CreateUserProfile(uProfile).RegisterDevice("127.0.0.1:123", 1).BuildRegisterPacket()
+	NewBuilderFactory().CreateNewSession().CreateSession(5*time.Minute).
+		CreateUserProfile(uProfile).RegisterDevice("[fe80::1]:123", 1).BuildRegisterPacket()
 	// Output:
 	// As expected panic handled: No reply-to value provided
-	// As expected panic handled: reply-to not provided in `ip-address:port` format!
+	// As expected panic handled: reply-to not provided in `ip-address:port` or `[ip-address]:port` format!
 }
 
 func TestRegisterPacketCreation(t *testing.T) {
@@ -95,6 +99,75 @@ func TestRegisterPacketCreation(t *testing.T) {
 	if connectionStr != regPacket.GetReplyTo() || deviceIndex != regPacket.GetDevicePreferenceIndex() {
 		t.Error("Device configuration did not match")
 	}
+	if len(regPacket.GetCapabilities()) != 0 {
+		t.Error("No capabilities should have been announced")
+	}
+}
+
+func TestRegisterPacketCapabilities(t *testing.T) {
+	regPacket := NewBuilderFactory().CreateNewSession().CreateSession(time.Minute).
+		CreateUserProfile(profile.NewUserProfile("a", "a", "a@a.co")).RegisterDevice("127.0.0.1:3000", 1).
+		AnnounceCapabilities("ack", "fragment").BuildRegisterPacket()
+	if len(regPacket.GetCapabilities()) != 2 || !regPacket.HasCapability("ack") ||
+		!regPacket.HasCapability("fragment") || regPacket.HasCapability("other") {
+		t.Error("Capabilities did not match", regPacket.GetCapabilities())
+	}
+	parsedPacket, _ := FromJSON([]byte(regPacket.ToJSON()), RegisterPacketType)
+	if !parsedPacket.(RegisterPacket).HasCapability("fragment") {
+		t.Error("Capabilities should have been parsed")
+	}
+	utils.PanicableInvocation(func() {
+		NewBuilderFactory().CreateNewSession().CreateSession(time.Minute).
+			CreateUserProfile(profile.NewUserProfile("a", "a", "a@a.co")).
+			RegisterDevice("127.0.0.1:3000", 1).AnnounceCapabilities("ack", " ")
+		t.Error("Should have paniced for blank capability")
+	}, func(r interface{}) {})
+}
+
+func TestRegisterPacketIdentityKey(t *testing.T) {
+	regPacket := NewBuilderFactory().CreateNewSession().CreateSession(time.Minute).
+		CreateUserProfile(profile.NewUserProfile("a", "a", "a@a.co")).RegisterDevice("127.0.0.1:3000", 1).
+		PublishIdentityKey([]byte("public-key")).BuildRegisterPacket()
+	parsedPacket, _ := FromJSON([]byte(regPacket.ToJSON()), RegisterPacketType)
+	if string(parsedPacket.(RegisterPacket).GetPublicKey()) != "public-key" {
+		t.Error("Identity key should have been parsed")
+	}
+	utils.PanicableInvocation(func() {
+		NewBuilderFactory().CreateNewSession().CreateSession(time.Minute).
+			CreateUserProfile(profile.NewUserProfile("a", "a", "a@a.co")).
+			RegisterDevice("127.0.0.1:3000", 1).PublishIdentityKey(nil)
+		t.Error("Should have paniced for blank identity key")
+	}, func(r interface{}) {})
+}
+
+func TestPresenceAnnouncement(t *testing.T) {
+	presence := profile.NewPresence(profile.Busy, "Coding")
+	regPacket := NewBuilderFactory().CreateNewSession().CreateSession(time.Minute).
+		CreateUserProfile(profile.NewUserProfile("a", "a", "a@a.co")).RegisterDevice("127.0.0.1:3000", 1).
+		AnnouncePresence(presence).BuildRegisterPacket()
+	pingPacket := NewBuilderFactory().Ping().RenewSession(time.Minute).UpdatePresence(presence).
+		BuildPingPacket()
+	parsedRegPacket, _ := FromJSON([]byte(regPacket.ToJSON()), RegisterPacketType)
+	parsedPingPacket, _ := FromJSON([]byte(pingPacket.ToJSON()), PingPacketType)
+	for _, aPacket := range []PingPacket{regPacket, pingPacket, parsedRegPacket.(PingPacket),
+		parsedPingPacket.(PingPacket)} {
+		if aPacket.GetPresence().GetState() != profile.Busy || aPacket.GetPresence().GetStatusMessage() != "Coding" {
+			t.Error("Presence did not match", aPacket.ToJSON())
+		}
+	}
+	legacyPacket, _ := FromJSON([]byte(`{"PacketID":1,"SessionID":"s","ExpiryTime":"2017-09-01T10:00:00Z"}`),
+		PingPacketType)
+	unknownPacket, _ := FromJSON([]byte(`{"PacketID":1,"SessionID":"s","PresenceState":"sleeping"}`),
+		PingPacketType)
+	for _, aPacket := range []BasePacket{legacyPacket, unknownPacket} {
+		if aPacket.(PingPacket).GetPresence().GetState() != profile.Available {
+			t.Error("Peer not announcing supported presence should have been available")
+		}
+	}
+	utils.PanicableInvocation(func() {
+		NewBuilderFactory().Ping().RenewSession(time.Minute).UpdatePresence(nil)
+		t.Error("Should have paniced for no presence")
+	}, func(r interface{}) {})
 }
 
 func checkSignOffPacket(t *testing.T, deregPacket SignOffPacket) {
@@ -135,3 +208,155 @@ func TestPingPacketCreation(t *testing.T) {
 	pingPacket := NewBuilderFactory().Ping().RenewSession(age).BuildPingPacket()
 	checkPingPacket(t, pingPacket, age)
 }
+
+func checkMessagePacket(t *testing.T, messagePacket MessagePacket, recipient string, body string) {
+	if messagePacket == nil {
+		t.Error("Message packet is nil!")
+	}
+	if messagePacket.GetPacketID() <= 0 {
+		t.Error("Not a valid packet ID")
+	}
+	if messagePacket.GetSessionID() != GetCurrentSessionID() {
+		t.Error("Sender session should be the current session")
+	}
+	if messagePacket.GetRecipientUsername() != recipient || messagePacket.GetBody() != body ||
+		messagePacket.GetContentType() != TextContentType {
+		t.Error("Message content did not match")
+	}
+	if messagePacket.GetTimestamp().IsZero() || messagePacket.GetTimestamp().After(time.Now()) {
+		t.Error("Invalid message timestamp")
+	}
+}
+
+func TestMessagePacketCreation(t *testing.T) {
+	messagePacket := NewBuilderFactory().Message().To("someone").
+		WithBody(TextContentType, "Hello World").BuildMessagePacket()
+	checkMessagePacket(t, messagePacket, "someone", "Hello World")
+	if messagePacket.GetRoomID() != "" {
+		t.Error("Direct message should not be in any room")
+	}
+	roomMessagePacket := NewBuilderFactory().Message().To("someone").InRoom("R1").
+		WithBody(TextContentType, "Hello Room").BuildMessagePacket()
+	checkMessagePacket(t, roomMessagePacket, "someone", "Hello Room")
+	if roomMessagePacket.GetRoomID() != "R1" {
+		t.Error("Message should have been posted to the room")
+	}
+}
+
+func ExampleNewBuilderFactory_messageWithPanic() {
+	panicHandler := func(r interface{}) {
+		fmt.Println("As expected panic handled:", r)
+	}
+	utils.PanicableInvocation(func() {
+		NewBuilderFactory().Message().To("some_one")
+	}, panicHandler)
+	utils.PanicableInvocation(func() {
+		NewBuilderFactory().Message().To("someone").WithBody(" ", "Hello")
+	}, panicHandler)
+	utils.PanicableInvocation(func() {
+		NewBuilderFactory().Message().To("someone").WithBody(TextContentType, "")
+	}, panicHandler)
+	// Output:
+	// As expected panic handled: Recipient username must be Alpha Numeric only
+	// As expected panic handled: No content type provided
+	// As expected panic handled: No message body provided
+}
+
+func TestAckPacketCreation(t *testing.T) {
+	ackPacket := NewBuilderFactory().Acknowledge("A1", 10).BuildAckPacket()
+	if ackPacket.GetPacketID() <= 0 || ackPacket.GetSessionID() != GetCurrentSessionID() {
+		t.Error("Ack packet should be from the current session")
+	}
+	if ackPacket.GetAcknowledgedSessionID() != "A1" || ackPacket.GetAcknowledgedPacketID() != 10 {
+		t.Error("Acknowledged packet identifier did not match")
+	}
+	utils.PanicableInvocation(func() {
+		NewBuilderFactory().Acknowledge(" ", 10)
+		t.Error("Should have paniced for blank session ID")
+	}, func(r interface{}) {})
+}
+
+func TestRoomPacketCreation(t *testing.T) {
+	roomPacket := NewBuilderFactory().Room("R1", "Team").WithMembers("a").Create("b", "c").
+		BuildRoomPacket()
+	if roomPacket.GetPacketID() <= 0 || roomPacket.GetSessionID() != GetCurrentSessionID() {
+		t.Error("Room packet should be from the current session")
+	}
+	if roomPacket.GetRoomID() != "R1" || roomPacket.GetRoomName() != "Team" ||
+		roomPacket.GetAction() != RoomCreateAction {
+		t.Error("Room did not match")
+	}
+	if len(roomPacket.GetMemberUsernames()) != 1 || len(roomPacket.GetInviteeUsernames()) != 2 {
+		t.Error("Room members did not match")
+	}
+	actions := map[RoomAction]RoomPacketBuilder{
+		RoomInviteAction: NewBuilderFactory().Room("R1", "Team").WithMembers("a").Invite("b"),
+		RoomJoinAction:   NewBuilderFactory().Room("R1", "Team").WithMembers("a", "b").Join(),
+		RoomLeaveAction:  NewBuilderFactory().Room("R1", "Team").WithMembers("a").Leave(),
+	}
+	for action, roomPacketBuilder := range actions {
+		if roomPacketBuilder.BuildRoomPacket().GetAction() != action {
+			t.Error("Room action did not match", action)
+		}
+	}
+}
+
+func ExampleNewBuilderFactory_roomWithPanic() {
+	panicHandler := func(r interface{}) {
+		fmt.Println("As expected panic handled:", r)
+	}
+	utils.PanicableInvocation(func() {
+		NewBuilderFactory().Room("R1", " ")
+	}, panicHandler)
+	utils.PanicableInvocation(func() {
+		NewBuilderFactory().Room("R1", "Team").WithMembers("a_b")
+	}, panicHandler)
+	utils.PanicableInvocation(func() {
+		NewBuilderFactory().Room("R1", "Team").WithMembers("a").Invite()
+	}, panicHandler)
+	utils.PanicableInvocation(func() {
+		NewBuilderFactory().Message().To("someone").InRoom(" ")
+	}, panicHandler)
+	// Output:
+	// As expected panic handled: Room ID and name must be provided
+	// As expected panic handled: Room member username must be Alpha Numeric only
+	// As expected panic handled: No invitee provided
+	// As expected panic handled: No room ID provided
+}
+
+func TestFilePacketCreation(t *testing.T) {
+	checksum := sha256.Sum256([]byte("content"))
+	offerPacket := NewBuilderFactory().File("T1").Offer("notes.txt", 7, checksum[:]).BuildFilePacket()
+	if offerPacket.GetPacketID() <= 0 || offerPacket.GetSessionID() != GetCurrentSessionID() {
+		t.Error("File packet should be from the current session")
+	}
+	if offerPacket.GetTransferID() != "T1" || offerPacket.GetAction() != FileOfferAction ||
+		offerPacket.GetFileName() != "notes.txt" || offerPacket.GetFileSize() != 7 ||
+		!bytes.Equal(offerPacket.GetChecksum(), checksum[:]) {
+		t.Error("File offer did not match")
+	}
+	if NewBuilderFactory().File("T1").Accept().BuildFilePacket().GetAction() != FileAcceptAction ||
+		NewBuilderFactory().File("T1").Reject().BuildFilePacket().GetAction() != FileRejectAction {
+		t.Error("File action did not match")
+	}
+}
+
+func ExampleNewBuilderFactory_fileWithPanic() {
+	panicHandler := func(r interface{}) {
+		fmt.Println("As expected panic handled:", r)
+	}
+	checksum := sha256.Sum256([]byte("content"))
+	utils.PanicableInvocation(func() {
+		NewBuilderFactory().File(" ")
+	}, panicHandler)
+	utils.PanicableInvocation(func() {
+		NewBuilderFactory().File("T1").Offer("../notes.txt", 7, checksum[:])
+	}, panicHandler)
+	utils.PanicableInvocation(func() {
+		NewBuilderFactory().File("T1").Offer("notes.txt", 7, checksum[:4])
+	}, panicHandler)
+	// Output:
+	// As expected panic handled: No transfer ID provided
+	// As expected panic handled: File name must not be blank or a path
+	// As expected panic handled: File size and SHA-256 checksum must be provided
+}
@@ -0,0 +1,63 @@
+package packet
+
+import "encoding/json"
+
+const (
+	// JSONCodecName is the name of the Codec encoding packets as JSON
+	JSONCodecName = "json"
+	// BinaryCodecName is the name of the Codec encoding packets in the compact binary format
+	BinaryCodecName = "binary"
+)
+
+// Codec converts packets to the byte representation transported over the network and back
+type Codec interface {
+	GetName() string
+	Encode(packet BasePacket) ([]byte, error)
+	Decode(buf []byte, packetType int) (BasePacket, error)
+}
+
+type _JSONCodec struct{}
+
+func (codec _JSONCodec) GetName() string {
+	return JSONCodecName
+}
+func (codec _JSONCodec) Encode(packet BasePacket) ([]byte, error) {
+	return json.Marshal(packet)
+}
+func (codec _JSONCodec) Decode(buf []byte, packetType int) (BasePacket, error) {
+	return FromJSON(buf, packetType)
+}
+
+type _BinaryCodec struct{}
+
+func (codec _BinaryCodec) GetName() string {
+	return BinaryCodecName
+}
+func (codec _BinaryCodec) Encode(packet BasePacket) ([]byte, error) {
+	return marshalBinary(packet)
+}
+func (codec _BinaryCodec) Decode(buf []byte, packetType int) (BasePacket, error) {
+	return decodePacket(buf, packetType, unmarshalBinary)
+}
+
+// NewJSONCodec returns the Codec encoding packets as JSON, which every peer understands
+func NewJSONCodec() Codec {
+	return _JSONCodec{}
+}
+
+// NewBinaryCodec returns the Codec encoding packets in a compact length-prefixed binary format
+func NewBinaryCodec() Codec {
+	return _BinaryCodec{}
+}
+
+// GetCodec returns the Codec for the codec name; false is returned for unknown codec names
+func GetCodec(name string) (Codec, bool) {
+	switch name {
+	case JSONCodecName:
+		return NewJSONCodec(), true
+	case BinaryCodecName:
+		return NewBinaryCodec(), true
+	default:
+		return nil, false
+	}
+}
@@ -0,0 +1,109 @@
+package packet
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/imyousuf/lan-messenger/profile"
+)
+
+func getTestPackets() map[int]BasePacket {
+	return map[int]BasePacket{
+		RegisterPacketType: NewBuilderFactory().CreateNewSession().CreateSession(5*time.Minute).
+			CreateUserProfile(profile.NewUserProfile("a", "a", "a@a.com")).
+			RegisterDevice("127.0.0.1:3000", 2).AnnounceCapabilities("ack", "fragment").
+			BuildRegisterPacket(),
+		PingPacketType:    NewBuilderFactory().Ping().RenewSession(5 * time.Minute).BuildPingPacket(),
+		SignOffPacketType: NewBuilderFactory().SignOff().BuildSignOffPacket(),
+		MessagePacketType: NewBuilderFactory().Message().To("a").WithBody(TextContentType, "Hi").
+			BuildMessagePacket(),
+		AckPacketType: NewBuilderFactory().Acknowledge("A1", 10).BuildAckPacket(),
+		RoomPacketType: NewBuilderFactory().Room("R1", "Team").WithMembers("a").Create("b").
+			BuildRoomPacket(),
+		FilePacketType: NewBuilderFactory().File("T1").Offer("notes.txt", 7, make([]byte, 32)).
+			BuildFilePacket(),
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, codec := range []Codec{NewJSONCodec(), NewBinaryCodec()} {
+		for packetType, aPacket := range getTestPackets() {
+			buf, err := codec.Encode(aPacket)
+			if err != nil {
+				t.Error(codec.GetName(), "could not encode packet type", packetType, err)
+				continue
+			}
+			decodedPacket, err := codec.Decode(buf, packetType)
+			if err != nil {
+				t.Error(codec.GetName(), "could not decode packet type", packetType, err)
+				continue
+			}
+			// Compare JSON representation as monotonic clock readings do not survive encoding
+			if decodedPacket.ToJSON() != aPacket.ToJSON() {
+				t.Error(codec.GetName(), "round trip did not match", decodedPacket.ToJSON(), aPacket.ToJSON())
+			}
+			if reflect.TypeOf(decodedPacket) != reflect.TypeOf(newEmptyPacket(packetType)) {
+				t.Error(codec.GetName(), "decoded to unexpected type", reflect.TypeOf(decodedPacket))
+			}
+		}
+	}
+}
+
+func TestBinaryCodecIsCompact(t *testing.T) {
+	pingPacket := NewBuilderFactory().Ping().RenewSession(5 * time.Minute).BuildPingPacket()
+	jsonBuf, _ := NewJSONCodec().Encode(pingPacket)
+	binaryBuf, _ := NewBinaryCodec().Encode(pingPacket)
+	if len(binaryBuf) >= len(jsonBuf) {
+		t.Error("Binary encoding should have been smaller than JSON", len(binaryBuf), len(jsonBuf))
+	}
+}
+
+func TestBinaryCodecCompatibility(t *testing.T) {
+	// _AckPacket as it would look if a field got appended to it
+	type _ExtendedAckPacket struct {
+		_BasePacket
+		AcknowledgedSessionID string
+		AcknowledgedPacketID  uint64
+		NewField              string
+	}
+	ackPacket := NewBuilderFactory().Acknowledge("A1", 10).BuildAckPacket().(*_AckPacket)
+	buf, err := marshalBinary(_ExtendedAckPacket{_BasePacket: ackPacket._BasePacket,
+		AcknowledgedSessionID: "A1", AcknowledgedPacketID: 10, NewField: "new"})
+	if err != nil {
+		t.Error("Could not encode extended packet", err)
+	}
+	decodedPacket, err := NewBinaryCodec().Decode(buf, AckPacketType)
+	if err != nil || decodedPacket.(AckPacket).GetAcknowledgedPacketID() != 10 {
+		t.Error("Packet with appended fields should have been decoded", err)
+	}
+	extendedPacket := &_ExtendedAckPacket{}
+	buf, _ = marshalBinary(ackPacket)
+	if err := unmarshalBinary(buf, extendedPacket); err != nil || extendedPacket.NewField != "" ||
+		extendedPacket.AcknowledgedSessionID != "A1" || extendedPacket.PacketID != ackPacket.PacketID {
+		t.Error("Packet missing appended fields should have been decoded", err)
+	}
+}
+
+func TestBinaryCodecMalformed(t *testing.T) {
+	codec := NewBinaryCodec()
+	buf, _ := codec.Encode(NewBuilderFactory().Message().To("a").WithBody(TextContentType, "Hi").
+		BuildMessagePacket())
+	if _, err := codec.Decode(buf[:len(buf)-3], MessagePacketType); err == nil {
+		t.Error("Truncated packet should not have been decoded")
+	}
+	if _, err := codec.Decode([]byte{0xff}, PingPacketType); err == nil {
+		t.Error("Garbage should not have been decoded")
+	}
+}
+
+func TestGetCodec(t *testing.T) {
+	for _, name := range []string{JSONCodecName, BinaryCodecName} {
+		if codec, found := GetCodec(name); !found || codec.GetName() != name {
+			t.Error("Codec not found for", name)
+		}
+	}
+	if _, found := GetCodec("xml"); found {
+		t.Error("Unknown codec should not have been found")
+	}
+}
@@ -6,6 +6,9 @@ import (
 	"github.com/imyousuf/lan-messenger/profile"
 )
 
+// TextContentType is the content type for plain text chat messages
+const TextContentType = "text/plain"
+
 // BasePacket represents the packet information required for all messages
 type BasePacket interface {
 	GetPacketID() uint64
@@ -17,6 +20,7 @@ type BasePacket interface {
 type PingPacket interface {
 	BasePacket
 	GetExpiryTime() time.Time
+	GetPresence() profile.Presence
 }
 
 // RegisterPacket represents information broadcasted when a device comes up live
@@ -26,9 +30,93 @@ type RegisterPacket interface {
 	GetReplyTo() string
 	GetUserProfile() profile.UserProfile
 	GetDevicePreferenceIndex() uint8
+	GetCapabilities() []string
+	HasCapability(capability string) bool
+	GetPublicKey() []byte
+	GetAgreementKey() []byte
 }
 
 // SignOffPacket represents the packet sent when a device exits
 type SignOffPacket interface {
 	BasePacket
 }
+
+// BodyCipher seals and opens message bodies exchanged with a peer session
+type BodyCipher interface {
+	Seal(plaintext []byte, additionalData []byte) ([]byte, error)
+	Open(ciphertext []byte, additionalData []byte) ([]byte, error)
+}
+
+// MessagePacket represents a chat message sent from the session in GetSessionID to a user. A post
+// to a room is sent to every member as the same MessagePacket with GetRoomID set. An encrypted message
+// carries its body as ciphertext readable only by the recipient session, so GetBody is empty till
+// it is decrypted.
+type MessagePacket interface {
+	BasePacket
+	GetRecipientUsername() string
+	GetRecipientSessionID() string
+	GetRoomID() string
+	GetContentType() string
+	GetBody() string
+	GetTimestamp() time.Time
+	IsEncrypted() bool
+	Encrypt(recipientSessionID string, cipher BodyCipher) (MessagePacket, error)
+	Decrypt(cipher BodyCipher) (MessagePacket, error)
+}
+
+// AckPacket represents the acknowledgement of a packet received from a peer; the acknowledged
+// packet is identified by the pair of its session ID and packet ID
+type AckPacket interface {
+	BasePacket
+	GetAcknowledgedSessionID() string
+	GetAcknowledgedPacketID() uint64
+}
+
+// RoomAction is the change to a room a RoomPacket notifies the members of
+type RoomAction string
+
+const (
+	// RoomCreateAction notifies that the sender created the room and invited the invitees to it
+	RoomCreateAction RoomAction = "create"
+	// RoomInviteAction notifies that the sender invited the invitees to the room
+	RoomInviteAction RoomAction = "invite"
+	// RoomJoinAction notifies that the sender accepted the invitation to the room
+	RoomJoinAction RoomAction = "join"
+	// RoomLeaveAction notifies that the sender left the room
+	RoomLeaveAction RoomAction = "leave"
+)
+
+// RoomPacket represents a change in membership of a chat room. Every RoomPacket carries the
+// members of the room as known to the sender, so that an invitee learns who else is in the room.
+type RoomPacket interface {
+	BasePacket
+	GetRoomID() string
+	GetRoomName() string
+	GetAction() RoomAction
+	GetMemberUsernames() []string
+	GetInviteeUsernames() []string
+}
+
+// FileAction is the step of a file transfer a FilePacket notifies the peer of
+type FileAction string
+
+const (
+	// FileOfferAction notifies that the sender offers the file to the recipient
+	FileOfferAction FileAction = "offer"
+	// FileAcceptAction notifies that the sender accepted the file offered to it
+	FileAcceptAction FileAction = "accept"
+	// FileRejectAction notifies that the sender rejected the file offered to it
+	FileRejectAction FileAction = "reject"
+)
+
+// FilePacket represents a step of transferring a file to a peer. The file itself is not sent in
+// packets but streamed over TCP once the offer is accepted; the offer carries the SHA-256
+// checksum of the file to verify the stream against.
+type FilePacket interface {
+	BasePacket
+	GetTransferID() string
+	GetAction() FileAction
+	GetFileName() string
+	GetFileSize() int64
+	GetChecksum() []byte
+}
@@ -1,11 +1,16 @@
 package packet
 
 import (
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"log"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/imyousuf/lan-messenger/profile"
+	"github.com/imyousuf/lan-messenger/utils"
 )
 
 func toJSON(packet interface{}) string {
@@ -34,13 +39,27 @@ func (packet _BasePacket) ToJSON() string {
 
 type _PingPacket struct {
 	_BasePacket
-	ExpiryTime time.Time
+	ExpiryTime    time.Time
+	PresenceState profile.PresenceState
+	StatusMessage string
 }
 
 func (packet _PingPacket) GetExpiryTime() time.Time {
 	return packet.ExpiryTime
 }
 
+// GetPresence returns the presence announced; peers not announcing any presence or announcing one
+// not supported by this version are considered available.
+func (packet _PingPacket) GetPresence() profile.Presence {
+	var presence profile.Presence
+	utils.PanicableInvocation(func() {
+		presence = profile.NewPresence(packet.PresenceState, packet.StatusMessage)
+	}, func(r interface{}) {
+		presence = profile.NewPresence(profile.Available, "")
+	})
+	return presence
+}
+
 func (packet _PingPacket) ToJSON() string {
 	return toJSON(packet)
 }
@@ -52,6 +71,9 @@ type _RegisterPacket struct {
 	Username              string
 	DisplayName           string
 	Email                 string
+	Capabilities          []string
+	PublicKey             []byte
+	AgreementKey          []byte
 }
 
 func (packet _RegisterPacket) GetReplyTo() string {
@@ -64,10 +86,279 @@ func (packet _RegisterPacket) GetDevicePreferenceIndex() uint8 {
 	return packet.DevicePreferenceIndex
 }
 
+func (packet _RegisterPacket) GetCapabilities() []string {
+	return packet.Capabilities
+}
+func (packet _RegisterPacket) HasCapability(capability string) bool {
+	for _, aCapability := range packet.Capabilities {
+		if aCapability == capability {
+			return true
+		}
+	}
+	return false
+}
+
+func (packet _RegisterPacket) GetPublicKey() []byte {
+	return packet.PublicKey
+}
+
+func (packet _RegisterPacket) GetAgreementKey() []byte {
+	return packet.AgreementKey
+}
+
 func (packet _RegisterPacket) ToJSON() string {
 	return toJSON(packet)
 }
 
+type _MessagePacket struct {
+	_BasePacket
+	RecipientUsername  string
+	ContentType        string
+	Body               string
+	Timestamp          time.Time
+	RecipientSessionID string
+	Ciphertext         []byte
+	RoomID             string
+}
+
+func (packet _MessagePacket) GetRecipientUsername() string {
+	return packet.RecipientUsername
+}
+func (packet _MessagePacket) GetRecipientSessionID() string {
+	return packet.RecipientSessionID
+}
+func (packet _MessagePacket) GetRoomID() string {
+	return packet.RoomID
+}
+func (packet _MessagePacket) GetContentType() string {
+	return packet.ContentType
+}
+func (packet _MessagePacket) GetBody() string {
+	return packet.Body
+}
+func (packet _MessagePacket) GetTimestamp() time.Time {
+	return packet.Timestamp
+}
+
+func (packet _MessagePacket) IsEncrypted() bool {
+	return len(packet.Ciphertext) > 0
+}
+
+// getAdditionalData binds every clear text field of the message to its ciphertext, so that the
+// ciphertext can not be replayed as part of any other message or to any other session
+func (packet _MessagePacket) getAdditionalData() []byte {
+	return []byte(strings.Join([]string{packet.SessionID, strconv.FormatUint(packet.PacketID, 10),
+		packet.RecipientUsername, packet.RecipientSessionID, packet.RoomID, packet.ContentType,
+		strconv.FormatInt(packet.Timestamp.UnixNano(), 10)}, "\n"))
+}
+
+func (packet _MessagePacket) Encrypt(recipientSessionID string, cipher BodyCipher) (MessagePacket, error) {
+	if packet.IsEncrypted() {
+		return nil, errors.New(MessageAlreadyEncryptedErrorMsg)
+	}
+	if utils.IsStringBlank(recipientSessionID) {
+		return nil, errors.New(InvalidMessageRecipientErrorMsg)
+	}
+	packet.RecipientSessionID = recipientSessionID
+	ciphertext, err := cipher.Seal([]byte(packet.Body), packet.getAdditionalData())
+	if err != nil {
+		return nil, err
+	}
+	packet.Body, packet.Ciphertext = "", ciphertext
+	return &packet, nil
+}
+
+func (packet _MessagePacket) Decrypt(cipher BodyCipher) (MessagePacket, error) {
+	if !packet.IsEncrypted() {
+		return nil, errors.New(MessageNotEncryptedErrorMsg)
+	}
+	body, err := cipher.Open(packet.Ciphertext, packet.getAdditionalData())
+	if err != nil {
+		return nil, err
+	}
+	packet.Body, packet.Ciphertext = string(body), nil
+	return &packet, nil
+}
+
+func (packet _MessagePacket) ToJSON() string {
+	return toJSON(packet)
+}
+
+func (packet _MessagePacket) validate() error {
+	if utils.IsStringBlank(packet.SessionID) {
+		return errors.New(InvalidMessageSenderErrorMsg)
+	}
+	if !utils.IsStringAlphaNumericWithSpace(packet.RecipientUsername) {
+		return errors.New(InvalidMessageRecipientErrorMsg)
+	}
+	if utils.IsStringBlank(packet.ContentType) || (utils.IsStringEmpty(packet.Body) &&
+		!packet.IsEncrypted()) {
+		return errors.New(InvalidMessageBodyErrorMsg)
+	}
+	if packet.Timestamp.IsZero() {
+		return errors.New(InvalidMessageTimestampErrorMsg)
+	}
+	return nil
+}
+
+type _AckPacket struct {
+	_BasePacket
+	AcknowledgedSessionID string
+	AcknowledgedPacketID  uint64
+}
+
+func (packet _AckPacket) GetAcknowledgedSessionID() string {
+	return packet.AcknowledgedSessionID
+}
+func (packet _AckPacket) GetAcknowledgedPacketID() uint64 {
+	return packet.AcknowledgedPacketID
+}
+
+func (packet _AckPacket) ToJSON() string {
+	return toJSON(packet)
+}
+
+type _RoomPacket struct {
+	_BasePacket
+	RoomID           string
+	RoomName         string
+	Action           RoomAction
+	MemberUsernames  []string
+	InviteeUsernames []string
+}
+
+func (packet _RoomPacket) GetRoomID() string {
+	return packet.RoomID
+}
+func (packet _RoomPacket) GetRoomName() string {
+	return packet.RoomName
+}
+func (packet _RoomPacket) GetAction() RoomAction {
+	return packet.Action
+}
+func (packet _RoomPacket) GetMemberUsernames() []string {
+	return packet.MemberUsernames
+}
+func (packet _RoomPacket) GetInviteeUsernames() []string {
+	return packet.InviteeUsernames
+}
+
+func (packet _RoomPacket) ToJSON() string {
+	return toJSON(packet)
+}
+
+func isValidRoomAction(action RoomAction) bool {
+	switch action {
+	case RoomCreateAction, RoomInviteAction, RoomJoinAction, RoomLeaveAction:
+		return true
+	default:
+		return false
+	}
+}
+
+func areValidUsernames(usernames []string) bool {
+	for _, username := range usernames {
+		if !utils.IsStringAlphaNumericWithSpace(username) {
+			return false
+		}
+	}
+	return true
+}
+
+func (packet _RoomPacket) validate() error {
+	if utils.IsStringBlank(packet.SessionID) || utils.IsStringBlank(packet.RoomID) ||
+		utils.IsStringBlank(packet.RoomName) {
+		return errors.New(InvalidRoomErrorMsg)
+	}
+	if !isValidRoomAction(packet.Action) ||
+		(packet.Action == RoomInviteAction && len(packet.InviteeUsernames) == 0) {
+		return errors.New(InvalidRoomActionErrorMsg)
+	}
+	if !areValidUsernames(packet.MemberUsernames) || !areValidUsernames(packet.InviteeUsernames) {
+		return errors.New(InvalidRoomMemberErrorMsg)
+	}
+	return nil
+}
+
+type _FilePacket struct {
+	_BasePacket
+	TransferID string
+	Action     FileAction
+	FileName   string
+	FileSize   int64
+	Checksum   []byte
+}
+
+func (packet _FilePacket) GetTransferID() string {
+	return packet.TransferID
+}
+func (packet _FilePacket) GetAction() FileAction {
+	return packet.Action
+}
+func (packet _FilePacket) GetFileName() string {
+	return packet.FileName
+}
+func (packet _FilePacket) GetFileSize() int64 {
+	return packet.FileSize
+}
+func (packet _FilePacket) GetChecksum() []byte {
+	return packet.Checksum
+}
+
+func (packet _FilePacket) ToJSON() string {
+	return toJSON(packet)
+}
+
+// isValidFileName checks that the name is a plain file name, so that it can not be used to write
+// outside of the directory files are received in
+func isValidFileName(fileName string) bool {
+	return !utils.IsStringBlank(fileName) && fileName != "." && fileName != ".." &&
+		!strings.ContainsAny(fileName, "/\\\x00")
+}
+
+func (packet _FilePacket) validate() error {
+	if utils.IsStringBlank(packet.SessionID) || utils.IsStringBlank(packet.TransferID) {
+		return errors.New(InvalidFileTransferErrorMsg)
+	}
+	switch packet.Action {
+	case FileOfferAction:
+		if !isValidFileName(packet.FileName) || packet.FileSize < 0 ||
+			len(packet.Checksum) != sha256.Size {
+			return errors.New(InvalidFileOfferErrorMsg)
+		}
+	case FileAcceptAction, FileRejectAction:
+	default:
+		return errors.New(InvalidFileTransferErrorMsg)
+	}
+	return nil
+}
+
+const (
+	// InvalidMessageSenderErrorMsg is returned when a message does not carry the sender session
+	InvalidMessageSenderErrorMsg = "message sender session missing"
+	// InvalidMessageRecipientErrorMsg is returned when a message does not have a valid recipient
+	InvalidMessageRecipientErrorMsg = "message recipient username invalid"
+	// InvalidMessageBodyErrorMsg is returned when a message misses either content type or body
+	InvalidMessageBodyErrorMsg = "message content type or body missing"
+	// InvalidMessageTimestampErrorMsg is returned when a message is not timestamped
+	InvalidMessageTimestampErrorMsg = "message timestamp missing"
+	// MessageAlreadyEncryptedErrorMsg is returned when encrypting a message already encrypted
+	MessageAlreadyEncryptedErrorMsg = "message is already encrypted"
+	// MessageNotEncryptedErrorMsg is returned when decrypting a message not encrypted
+	MessageNotEncryptedErrorMsg = "message is not encrypted"
+	// InvalidRoomErrorMsg is returned when a room packet misses the sender session, room ID or name
+	InvalidRoomErrorMsg = "room sender session, id or name missing"
+	// InvalidRoomActionErrorMsg is returned when a room packet does not have a valid action
+	InvalidRoomActionErrorMsg = "room action invalid"
+	// InvalidRoomMemberErrorMsg is returned when a room packet has an invalid member username
+	InvalidRoomMemberErrorMsg = "room member username invalid"
+	// InvalidFileTransferErrorMsg is returned when a file packet misses the sender session or the
+	// transfer ID or does not have a valid action
+	InvalidFileTransferErrorMsg = "file transfer session, id or action invalid"
+	// InvalidFileOfferErrorMsg is returned when a file offer does not describe a valid file
+	InvalidFileOfferErrorMsg = "file offer name, size or checksum invalid"
+)
+
 const (
 	// RegisterPacketType should be used when wanting to parse a buffer as RegisterPacket
 	RegisterPacketType = iota
@@ -75,36 +366,59 @@ const (
 	PingPacketType
 	// SignOffPacketType should be used when wanting to parse a buffer as SignOffPacket
 	SignOffPacketType
+	// MessagePacketType should be used when wanting to parse a buffer as MessagePacket
+	MessagePacketType
+	// AckPacketType should be used when wanting to parse a buffer as AckPacket
+	AckPacketType
+	// RoomPacketType should be used when wanting to parse a buffer as RoomPacket
+	RoomPacketType
+	// FilePacketType should be used when wanting to parse a buffer as FilePacket
+	FilePacketType
 )
 
-// FromJSON converts a byte array to a packet type as requested the API invoker
-func FromJSON(jsonBuf []byte, packetType int) (BasePacket, error) {
+// newEmptyPacket returns a pointer to a zero value packet of the packet type requested
+func newEmptyPacket(packetType int) BasePacket {
 	switch packetType {
 	case RegisterPacketType:
-		packet := _RegisterPacket{}
-		err := json.Unmarshal(jsonBuf, &packet)
-		if err != nil {
-			log.Println(err)
-			return nil, err
-		}
-		return packet, err
+		return &_RegisterPacket{}
 	case PingPacketType:
-		packet := _PingPacket{}
-		err := json.Unmarshal(jsonBuf, &packet)
-		if err != nil {
-			log.Println(err)
-			return nil, err
-		}
-		return packet, err
+		return &_PingPacket{}
 	case SignOffPacketType:
-		packet := _BasePacket{}
-		err := json.Unmarshal(jsonBuf, &packet)
-		if err != nil {
-			log.Println(err)
-			return nil, err
-		}
-		return packet, err
+		return &_BasePacket{}
+	case MessagePacketType:
+		return &_MessagePacket{}
+	case AckPacketType:
+		return &_AckPacket{}
+	case RoomPacketType:
+		return &_RoomPacket{}
+	case FilePacketType:
+		return &_FilePacket{}
 	default:
 		panic("Unknown packet type!")
 	}
 }
+
+type _Validatable interface {
+	validate() error
+}
+
+// decodePacket populates a packet of the requested type using unmarshal and validates it if the
+// packet type supports validation
+func decodePacket(buf []byte, packetType int, unmarshal func([]byte, interface{}) error) (BasePacket,
+	error) {
+	packet := newEmptyPacket(packetType)
+	err := unmarshal(buf, packet)
+	if validatable, ok := packet.(_Validatable); ok && err == nil {
+		err = validatable.validate()
+	}
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	return packet, err
+}
+
+// FromJSON converts a byte array to a packet type as requested the API invoker
+func FromJSON(jsonBuf []byte, packetType int) (BasePacket, error) {
+	return decodePacket(jsonBuf, packetType, json.Unmarshal)
+}
@@ -4,6 +4,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/imyousuf/lan-messenger/identity"
 	"github.com/imyousuf/lan-messenger/profile"
 )
 
@@ -24,4 +25,112 @@ func TestFromJSON(t *testing.T) {
 	pingPacket := NewBuilderFactory().Ping().RenewSession(age).BuildPingPacket()
 	basePack, _ = FromJSON([]byte(pingPacket.ToJSON()), PingPacketType)
 	checkPingPacket(t, basePack.(PingPacket), age)
+	messagePacket := NewBuilderFactory().Message().To(username).WithBody(TextContentType, "Hi").
+		BuildMessagePacket()
+	basePack, _ = FromJSON([]byte(messagePacket.ToJSON()), MessagePacketType)
+	checkMessagePacket(t, basePack.(MessagePacket), username, "Hi")
+	ackPacket := NewBuilderFactory().Acknowledge(messagePacket.GetSessionID(),
+		messagePacket.GetPacketID()).BuildAckPacket()
+	basePack, _ = FromJSON([]byte(ackPacket.ToJSON()), AckPacketType)
+	if basePack.(AckPacket).GetAcknowledgedPacketID() != messagePacket.GetPacketID() {
+		t.Error("Acknowledged packet ID did not match")
+	}
+}
+
+func TestFromJSONInvalidMessage(t *testing.T) {
+	invalidMessages := map[string]string{
+		InvalidMessageSenderErrorMsg: `{"PacketID":1,"RecipientUsername":"a","ContentType":"text/plain",` +
+			`"Body":"Hi","Timestamp":"2017-09-01T10:00:00Z"}`,
+		InvalidMessageRecipientErrorMsg: `{"PacketID":1,"SessionID":"s","RecipientUsername":"a_b",` +
+			`"ContentType":"text/plain","Body":"Hi","Timestamp":"2017-09-01T10:00:00Z"}`,
+		InvalidMessageBodyErrorMsg: `{"PacketID":1,"SessionID":"s","RecipientUsername":"a",` +
+			`"ContentType":"text/plain","Timestamp":"2017-09-01T10:00:00Z"}`,
+		InvalidMessageTimestampErrorMsg: `{"PacketID":1,"SessionID":"s","RecipientUsername":"a",` +
+			`"ContentType":"text/plain","Body":"Hi"}`,
+	}
+	for expectedErr, jsonStr := range invalidMessages {
+		basePack, err := FromJSON([]byte(jsonStr), MessagePacketType)
+		if err == nil || err.Error() != expectedErr || basePack != nil {
+			t.Error("Expected validation error", expectedErr, "but got", err)
+		}
+	}
+}
+
+func TestFromJSONInvalidRoom(t *testing.T) {
+	invalidRooms := map[string]string{
+		InvalidRoomErrorMsg:       `{"PacketID":1,"SessionID":"s","RoomName":"Team","Action":"join"}`,
+		InvalidRoomActionErrorMsg: `{"PacketID":1,"SessionID":"s","RoomID":"R1","RoomName":"Team","Action":"invite"}`,
+		InvalidRoomMemberErrorMsg: `{"PacketID":1,"SessionID":"s","RoomID":"R1","RoomName":"Team",` +
+			`"Action":"create","InviteeUsernames":["a_b"]}`,
+	}
+	for expectedErr, jsonStr := range invalidRooms {
+		basePack, err := FromJSON([]byte(jsonStr), RoomPacketType)
+		if err == nil || err.Error() != expectedErr || basePack != nil {
+			t.Error("Expected validation error", expectedErr, "but got", err)
+		}
+	}
+}
+
+func TestMessagePacketEncryption(t *testing.T) {
+	senderID, _ := identity.NewIdentity()
+	recipientID, _ := identity.NewIdentity()
+	senderCipher, _ := senderID.NewCipher(recipientID.GetAgreementKey())
+	recipientCipher, _ := recipientID.NewCipher(senderID.GetAgreementKey())
+	messagePacket := NewBuilderFactory().Message().To("a").WithBody(TextContentType, "Hi").
+		BuildMessagePacket()
+	if messagePacket.IsEncrypted() {
+		t.Error("Message built should not be encrypted")
+	}
+	if _, err := messagePacket.Decrypt(recipientCipher); err == nil ||
+		err.Error() != MessageNotEncryptedErrorMsg {
+		t.Error("Message not encrypted should not be decrypted", err)
+	}
+	encryptedPacket, err := messagePacket.Encrypt("recipient-session", senderCipher)
+	if err != nil || !encryptedPacket.IsEncrypted() || encryptedPacket.GetBody() != "" ||
+		encryptedPacket.GetRecipientSessionID() != "recipient-session" {
+		t.Fatal("Message should have been encrypted", err)
+	}
+	if _, err := encryptedPacket.Encrypt("recipient-session", senderCipher); err == nil ||
+		err.Error() != MessageAlreadyEncryptedErrorMsg {
+		t.Error("Message should not be encrypted twice", err)
+	}
+	basePack, err := FromJSON([]byte(encryptedPacket.ToJSON()), MessagePacketType)
+	if err != nil {
+		t.Fatal("Encrypted message should have been parsed", err)
+	}
+	decryptedPacket, err := basePack.(MessagePacket).Decrypt(recipientCipher)
+	if err != nil || decryptedPacket.IsEncrypted() {
+		t.Fatal("Message should have been decrypted", err)
+	}
+	checkMessagePacket(t, decryptedPacket, "a", "Hi")
+	otherID, _ := identity.NewIdentity()
+	otherCipher, _ := otherID.NewCipher(senderID.GetAgreementKey())
+	if _, err := encryptedPacket.Decrypt(otherCipher); err == nil {
+		t.Error("Message should not be decrypted by any session other than the recipient")
+	}
+	replayedPacket := *encryptedPacket.(*_MessagePacket)
+	replayedPacket.RecipientSessionID = "other-session"
+	if _, err := replayedPacket.Decrypt(recipientCipher); err == nil {
+		t.Error("Message should not be decrypted once redirected to another session")
+	}
+}
+
+func TestFromJSONInvalidFile(t *testing.T) {
+	checksum := `"Checksum":"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="`
+	invalidFiles := map[string]string{
+		InvalidFileTransferErrorMsg: `{"PacketID":1,"SessionID":"s","Action":"accept"}`,
+		InvalidFileOfferErrorMsg: `{"PacketID":1,"SessionID":"s","TransferID":"T1","Action":"offer",` +
+			`"FileName":"../notes.txt","FileSize":7,` + checksum + `}`,
+	}
+	for expectedErr, jsonStr := range invalidFiles {
+		basePack, err := FromJSON([]byte(jsonStr), FilePacketType)
+		if err == nil || err.Error() != expectedErr || basePack != nil {
+			t.Error("Expected validation error", expectedErr, "but got", err)
+		}
+	}
+	validOffer := `{"PacketID":1,"SessionID":"s","TransferID":"T1","Action":"offer",` +
+		`"FileName":"notes.txt","FileSize":7,` + checksum + `}`
+	if _, err := FromJSON([]byte(validOffer), FilePacketType); err != nil {
+		t.Error("Valid file offer should have been parsed", err)
+	}
 }
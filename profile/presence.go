@@ -0,0 +1,60 @@
+package profile
+
+import "unicode/utf8"
+
+// PresenceState represents the availability of a user to chat
+type PresenceState string
+
+const (
+	// Available signifies that the user is available to chat
+	Available PresenceState = "available"
+	// Away signifies that the user is away from the device
+	Away PresenceState = "away"
+	// Busy signifies that the user is busy but may still respond
+	Busy PresenceState = "busy"
+	// DoNotDisturb signifies that the user does not want to be disturbed
+	DoNotDisturb PresenceState = "do-not-disturb"
+	// MaxStatusMessageLength is the maximum number of characters in a status message
+	MaxStatusMessageLength = 140
+)
+
+// Presence represents the availability of a user along with a free-text status message
+type Presence interface {
+	GetState() PresenceState
+	GetStatusMessage() string
+}
+
+type _Presence struct {
+	state         PresenceState
+	statusMessage string
+}
+
+func (presence _Presence) GetState() PresenceState {
+	return presence.state
+}
+
+func (presence _Presence) GetStatusMessage() string {
+	return presence.statusMessage
+}
+
+// IsValidPresenceState checks whether the state is one of the presence states supported
+func IsValidPresenceState(state PresenceState) bool {
+	switch state {
+	case Available, Away, Busy, DoNotDisturb:
+		return true
+	default:
+		return false
+	}
+}
+
+// NewPresence creates a Presence from the state and status message; the status message is
+// optional but the state must be one of the presence states supported
+func NewPresence(state PresenceState, statusMessage string) Presence {
+	if !IsValidPresenceState(state) {
+		panic("Presence state is not supported")
+	}
+	if utf8.RuneCountInString(statusMessage) > MaxStatusMessageLength {
+		panic("Status message is too long")
+	}
+	return &_Presence{state: state, statusMessage: statusMessage}
+}
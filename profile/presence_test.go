@@ -0,0 +1,26 @@
+package profile
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/imyousuf/lan-messenger/utils"
+)
+
+func ExampleNewPresence() {
+	panicHandler := func(r interface{}) {
+		fmt.Println("As expected panic handled:", r)
+	}
+	utils.PanicableInvocation(func() {
+		NewPresence("sleeping", "")
+	}, panicHandler)
+	utils.PanicableInvocation(func() {
+		NewPresence(Away, strings.Repeat("a", MaxStatusMessageLength+1))
+	}, panicHandler)
+	presence := NewPresence(DoNotDisturb, "In a meeting")
+	fmt.Println(presence.GetState(), presence.GetStatusMessage())
+	// Output:
+	// As expected panic handled: Presence state is not supported
+	// As expected panic handled: Status message is too long
+	// do-not-disturb In a meeting
+}
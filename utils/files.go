@@ -0,0 +1,37 @@
+package utils
+
+import (
+	"io"
+	"os"
+)
+
+// CopyFile copies the file to the destination, overwriting it if it exists, and syncs it to disk
+func CopyFile(sourcePath string, destinationPath string, perm os.FileMode) error {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	destination, err := os.OpenFile(destinationPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(destination, source); err == nil {
+		err = destination.Sync()
+	}
+	if closeErr := destination.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// ReplaceFile replaces the destination with a copy of the file, so that the destination is either
+// left as it was or replaced as a whole, even when the file is on another file system
+func ReplaceFile(sourcePath string, destinationPath string, perm os.FileMode) error {
+	replacingPath := destinationPath + ".replacing"
+	if err := CopyFile(sourcePath, replacingPath, perm); err != nil {
+		os.Remove(replacingPath)
+		return err
+	}
+	return os.Rename(replacingPath, destinationPath)
+}
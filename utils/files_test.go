@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReplaceFile(t *testing.T) {
+	directory, err := ioutil.TempDir("", "lamess-utils")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	sourcePath, destinationPath := filepath.Join(directory, "source"), filepath.Join(directory, "destination")
+	ioutil.WriteFile(sourcePath, []byte("new"), 0600)
+	ioutil.WriteFile(destinationPath, []byte("old content"), 0600)
+	if err := ReplaceFile(sourcePath, destinationPath, 0600); err != nil {
+		t.Error("File should have been replaced", err)
+	}
+	if content, _ := ioutil.ReadFile(destinationPath); string(content) != "new" {
+		t.Error("Destination should have had the content of the file", string(content))
+	}
+	if _, err := os.Stat(destinationPath + ".replacing"); !os.IsNotExist(err) {
+		t.Error("Copy being replaced with should not have been left behind")
+	}
+	if err := ReplaceFile(filepath.Join(directory, "missing"), destinationPath, 0600); err == nil {
+		t.Error("Missing file should not have replaced the destination")
+	}
+	if content, _ := ioutil.ReadFile(destinationPath); string(content) != "new" {
+		t.Error("Destination should have been left as it was", string(content))
+	}
+}
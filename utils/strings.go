@@ -1,22 +1,21 @@
 package utils
 
 import (
+	"net"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
 // https://www.w3.org/TR/html5/forms.html#valid-e-mail-address
 const (
-	emailRegex     = "^[a-zA-Z0-9.!#$%&'*+/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$"
-	ipAddressRegex = `^(([0-9]|[0-9][0-9]|[1][0-9]{2}|[2][0-4][0-9]|[2][5][1-5])[.]){3}([0-9]|[0-9][0-9]|[1][0-9]{2}|[2][0-4][0-9]|[2][5][1-5])$`
+	emailRegex = "^[a-zA-Z0-9.!#$%&'*+/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$"
 )
 
 var (
 	isAlphaNumeric          = regexp.MustCompile(`^[a-zA-Z0-9]+$`).MatchString
 	isAlphaNumericWithSpace = regexp.MustCompile(`^[a-zA-Z0-9 ]+$`).MatchString
 	isValidEmailString      = regexp.MustCompile(emailRegex).MatchString
-	isValidIPAddress        = regexp.MustCompile(ipAddressRegex).MatchString
-	isValidConnectionString = regexp.MustCompile(ipAddressRegex[:len(ipAddressRegex)-1] + "[:][0-9]+$").MatchString
 )
 
 // IsStringAlphaNumeric checks whether the passed String is a alpha numeric only
@@ -35,14 +34,30 @@ func IsStringValidEmailFormat(String string) bool {
 	return isValidEmailString(String)
 }
 
-// IsValidIPv4Address checks for valid IP Addresses
+// IsValidIPv4Address checks for valid IPv4 Addresses
 func IsValidIPv4Address(String string) bool {
-	return isValidIPAddress(String)
+	return !strings.Contains(String, ":") && net.ParseIP(String) != nil
 }
 
-// IsValidConnectionString checks for ip-v4-address:port format of the string
+// IsValidIPAddress checks for valid IPv4 or IPv6 Addresses; an IPv6 address may be qualified with
+// the zone, i.e. the interface, it is scoped to as in `fe80::1%eth0`
+func IsValidIPAddress(String string) bool {
+	if zoneIndex := strings.LastIndex(String, "%"); zoneIndex > 0 && zoneIndex < len(String)-1 &&
+		strings.Contains(String, ":") {
+		String = String[:zoneIndex]
+	}
+	return net.ParseIP(String) != nil
+}
+
+// IsValidConnectionString checks for ip-v4-address:port or [ip-v6-address]:port format of the
+// string
 func IsValidConnectionString(String string) bool {
-	return isValidConnectionString(String)
+	host, port, err := net.SplitHostPort(String)
+	if err != nil || !IsValidIPAddress(host) {
+		return false
+	}
+	portNumber, err := strconv.Atoi(port)
+	return err == nil && portNumber > 0 && portNumber <= 65535
 }
 
 // IsStringEmpty checks whether the string is empty
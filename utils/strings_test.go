@@ -56,14 +56,16 @@ func TestIsStringValidEmailFormat(t *testing.T) {
 }
 
 func TestIsValidIPv4Address(t *testing.T) {
-	successCases := []string{"255.255.255.255", "0.0.0.0", "00.00.00.00", "127.0.0.1", "192.168.1.101", "192.168.1.207"}
+	successCases := []string{"255.255.255.255", "0.0.0.0", "127.0.0.1", "192.168.1.101", "192.168.1.207",
+		"192.168.1.250"}
 	for _, successCase := range successCases {
 		if !IsValidIPv4Address(successCase) {
 			t.Error("Should pass as IP Address: ", successCase)
 			t.Fail()
 		}
 	}
-	failCases := []string{"A$a", "9(o", "000.000.000.000", "0.0.256.0", "0.0.0.256", "0.0.0."}
+	failCases := []string{"A$a", "9(o", "000.000.000.000", "0.0.256.0", "0.0.0.256", "0.0.0.", "::1",
+		"::ffff:127.0.0.1"}
 	for _, failCase := range failCases {
 		if IsValidIPv4Address(failCase) {
 			t.Error("Should not pass as IP Address: ", failCase)
@@ -72,15 +74,32 @@ func TestIsValidIPv4Address(t *testing.T) {
 	}
 }
 
+func TestIsValidIPAddress(t *testing.T) {
+	successCases := []string{"192.168.1.250", "::1", "fe80::1", "fe80::1%eth0", "fd12:3456::1", "ff02::1"}
+	for _, successCase := range successCases {
+		if !IsValidIPAddress(successCase) {
+			t.Error("Should pass as IP Address: ", successCase)
+		}
+	}
+	failCases := []string{"A$a", "0.0.0.256", "fe80::1%", "127.0.0.1%eth0", "fe80:::1", "[::1]"}
+	for _, failCase := range failCases {
+		if IsValidIPAddress(failCase) {
+			t.Error("Should not pass as IP Address: ", failCase)
+		}
+	}
+}
+
 func TestIsValidConnectionString(t *testing.T) {
-	successCases := []string{"127.0.0.1:3000", "192.168.1.101:2"}
+	successCases := []string{"127.0.0.1:3000", "192.168.1.101:2", "192.168.1.250:3000", "[::1]:3000",
+		"[fe80::1%eth0]:3000", "[fd12:3456::1]:30000"}
 	for _, successCase := range successCases {
 		if !IsValidConnectionString(successCase) {
 			t.Error("Should pass as Connection String: ", successCase)
 			t.Fail()
 		}
 	}
-	failCases := []string{"A$a", "127.0.0.1:", "127.0.0.1", ":3000"}
+	failCases := []string{"A$a", "127.0.0.1:", "127.0.0.1", ":3000", "127.0.0.1:65536", "127.0.0.1:port",
+		"::1:3000", "[::1]", "localhost:3000"}
 	for _, failCase := range failCases {
 		if IsValidConnectionString(failCase) {
 			t.Error("Should not pass as Connection String: ", failCase)